@@ -0,0 +1,204 @@
+package pxeserver
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"os"
+	"sync"
+	"time"
+)
+
+const (
+	AuditSecretAccess  = "secret_access"
+	AuditFileRender    = "file_render"
+	AuditCmdlineRender = "cmdline_render"
+	AuditFileServe     = "file_serve"
+)
+
+// AuditEvent records that a secret was read or a file was rendered or
+// served. Secret values are never recorded.
+type AuditEvent struct {
+	Time     time.Time `json:"time"`
+	Event    string    `json:"event"`
+	Host     string    `json:"host,omitempty"`
+	SecretID string    `json:"secret_id,omitempty"`
+	Scope    string    `json:"scope,omitempty"`
+	FileID   string    `json:"file_id,omitempty"`
+	Client   string    `json:"client,omitempty"`
+}
+
+// UnmarshalJSON reads the host of events logged before hosts were named,
+// which recorded it as 'mac'.
+func (e *AuditEvent) UnmarshalJSON(data []byte) error {
+	type auditEvent AuditEvent
+	var event struct {
+		auditEvent
+		Mac string `json:"mac"`
+	}
+	if err := json.Unmarshal(data, &event); err != nil {
+		return err
+	}
+	*e = AuditEvent(event.auditEvent)
+	if e.Host == "" {
+		e.Host = event.Mac
+	}
+	return nil
+}
+
+// AuditLog appends events as JSON lines, rotating the file to path.1,
+// path.2, etc. once it grows past maxSize bytes and keeping maxBackups of
+// them, or all of them if maxBackups is 0. A nil AuditLog discards all
+// events.
+type AuditLog struct {
+	path       string
+	maxSize    int64
+	maxBackups int
+	file       *os.File
+	size       int64
+	mu         sync.Mutex
+}
+
+func OpenAuditLog(path string, maxSize int64, maxBackups int) (*AuditLog, error) {
+	a := &AuditLog{
+		path:       path,
+		maxSize:    maxSize,
+		maxBackups: maxBackups,
+	}
+	if err := a.open(); err != nil {
+		return nil, err
+	}
+	return a, nil
+}
+
+func (a *AuditLog) Record(event AuditEvent) error {
+	if a == nil {
+		return nil
+	}
+	if event.Time.IsZero() {
+		event.Time = time.Now().UTC()
+	}
+	line, err := json.Marshal(event)
+	if err != nil {
+		return err
+	}
+	line = append(line, '\n')
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if a.maxSize > 0 && a.size > 0 && a.size+int64(len(line)) > a.maxSize {
+		if err := a.rotate(); err != nil {
+			return err
+		}
+	}
+	n, err := a.file.Write(line)
+	a.size += int64(n)
+	return err
+}
+
+func (a *AuditLog) Close() error {
+	if a == nil {
+		return nil
+	}
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	return a.file.Close()
+}
+
+func (a *AuditLog) open() error {
+	file, err := os.OpenFile(a.path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600)
+	if err != nil {
+		return err
+	}
+	stat, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return err
+	}
+	a.file = file
+	a.size = stat.Size()
+	return nil
+}
+
+// rotate moves the log to path.1, shifting older backups up, so events are
+// only ever discarded by dropping the oldest backup past maxBackups. With
+// maxBackups 0 every backup is kept.
+func (a *AuditLog) rotate() error {
+	if err := a.file.Close(); err != nil {
+		return err
+	}
+	last := a.maxBackups
+	if last == 0 {
+		last = 1
+		for {
+			if _, err := os.Stat(fmt.Sprintf("%s.%d", a.path, last)); os.IsNotExist(err) {
+				break
+			}
+			last++
+		}
+	}
+	for i := last - 1; i > 0; i-- {
+		err := os.Rename(fmt.Sprintf("%s.%d", a.path, i), fmt.Sprintf("%s.%d", a.path, i+1))
+		if err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+	if err := os.Rename(a.path, fmt.Sprintf("%s.1", a.path)); err != nil {
+		return err
+	}
+	return a.open()
+}
+
+type AuditFilter struct {
+	Event    string
+	Host     string
+	SecretID string
+	FileID   string
+	Since    time.Time
+}
+
+func (f AuditFilter) matches(event AuditEvent) bool {
+	return (f.Event == "" || f.Event == event.Event) &&
+		(f.Host == "" || f.Host == event.Host) &&
+		(f.SecretID == "" || f.SecretID == event.SecretID) &&
+		(f.FileID == "" || f.FileID == event.FileID) &&
+		!event.Time.Before(f.Since)
+}
+
+// QueryAuditLog returns the matching events from path and its rotated
+// backups, oldest first.
+func QueryAuditLog(path string, filter AuditFilter) ([]AuditEvent, error) {
+	paths := []string{}
+	for i := 1; ; i++ {
+		backupPath := fmt.Sprintf("%s.%d", path, i)
+		if _, err := os.Stat(backupPath); err != nil {
+			break
+		}
+		paths = append([]string{backupPath}, paths...)
+	}
+	paths = append(paths, path)
+
+	events := []AuditEvent{}
+	for _, p := range paths {
+		file, err := os.Open(p)
+		if err != nil {
+			return nil, err
+		}
+		scanner := bufio.NewScanner(file)
+		for scanner.Scan() {
+			var event AuditEvent
+			if err := json.Unmarshal(scanner.Bytes(), &event); err != nil {
+				file.Close()
+				return nil, fmt.Errorf("invalid audit log entry in '%s': %s", p, err)
+			}
+			if filter.matches(event) {
+				events = append(events, event)
+			}
+		}
+		file.Close()
+		if err := scanner.Err(); err != nil {
+			return nil, err
+		}
+	}
+	return events, nil
+}
@@ -0,0 +1,207 @@
+package pxeserver_test
+
+import (
+	"io/ioutil"
+	"os"
+	"path"
+	"testing"
+	"time"
+
+	"github.com/ljfranklin/pxeserver"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestAuditLogRecordAndQuery(t *testing.T) {
+	assert := assert.New(t)
+
+	tmpdir, err := ioutil.TempDir("", "pxeserver-audit")
+	assert.NoError(err)
+	defer os.RemoveAll(tmpdir)
+	logPath := path.Join(tmpdir, "audit.log")
+
+	audit, err := pxeserver.OpenAuditLog(logPath, 0, 0)
+	assert.NoError(err)
+	assert.NoError(audit.Record(pxeserver.AuditEvent{
+		Event:    pxeserver.AuditSecretAccess,
+		Host:     "some-host",
+		SecretID: "some-secret",
+		FileID:   "some-file",
+	}))
+	assert.NoError(audit.Record(pxeserver.AuditEvent{
+		Event:  pxeserver.AuditFileServe,
+		Host:   "some-host",
+		FileID: "some-file",
+		Client: "10.0.0.5:1234",
+	}))
+	assert.NoError(audit.Close())
+
+	events, err := pxeserver.QueryAuditLog(logPath, pxeserver.AuditFilter{})
+	assert.NoError(err)
+	assert.Len(events, 2)
+	assert.Equal(pxeserver.AuditSecretAccess, events[0].Event)
+	assert.Equal("some-secret", events[0].SecretID)
+	assert.False(events[0].Time.IsZero())
+	assert.Equal(pxeserver.AuditFileServe, events[1].Event)
+	assert.Equal("10.0.0.5:1234", events[1].Client)
+
+	// reopening appends rather than truncating
+	audit, err = pxeserver.OpenAuditLog(logPath, 0, 0)
+	assert.NoError(err)
+	assert.NoError(audit.Record(pxeserver.AuditEvent{
+		Event:  pxeserver.AuditFileRender,
+		Host:   "some-host",
+		FileID: "some-file",
+	}))
+	assert.NoError(audit.Close())
+
+	events, err = pxeserver.QueryAuditLog(logPath, pxeserver.AuditFilter{})
+	assert.NoError(err)
+	assert.Len(events, 3)
+}
+
+func TestAuditLogFilter(t *testing.T) {
+	assert := assert.New(t)
+
+	tmpdir, err := ioutil.TempDir("", "pxeserver-audit")
+	assert.NoError(err)
+	defer os.RemoveAll(tmpdir)
+	logPath := path.Join(tmpdir, "audit.log")
+
+	audit, err := pxeserver.OpenAuditLog(logPath, 0, 0)
+	assert.NoError(err)
+	now := time.Now().UTC()
+	assert.NoError(audit.Record(pxeserver.AuditEvent{
+		Time:     now.Add(-2 * time.Hour),
+		Event:    pxeserver.AuditSecretAccess,
+		Host:     "some-host",
+		SecretID: "some-secret",
+	}))
+	assert.NoError(audit.Record(pxeserver.AuditEvent{
+		Time:     now,
+		Event:    pxeserver.AuditSecretAccess,
+		Host:     "some-host",
+		SecretID: "other-secret",
+	}))
+	assert.NoError(audit.Record(pxeserver.AuditEvent{
+		Time:     now,
+		Event:    pxeserver.AuditSecretAccess,
+		Host:     "other-host",
+		SecretID: "some-secret",
+	}))
+	assert.NoError(audit.Close())
+
+	events, err := pxeserver.QueryAuditLog(logPath, pxeserver.AuditFilter{
+		Host: "some-host",
+	})
+	assert.NoError(err)
+	assert.Len(events, 2)
+
+	events, err = pxeserver.QueryAuditLog(logPath, pxeserver.AuditFilter{
+		SecretID: "some-secret",
+	})
+	assert.NoError(err)
+	assert.Len(events, 2)
+
+	events, err = pxeserver.QueryAuditLog(logPath, pxeserver.AuditFilter{
+		SecretID: "some-secret",
+		Since:    now.Add(-time.Hour),
+	})
+	assert.NoError(err)
+	assert.Len(events, 1)
+	assert.Equal("other-host", events[0].Host)
+
+	events, err = pxeserver.QueryAuditLog(logPath, pxeserver.AuditFilter{
+		Event: pxeserver.AuditFileServe,
+	})
+	assert.NoError(err)
+	assert.Len(events, 0)
+}
+
+func TestAuditLogRotation(t *testing.T) {
+	assert := assert.New(t)
+
+	tmpdir, err := ioutil.TempDir("", "pxeserver-audit")
+	assert.NoError(err)
+	defer os.RemoveAll(tmpdir)
+	logPath := path.Join(tmpdir, "audit.log")
+
+	audit, err := pxeserver.OpenAuditLog(logPath, 1, 2)
+	assert.NoError(err)
+	for _, id := range []string{"secret-1", "secret-2", "secret-3", "secret-4"} {
+		assert.NoError(audit.Record(pxeserver.AuditEvent{
+			Event:    pxeserver.AuditSecretAccess,
+			Host:     "some-host",
+			SecretID: id,
+		}))
+	}
+	assert.NoError(audit.Close())
+
+	assert.FileExists(logPath + ".1")
+	assert.FileExists(logPath + ".2")
+	_, err = os.Stat(logPath + ".3")
+	assert.True(os.IsNotExist(err))
+
+	// the oldest event was dropped along with the third backup
+	events, err := pxeserver.QueryAuditLog(logPath, pxeserver.AuditFilter{})
+	assert.NoError(err)
+	assert.Len(events, 3)
+	assert.Equal("secret-2", events[0].SecretID)
+	assert.Equal("secret-4", events[2].SecretID)
+}
+
+func TestAuditLogRotationKeepsAllBackups(t *testing.T) {
+	assert := assert.New(t)
+
+	tmpdir, err := ioutil.TempDir("", "pxeserver-audit")
+	assert.NoError(err)
+	defer os.RemoveAll(tmpdir)
+	logPath := path.Join(tmpdir, "audit.log")
+
+	audit, err := pxeserver.OpenAuditLog(logPath, 1, 0)
+	assert.NoError(err)
+	for _, id := range []string{"secret-1", "secret-2", "secret-3", "secret-4"} {
+		assert.NoError(audit.Record(pxeserver.AuditEvent{
+			Event:    pxeserver.AuditSecretAccess,
+			Host:     "some-host",
+			SecretID: id,
+		}))
+	}
+	assert.NoError(audit.Close())
+
+	assert.FileExists(logPath + ".3")
+	events, err := pxeserver.QueryAuditLog(logPath, pxeserver.AuditFilter{})
+	assert.NoError(err)
+	assert.Len(events, 4)
+	assert.Equal("secret-1", events[0].SecretID)
+	assert.Equal("secret-4", events[3].SecretID)
+}
+
+func TestAuditLogNilDiscardsEvents(t *testing.T) {
+	assert := assert.New(t)
+
+	var audit *pxeserver.AuditLog
+	assert.NoError(audit.Record(pxeserver.AuditEvent{
+		Event: pxeserver.AuditFileRender,
+	}))
+	assert.NoError(audit.Close())
+}
+
+func TestAuditLogReadsMacOfOlderEvents(t *testing.T) {
+	assert := assert.New(t)
+
+	tmpdir, err := ioutil.TempDir("", "pxeserver-audit")
+	assert.NoError(err)
+	defer os.RemoveAll(tmpdir)
+	logPath := path.Join(tmpdir, "audit.log")
+
+	err = ioutil.WriteFile(logPath, []byte(`{"time":"2020-01-01T00:00:00Z","event":"file_serve","mac":"52:54:00:12:34:56","file_id":"some-file"}`+"\n"), 0600)
+	assert.NoError(err)
+
+	events, err := pxeserver.QueryAuditLog(logPath, pxeserver.AuditFilter{
+		Host: "52:54:00:12:34:56",
+	})
+	assert.NoError(err)
+	assert.Len(events, 1)
+	assert.Equal("52:54:00:12:34:56", events[0].Host)
+	assert.Equal("some-file", events[0].FileID)
+}
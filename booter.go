@@ -8,14 +8,24 @@ import (
 )
 
 type configBooter struct {
-	specs map[string]*pixiecore.Spec
-	files Files
+	specs  map[string]*pixiecore.Spec
+	files  Files
+	tokens *FileTokens
+	audit  *AuditLog
 }
 
-func ConfigBooter(cfg Pixiecore, files Files) (pixiecore.Booter, error) {
+// ConfigBooter boots each host with the files from its config. If tokens is
+// non-nil, file IDs handed to clients are signed and ReadBootFile rejects
+// IDs without a valid token. BootSpec signs them for any caller, wrap it in
+// LeaseBooter to only hand them to the host. Files read through Pixiecore
+// are recorded in audit, without a client address as Pixiecore doesn't
+// expose it.
+func ConfigBooter(cfg Pixiecore, files Files, tokens *FileTokens, audit *AuditLog) (pixiecore.Booter, error) {
 	ret := &configBooter{
-		specs: make(map[string]*pixiecore.Spec),
-		files: files,
+		specs:  make(map[string]*pixiecore.Spec),
+		files:  files,
+		tokens: tokens,
+		audit:  audit,
 	}
 
 	for mac, hostCfg := range cfg {
@@ -40,14 +50,104 @@ func (s *configBooter) BootSpec(m pixiecore.Machine) (*pixiecore.Spec, error) {
 	if !ok {
 		return nil, fmt.Errorf("Could not find BootSpec for '%s'", mac)
 	}
-	return spec, nil
+	if s.tokens == nil {
+		return spec, nil
+	}
+
+	signedSpec := *spec
+	signedSpec.Kernel = pixiecore.ID(s.tokens.Sign(string(spec.Kernel)))
+	signedSpec.Initrd = make([]pixiecore.ID, 0, len(spec.Initrd))
+	for _, initrd := range spec.Initrd {
+		signedSpec.Initrd = append(signedSpec.Initrd, pixiecore.ID(s.tokens.Sign(string(initrd))))
+	}
+	return &signedSpec, nil
 }
 
 func (s *configBooter) ReadBootFile(id pixiecore.ID) (io.ReadCloser, int64, error) {
-	return s.files.Read(string(id))
+	fileID := string(id)
+	if s.tokens != nil {
+		var err error
+		fileID, err = s.tokens.Verify(fileID)
+		if err != nil {
+			return nil, -1, err
+		}
+	}
+
+	reader, size, err := s.files.Read(fileID)
+	if err != nil {
+		return nil, -1, err
+	}
+	file, _ := s.files.Lookup(fileID)
+	if err := s.audit.Record(AuditEvent{
+		Event:  AuditFileServe,
+		Host:   file.Host,
+		FileID: fileID,
+	}); err != nil {
+		reader.Close()
+		return nil, -1, err
+	}
+	return reader, size, nil
 }
 
 // unused
 func (s *configBooter) WriteBootFile(pixiecore.ID, io.Reader) error {
 	return nil
 }
+
+type chainBooter struct {
+	pixiecore.Booter
+	urls *SubnetURLs
+}
+
+// ChainBooter hands iPXE clients off to the HTTPHandler at the base URL
+// for their subnet, which builds the real boot script and serves the
+// files. PXELinux clients are left to Pixiecore, and load their files
+// over pxeserver's TFTP.
+func ChainBooter(booter pixiecore.Booter, urls *SubnetURLs) pixiecore.Booter {
+	return &chainBooter{
+		Booter: booter,
+		urls:   urls,
+	}
+}
+
+func (s *chainBooter) BootSpec(m pixiecore.Machine) (*pixiecore.Spec, error) {
+	spec, err := s.Booter.BootSpec(m)
+	if err != nil || spec == nil || spec.ForcePXELinux {
+		return spec, err
+	}
+	return &pixiecore.Spec{
+		IpxeScript: fmt.Sprintf("#!ipxe\nchain %s/_/ipxe?mac=%s&arch=%d\n", s.urls.ForHost(m.MAC.String()), m.MAC, m.Arch),
+	}, nil
+}
+
+// ReadBootFile refuses to serve files through Pixiecore, as the
+// HTTPHandler serves them with the lease, TLS and interface checks
+// Pixiecore's HTTP server can't make.
+func (s *chainBooter) ReadBootFile(id pixiecore.ID) (io.ReadCloser, int64, error) {
+	return nil, -1, fmt.Errorf("file '%s' is only served from pxeserver's HTTP address", id)
+}
+
+type excludeBooter struct {
+	pixiecore.Booter
+	hosts map[string]bool
+}
+
+// ExcludeBooter leaves the hosts with the given MACs out of booter, for
+// Pixiecore to ignore hosts pxeserver boots by other means.
+func ExcludeBooter(booter pixiecore.Booter, macs []string) pixiecore.Booter {
+	hosts := make(map[string]bool)
+	for _, mac := range macs {
+		hosts[mac] = true
+	}
+	return &excludeBooter{
+		Booter: booter,
+		hosts:  hosts,
+	}
+}
+
+func (b *excludeBooter) BootSpec(m pixiecore.Machine) (*pixiecore.Spec, error) {
+	if b.hosts[m.MAC.String()] {
+		return nil, nil
+	}
+	return b.Booter.BootSpec(m)
+}
@@ -0,0 +1,110 @@
+package pxeserver_test
+
+import (
+	"io/ioutil"
+	"net"
+	"path"
+	"testing"
+	"time"
+
+	"github.com/ljfranklin/pxeserver"
+	"github.com/stretchr/testify/assert"
+	"go.universe.tf/netboot/pixiecore"
+)
+
+func TestBooterSignsFileIDs(t *testing.T) {
+	assert := assert.New(t)
+
+	fixturePath := path.Join(fixturesDir(), "files", "simple.txt")
+	mockRenderer := new(MockRenderer)
+	mockRenderer.On("RenderPath", fixturePath).Return(fixturePath, nil)
+	files, err := pxeserver.LoadFiles([]pxeserver.File{
+		{
+			ID:   "52:54:00:12:34:56-__kernel__",
+			Path: fixturePath,
+		},
+	}, mockRenderer)
+	assert.NoError(err)
+
+	tokens := pxeserver.NewFileTokens([]byte("some-key"), time.Hour)
+	booter, err := pxeserver.ConfigBooter(pxeserver.Pixiecore{
+		"52:54:00:12:34:56": {
+			Kernel: "52:54:00:12:34:56-__kernel__",
+		},
+	}, files, tokens, nil)
+	assert.NoError(err)
+
+	mac, err := net.ParseMAC("52:54:00:12:34:56")
+	assert.NoError(err)
+	spec, err := booter.BootSpec(pixiecore.Machine{MAC: mac})
+	assert.NoError(err)
+	assert.NotEqual(pixiecore.ID("52:54:00:12:34:56-__kernel__"), spec.Kernel)
+
+	fileReader, _, err := booter.ReadBootFile(spec.Kernel)
+	assert.NoError(err)
+	defer fileReader.Close()
+	fileContents, err := ioutil.ReadAll(fileReader)
+	assert.NoError(err)
+	assert.Equal([]byte("some-text\n"), fileContents)
+
+	_, _, err = booter.ReadBootFile("52:54:00:12:34:56-__kernel__")
+	assert.NotNil(err)
+	assert.Contains(err.Error(), "missing access token")
+}
+
+func TestChainBooterHandsOffToHTTPAddress(t *testing.T) {
+	assert := assert.New(t)
+
+	booter, err := pxeserver.ConfigBooter(pxeserver.Pixiecore{
+		"52:54:00:12:34:56": {
+			Kernel: "52:54:00:12:34:56-__kernel__",
+		},
+		"52:54:00:65:43:21": {
+			Kernel:        "52:54:00:65:43:21-__kernel__",
+			ForcePXELinux: true,
+		},
+	}, pxeserver.Files{}, nil, nil)
+	assert.NoError(err)
+	urls, err := pxeserver.NewSubnetURLs(pxeserver.ServerSettings{HTTPAddress: "10.0.0.1:8080"}, nil, nil)
+	assert.NoError(err)
+	booter = pxeserver.ChainBooter(booter, urls)
+
+	mac, err := net.ParseMAC("52:54:00:12:34:56")
+	assert.NoError(err)
+	spec, err := booter.BootSpec(pixiecore.Machine{MAC: mac, Arch: pixiecore.ArchX64})
+	assert.NoError(err)
+	assert.Equal("#!ipxe\nchain http://10.0.0.1:8080/_/ipxe?mac=52:54:00:12:34:56&arch=1\n", spec.IpxeScript)
+
+	pxeLinuxMac, err := net.ParseMAC("52:54:00:65:43:21")
+	assert.NoError(err)
+	spec, err = booter.BootSpec(pixiecore.Machine{MAC: pxeLinuxMac})
+	assert.NoError(err)
+	assert.Empty(spec.IpxeScript)
+	assert.Equal(pixiecore.ID("52:54:00:65:43:21-__kernel__"), spec.Kernel)
+}
+
+func TestChainBooterLeavesFilesToHTTPHandler(t *testing.T) {
+	assert := assert.New(t)
+
+	logs := []string{}
+	handler := newTestHTTPHandler(assert, nil, &logs)
+	urls, err := pxeserver.NewSubnetURLs(pxeserver.ServerSettings{HTTPAddress: "10.0.0.1:8080"}, nil, nil)
+	assert.NoError(err)
+	booter := pxeserver.ChainBooter(handler.Booter, urls)
+
+	_, _, err = booter.ReadBootFile(pixiecore.ID(handler.Tokens.Sign("52:54:00:12:34:56-some-image")))
+	assert.NotNil(err)
+}
+
+func TestExcludeBooter(t *testing.T) {
+	assert := assert.New(t)
+
+	logs := []string{}
+	handler := newTestHTTPHandler(assert, nil, &logs)
+	booter := pxeserver.ExcludeBooter(handler.Booter, []string{"52:54:00:12:34:56"})
+
+	mac, _ := net.ParseMAC("52:54:00:12:34:56")
+	spec, err := booter.BootSpec(pixiecore.Machine{MAC: mac, Arch: pixiecore.ArchArm64})
+	assert.NoError(err)
+	assert.Nil(spec)
+}
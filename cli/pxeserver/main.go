@@ -3,9 +3,13 @@ package main
 import (
 	"fmt"
 	"io"
+	"io/ioutil"
 	"log"
 	"os"
+	"sort"
+	"strings"
 	"sync"
+	"time"
 
 	"github.com/ljfranklin/pxeserver"
 	"github.com/spf13/cobra"
@@ -17,6 +21,28 @@ func main() {
 	var host string
 	var id string
 	var field string
+	var value string
+	var valueFile string
+	var importFile string
+	var format string
+	var previous bool
+	var fileTokenTTL time.Duration
+	var auditLog string
+	var auditLogMaxSize int64
+	var auditLogMaxBackups int
+	var event string
+	var since time.Duration
+	var fileID string
+	var debug bool
+	var showSecrets bool
+	var address string
+	var ipv6Address string
+	var interfaces []string
+	var ipv6Only bool
+	var advertiseAddress string
+	var httpPort int
+	var statusPort int
+	var dhcpMode string
 	rootCmd := &cobra.Command{
 		Use:   "pxeserver",
 		Short: "A server to PXE boot machines over the network",
@@ -26,17 +52,50 @@ func main() {
 		Use:   "boot",
 		Short: "Start listening for PXE boot requests",
 		Run: func(cmd *cobra.Command, args []string) {
+			if err := applyEnv(cmd, bootEnvFlags); err != nil {
+				log.Fatal(err)
+			}
+			flags := cmd.Flags()
 			executeBoot(bootArgs{
-				ConfigPath:  cfgFile,
-				SecretsPath: secretsFile,
+				ConfigPath:   cfgFile,
+				SecretsPath:  secretsFile,
+				FileTokenTTL: fileTokenTTL,
+				AuditLog:     auditLog,
+				AuditMaxSize: auditLogMaxSize,
+				AuditBackups: auditLogMaxBackups,
+				ShowSecrets:  showSecrets,
+				Address:      address,
+				IPv6Address:  ipv6Address,
+				IPv6Only:     ipv6Only,
+				OverrideSettings: func(settings *pxeserver.ServerSettings) {
+					if flags.Changed("interface") {
+						settings.Interfaces = overrideInterfaces(settings.Interfaces, interfaces)
+					}
+					if flags.Changed("advertise-address") {
+						settings.AdvertiseAddress = advertiseAddress
+					}
+					if flags.Changed("http-port") {
+						settings.Ports.HTTP = httpPort
+					}
+					if flags.Changed("status-port") {
+						settings.StatusPort = statusPort
+					}
+					if flags.Changed("dhcp-mode") {
+						settings.DHCPMode = dhcpMode
+					}
+					if flags.Changed("debug") {
+						settings.Debug = debug
+					}
+				},
 			})
 		},
 	}
 	secretsCmd := &cobra.Command{
 		Use:   "secrets",
-		Short: "Print generated secret to Stdout",
+		Short: "Manage generated secrets, prints a secret to Stdout if no subcommand is given",
 		Run: func(cmd *cobra.Command, args []string) {
-			executeSecrets(secretsArgs{
+			executeSecretsGet(secretsArgs{
+				ConfigPath:  cfgFile,
 				SecretsPath: secretsFile,
 				Host:        host,
 				ID:          id,
@@ -44,34 +103,261 @@ func main() {
 			})
 		},
 	}
+	secretsListCmd := &cobra.Command{
+		Use:   "list",
+		Short: "List the IDs of all stored secrets",
+		Run: func(cmd *cobra.Command, args []string) {
+			executeSecretsList(secretsArgs{
+				ConfigPath:  cfgFile,
+				SecretsPath: secretsFile,
+				Host:        host,
+			})
+		},
+	}
+	secretsGetCmd := &cobra.Command{
+		Use:   "get",
+		Short: "Print a stored secret to Stdout",
+		Run: func(cmd *cobra.Command, args []string) {
+			executeSecretsGet(secretsArgs{
+				ConfigPath:  cfgFile,
+				SecretsPath: secretsFile,
+				Host:        host,
+				ID:          id,
+				Field:       field,
+				Previous:    previous,
+				AuditLog:    auditLog,
+			})
+		},
+	}
+	secretsSetCmd := &cobra.Command{
+		Use:   "set",
+		Short: "Store a secret value, keeping the existing value as the previous version",
+		Run: func(cmd *cobra.Command, args []string) {
+			executeSecretsSet(secretsArgs{
+				ConfigPath:  cfgFile,
+				SecretsPath: secretsFile,
+				Host:        host,
+				ID:          id,
+				Value:       value,
+				ValueFile:   valueFile,
+			})
+		},
+	}
+	secretsImportCmd := &cobra.Command{
+		Use:   "import",
+		Short: "Merge secrets from a file in the secrets store format",
+		Run: func(cmd *cobra.Command, args []string) {
+			executeSecretsImport(secretsArgs{
+				ConfigPath:  cfgFile,
+				SecretsPath: secretsFile,
+				ImportFile:  importFile,
+			})
+		},
+	}
+	secretsDeleteCmd := &cobra.Command{
+		Use:   "delete",
+		Short: "Delete a stored secret",
+		Run: func(cmd *cobra.Command, args []string) {
+			executeSecretsDelete(secretsArgs{
+				ConfigPath:  cfgFile,
+				SecretsPath: secretsFile,
+				Host:        host,
+				ID:          id,
+			})
+		},
+	}
+	secretsRotateCmd := &cobra.Command{
+		Use:   "rotate",
+		Short: "Regenerate a secret, keeping the existing value as the previous version",
+		Run: func(cmd *cobra.Command, args []string) {
+			executeSecretsRotate(secretsArgs{
+				ConfigPath:  cfgFile,
+				SecretsPath: secretsFile,
+				Host:        host,
+				ID:          id,
+			})
+		},
+	}
+	secretsRefreshCmd := &cobra.Command{
+		Use:   "refresh",
+		Short: "Re-read imported secrets (file, env, static) from their sources",
+		Run: func(cmd *cobra.Command, args []string) {
+			executeSecretsRefresh(secretsArgs{
+				ConfigPath:  cfgFile,
+				SecretsPath: secretsFile,
+				Host:        host,
+				ID:          id,
+			})
+		},
+	}
+	secretsGenerateCmd := &cobra.Command{
+		Use:   "generate",
+		Short: "Generate all secrets declared in the config file",
+		Run: func(cmd *cobra.Command, args []string) {
+			executeSecretsGenerate(secretsArgs{
+				ConfigPath:  cfgFile,
+				SecretsPath: secretsFile,
+			})
+		},
+	}
+	secretsMigrateCmd := &cobra.Command{
+		Use:   "migrate",
+		Short: "Move secrets stored under a MAC to the name of its host, done on every boot",
+		Run: func(cmd *cobra.Command, args []string) {
+			executeSecretsMigrate(secretsArgs{
+				ConfigPath:  cfgFile,
+				SecretsPath: secretsFile,
+			})
+		},
+	}
+	secretsExportCmd := &cobra.Command{
+		Use:   "export",
+		Short: "Print all secrets for a host to Stdout as JSON or dotenv",
+		Run: func(cmd *cobra.Command, args []string) {
+			executeSecretsExport(secretsArgs{
+				ConfigPath:  cfgFile,
+				SecretsPath: secretsFile,
+				Host:        host,
+				Format:      format,
+				AuditLog:    auditLog,
+			})
+		},
+	}
 	filesCmd := &cobra.Command{
 		Use:   "files",
-		Short: "Print templated files to Stdout",
+		Short: "Print templated files to Stdout, with secrets masked unless --show-secrets is given",
 		Run: func(cmd *cobra.Command, args []string) {
 			executeFiles(filesArgs{
 				ConfigPath:  cfgFile,
 				SecretsPath: secretsFile,
 				Host:        host,
 				ID:          id,
+				ShowSecrets: showSecrets,
+			})
+		},
+	}
+	tlsCertCmd := &cobra.Command{
+		Use:   "tls-cert",
+		Short: "Print the HTTPS certificate to embed in iPXE as a trust anchor, generating it if needed",
+		Run: func(cmd *cobra.Command, args []string) {
+			executeTLSCert(trustAnchorArgs{
+				ConfigPath:  cfgFile,
+				SecretsPath: secretsFile,
+			})
+		},
+	}
+	imgverifyCACmd := &cobra.Command{
+		Use:   "imgverify-ca",
+		Short: "Print the code signing CA to embed in iPXE as a trust anchor, generating it if needed",
+		Run: func(cmd *cobra.Command, args []string) {
+			executeImgverifyCA(trustAnchorArgs{
+				ConfigPath:  cfgFile,
+				SecretsPath: secretsFile,
+			})
+		},
+	}
+	auditCmd := &cobra.Command{
+		Use:   "audit",
+		Short: "Print audit log events, oldest first",
+		Run: func(cmd *cobra.Command, args []string) {
+			executeAudit(auditArgs{
+				AuditLog: auditLog,
+				Host:     host,
+				ID:       id,
+				FileID:   fileID,
+				Event:    event,
+				Since:    since,
+			})
+		},
+	}
+	dhcpSnippetsCmd := &cobra.Command{
+		Use:   "dhcp-snippets",
+		Short: "Print config for an existing DHCP server to chain hosts to pxeserver with server.dhcp_mode 'none'",
+		Run: func(cmd *cobra.Command, args []string) {
+			executeDHCPSnippets(dhcpSnippetsArgs{
+				ConfigPath: cfgFile,
+				Format:     format,
 			})
 		},
 	}
 	// TODO: document flags
 	bootCmd.Flags().StringVar(&cfgFile, "config", "", "config file")
 	bootCmd.Flags().StringVar(&secretsFile, "secrets", "", "secrets file")
-	secretsCmd.Flags().StringVar(&cfgFile, "config", "", "config file")
-	secretsCmd.Flags().StringVar(&secretsFile, "secrets", "", "secrets file")
-	secretsCmd.Flags().StringVar(&host, "host", "", "host mac")
+	bootCmd.Flags().DurationVar(&fileTokenTTL, "file-token-ttl", time.Hour, "how long file URLs handed to a booting host remain valid")
+	bootCmd.Flags().StringVar(&auditLog, "audit-log", "", "record secret reads and file renders and serves to this file")
+	bootCmd.Flags().Int64Var(&auditLogMaxSize, "audit-log-max-size", 10*1024*1024, "rotate the audit log after this many bytes, 0 disables rotation")
+	bootCmd.Flags().IntVar(&auditLogMaxBackups, "audit-log-max-backups", 5, "number of rotated audit logs to keep, 0 keeps all")
+	bootCmd.Flags().BoolVar(&debug, "debug", false, "log Pixiecore internals, overrides server.debug")
+	bootCmd.Flags().BoolVar(&showSecrets, "show-secrets", false, "do not mask secret values in log output")
+	bootCmd.Flags().StringVar(&address, "address", "0.0.0.0", "IPv4 address to listen on")
+	bootCmd.Flags().StringVar(&ipv6Address, "ipv6-address", "", "IPv6 address of the interface to answer DHCPv6 on, overrides server.dhcpv6.address")
+	bootCmd.Flags().StringSliceVar(&interfaces, "interface", nil, "only answer boot requests on these interfaces, overrides server.interfaces")
+	bootCmd.Flags().BoolVar(&ipv6Only, "ipv6-only", false, "only boot hosts over DHCPv6")
+	bootCmd.Flags().StringVar(&advertiseAddress, "advertise-address", "", "address clients use to reach the HTTP server, overrides server.advertise_address")
+	bootCmd.Flags().IntVar(&httpPort, "http-port", 80, "Pixiecore's HTTP port, overrides server.ports.http")
+	bootCmd.Flags().IntVar(&statusPort, "status-port", 0, "serve /healthz and /status on this port, overrides server.status_port")
+	bootCmd.Flags().StringVar(&dhcpMode, "dhcp-mode", "proxy", "one of proxy, bind, none, overrides server.dhcp_mode")
+	secretsCmd.PersistentFlags().StringVar(&cfgFile, "config", "", "config file")
+	secretsCmd.PersistentFlags().StringVar(&secretsFile, "secrets", "", "secrets file")
+	secretsCmd.Flags().StringVar(&host, "host", "", "host name, or mac for hosts without one")
 	secretsCmd.Flags().StringVar(&id, "id", "", "secret id")
 	secretsCmd.Flags().StringVar(&field, "field", "", "secret field")
+	secretsListCmd.Flags().StringVar(&host, "host", "", "only list secrets for this host name or mac")
+	secretsGetCmd.Flags().StringVar(&host, "host", "", "host name, or mac for hosts without one")
+	secretsGetCmd.Flags().StringVar(&id, "id", "", "secret id")
+	secretsGetCmd.Flags().StringVar(&field, "field", "", "secret field")
+	secretsGetCmd.Flags().BoolVar(&previous, "previous", false, "print the version replaced by the last set or rotate")
+	secretsGetCmd.Flags().StringVar(&auditLog, "audit-log", "", "record the secret read to this audit log")
+	secretsSetCmd.Flags().StringVar(&host, "host", "", "host name, or mac for hosts without one")
+	secretsSetCmd.Flags().StringVar(&id, "id", "", "secret id")
+	secretsSetCmd.Flags().StringVar(&value, "value", "", "secret value")
+	secretsSetCmd.Flags().StringVar(&valueFile, "value-file", "", "read the secret value from this file")
+	secretsImportCmd.Flags().StringVar(&importFile, "file", "", "file to import, or '-' for Stdin")
+	secretsDeleteCmd.Flags().StringVar(&host, "host", "", "host name, or mac for hosts without one")
+	secretsDeleteCmd.Flags().StringVar(&id, "id", "", "secret id")
+	secretsRotateCmd.Flags().StringVar(&host, "host", "", "host name, or mac for hosts without one")
+	secretsRotateCmd.Flags().StringVar(&id, "id", "", "secret id")
+	secretsRefreshCmd.Flags().StringVar(&host, "host", "", "host name, or mac for hosts without one")
+	secretsRefreshCmd.Flags().StringVar(&id, "id", "", "secret id, refreshes all imported secrets if not given")
+	secretsExportCmd.Flags().StringVar(&host, "host", "", "host name, or mac for hosts without one")
+	secretsExportCmd.Flags().StringVar(&format, "format", "json", "output format, one of json, dotenv")
+	secretsExportCmd.Flags().StringVar(&auditLog, "audit-log", "", "record the secrets read to this audit log")
 	filesCmd.Flags().StringVar(&cfgFile, "config", "", "config file")
 	filesCmd.Flags().StringVar(&secretsFile, "secrets", "", "secrets file")
-	filesCmd.Flags().StringVar(&host, "host", "", "host mac")
+	filesCmd.Flags().StringVar(&host, "host", "", "host name, or mac for hosts without one")
 	filesCmd.Flags().StringVar(&id, "id", "", "secret id")
+	filesCmd.Flags().BoolVar(&showSecrets, "show-secrets", false, "do not mask secret values in the output")
+	tlsCertCmd.Flags().StringVar(&cfgFile, "config", "", "config file")
+	tlsCertCmd.Flags().StringVar(&secretsFile, "secrets", "", "secrets file")
+	imgverifyCACmd.Flags().StringVar(&cfgFile, "config", "", "config file")
+	imgverifyCACmd.Flags().StringVar(&secretsFile, "secrets", "", "secrets file")
+	dhcpSnippetsCmd.Flags().StringVar(&cfgFile, "config", "", "config file")
+	dhcpSnippetsCmd.Flags().StringVar(&format, "format", "dnsmasq", fmt.Sprintf("output format, one of %s", strings.Join(pxeserver.DHCPSnippetFormats, ", ")))
+	auditCmd.Flags().StringVar(&auditLog, "audit-log", "", "audit log file")
+	auditCmd.Flags().StringVar(&host, "host", "", "only print events for this host name or mac")
+	auditCmd.Flags().StringVar(&id, "secret", "", "only print events for this secret id")
+	auditCmd.Flags().StringVar(&fileID, "file", "", "only print events for this file id")
+	auditCmd.Flags().StringVar(&event, "event", "", "only print events of this type, one of secret_access, file_render, cmdline_render, file_serve")
+	auditCmd.Flags().DurationVar(&since, "since", 0, "only print events newer than this duration")
+
+	secretsCmd.AddCommand(secretsListCmd)
+	secretsCmd.AddCommand(secretsGetCmd)
+	secretsCmd.AddCommand(secretsSetCmd)
+	secretsCmd.AddCommand(secretsImportCmd)
+	secretsCmd.AddCommand(secretsDeleteCmd)
+	secretsCmd.AddCommand(secretsRotateCmd)
+	secretsCmd.AddCommand(secretsRefreshCmd)
+	secretsCmd.AddCommand(secretsGenerateCmd)
+	secretsCmd.AddCommand(secretsMigrateCmd)
+	secretsCmd.AddCommand(secretsExportCmd)
 
 	rootCmd.AddCommand(bootCmd)
 	rootCmd.AddCommand(secretsCmd)
 	rootCmd.AddCommand(filesCmd)
+	rootCmd.AddCommand(tlsCertCmd)
+	rootCmd.AddCommand(imgverifyCACmd)
+	rootCmd.AddCommand(auditCmd)
+	rootCmd.AddCommand(dhcpSnippetsCmd)
 
 	if err := rootCmd.Execute(); err != nil {
 		log.Fatal(err)
@@ -79,8 +365,35 @@ func main() {
 }
 
 type bootArgs struct {
-	ConfigPath  string
-	SecretsPath string
+	ConfigPath   string
+	SecretsPath  string
+	FileTokenTTL time.Duration
+	AuditLog     string
+	AuditMaxSize int64
+	AuditBackups int
+	ShowSecrets  bool
+	Address      string
+	IPv6Address  string
+	IPv6Only     bool
+	// OverrideSettings applies flags given on the command line or through
+	// the environment to the config's server block
+	OverrideSettings func(settings *pxeserver.ServerSettings)
+}
+
+// bootEnvFlags may also be set as PXESERVER_<FLAG>, e.g.
+// PXESERVER_HTTP_PORT for --http-port.
+var bootEnvFlags = []string{
+	"config",
+	"secrets",
+	"address",
+	"ipv6-address",
+	"interface",
+	"ipv6-only",
+	"advertise-address",
+	"http-port",
+	"status-port",
+	"dhcp-mode",
+	"debug",
 }
 
 func executeBoot(args bootArgs) {
@@ -98,42 +411,330 @@ func executeBoot(args bootArgs) {
 	defer configFile.Close()
 
 	server := pxeserver.Server{
-		// TODO: address flag
-		Address: "0.0.0.0",
-		Config:  configFile,
-		LogFunc: logFunc,
-		// TODO: debug flag
-		// TODO: DHCP nobind flag
-		DHCPNoBind:  true,
-		SecretsPath: args.SecretsPath,
+		Address:            args.Address,
+		IPv6Address:        args.IPv6Address,
+		IPv4Disabled:       args.IPv6Only,
+		Config:             configFile,
+		LogFunc:            logFunc,
+		SecretsPath:        args.SecretsPath,
+		ShowSecrets:        args.ShowSecrets,
+		FileTokenTTL:       args.FileTokenTTL,
+		AuditLogPath:       args.AuditLog,
+		AuditLogMaxSize:    args.AuditMaxSize,
+		AuditLogMaxBackups: args.AuditBackups,
+		OverrideSettings:   args.OverrideSettings,
 	}
 	fmt.Println(server.Serve())
 }
 
+// applyEnv sets each of names not given on the command line from its
+// PXESERVER_ environment variable, if present.
+func applyEnv(cmd *cobra.Command, names []string) error {
+	for _, name := range names {
+		flag := cmd.Flags().Lookup(name)
+		if flag == nil || flag.Changed {
+			continue
+		}
+		envName := "PXESERVER_" + strings.ToUpper(strings.ReplaceAll(name, "-", "_"))
+		if value, ok := os.LookupEnv(envName); ok {
+			if err := cmd.Flags().Set(name, value); err != nil {
+				return fmt.Errorf("invalid %s: %s", envName, err)
+			}
+		}
+	}
+	return nil
+}
+
+// overrideInterfaces keeps the host restrictions of configured interfaces
+// which are also given by name on the command line.
+func overrideInterfaces(configured []pxeserver.InterfaceSettings, names []string) []pxeserver.InterfaceSettings {
+	interfaces := make([]pxeserver.InterfaceSettings, 0, len(names))
+	for _, name := range names {
+		iface := pxeserver.InterfaceSettings{Name: name}
+		for _, existing := range configured {
+			if existing.Name == name {
+				iface = existing
+			}
+		}
+		interfaces = append(interfaces, iface)
+	}
+	return interfaces
+}
+
 type secretsArgs struct {
+	ConfigPath  string
 	SecretsPath string
 	Host        string
 	ID          string
 	Field       string
+	Previous    bool
+	Value       string
+	ValueFile   string
+	ImportFile  string
+	Format      string
+	AuditLog    string
 }
 
-func executeSecrets(args secretsArgs) {
-	secrets, err := pxeserver.LoadLocalSecrets(args.SecretsPath, nil)
+// loadSecretsStore only requires a config file for commands which need
+// secret defs, i.e. generating new values. It also returns the MACs of each
+// host in the config, if given. Secrets are only moved from MACs to host
+// names by 'boot' and 'secrets migrate'.
+func loadSecretsStore(args secretsArgs) (pxeserver.SecretsStore, map[string][]string) {
+	var defs map[string][]pxeserver.SecretDef
+	var hostMACs map[string][]string
+	if args.ConfigPath != "" {
+		configFile, err := os.Open(args.ConfigPath)
+		if err != nil {
+			log.Fatal(err)
+		}
+		defer configFile.Close()
+		cfg, err := pxeserver.LoadConfig(configFile)
+		if err != nil {
+			log.Fatal(err)
+		}
+		defs = cfg.SecretDefs()
+		hostMACs = cfg.HostMACs()
+	}
+
+	secrets, err := pxeserver.LoadLocalSecrets(args.SecretsPath, defs)
 	if err != nil {
 		log.Fatal(err)
 	}
-	result, err := secrets.GetField(args.Host, args.ID, args.Field)
+	return secrets, hostMACs
+}
+
+// requireMigratedSecrets stops commands which may store secrets under a
+// host's name while its existing secrets are still stored under its MAC.
+func requireMigratedSecrets(secrets pxeserver.SecretsStore, hostMACs map[string][]string) {
+	for mac, name := range pxeserver.UnmigratedSecrets(secrets, hostMACs) {
+		log.Fatalf("secrets of host '%s' are still stored under its MAC '%s': run 'pxeserver secrets migrate' first", name, mac)
+	}
+}
+
+func executeSecretsList(args secretsArgs) {
+	secrets, _ := loadSecretsStore(args)
+	hostToIDs := secrets.List()
+
+	macs := make([]string, 0, len(hostToIDs))
+	for mac := range hostToIDs {
+		macs = append(macs, mac)
+	}
+	sort.Strings(macs)
+	for _, mac := range macs {
+		if args.Host != "" && mac != args.Host {
+			continue
+		}
+		for _, id := range hostToIDs[mac] {
+			fmt.Printf("%s\t%s\n", mac, id)
+		}
+	}
+}
+
+func executeSecretsGet(args secretsArgs) {
+	secrets, hostMACs := loadSecretsStore(args)
+	args.Host = resolveSecretsHost(secrets, hostMACs, args.Host)
+
+	var result interface{}
+	var err error
+	if args.Previous {
+		result, err = secrets.GetPrevious(args.Host, args.ID)
+		if err == nil && args.Field != "" {
+			fields, ok := result.(map[string]interface{})
+			if !ok {
+				log.Fatalf("previous version of secret '%s' does not have fields", args.ID)
+			}
+			result = fields[args.Field]
+		}
+	} else if args.Field != "" {
+		result, err = secrets.GetField(args.Host, args.ID, args.Field)
+	} else {
+		result, err = secrets.Get(args.Host, args.ID)
+	}
 	if err != nil {
 		log.Fatal(err)
 	}
+	recordSecretReads(args, []string{args.ID})
 	fmt.Println(result)
 }
 
+func executeSecretsSet(args secretsArgs) {
+	if args.ID == "" {
+		log.Fatal("--id is required")
+	}
+	value := args.Value
+	if args.ValueFile != "" {
+		contents, err := ioutil.ReadFile(args.ValueFile)
+		if err != nil {
+			log.Fatal(err)
+		}
+		value = string(contents)
+	}
+
+	secrets, hostMACs := loadSecretsStore(args)
+	requireMigratedSecrets(secrets, hostMACs)
+	if err := secrets.Set(args.Host, args.ID, value); err != nil {
+		log.Fatal(err)
+	}
+}
+
+func executeSecretsImport(args secretsArgs) {
+	var importReader io.Reader = os.Stdin
+	if args.ImportFile != "-" {
+		importFile, err := os.Open(args.ImportFile)
+		if err != nil {
+			log.Fatal(err)
+		}
+		defer importFile.Close()
+		importReader = importFile
+	}
+
+	secrets, hostMACs := loadSecretsStore(args)
+	requireMigratedSecrets(secrets, hostMACs)
+	if err := secrets.Import(importReader); err != nil {
+		log.Fatal(err)
+	}
+}
+
+func executeSecretsDelete(args secretsArgs) {
+	secrets, _ := loadSecretsStore(args)
+	if err := secrets.Delete(args.Host, args.ID); err != nil {
+		log.Fatal(err)
+	}
+}
+
+func executeSecretsRotate(args secretsArgs) {
+	if args.ConfigPath == "" {
+		log.Fatal("--config is required to rotate secrets")
+	}
+	secrets, hostMACs := loadSecretsStore(args)
+	requireMigratedSecrets(secrets, hostMACs)
+	if err := secrets.Rotate(args.Host, args.ID); err != nil {
+		log.Fatal(err)
+	}
+}
+
+func executeSecretsRefresh(args secretsArgs) {
+	if args.ConfigPath == "" {
+		log.Fatal("--config is required to refresh secrets")
+	}
+	secrets, hostMACs := loadSecretsStore(args)
+	requireMigratedSecrets(secrets, hostMACs)
+	var err error
+	if args.ID != "" {
+		err = secrets.Refresh(args.Host, args.ID)
+	} else {
+		err = secrets.RefreshImported()
+	}
+	if err != nil {
+		log.Fatal(err)
+	}
+}
+
+func executeSecretsGenerate(args secretsArgs) {
+	if args.ConfigPath == "" {
+		log.Fatal("--config is required to generate secrets")
+	}
+	secrets, hostMACs := loadSecretsStore(args)
+	requireMigratedSecrets(secrets, hostMACs)
+	if err := secrets.GenerateAll(); err != nil {
+		log.Fatal(err)
+	}
+}
+
+func executeSecretsMigrate(args secretsArgs) {
+	if args.ConfigPath == "" {
+		log.Fatal("--config is required to migrate secrets")
+	}
+	secrets, hostMACs := loadSecretsStore(args)
+	migrated, err := pxeserver.MigrateSecrets(secrets, hostMACs)
+	if err != nil {
+		log.Fatal(err)
+	}
+	for mac, name := range migrated {
+		log.Printf("moved secrets of host '%s' from its MAC '%s'", name, mac)
+	}
+}
+
+func executeSecretsExport(args secretsArgs) {
+	secrets, hostMACs := loadSecretsStore(args)
+	args.Host = resolveSecretsHost(secrets, hostMACs, args.Host)
+
+	hostSecrets := make(map[string]interface{})
+	for _, id := range secrets.List()[args.Host] {
+		value, err := secrets.Get(args.Host, id)
+		if err != nil {
+			log.Fatal(err)
+		}
+		hostSecrets[id] = value
+	}
+	recordSecretReads(args, secrets.List()[args.Host])
+	if err := pxeserver.ExportSecrets(os.Stdout, hostSecrets, args.Format); err != nil {
+		log.Fatal(err)
+	}
+}
+
+// resolveSecretsHost returns the name of the host given by name or by one
+// of its MACs, failing if there is no such host.
+func resolveSecretsHost(secrets pxeserver.SecretsStore, hostMACs map[string][]string, host string) string {
+	host = hostName(hostMACs, host)
+	if host == "" {
+		return host
+	}
+	if _, ok := hostMACs[host]; ok {
+		return host
+	}
+	if _, ok := secrets.List()[host]; ok {
+		return host
+	}
+	if hostMACs == nil {
+		log.Fatalf("no secrets are stored for host '%s', pass --config to look a host up by MAC", host)
+	}
+	log.Fatalf("unknown host '%s'", host)
+	return ""
+}
+
+// hostName returns the name of the host with the given MAC, or host if it
+// isn't one of their MACs.
+func hostName(hostMACs map[string][]string, host string) string {
+	for name, macs := range hostMACs {
+		for _, mac := range macs {
+			if mac == host {
+				return name
+			}
+		}
+	}
+	return host
+}
+
+// recordSecretReads audits secrets printed by the CLI before they're
+// printed, so a secret is never shown without a record of it.
+func recordSecretReads(args secretsArgs, ids []string) {
+	if args.AuditLog == "" {
+		return
+	}
+	audit, err := pxeserver.OpenAuditLog(args.AuditLog, 0, 0)
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer audit.Close()
+	for _, id := range ids {
+		if err := audit.Record(pxeserver.AuditEvent{
+			Event:    pxeserver.AuditSecretAccess,
+			Host:     args.Host,
+			SecretID: id,
+			Client:   "cli",
+		}); err != nil {
+			log.Fatal(err)
+		}
+	}
+}
+
 type filesArgs struct {
 	ConfigPath  string
 	SecretsPath string
 	Host        string
 	ID          string
+	ShowSecrets bool
 }
 
 func executeFiles(args filesArgs) {
@@ -151,23 +752,126 @@ func executeFiles(args filesArgs) {
 	if err != nil {
 		log.Fatal(err)
 	}
+	requireMigratedSecrets(secrets, cfg.HostMACs())
+	var redactor *pxeserver.Redactor
+	if !args.ShowSecrets {
+		redactor = pxeserver.NewRedactor()
+	}
 	renderer := pxeserver.Renderer{
-		Secrets: secrets,
+		Secrets:  secrets,
+		Scopes:   cfg.SecretScopes(),
+		Redactor: redactor,
 	}
 	files, err := pxeserver.LoadFiles(cfg.Files(), renderer)
 	if err != nil {
 		log.Fatal(err)
 	}
+	host := hostName(cfg.HostMACs(), args.Host)
 	// TODO(ljfranklin): extract into helper
-	namespacedID := fmt.Sprintf("%s-%s", args.Host, args.ID)
+	namespacedID := fmt.Sprintf("%s-%s", host, args.ID)
 	fileReader, _, err := files.Read(namespacedID)
 	if err != nil {
 		log.Fatal(err)
 	}
 	defer fileReader.Close()
 
-	_, err = io.Copy(os.Stdout, fileReader)
+	contents, err := ioutil.ReadAll(fileReader)
+	if err != nil {
+		log.Fatal(err)
+	}
+	fmt.Print(redactor.Redact(string(contents)))
+}
+
+type trustAnchorArgs struct {
+	ConfigPath  string
+	SecretsPath string
+}
+
+func executeTLSCert(args trustAnchorArgs) {
+	configFile, err := os.Open(args.ConfigPath)
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer configFile.Close()
+	cfg, err := pxeserver.LoadConfig(configFile)
+	if err != nil {
+		log.Fatal(err)
+	}
+	settings := cfg.ServerSettings()
+	if !settings.TLS.Enabled {
+		log.Fatal("server.tls is not enabled in the config")
+	}
+
+	secrets, err := pxeserver.LoadLocalSecrets(args.SecretsPath, cfg.SecretDefs())
+	if err != nil {
+		log.Fatal(err)
+	}
+	requireMigratedSecrets(secrets, cfg.HostMACs())
+	certPEM, _, err := pxeserver.LoadTLSCertificate(settings, secrets)
+	if err != nil {
+		log.Fatal(err)
+	}
+	os.Stdout.Write(certPEM)
+}
+
+func executeImgverifyCA(args trustAnchorArgs) {
+	secrets, hostMACs := loadSecretsStore(secretsArgs{
+		ConfigPath:  args.ConfigPath,
+		SecretsPath: args.SecretsPath,
+	})
+	requireMigratedSecrets(secrets, hostMACs)
+	signer, err := pxeserver.LoadCodeSigner(secrets)
+	if err != nil {
+		log.Fatal(err)
+	}
+	os.Stdout.Write(signer.TrustAnchor())
+}
+
+type dhcpSnippetsArgs struct {
+	ConfigPath string
+	Format     string
+}
+
+func executeDHCPSnippets(args dhcpSnippetsArgs) {
+	configFile, err := os.Open(args.ConfigPath)
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer configFile.Close()
+	cfg, err := pxeserver.LoadConfig(configFile)
+	if err != nil {
+		log.Fatal(err)
+	}
+	if err := pxeserver.WriteDHCPSnippets(os.Stdout, cfg, args.Format); err != nil {
+		log.Fatal(err)
+	}
+}
+
+type auditArgs struct {
+	AuditLog string
+	Host     string
+	ID       string
+	FileID   string
+	Event    string
+	Since    time.Duration
+}
+
+func executeAudit(args auditArgs) {
+	filter := pxeserver.AuditFilter{
+		Event:    args.Event,
+		Host:     args.Host,
+		SecretID: args.ID,
+		FileID:   args.FileID,
+	}
+	if args.Since > 0 {
+		filter.Since = time.Now().Add(-args.Since)
+	}
+	events, err := pxeserver.QueryAuditLog(args.AuditLog, filter)
 	if err != nil {
 		log.Fatal(err)
 	}
+	for _, e := range events {
+		fmt.Printf("%s\t%s\t%s\t%s\t%s\t%s\t%s\n",
+			e.Time.Format(time.RFC3339), e.Event, e.Host, e.SecretID, e.Scope, e.FileID, e.Client)
+	}
 }
@@ -0,0 +1,207 @@
+package pxeserver
+
+import (
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"encoding/pem"
+	"errors"
+	"math/big"
+)
+
+const (
+	codeSigningCACertID = "/pxeserver/imgverify_ca_cert"
+	codeSigningCAKeyID  = "/pxeserver/imgverify_ca_key"
+	codeSigningCertID   = "/pxeserver/imgverify_cert"
+	codeSigningKeyID    = "/pxeserver/imgverify_key"
+)
+
+var (
+	oidData          = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 7, 1}
+	oidSignedData    = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 7, 2}
+	oidSHA256        = asn1.ObjectIdentifier{2, 16, 840, 1, 101, 3, 4, 2, 1}
+	oidRSAEncryption = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 1, 1}
+)
+
+// CodeSigner produces detached CMS signatures which iPXE's imgverify
+// command checks against the CA embedded in the iPXE build.
+type CodeSigner struct {
+	caCert *x509.Certificate
+	cert   *x509.Certificate
+	key    *rsa.PrivateKey
+}
+
+// LoadCodeSigner reads the code-signing CA and certificate from the secrets
+// store, generating them on first use. A store is required as a CA which
+// changes on every start could never match the one trusted by iPXE.
+func LoadCodeSigner(secrets SecretsStore) (*CodeSigner, error) {
+	if secrets == nil {
+		return nil, errors.New("server.imgverify requires a secrets store to keep its code signing CA")
+	}
+	caCertPEM, caKeyPEM, _, ok := storedKeyPair(secrets, codeSigningCACertID, codeSigningCAKeyID)
+	if !ok {
+		var err error
+		caCertPEM, caKeyPEM, err = generateCertificate(&x509.Certificate{
+			Subject:  pkix.Name{CommonName: "pxeserver code signing CA"},
+			KeyUsage: x509.KeyUsageCertSign,
+			IsCA:     true,
+		}, nil, nil)
+		if err != nil {
+			return nil, err
+		}
+		if err := storeKeyPair(secrets, codeSigningCACertID, codeSigningCAKeyID, caCertPEM, caKeyPEM); err != nil {
+			return nil, err
+		}
+	}
+	caCert, caKey, err := parseKeyPair(caCertPEM, caKeyPEM)
+	if err != nil {
+		return nil, err
+	}
+
+	certPEM, keyPEM, cert, ok := storedKeyPair(secrets, codeSigningCertID, codeSigningKeyID)
+	// the CA is regenerated if it expires, which invalidates the old cert
+	ok = ok && cert.CheckSignatureFrom(caCert) == nil
+	if !ok {
+		certPEM, keyPEM, err = generateCertificate(&x509.Certificate{
+			Subject:     pkix.Name{CommonName: "pxeserver code signing"},
+			KeyUsage:    x509.KeyUsageDigitalSignature,
+			ExtKeyUsage: []x509.ExtKeyUsage{x509.ExtKeyUsageCodeSigning},
+		}, caCert, caKey)
+		if err != nil {
+			return nil, err
+		}
+		if err := storeKeyPair(secrets, codeSigningCertID, codeSigningKeyID, certPEM, keyPEM); err != nil {
+			return nil, err
+		}
+	}
+	cert, key, err := parseKeyPair(certPEM, keyPEM)
+	if err != nil {
+		return nil, err
+	}
+
+	return &CodeSigner{
+		caCert: caCert,
+		cert:   cert,
+		key:    key,
+	}, nil
+}
+
+// TrustAnchor is the PEM encoded CA to embed in iPXE, e.g. via TRUST=.
+func (c *CodeSigner) TrustAnchor() []byte {
+	return pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: c.caCert.Raw})
+}
+
+// Sign returns a DER encoded, detached CMS signature over the content with
+// the given SHA256 digest. Signed attributes are omitted as iPXE verifies
+// the signature against the digest of the content directly.
+func (c *CodeSigner) Sign(sha256Digest []byte) ([]byte, error) {
+	signature, err := rsa.SignPKCS1v15(rand.Reader, c.key, crypto.SHA256, sha256Digest)
+	if err != nil {
+		return nil, err
+	}
+
+	certs := append(append([]byte{}, c.cert.Raw...), c.caCert.Raw...)
+	signedData, err := asn1.Marshal(cmsSignedData{
+		Version:          1,
+		DigestAlgorithms: []pkix.AlgorithmIdentifier{sha256Algorithm()},
+		EncapContentInfo: cmsEncapContentInfo{ContentType: oidData},
+		Certificates: asn1.RawValue{
+			Class:      asn1.ClassContextSpecific,
+			Tag:        0,
+			IsCompound: true,
+			Bytes:      certs,
+		},
+		SignerInfos: []cmsSignerInfo{
+			{
+				Version: 1,
+				SID: cmsIssuerAndSerial{
+					Issuer:       asn1.RawValue{FullBytes: c.cert.RawIssuer},
+					SerialNumber: c.cert.SerialNumber,
+				},
+				DigestAlgorithm: sha256Algorithm(),
+				SignatureAlgorithm: pkix.AlgorithmIdentifier{
+					Algorithm:  oidRSAEncryption,
+					Parameters: asn1.NullRawValue,
+				},
+				Signature: signature,
+			},
+		},
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return asn1.Marshal(cmsContentInfo{
+		ContentType: oidSignedData,
+		Content: asn1.RawValue{
+			Class:      asn1.ClassContextSpecific,
+			Tag:        0,
+			IsCompound: true,
+			Bytes:      signedData,
+		},
+	})
+}
+
+type cmsContentInfo struct {
+	ContentType asn1.ObjectIdentifier
+	Content     asn1.RawValue
+}
+
+type cmsSignedData struct {
+	Version          int
+	DigestAlgorithms []pkix.AlgorithmIdentifier `asn1:"set"`
+	EncapContentInfo cmsEncapContentInfo
+	Certificates     asn1.RawValue   `asn1:"optional"`
+	SignerInfos      []cmsSignerInfo `asn1:"set"`
+}
+
+type cmsEncapContentInfo struct {
+	ContentType asn1.ObjectIdentifier
+}
+
+type cmsSignerInfo struct {
+	Version            int
+	SID                cmsIssuerAndSerial
+	DigestAlgorithm    pkix.AlgorithmIdentifier
+	SignatureAlgorithm pkix.AlgorithmIdentifier
+	Signature          []byte
+}
+
+type cmsIssuerAndSerial struct {
+	Issuer       asn1.RawValue
+	SerialNumber *big.Int
+}
+
+func sha256Algorithm() pkix.AlgorithmIdentifier {
+	return pkix.AlgorithmIdentifier{
+		Algorithm:  oidSHA256,
+		Parameters: asn1.NullRawValue,
+	}
+}
+
+func storeKeyPair(secrets SecretsStore, certID string, keyID string, certPEM []byte, keyPEM []byte) error {
+	if err := secrets.SetInternal(certID, string(certPEM)); err != nil {
+		return err
+	}
+	return secrets.SetInternal(keyID, string(keyPEM))
+}
+
+func parseKeyPair(certPEM []byte, keyPEM []byte) (*x509.Certificate, *rsa.PrivateKey, error) {
+	keyPair, err := tls.X509KeyPair(certPEM, keyPEM)
+	if err != nil {
+		return nil, nil, err
+	}
+	key, ok := keyPair.PrivateKey.(*rsa.PrivateKey)
+	if !ok {
+		return nil, nil, errors.New("code signing key must be RSA")
+	}
+	cert, err := x509.ParseCertificate(keyPair.Certificate[0])
+	if err != nil {
+		return nil, nil, err
+	}
+	return cert, key, nil
+}
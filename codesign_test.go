@@ -0,0 +1,124 @@
+package pxeserver_test
+
+import (
+	"crypto"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+	"os"
+	"path"
+	"testing"
+
+	"github.com/ljfranklin/pxeserver"
+	"github.com/stretchr/testify/assert"
+)
+
+type testContentInfo struct {
+	ContentType asn1.ObjectIdentifier
+	Content     asn1.RawValue `asn1:"explicit,tag:0"`
+}
+
+type testSignedData struct {
+	Version          int
+	DigestAlgorithms []pkix.AlgorithmIdentifier `asn1:"set"`
+	EncapContentInfo struct {
+		ContentType asn1.ObjectIdentifier
+	}
+	Certificates asn1.RawValue `asn1:"optional,tag:0"`
+	SignerInfos  []struct {
+		Version int
+		SID     struct {
+			Issuer       asn1.RawValue
+			SerialNumber *big.Int
+		}
+		DigestAlgorithm    pkix.AlgorithmIdentifier
+		SignatureAlgorithm pkix.AlgorithmIdentifier
+		Signature          []byte
+	} `asn1:"set"`
+}
+
+// testCodeSigner loads a signer from a temp secrets store, removed by the
+// returned func.
+func testCodeSigner(assert *assert.Assertions) (*pxeserver.CodeSigner, func()) {
+	tmpdir, err := ioutil.TempDir("", "pxeserver-codesign")
+	assert.NoError(err)
+	secrets, err := pxeserver.LoadLocalSecrets(path.Join(tmpdir, "secrets.yaml"), nil)
+	assert.NoError(err)
+	signer, err := pxeserver.LoadCodeSigner(secrets)
+	assert.NoError(err)
+	return signer, func() { os.RemoveAll(tmpdir) }
+}
+
+func TestCodeSignerProducesDetachedCMSSignature(t *testing.T) {
+	assert := assert.New(t)
+
+	signer, cleanup := testCodeSigner(assert)
+	defer cleanup()
+
+	content := []byte("some-kernel")
+	digest := sha256.Sum256(content)
+	signature, err := signer.Sign(digest[:])
+	assert.NoError(err)
+
+	var contentInfo testContentInfo
+	_, err = asn1.Unmarshal(signature, &contentInfo)
+	assert.NoError(err)
+	assert.Equal(asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 7, 2}, contentInfo.ContentType)
+
+	var signedData testSignedData
+	_, err = asn1.Unmarshal(contentInfo.Content.Bytes, &signedData)
+	assert.NoError(err)
+	assert.Equal(asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 7, 1}, signedData.EncapContentInfo.ContentType)
+	assert.Len(signedData.SignerInfos, 1)
+
+	certs, err := x509.ParseCertificates(signedData.Certificates.Bytes)
+	assert.NoError(err)
+	assert.Len(certs, 2)
+	signingCert := certs[0]
+	assert.Equal(signingCert.SerialNumber, signedData.SignerInfos[0].SID.SerialNumber)
+	assert.Equal([]x509.ExtKeyUsage{x509.ExtKeyUsageCodeSigning}, signingCert.ExtKeyUsage)
+
+	block, _ := pem.Decode(signer.TrustAnchor())
+	assert.NotNil(block)
+	ca, err := x509.ParseCertificate(block.Bytes)
+	assert.NoError(err)
+	assert.True(ca.IsCA)
+	assert.NoError(signingCert.CheckSignatureFrom(ca))
+
+	err = rsa.VerifyPKCS1v15(signingCert.PublicKey.(*rsa.PublicKey), crypto.SHA256, digest[:], signedData.SignerInfos[0].Signature)
+	assert.NoError(err)
+}
+
+func TestCodeSignerPersistsCA(t *testing.T) {
+	assert := assert.New(t)
+
+	tmpdir, err := ioutil.TempDir("", "pxeserver-codesign")
+	assert.NoError(err)
+	defer os.RemoveAll(tmpdir)
+	secretsPath := path.Join(tmpdir, "secrets.yaml")
+
+	secrets, err := pxeserver.LoadLocalSecrets(secretsPath, nil)
+	assert.NoError(err)
+	signer, err := pxeserver.LoadCodeSigner(secrets)
+	assert.NoError(err)
+
+	secrets, err = pxeserver.LoadLocalSecrets(secretsPath, nil)
+	assert.NoError(err)
+	reloaded, err := pxeserver.LoadCodeSigner(secrets)
+	assert.NoError(err)
+
+	assert.Equal(signer.TrustAnchor(), reloaded.TrustAnchor())
+}
+
+func TestCodeSignerErrorWithoutSecretsStore(t *testing.T) {
+	assert := assert.New(t)
+
+	_, err := pxeserver.LoadCodeSigner(nil)
+	assert.NotNil(err)
+	assert.Contains(err.Error(), "secrets store")
+}
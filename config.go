@@ -4,25 +4,131 @@ import (
 	"fmt"
 	"io"
 	"io/ioutil"
+	"net"
+	"path/filepath"
+	"regexp"
+	"sort"
 	"strings"
 
 	// This yaml library outputs maps with string keys for better
 	// interoperability with template funcs like 'toJson'
 	"github.com/ghodss/yaml"
 	"github.com/imdario/mergo"
+	"go.universe.tf/netboot/pixiecore"
 )
 
+var hostNamePattern = regexp.MustCompile(`^[A-Za-z0-9][A-Za-z0-9._-]*$`)
+
 type Config struct {
-	macToFiles      map[string][]File
-	macToVars       map[string]map[string]interface{}
-	macToSecrets    map[string][]SecretDef
+	hostToFiles     map[string][]File
+	hostToVars      map[string]map[string]interface{}
+	hostToSecrets   map[string][]SecretDef
+	hostToScopes    map[string][]string
+	reservations    map[string]DHCPReservation
+	hostToSubnet    map[string]DHCPSubnet
+	httpBootModes   map[string]string
+	grubHosts       []string
+	ubootHosts      map[string]UBootHost
+	rpiHosts        map[string]string
+	tftpFiles       []TFTPFile
+	ipxeFirmware    map[string]map[pixiecore.Firmware]string
+	smbiosHosts     map[string]SMBIOS
+	hostNames       []string
+	nameToMACs      map[string][]string
+	macToName       map[string]string
 	pixiecoreConfig Pixiecore
+	settings        ServerSettings
 }
 
 type ServerConfig struct {
-	Hosts         []Host
+	Server ServerSettings
+	Hosts  []Host
+	// HostSets generate hosts from a count or an inventory file, which are
+	// added after Hosts
+	HostSets      []HostSet `json:"host_sets"`
 	Vars          map[string]interface{}
-	SharedSecrets []SecretDef `json:"shared_secrets"`
+	SharedSecrets []SecretDef   `json:"shared_secrets"`
+	SecretScopes  []SecretScope `json:"secret_scopes"`
+	// TFTP serves files by path to any TFTP client, e.g. devices which
+	// fetch their config without booting through pxeserver
+	TFTP []TFTPFile `json:"tftp"`
+}
+type ServerSettings struct {
+	// HTTPAddress is the host:port of pxeserver's own HTTP server, which
+	// serves boot scripts and files in place of Pixiecore's when set. Boot
+	// scripts, and the file tokens in them, are only served to the host at
+	// its lease, so DHCP or TrustedDHCPServers must be set too.
+	HTTPAddress string `json:"http_address"`
+	// BindFilesToLease only serves a host's files to the IP address it was
+	// seen leasing over DHCP, requires HTTPAddress
+	BindFilesToLease bool `json:"bind_files_to_lease"`
+	// TrustedDHCPServers are the server identifiers of the DHCP servers
+	// whose DHCPACKs are recorded as leases when server.dhcp is off. ACKs
+	// from other servers are ignored, as any client could send one.
+	TrustedDHCPServers []string `json:"trusted_dhcp_servers"`
+	// TrustedRelays are the relay addresses (giaddr) recorded for hosts
+	// behind a relay when server.dhcp is off, other relays are ignored
+	TrustedRelays []string `json:"trusted_relays"`
+	// TLS serves HTTPAddress over HTTPS, requires HTTPAddress and Ipxe
+	// firmware trusting the certificate, see scripts/build_ipxe
+	TLS TLSSettings `json:"tls"`
+	// ImgVerify signs each file and has iPXE verify the kernel and initrds
+	// before booting, requires HTTPAddress and Ipxe firmware trusting the
+	// code signing CA
+	ImgVerify bool `json:"imgverify"`
+	// DHCP hands out addresses in addition to Pixiecore's ProxyDHCP
+	DHCP DHCPSettings `json:"dhcp"`
+	// DHCPv6 answers UEFI clients on IPv6 networks with a boot file URL on
+	// HTTPAddress, requires HTTPAddress
+	DHCPv6 DHCPv6Settings `json:"dhcpv6"`
+	// Interfaces limits answering boot requests to these NICs, all
+	// interfaces are used if empty
+	Interfaces []InterfaceSettings `json:"interfaces"`
+	// AdvertiseAddress is the host clients are sent to reach HTTPAddress,
+	// defaults to the host in HTTPAddress
+	AdvertiseAddress string       `json:"advertise_address"`
+	Ports            PortSettings `json:"ports"`
+	// DHCPMode is "proxy" to run alongside another DHCP server on this
+	// machine, the default, "bind" to bind Pixiecore to the DHCP port, or
+	// "none" to leave DHCP to a server which chains iPXE to /boot on
+	// HTTPAddress, see 'pxeserver dhcp-snippets'
+	DHCPMode string `json:"dhcp_mode"`
+	// Debug logs Pixiecore internals
+	Debug bool `json:"debug"`
+	// StatusPort serves /healthz and /status, disabled if 0
+	StatusPort int `json:"status_port"`
+	// Grub is the shim and GRUB served to hosts with bootloader 'grub'
+	Grub GrubSettings `json:"grub"`
+	// RaspberryPi is the firmware served to hosts with bootloader
+	// 'raspberrypi'
+	RaspberryPi RaspberryPiSettings `json:"raspberry_pi"`
+	// Ipxe replaces the builtin iPXE build for each firmware type, e.g.
+	// 'x86pc' or 'efi64'
+	Ipxe map[string]File `json:"ipxe"`
+}
+
+// PortSettings replace Pixiecore's defaults. Only HTTP is safe to change
+// outside of testing, client firmware expects the standard DHCP, TFTP and
+// PXE ports.
+type PortSettings struct {
+	HTTP int `json:"http"`
+	DHCP int `json:"dhcp"`
+	TFTP int `json:"tftp"`
+	PXE  int `json:"pxe"`
+}
+type TLSSettings struct {
+	Enabled bool `json:"enabled"`
+	// CertFile and KeyFile are PEM encoded, a self-signed certificate is
+	// generated and kept in the secrets store if they are not given
+	CertFile string `json:"cert_file"`
+	KeyFile  string `json:"key_file"`
+	// Hostnames are added to the generated certificate alongside the host
+	// from HTTPAddress
+	Hostnames []string `json:"hostnames"`
+}
+type SecretScope struct {
+	Name    string
+	Secrets []SecretDef
 }
 type Pixiecore map[MacAddress]MachineConfig
 type MacAddress string
@@ -33,17 +139,53 @@ type MachineConfig struct {
 	ForcePXELinux bool
 }
 type Host struct {
-	Mac           string
+	// Name keys the host's files, vars and secrets, defaulting to its
+	// first MAC. Naming a host keeps its secrets when a NIC is replaced.
+	Name string
+	Mac  string
+	// Macs are the host's other NICs, any of which it may boot from
+	Macs          []string `json:"macs"`
 	Kernel        File
 	Initrds       []File
 	Files         []File
 	BootArgs      []string `json:"boot_args"`
 	Vars          map[string]interface{}
 	Secrets       []SecretDef
-	ForcePXELinux bool `json:"force_pxe_linux"`
+	SecretScopes  []string `json:"secret_scopes"`
+	ForcePXELinux bool     `json:"force_pxe_linux"`
+	// IP and Hostname are handed out by the built-in DHCP server
+	IP       string
+	Hostname string
+	// Subnet is the name of the subnet the host boots from, defaults to the
+	// subnet containing IP
+	Subnet string
+	// HTTPBoot is what UEFI HTTP Boot clients are sent, "ipxe" or "kernel"
+	HTTPBoot string `json:"http_boot"`
+	// Bootloader is "ipxe", "grub" for the signed shim and GRUB in
+	// server.grub, "uboot" for boards which boot with U-Boot's 'pxe'
+	// command, or "raspberrypi" for the Raspberry Pi's own network boot
+	Bootloader string
+	// FDT and FDTOverlays are the device tree and overlays U-Boot loads
+	// for the kernel, bootloader 'uboot' only
+	FDT         File   `json:"fdt"`
+	FDTOverlays []File `json:"fdt_overlays"`
+	// Serial is the last 8 hex digits of a Raspberry Pi's serial number,
+	// which its bootloader requests files below. Pis configured to use
+	// their MAC instead may leave it empty.
+	Serial string
+	// Ipxe replaces server.ipxe for this host, e.g. an snponly build for
+	// a NIC the builtin drivers don't support
+	Ipxe map[string]File `json:"ipxe"`
+	// SMBIOS boots machines reporting this identity as the host from any
+	// NIC, keeping Name as the key for its files and secrets. Every unknown
+	// machine is offered iPXE to report its identity, requires
+	// server.http_address.
+	SMBIOS SMBIOS `json:"smbios"`
 }
 type File struct {
-	Mac          string
+	// Host is the name of the host the file belongs to, empty for
+	// server.files
+	Host         string
 	Path         string
 	URL          string
 	SHA256       string
@@ -52,6 +194,9 @@ type File struct {
 	Vars         map[string]interface{}
 	ImageConvert ImageConvert `json:"image_convert"`
 	Gzip         bool
+	// Public files are served to any client with a valid token, skipping
+	// the BindFilesToLease check
+	Public bool
 }
 type ImageConvert struct {
 	InputFormat string `json:"input_format"`
@@ -60,10 +205,20 @@ type ImageConvert struct {
 func LoadConfig(configReader io.Reader) (Config, error) {
 	c := Config{
 		pixiecoreConfig: Pixiecore{},
-		macToFiles:      make(map[string][]File),
-		macToVars:       make(map[string]map[string]interface{}),
-		macToSecrets:    make(map[string][]SecretDef),
+		hostToFiles:     make(map[string][]File),
+		hostToVars:      make(map[string]map[string]interface{}),
+		hostToSecrets:   make(map[string][]SecretDef),
+		hostToScopes:    make(map[string][]string),
+		reservations:    make(map[string]DHCPReservation),
+		httpBootModes:   make(map[string]string),
+		ubootHosts:      make(map[string]UBootHost),
+		rpiHosts:        make(map[string]string),
+		ipxeFirmware:    make(map[string]map[pixiecore.Firmware]string),
+		smbiosHosts:     make(map[string]SMBIOS),
+		nameToMACs:      make(map[string][]string),
+		macToName:       make(map[string]string),
 	}
+	subnetNames := make(map[string]string)
 
 	input := ServerConfig{}
 	configContents, err := ioutil.ReadAll(configReader)
@@ -73,22 +228,76 @@ func LoadConfig(configReader io.Reader) (Config, error) {
 	if err = yaml.Unmarshal(configContents, &input); err != nil {
 		return Config{}, fmt.Errorf("config file was not valid YAML/JSON: %s", err)
 	}
+	if err := input.Server.validate(); err != nil {
+		return Config{}, err
+	}
+	c.settings = input.Server
+	if err := c.addIpxeFirmware("", input.Server.Ipxe); err != nil {
+		return Config{}, fmt.Errorf("server.ipxe has %s", err)
+	}
+
 	if len(input.SharedSecrets) > 0 {
-		c.macToSecrets[""] = input.SharedSecrets
+		sharedSecrets, err := validateSecretDefs("shared secret", input.SharedSecrets)
+		if err != nil {
+			return Config{}, err
+		}
+		c.hostToSecrets[""] = sharedSecrets
+	}
+	for _, scope := range input.SecretScopes {
+		if scope.Name == "" {
+			return Config{}, fmt.Errorf("secret scope is missing a 'name'")
+		}
+		if _, ok := c.hostToSecrets[SecretScopeKey(scope.Name)]; ok {
+			return Config{}, fmt.Errorf("secret scope '%s' is declared more than once", scope.Name)
+		}
+		scopeSecrets, err := validateSecretDefs(fmt.Sprintf("secret for scope '%s'", scope.Name), scope.Secrets)
+		if err != nil {
+			return Config{}, err
+		}
+		c.hostToSecrets[SecretScopeKey(scope.Name)] = scopeSecrets
 	}
 
-	for _, host := range input.Hosts {
+	setHosts, err := expandHostSets(input.HostSets)
+	if err != nil {
+		return Config{}, err
+	}
+	for _, host := range append(input.Hosts, setHosts...) {
 		machine := MachineConfig{}
 
-		host.Kernel.ID = fmt.Sprintf("%s-__kernel__", host.Mac)
-		host.Kernel.Mac = host.Mac
-		c.macToFiles[host.Mac] = append(c.macToFiles[host.Mac], host.Kernel)
+		macs := host.Macs
+		if host.Mac != "" {
+			macs = append([]string{host.Mac}, macs...)
+		}
+		if len(macs) == 0 {
+			return Config{}, fmt.Errorf("host '%s' is missing a 'mac'", host.Name)
+		}
+		name := host.Name
+		if name == "" {
+			name = macs[0]
+		} else if err := validateHostName(name); err != nil {
+			return Config{}, err
+		}
+		if _, ok := c.nameToMACs[name]; ok {
+			return Config{}, fmt.Errorf("host '%s' is declared more than once", name)
+		}
+		for _, mac := range macs {
+			if other, ok := c.macToName[mac]; ok {
+				return Config{}, fmt.Errorf("hosts '%s' and '%s' both have MAC '%s'", other, name, mac)
+			}
+			c.macToName[mac] = name
+		}
+		c.nameToMACs[name] = macs
+		c.hostNames = append(c.hostNames, name)
+
+		host.Kernel.ID = fmt.Sprintf("%s-__kernel__", name)
+		host.Kernel.Host = name
+		c.hostToFiles[name] = append(c.hostToFiles[name], host.Kernel)
 		machine.Kernel = host.Kernel.ID
 
 		for i, f := range host.Initrds {
-			f.ID = fmt.Sprintf("%s-__initrd%d__", host.Mac, i)
-			f.Mac = host.Mac
-			c.macToFiles[host.Mac] = append(c.macToFiles[host.Mac], f)
+			f.ID = fmt.Sprintf("%s-__initrd%d__", name, i)
+			f.Host = name
+			c.hostToFiles[name] = append(c.hostToFiles[name], f)
 			machine.Initrd = append(machine.Initrd, f.ID)
 		}
 
@@ -96,8 +305,19 @@ func LoadConfig(configReader io.Reader) (Config, error) {
 			return Config{}, err
 		}
 
-		c.macToVars[host.Mac] = host.Vars
-		c.macToSecrets[host.Mac] = host.Secrets
+		c.hostToVars[name] = host.Vars
+		hostSecrets, err := validateSecretDefs(fmt.Sprintf("secret for host '%s'", name), host.Secrets)
+		if err != nil {
+			return Config{}, err
+		}
+		c.hostToSecrets[name] = hostSecrets
+
+		for _, scope := range host.SecretScopes {
+			if _, ok := c.hostToSecrets[SecretScopeKey(scope)]; !ok {
+				return Config{}, fmt.Errorf("host '%s' references unknown secret scope '%s'", name, scope)
+			}
+		}
+		c.hostToScopes[name] = host.SecretScopes
 
 		for _, f := range host.Files {
 			if len(f.Vars) > 0 && !f.Template {
@@ -107,40 +327,474 @@ func LoadConfig(configReader io.Reader) (Config, error) {
 			if err := mergo.Merge(&f.Vars, host.Vars, mergo.WithOverride); err != nil {
 				return Config{}, err
 			}
-			f.ID = fmt.Sprintf("%s-%s", host.Mac, f.ID)
-			f.Mac = host.Mac
-			c.macToFiles[host.Mac] = append(c.macToFiles[host.Mac], f)
+			f.ID = fmt.Sprintf("%s-%s", name, f.ID)
+			f.Host = name
+			c.hostToFiles[name] = append(c.hostToFiles[name], f)
+		}
+
+		// each of the host's NICs is handed its IP, only one is expected
+		// to be up at a time
+		if host.IP != "" {
+			ip := net.ParseIP(host.IP).To4()
+			if ip == nil {
+				return Config{}, fmt.Errorf("host '%s' has invalid IPv4 address '%s'", name, host.IP)
+			}
+			for otherMac, reservation := range c.reservations {
+				if reservation.IP.Equal(ip) {
+					return Config{}, fmt.Errorf("hosts '%s' and '%s' both have IP '%s'", c.macToName[otherMac], name, host.IP)
+				}
+			}
+			for _, mac := range macs {
+				c.reservations[mac] = DHCPReservation{
+					IP:       ip,
+					Hostname: host.Hostname,
+				}
+			}
+		}
+
+		if host.Subnet != "" {
+			for _, mac := range macs {
+				subnetNames[mac] = host.Subnet
+			}
+		}
+
+		if err := validateHTTPBootMode(host.HTTPBoot); err != nil {
+			return Config{}, fmt.Errorf("host '%s' has %s", name, err)
+		}
+		if host.HTTPBoot == HTTPBootKernel && (len(host.Initrds) > 0 || len(host.BootArgs) > 0) {
+			return Config{}, fmt.Errorf("host '%s' has http_boot '%s' which can't pass initrds or boot_args, they must be built into the kernel", name, HTTPBootKernel)
+		}
+		if host.HTTPBoot != "" {
+			for _, mac := range macs {
+				c.httpBootModes[mac] = host.HTTPBoot
+			}
+		}
+
+		if err := validateBootloader(host.Bootloader); err != nil {
+			return Config{}, fmt.Errorf("host '%s' has %s", name, err)
+		}
+		if host.Bootloader == BootloaderGrub {
+			if c.settings.Grub.Shim == "" || c.settings.Grub.Grub == "" {
+				return Config{}, fmt.Errorf("host '%s' has bootloader '%s' which requires server.grub.shim and server.grub.grub to be set", name, BootloaderGrub)
+			}
+			if host.ForcePXELinux || host.HTTPBoot == HTTPBootKernel {
+				return Config{}, fmt.Errorf("host '%s' has bootloader '%s' which can't be combined with force_pxe_linux or http_boot '%s'", name, BootloaderGrub, HTTPBootKernel)
+			}
+			c.grubHosts = append(c.grubHosts, macs...)
+		}
+		if host.Bootloader == BootloaderUBoot {
+			if host.ForcePXELinux || host.HTTPBoot != "" {
+				return Config{}, fmt.Errorf("host '%s' has bootloader '%s' which can't be combined with force_pxe_linux or http_boot", name, BootloaderUBoot)
+			}
+			if len(host.Initrds) > 1 {
+				return Config{}, fmt.Errorf("host '%s' has bootloader '%s' which only loads a single initrd", name, BootloaderUBoot)
+			}
+			ubootHost := UBootHost{}
+			if host.FDT.Path != "" || host.FDT.URL != "" {
+				host.FDT.ID = fmt.Sprintf("%s-__fdt__", name)
+				host.FDT.Host = name
+				c.hostToFiles[name] = append(c.hostToFiles[name], host.FDT)
+				ubootHost.FDT = host.FDT.ID
+			}
+			for i, f := range host.FDTOverlays {
+				f.ID = fmt.Sprintf("%s-__fdt_overlay%d__", name, i)
+				f.Host = name
+				c.hostToFiles[name] = append(c.hostToFiles[name], f)
+				ubootHost.FDTOverlays = append(ubootHost.FDTOverlays, f.ID)
+			}
+			for _, mac := range macs {
+				c.ubootHosts[mac] = ubootHost
+			}
+		} else if host.FDT.Path != "" || host.FDT.URL != "" || len(host.FDTOverlays) > 0 {
+			return Config{}, fmt.Errorf("host '%s' has fdt or fdt_overlays which require bootloader '%s'", name, BootloaderUBoot)
+		}
+		if host.Bootloader == BootloaderRaspberryPi {
+			if c.settings.RaspberryPi.FirmwareDir == "" {
+				return Config{}, fmt.Errorf("host '%s' has bootloader '%s' which requires server.raspberry_pi.firmware_dir to be set", name, BootloaderRaspberryPi)
+			}
+			if host.ForcePXELinux || host.HTTPBoot != "" {
+				return Config{}, fmt.Errorf("host '%s' has bootloader '%s' which can't be combined with force_pxe_linux or http_boot", name, BootloaderRaspberryPi)
+			}
+			serial := strings.ToLower(host.Serial)
+			if serial != "" {
+				if err := validateRaspberryPiSerial(serial); err != nil {
+					return Config{}, fmt.Errorf("host '%s' has %s", name, err)
+				}
+				for otherMac, otherSerial := range c.rpiHosts {
+					if otherSerial == serial {
+						return Config{}, fmt.Errorf("hosts '%s' and '%s' both have serial '%s'", c.macToName[otherMac], name, host.Serial)
+					}
+				}
+			}
+			for _, file := range raspberryPiTemplates {
+				c.hostToFiles[name] = append(c.hostToFiles[name], File{
+					ID:       raspberryPiTemplateID(name, file),
+					Host:     name,
+					Path:     filepath.Join(c.settings.RaspberryPi.FirmwareDir, file),
+					Template: true,
+					Vars:     host.Vars,
+				})
+			}
+			for _, mac := range macs {
+				c.rpiHosts[mac] = serial
+			}
+		} else if host.Serial != "" {
+			return Config{}, fmt.Errorf("host '%s' has a serial which requires bootloader '%s'", name, BootloaderRaspberryPi)
+		}
+
+		if len(host.Ipxe) > 0 && host.Bootloader != "" && host.Bootloader != BootloaderIpxe {
+			return Config{}, fmt.Errorf("host '%s' has ipxe which requires bootloader '%s'", name, BootloaderIpxe)
+		}
+		if err := c.addIpxeFirmware(name, host.Ipxe); err != nil {
+			return Config{}, fmt.Errorf("host '%s' has %s", name, err)
+		}
+
+		if !host.SMBIOS.empty() {
+			if c.settings.HTTPAddress == "" {
+				return Config{}, fmt.Errorf("host '%s' has smbios which requires server.http_address to be set", name)
+			}
+			if host.Bootloader != "" && host.Bootloader != BootloaderIpxe {
+				return Config{}, fmt.Errorf("host '%s' has smbios which requires bootloader '%s'", name, BootloaderIpxe)
+			}
+			if err := validateSMBIOS(host.SMBIOS); err != nil {
+				return Config{}, fmt.Errorf("host '%s' has %s", name, err)
+			}
+			host.SMBIOS.UUID = strings.ToLower(host.SMBIOS.UUID)
+			for otherName, other := range c.smbiosHosts {
+				if other.overlaps(host.SMBIOS) {
+					return Config{}, fmt.Errorf("hosts '%s' and '%s' have smbios which could both match the same machine", otherName, name)
+				}
+			}
+			c.smbiosHosts[name] = host.SMBIOS
 		}
 
 		machine.Cmdline = strings.Join(host.BootArgs, " ")
 		machine.ForcePXELinux = host.ForcePXELinux
 
-		c.pixiecoreConfig[MacAddress(host.Mac)] = machine
+		for _, mac := range macs {
+			c.pixiecoreConfig[MacAddress(mac)] = machine
+		}
+	}
+
+	for i, f := range input.TFTP {
+		if err := validateTFTPMatch(f.Match); err != nil {
+			return Config{}, err
+		}
+		if len(f.Vars) > 0 && !f.Template {
+			return Config{}, fmt.Errorf("tftp file '%s' must have 'template: true' if 'vars' are non-empty", f.Match)
+		}
+		if err := mergo.Merge(&f.Vars, input.Vars, mergo.WithOverride); err != nil {
+			return Config{}, err
+		}
+		f.ID = fmt.Sprintf("__tftp%d__", i)
+		f.Host = ""
+		c.hostToFiles[""] = append(c.hostToFiles[""], f.File)
+		c.tftpFiles = append(c.tftpFiles, f)
+	}
+
+	// interfaces may list hosts by name, which are served on all their
+	// MACs
+	for i, iface := range c.settings.Interfaces {
+		macs := []string{}
+		for _, host := range iface.Hosts {
+			if hostMACs, ok := c.nameToMACs[host]; ok {
+				macs = append(macs, hostMACs...)
+			} else if _, ok := c.macToName[host]; ok {
+				macs = append(macs, host)
+			} else {
+				return Config{}, fmt.Errorf("server.interfaces '%s' lists unknown host '%s'", iface.Name, host)
+			}
+		}
+		c.settings.Interfaces[i].Hosts = macs
+	}
+	if c.settings.DHCP.Enabled || len(c.settings.DHCP.Subnets) > 0 {
+		if err := validateDHCPSettings(c.settings.DHCP, c.reservations); err != nil {
+			return Config{}, err
+		}
+	}
+	c.hostToSubnet, err = hostSubnets(c.settings.DHCP.Subnets, subnetNames, c.reservations)
+	if err != nil {
+		return Config{}, err
+	}
+	// templates look the subnet up by the host's name
+	for name, macs := range c.nameToMACs {
+		if subnet, ok := c.hostToSubnet[macs[0]]; ok {
+			c.hostToSubnet[name] = subnet
+		}
+	}
+	if err := c.validateFileIDs(); err != nil {
+		return Config{}, err
 	}
 
 	return c, nil
 }
 
+// validateFileIDs rejects files with the same ID, e.g. host 'web' with file
+// '01-config' and host 'web-01' with file 'config', as one would replace
+// the other.
+func (c *Config) validateFileIDs() error {
+	hosts := make([]string, 0, len(c.hostToFiles))
+	for host := range c.hostToFiles {
+		hosts = append(hosts, host)
+	}
+	sort.Strings(hosts)
+	idToHost := make(map[string]string)
+	for _, host := range hosts {
+		for _, f := range c.hostToFiles[host] {
+			if other, ok := idToHost[f.ID]; ok {
+				return fmt.Errorf("hosts '%s' and '%s' both have a file with ID '%s', rename one of the files", other, host, f.ID)
+			}
+			idToHost[f.ID] = host
+		}
+	}
+	return nil
+}
+
+// validateHostName keeps names usable as file ID prefixes and apart from
+// MACs and secret scope keys.
+func validateHostName(name string) error {
+	if !hostNamePattern.MatchString(name) {
+		return fmt.Errorf("invalid host name '%s': must only contain letters, digits, '.', '_' and '-'", name)
+	}
+	if _, err := net.ParseMAC(name); err == nil {
+		return fmt.Errorf("invalid host name '%s': must not be a MAC address", name)
+	}
+	return nil
+}
+
+// addIpxeFirmware adds the files of server.ipxe, if host is empty, or of the
+// named host's ipxe.
+func (c *Config) addIpxeFirmware(host string, firmware map[string]File) error {
+	for name, f := range firmware {
+		fwtype, err := validateIpxeFirmwareName(name)
+		if err != nil {
+			return err
+		}
+		if f.Path == "" && f.URL == "" {
+			return fmt.Errorf("ipxe firmware '%s' which is missing a 'path' or 'url'", name)
+		}
+		f.ID = ipxeFirmwareID(host, name)
+		f.Host = host
+		c.hostToFiles[host] = append(c.hostToFiles[host], f)
+		if c.ipxeFirmware[host] == nil {
+			c.ipxeFirmware[host] = make(map[pixiecore.Firmware]string)
+		}
+		c.ipxeFirmware[host][fwtype] = f.ID
+	}
+	return nil
+}
+
+func validateSecretDefs(description string, defs []SecretDef) ([]SecretDef, error) {
+	seenIDs := make(map[string]bool)
+	validDefs := make([]SecretDef, 0, len(defs))
+	for _, def := range defs {
+		validDef, err := validateSecretDef(def)
+		if err == nil {
+			err = checkSecretID(def.ID)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("invalid %s with ID '%s': %s", description, def.ID, err)
+		}
+		if seenIDs[def.ID] {
+			return nil, fmt.Errorf("invalid %s with ID '%s': ID is declared more than once", description, def.ID)
+		}
+		seenIDs[def.ID] = true
+		validDefs = append(validDefs, validDef)
+	}
+	return validDefs, nil
+}
+
 func (c *Config) Pixiecore() Pixiecore {
 	return c.pixiecoreConfig
 }
 
+func (c *Config) ServerSettings() ServerSettings {
+	return c.settings
+}
+
+// DHCPReservations maps each host MAC to the static address in its config.
+func (c *Config) DHCPReservations() map[string]DHCPReservation {
+	return c.reservations
+}
+
+// HostSubnets maps each host MAC and name to the subnet it boots from,
+// hosts without a 'subnet' or an 'ip' in a configured subnet are left out.
+func (c *Config) HostSubnets() map[string]DHCPSubnet {
+	return c.hostToSubnet
+}
+
+// GrubHosts are the MACs of hosts with bootloader 'grub'.
+func (c *Config) GrubHosts() []string {
+	return c.grubHosts
+}
+
+// UBootHosts maps the MACs of hosts with bootloader 'uboot' to their device
+// tree file IDs.
+func (c *Config) UBootHosts() map[string]UBootHost {
+	return c.ubootHosts
+}
+
+// RaspberryPiHosts maps the MACs of hosts with bootloader 'raspberrypi' to
+// their serial, which may be empty.
+func (c *Config) RaspberryPiHosts() map[string]string {
+	return c.rpiHosts
+}
+
+// TFTPFiles are the files in the tftp section, in the order they're
+// matched.
+func (c *Config) TFTPFiles() []TFTPFile {
+	return c.tftpFiles
+}
+
+// IpxeFirmware maps host names, or "" for server.ipxe, to the file ID of
+// each firmware type they replace.
+func (c *Config) IpxeFirmware() map[string]map[pixiecore.Firmware]string {
+	return c.ipxeFirmware
+}
+
+// SMBIOSHosts maps the names of hosts with an smbios to it.
+func (c *Config) SMBIOSHosts() map[string]SMBIOS {
+	return c.smbiosHosts
+}
+
+// HostNames are the names of all hosts, in the order of the config. Hosts
+// without a 'name' are named by their MAC.
+func (c *Config) HostNames() []string {
+	return c.hostNames
+}
+
+// HostMACs maps each host name to the MACs it boots from, 'mac' first.
+func (c *Config) HostMACs() map[string][]string {
+	return c.nameToMACs
+}
+
+// HTTPBootModes maps each host MAC to its http_boot, hosts without one are
+// left out.
+func (c *Config) HTTPBootModes() map[string]string {
+	return c.httpBootModes
+}
+
+// BaseURL is the scheme and address clients use to reach pxeserver's own
+// HTTP server.
+func (s ServerSettings) BaseURL() string {
+	return s.baseURLWithHost(s.AdvertiseAddress)
+}
+
+// SubnetBaseURL is BaseURL with the host replaced by the subnet's
+// server_address, if it has one.
+func (s ServerSettings) SubnetBaseURL(subnet DHCPSubnet) string {
+	if subnet.ServerAddress == "" {
+		return s.BaseURL()
+	}
+	return s.baseURLWithHost(subnet.ServerAddress)
+}
+
+// baseURLWithHost swaps the host in HTTPAddress for host, if non-empty.
+func (s ServerSettings) baseURLWithHost(host string) string {
+	address := s.HTTPAddress
+	if host != "" {
+		address = host
+		if _, port, err := net.SplitHostPort(s.HTTPAddress); err == nil {
+			address = net.JoinHostPort(host, port)
+		}
+	}
+	if s.TLS.Enabled {
+		return "https://" + address
+	}
+	return "http://" + address
+}
+
+func (s ServerSettings) validate() error {
+	if s.BindFilesToLease && s.HTTPAddress == "" {
+		return fmt.Errorf("server.bind_files_to_lease requires server.http_address to be set")
+	}
+	if s.BindFilesToLease && !s.DHCP.Enabled && len(s.TrustedDHCPServers) == 0 {
+		return fmt.Errorf("server.bind_files_to_lease requires server.dhcp to be enabled or server.trusted_dhcp_servers to be set")
+	}
+	for _, ip := range s.TrustedDHCPServers {
+		if net.ParseIP(ip) == nil {
+			return fmt.Errorf("invalid server.trusted_dhcp_servers address '%s'", ip)
+		}
+	}
+	for _, ip := range s.TrustedRelays {
+		if net.ParseIP(ip) == nil {
+			return fmt.Errorf("invalid server.trusted_relays address '%s'", ip)
+		}
+	}
+	if s.TLS.Enabled && s.HTTPAddress == "" {
+		return fmt.Errorf("server.tls requires server.http_address to be set")
+	}
+	if s.ImgVerify && s.HTTPAddress == "" {
+		return fmt.Errorf("server.imgverify requires server.http_address to be set")
+	}
+	if (s.TLS.CertFile == "") != (s.TLS.KeyFile == "") {
+		return fmt.Errorf("server.tls.cert_file and server.tls.key_file must be given together")
+	}
+	if s.DHCPMode != "" && s.DHCPMode != "proxy" && s.DHCPMode != "bind" && s.DHCPMode != "none" {
+		return fmt.Errorf("invalid server.dhcp_mode '%s': must be one of proxy, bind, none", s.DHCPMode)
+	}
+	if s.DHCPMode == "none" && s.HTTPAddress == "" {
+		return fmt.Errorf("server.dhcp_mode 'none' requires server.http_address to be set")
+	}
+	if s.DHCPMode == "none" && s.DHCP.Enabled {
+		return fmt.Errorf("server.dhcp can't be enabled with server.dhcp_mode 'none'")
+	}
+	if s.AdvertiseAddress != "" && net.ParseIP(s.AdvertiseAddress) == nil {
+		return fmt.Errorf("invalid server.advertise_address '%s': must be an IP address", s.AdvertiseAddress)
+	}
+	ports := map[string]int{
+		"ports.http":  s.Ports.HTTP,
+		"ports.dhcp":  s.Ports.DHCP,
+		"ports.tftp":  s.Ports.TFTP,
+		"ports.pxe":   s.Ports.PXE,
+		"status_port": s.StatusPort,
+	}
+	for name, port := range ports {
+		if port < 0 || port > 65535 {
+			return fmt.Errorf("invalid server.%s %d", name, port)
+		}
+	}
+	if err := s.validateInterfaces(); err != nil {
+		return err
+	}
+	if s.DHCPv6.Enabled {
+		if s.HTTPAddress == "" {
+			return fmt.Errorf("server.dhcpv6 requires server.http_address to be set")
+		}
+		if err := validateDHCPv6Settings(s.DHCPv6); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
 func (c *Config) Files() []File {
 	allFiles := []File{}
-	for _, filesForHost := range c.macToFiles {
+	for _, filesForHost := range c.hostToFiles {
 		allFiles = append(allFiles, filesForHost...)
 	}
 	return allFiles
 }
 
 func (c *Config) SecretDefs() map[string][]SecretDef {
-	return c.macToSecrets
+	return c.hostToSecrets
+}
+
+// SecretScopes returns the names of the secret scopes each host may read.
+func (c *Config) SecretScopes() map[string][]string {
+	return c.hostToScopes
+}
+
+// SecretScopeKey returns the key under which secrets for the named scope
+// are stored, alongside the per-host secrets keyed by host name.
+func SecretScopeKey(name string) string {
+	return fmt.Sprintf("scope:%s", name)
 }
 
-func (c *Config) VarsForHost(mac string) (map[string]interface{}, error) {
-	vars, ok := c.macToVars[mac]
+func (c *Config) VarsForHost(name string) (map[string]interface{}, error) {
+	vars, ok := c.hostToVars[name]
 	if !ok {
-		return nil, fmt.Errorf("could not find host '%s' in config file", mac)
+		return nil, fmt.Errorf("could not find host '%s' in config file", name)
 	}
 	return vars, nil
 }
@@ -2,6 +2,7 @@ package pxeserver_test
 
 import (
 	"errors"
+	"net"
 	"os"
 	"path"
 	"runtime"
@@ -106,14 +107,61 @@ func TestSecretDefs(t *testing.T) {
 				ID:   "/some_namespace/some_password",
 				Type: "password",
 				Opts: map[string]interface{}{
-					// TODO: YAMLtoJSON step turns ints to floats
-					"length": 123.0,
+					"length": 123,
 				},
 			},
 		},
 	}, actual)
 }
 
+func TestErrorOnMissingRequiredSecretOpt(t *testing.T) {
+	assert := assert.New(t)
+
+	input := strings.NewReader(`
+shared_secrets:
+- id: /some_namespace/registry_token
+  type: env
+`)
+	_, err := pxeserver.LoadConfig(input)
+	assert.NotNil(err)
+	assert.Contains(err.Error(), "/some_namespace/registry_token")
+	assert.Contains(err.Error(), "name")
+}
+
+func TestSecretScopes(t *testing.T) {
+	assert := assert.New(t)
+
+	inputFile, err := os.Open(path.Join(fixturesDir(), "config", "secret-scopes.yaml"))
+	assert.NoError(err)
+	defer inputFile.Close()
+
+	cfg, err := pxeserver.LoadConfig(inputFile)
+	assert.NoError(err)
+
+	assert.Equal(map[string][]string{
+		"52:54:00:12:34:56": {"cluster-a"},
+	}, cfg.SecretScopes())
+	assert.Equal([]pxeserver.SecretDef{
+		{
+			ID:   "join_token",
+			Type: "bootstrap_token",
+		},
+	}, cfg.SecretDefs()[pxeserver.SecretScopeKey("cluster-a")])
+}
+
+func TestErrorOnUnknownSecretScope(t *testing.T) {
+	assert := assert.New(t)
+
+	inputFile, err := os.Open(path.Join(fixturesDir(), "config", "bad-secret-scope.yaml"))
+	assert.NoError(err)
+	defer inputFile.Close()
+
+	_, err = pxeserver.LoadConfig(inputFile)
+	assert.NotNil(err)
+	assert.Contains(err.Error(), "52:54:00:12:34:56")
+	assert.Contains(err.Error(), "some-missing-scope")
+}
+
 func TestErrorOnBadReader(t *testing.T) {
 	assert := assert.New(t)
 
@@ -143,6 +191,283 @@ func TestErrorIfVarsAreGivenButNotTemplate(t *testing.T) {
 	assert.Contains(err.Error(), "template: true")
 }
 
+func TestErrorOnUnknownSecretType(t *testing.T) {
+	assert := assert.New(t)
+
+	inputFile, err := os.Open(path.Join(fixturesDir(), "config", "bad-secret-type.yaml"))
+	assert.NoError(err)
+	defer inputFile.Close()
+
+	_, err = pxeserver.LoadConfig(inputFile)
+	assert.NotNil(err)
+	assert.Contains(err.Error(), "52:54:00:12:34:56")
+	assert.Contains(err.Error(), "/some_namespace/some_password")
+	assert.Contains(err.Error(), "some-unknown-type")
+}
+
+func TestErrorOnInvalidSecretOpts(t *testing.T) {
+	assert := assert.New(t)
+
+	inputFile, err := os.Open(path.Join(fixturesDir(), "config", "bad-secret-opts.yaml"))
+	assert.NoError(err)
+	defer inputFile.Close()
+
+	_, err = pxeserver.LoadConfig(inputFile)
+	assert.NotNil(err)
+	assert.Contains(err.Error(), "52:54:00:12:34:56")
+	assert.Contains(err.Error(), "/some_namespace/some_password")
+	assert.Contains(err.Error(), "length")
+}
+
+func TestErrorOnUnknownSecretOpt(t *testing.T) {
+	assert := assert.New(t)
+
+	input := strings.NewReader(`
+shared_secrets:
+- id: /some_namespace/some_password
+  type: password
+  opts:
+    some_unknown_opt: true
+`)
+	_, err := pxeserver.LoadConfig(input)
+	assert.NotNil(err)
+	assert.Contains(err.Error(), "shared secret")
+	assert.Contains(err.Error(), "some_unknown_opt")
+}
+
+func TestErrorOnSecretLengthTooLarge(t *testing.T) {
+	assert := assert.New(t)
+
+	input := strings.NewReader(`
+shared_secrets:
+- id: /some_namespace/some_password
+  type: password
+  opts:
+    length: 1e12
+`)
+	_, err := pxeserver.LoadConfig(input)
+	assert.NotNil(err)
+	assert.Contains(err.Error(), "length")
+	assert.Contains(err.Error(), "at most 4096")
+}
+
+func TestErrorOnCharsWithCharset(t *testing.T) {
+	assert := assert.New(t)
+
+	input := strings.NewReader(`
+shared_secrets:
+- id: /some_namespace/some_password
+  type: password
+  opts:
+    charset: no_symbols
+    chars: ab
+`)
+	_, err := pxeserver.LoadConfig(input)
+	assert.NotNil(err)
+	assert.Contains(err.Error(), "'chars' and 'charset'")
+}
+
+func TestErrorOnDuplicateFileID(t *testing.T) {
+	assert := assert.New(t)
+
+	input := strings.NewReader(`
+hosts:
+- name: web
+  mac: "52:54:00:12:34:56"
+  kernel:
+    path: fixtures/x86_64/bzImage
+  files:
+  - id: 01-config
+    path: fixtures/simple-preseed.cfg
+- name: web-01
+  mac: "52:54:00:12:34:57"
+  kernel:
+    path: fixtures/x86_64/bzImage
+  files:
+  - id: config
+    path: fixtures/simple-preseed.cfg
+`)
+	_, err := pxeserver.LoadConfig(input)
+	assert.NotNil(err)
+	assert.Contains(err.Error(), "'web-01-config'")
+}
+
+func TestErrorOnReservedSecretID(t *testing.T) {
+	assert := assert.New(t)
+
+	input := strings.NewReader(`
+shared_secrets:
+- id: /pxeserver/tls_key
+  type: password
+`)
+	_, err := pxeserver.LoadConfig(input)
+	assert.NotNil(err)
+	assert.Contains(err.Error(), "/pxeserver/tls_key")
+	assert.Contains(err.Error(), "reserved")
+}
+
+func TestErrorOnBindFilesWithoutHTTPAddress(t *testing.T) {
+	assert := assert.New(t)
+
+	input := strings.NewReader(`
+server:
+  bind_files_to_lease: true
+`)
+	_, err := pxeserver.LoadConfig(input)
+	assert.NotNil(err)
+	assert.Contains(err.Error(), "http_address")
+}
+
+func TestErrorOnBindFilesWithoutTrustedDHCPServers(t *testing.T) {
+	assert := assert.New(t)
+
+	input := strings.NewReader(`
+server:
+  http_address: 10.0.0.1:8080
+  bind_files_to_lease: true
+`)
+	_, err := pxeserver.LoadConfig(input)
+	assert.NotNil(err)
+	assert.Contains(err.Error(), "trusted_dhcp_servers")
+
+	input = strings.NewReader(`
+server:
+  http_address: 10.0.0.1:8080
+  bind_files_to_lease: true
+  trusted_dhcp_servers: [10.0.0.1]
+  trusted_relays: [not-an-ip]
+`)
+	_, err = pxeserver.LoadConfig(input)
+	assert.NotNil(err)
+	assert.Contains(err.Error(), "not-an-ip")
+}
+
+func TestErrorOnTLSWithoutHTTPAddress(t *testing.T) {
+	assert := assert.New(t)
+
+	input := strings.NewReader(`
+server:
+  tls:
+    enabled: true
+`)
+	_, err := pxeserver.LoadConfig(input)
+	assert.NotNil(err)
+	assert.Contains(err.Error(), "http_address")
+}
+
+func TestErrorOnTLSCertWithoutKey(t *testing.T) {
+	assert := assert.New(t)
+
+	input := strings.NewReader(`
+server:
+  http_address: 10.0.0.1:8443
+  tls:
+    enabled: true
+    cert_file: /some/cert.pem
+`)
+	_, err := pxeserver.LoadConfig(input)
+	assert.NotNil(err)
+	assert.Contains(err.Error(), "key_file")
+}
+
+func TestErrorOnImgverifyWithoutHTTPAddress(t *testing.T) {
+	assert := assert.New(t)
+
+	input := strings.NewReader(`
+server:
+  imgverify: true
+`)
+	_, err := pxeserver.LoadConfig(input)
+	assert.NotNil(err)
+	assert.Contains(err.Error(), "http_address")
+}
+
+func TestDHCPReservations(t *testing.T) {
+	assert := assert.New(t)
+
+	inputFile, err := os.Open(path.Join(fixturesDir(), "config", "dhcp.yaml"))
+	assert.NoError(err)
+	defer inputFile.Close()
+
+	cfg, err := pxeserver.LoadConfig(inputFile)
+	assert.NoError(err)
+
+	assert.True(cfg.ServerSettings().DHCP.Enabled)
+	assert.Equal(map[string]pxeserver.DHCPReservation{
+		"52:54:00:12:34:56": {
+			IP:       net.ParseIP("10.0.0.10").To4(),
+			Hostname: "node-1",
+		},
+	}, cfg.DHCPReservations())
+}
+
+func TestErrorOnDHCPReservationOutsideSubnets(t *testing.T) {
+	assert := assert.New(t)
+
+	input := strings.NewReader(`
+server:
+  dhcp:
+    enabled: true
+    subnets:
+    - cidr: 10.0.0.0/24
+      range_start: 10.0.0.100
+      range_end: 10.0.0.200
+hosts:
+- mac: "52:54:00:12:34:56"
+  ip: 192.168.1.10
+`)
+	_, err := pxeserver.LoadConfig(input)
+	assert.NotNil(err)
+	assert.Contains(err.Error(), "192.168.1.10")
+}
+
+func TestErrorOnDuplicateHostIP(t *testing.T) {
+	assert := assert.New(t)
+
+	input := strings.NewReader(`
+hosts:
+- mac: "52:54:00:12:34:56"
+  ip: 10.0.0.10
+- mac: "52:54:00:65:43:21"
+  ip: 10.0.0.10
+`)
+	_, err := pxeserver.LoadConfig(input)
+	assert.NotNil(err)
+	assert.Contains(err.Error(), "10.0.0.10")
+}
+
+func TestErrorOnInvalidDHCPRange(t *testing.T) {
+	assert := assert.New(t)
+
+	input := strings.NewReader(`
+server:
+  dhcp:
+    enabled: true
+    subnets:
+    - cidr: 10.0.0.0/24
+      range_start: 10.0.1.100
+      range_end: 10.0.1.200
+`)
+	_, err := pxeserver.LoadConfig(input)
+	assert.NotNil(err)
+	assert.Contains(err.Error(), "range_start")
+}
+
+func TestServerSettingsBaseURL(t *testing.T) {
+	assert := assert.New(t)
+
+	input := strings.NewReader(`
+server:
+  http_address: 10.0.0.1:8443
+  tls:
+    enabled: true
+`)
+	cfg, err := pxeserver.LoadConfig(input)
+	assert.NoError(err)
+	assert.Equal("https://10.0.0.1:8443", cfg.ServerSettings().BaseURL())
+	assert.Equal("http://10.0.0.1:8443", pxeserver.ServerSettings{HTTPAddress: "10.0.0.1:8443"}.BaseURL())
+}
+
 func TestErrorOnMissingHost(t *testing.T) {
 	assert := assert.New(t)
 
@@ -168,3 +493,237 @@ func fixturesDir() string {
 	_, filename, _, _ := runtime.Caller(0)
 	return path.Join(path.Dir(filename), "fixtures")
 }
+
+func TestDHCPv6Settings(t *testing.T) {
+	assert := assert.New(t)
+
+	input := strings.NewReader(`
+server:
+  http_address: "[2001:db8::1]:8080"
+  dhcpv6:
+    enabled: true
+    address: 2001:db8::1
+    range_start: 2001:db8::100
+    range_end: 2001:db8::1ff
+    dns:
+    - 2001:db8::53
+`)
+	cfg, err := pxeserver.LoadConfig(input)
+	assert.NoError(err)
+	assert.Equal(pxeserver.DHCPv6Settings{
+		Enabled:    true,
+		Address:    "2001:db8::1",
+		RangeStart: "2001:db8::100",
+		RangeEnd:   "2001:db8::1ff",
+		DNS:        []string{"2001:db8::53"},
+	}, cfg.ServerSettings().DHCPv6)
+	assert.Equal("http://[2001:db8::1]:8080", cfg.ServerSettings().BaseURL())
+}
+
+func TestErrorOnDHCPv6WithoutHTTPAddress(t *testing.T) {
+	assert := assert.New(t)
+
+	input := strings.NewReader(`
+server:
+  dhcpv6:
+    enabled: true
+    range_start: 2001:db8::100
+    range_end: 2001:db8::1ff
+`)
+	_, err := pxeserver.LoadConfig(input)
+	assert.NotNil(err)
+	assert.Contains(err.Error(), "http_address")
+}
+
+func TestErrorOnInvalidDHCPv6Settings(t *testing.T) {
+	assert := assert.New(t)
+
+	input := strings.NewReader(`
+server:
+  http_address: "[2001:db8::1]:8080"
+  dhcpv6:
+    enabled: true
+    address: 10.0.0.1
+    range_start: 2001:db8::100
+    range_end: 2001:db8::1ff
+`)
+	_, err := pxeserver.LoadConfig(input)
+	assert.NotNil(err)
+	assert.Contains(err.Error(), "server.dhcpv6.address")
+}
+
+func TestHostSubnets(t *testing.T) {
+	assert := assert.New(t)
+
+	input := strings.NewReader(`
+server:
+  http_address: 10.0.0.1:8080
+  dhcp:
+    subnets:
+    - cidr: 10.0.0.0/24
+    - name: rack-2
+      cidr: 10.0.1.0/24
+      server_address: 192.168.0.10
+hosts:
+- mac: "52:54:00:00:00:01"
+  ip: 10.0.0.10
+- mac: "52:54:00:00:00:02"
+  subnet: rack-2
+- mac: "52:54:00:00:00:03"
+`)
+	cfg, err := pxeserver.LoadConfig(input)
+	assert.NoError(err)
+
+	subnets := cfg.HostSubnets()
+	assert.Len(subnets, 2)
+	assert.Equal("10.0.0.0/24", subnets["52:54:00:00:00:01"].CIDR)
+	assert.Equal("192.168.0.10", subnets["52:54:00:00:00:02"].ServerAddress)
+}
+
+func TestErrorOnUnknownHostSubnet(t *testing.T) {
+	assert := assert.New(t)
+
+	input := strings.NewReader(`
+server:
+  dhcp:
+    subnets:
+    - name: rack-1
+      cidr: 10.0.0.0/24
+hosts:
+- mac: "52:54:00:00:00:01"
+  subnet: rack-2
+`)
+	_, err := pxeserver.LoadConfig(input)
+	assert.NotNil(err)
+	assert.Contains(err.Error(), "rack-2")
+}
+
+func TestErrorOnInvalidSubnetServerAddress(t *testing.T) {
+	assert := assert.New(t)
+
+	input := strings.NewReader(`
+server:
+  dhcp:
+    subnets:
+    - cidr: 10.0.0.0/24
+      server_address: not-an-ip
+`)
+	_, err := pxeserver.LoadConfig(input)
+	assert.NotNil(err)
+	assert.Contains(err.Error(), "server_address")
+}
+
+func TestServerListenSettings(t *testing.T) {
+	assert := assert.New(t)
+
+	input := strings.NewReader(`
+server:
+  http_address: 10.0.0.1:8080
+  advertise_address: 192.168.0.10
+  dhcp_mode: bind
+  debug: true
+  status_port: 9090
+  ports:
+    http: 8080
+    tftp: 6969
+`)
+	cfg, err := pxeserver.LoadConfig(input)
+	assert.NoError(err)
+
+	settings := cfg.ServerSettings()
+	assert.Equal("bind", settings.DHCPMode)
+	assert.True(settings.Debug)
+	assert.Equal(9090, settings.StatusPort)
+	assert.Equal(6969, settings.Ports.TFTP)
+	assert.Equal("http://192.168.0.10:8080", settings.BaseURL())
+}
+
+func TestErrorOnInvalidServerListenSettings(t *testing.T) {
+	assert := assert.New(t)
+
+	input := strings.NewReader(`
+server:
+  dhcp_mode: relay
+`)
+	_, err := pxeserver.LoadConfig(input)
+	assert.NotNil(err)
+	assert.Contains(err.Error(), "dhcp_mode")
+
+	for _, server := range []string{
+		"dhcp_mode: none",
+		"dhcp_mode: none\n  http_address: 10.0.0.1:8080\n  dhcp:\n    enabled: true",
+	} {
+		_, err = pxeserver.LoadConfig(strings.NewReader("server:\n  " + server + "\n"))
+		assert.NotNil(err, server)
+		assert.Contains(err.Error(), "dhcp_mode", server)
+	}
+
+	input = strings.NewReader(`
+server:
+  ports:
+    http: 70000
+`)
+	_, err = pxeserver.LoadConfig(input)
+	assert.NotNil(err)
+	assert.Contains(err.Error(), "ports")
+}
+
+func TestNamedHostWithMultipleMACs(t *testing.T) {
+	assert := assert.New(t)
+
+	cfg, err := pxeserver.LoadConfig(strings.NewReader(`
+server:
+  interfaces:
+  - name: eth1
+    hosts: [web-1]
+hosts:
+- name: web-1
+  mac: "52:54:00:12:34:56"
+  macs: ["52:54:00:12:34:57"]
+  ip: 10.0.0.20
+  kernel:
+    path: /srv/vmlinuz
+  vars:
+    role: web
+  secrets:
+  - id: /web/password
+    type: password
+- mac: "52:54:00:65:43:21"
+`))
+	assert.NoError(err)
+
+	assert.Equal([]string{"web-1", "52:54:00:65:43:21"}, cfg.HostNames())
+	assert.Equal(map[string][]string{
+		"web-1":             {"52:54:00:12:34:56", "52:54:00:12:34:57"},
+		"52:54:00:65:43:21": {"52:54:00:65:43:21"},
+	}, cfg.HostMACs())
+	for _, mac := range []string{"52:54:00:12:34:56", "52:54:00:12:34:57"} {
+		assert.Equal("web-1-__kernel__", cfg.Pixiecore()[pxeserver.MacAddress(mac)].Kernel, mac)
+		assert.Equal(net.ParseIP("10.0.0.20").To4(), cfg.DHCPReservations()[mac].IP, mac)
+	}
+	assert.Equal("52:54:00:65:43:21-__kernel__", cfg.Pixiecore()["52:54:00:65:43:21"].Kernel)
+	assert.Equal([]string{"52:54:00:12:34:56", "52:54:00:12:34:57"}, cfg.ServerSettings().Interfaces[0].Hosts)
+
+	vars, err := cfg.VarsForHost("web-1")
+	assert.NoError(err)
+	assert.Equal("web", vars["role"])
+	assert.Len(cfg.SecretDefs()["web-1"], 1)
+	_, ok := cfg.SecretDefs()["52:54:00:12:34:56"]
+	assert.False(ok)
+}
+
+func TestErrorOnInvalidHostNames(t *testing.T) {
+	assert := assert.New(t)
+
+	for _, cfg := range []string{
+		"hosts:\n- name: web-1\n",
+		"hosts:\n- name: web 1\n  mac: \"52:54:00:12:34:56\"\n",
+		"hosts:\n- name: \"52:54:00:12:34:57\"\n  mac: \"52:54:00:12:34:56\"\n",
+		"hosts:\n- name: web-1\n  mac: \"52:54:00:12:34:56\"\n- name: web-1\n  mac: \"52:54:00:12:34:57\"\n",
+		"hosts:\n- name: web-1\n  mac: \"52:54:00:12:34:56\"\n- mac: \"52:54:00:65:43:21\"\n  macs: [\"52:54:00:12:34:56\"]\n",
+		"hosts:\n- name: web-1\n  mac: \"52:54:00:12:34:56\"\n  ip: 10.0.0.20\n- mac: \"52:54:00:65:43:21\"\n  ip: 10.0.0.20\n",
+	} {
+		_, err := pxeserver.LoadConfig(strings.NewReader(cfg))
+		assert.NotNil(err, cfg)
+	}
+}
@@ -0,0 +1,703 @@
+package pxeserver
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"go.universe.tf/netboot/dhcp4"
+)
+
+const (
+	defaultDHCPLeaseTime = 12 * time.Hour
+	// offered addresses are held for a client until it sends a REQUEST
+	dhcpOfferTimeout = time.Minute
+	// optRelayAgentInfo is added by relays and echoed back, see RFC 3046
+	optRelayAgentInfo dhcp4.Option = 82
+	// subOptLinkSelection names the client's subnet when it differs from
+	// giaddr, see RFC 3527
+	subOptLinkSelection = 5
+)
+
+type DHCPSettings struct {
+	Enabled bool `json:"enabled"`
+	// LeaseFile persists leases across restarts, leases are only kept in
+	// memory if empty
+	LeaseFile string `json:"lease_file"`
+	// LeaseTime is a Go duration, e.g. 12h
+	LeaseTime string       `json:"lease_time"`
+	Subnets   []DHCPSubnet `json:"subnets"`
+}
+type DHCPSubnet struct {
+	// Name lets hosts outside the DHCP pools refer to the subnet they boot
+	// from with 'subnet'
+	Name string `json:"name"`
+	CIDR string `json:"cidr"`
+	// ServerAddress is the address clients in this subnet reach pxeserver
+	// on, e.g. when their requests are forwarded by a relay. It replaces
+	// the host in server.http_address and is the DHCP server identifier.
+	ServerAddress string `json:"server_address"`
+	// RangeStart and RangeEnd bound the pool of dynamically assigned
+	// addresses, hosts with an 'ip' may be outside the pool. Only required
+	// if DHCP is enabled.
+	RangeStart string   `json:"range_start"`
+	RangeEnd   string   `json:"range_end"`
+	Gateway    string   `json:"gateway"`
+	DNS        []string `json:"dns"`
+	Domain     string   `json:"domain"`
+}
+
+// DHCPReservation is the static address declared on a Host.
+type DHCPReservation struct {
+	IP       net.IP
+	Hostname string
+}
+
+type dhcpSubnet struct {
+	network       *net.IPNet
+	serverAddress net.IP
+	rangeStart    uint32
+	rangeEnd      uint32
+	gateway       net.IP
+	dns           []net.IP
+	domain        string
+}
+
+type dhcpLease struct {
+	IP      net.IP    `json:"ip"`
+	Expires time.Time `json:"expires"`
+}
+
+// DHCPServer hands out addresses from each subnet's pool, or the address
+// reserved for a host, while Pixiecore continues to answer PXE requests as
+// ProxyDHCP.
+type DHCPServer struct {
+	subnets      []dhcpSubnet
+	leaseTime    time.Duration
+	reservations map[string]DHCPReservation
+	reservedIPs  map[string]string
+	leaseFile    string
+	leases       map[string]dhcpLease
+	// leasedIPs maps each leased address to its host's MAC, so checking an
+	// address is free doesn't scan every lease
+	leasedIPs map[string]string
+	// declined holds addresses clients found already in use until the
+	// time they are offered again
+	declined map[string]time.Time
+	now      func() time.Time
+	mu       sync.Mutex
+
+	// OnAck is called with each address acknowledged to a client, if non-nil
+	OnAck func(mac string, ip net.IP)
+	// HTTPBoot sends UEFI HTTP Boot clients their boot URL, if non-nil
+	HTTPBoot *HTTPBootConfiguration
+	// UBoot points hosts booting with U-Boot at this server's TFTP, if
+	// non-nil
+	UBoot *UBoot
+	// RaspberryPi sends Pi bootloaders the options they expect, if non-nil
+	RaspberryPi *RaspberryPi
+	// Identities learns the hosts clients are from their option 97 UUID,
+	// if non-nil
+	Identities *Identities
+	LogFunc    func(subsys, msg string)
+}
+
+func NewDHCPServer(settings DHCPSettings, reservations map[string]DHCPReservation) (*DHCPServer, error) {
+	subnets, leaseTime, err := parseDHCPSettings(settings)
+	if err != nil {
+		return nil, err
+	}
+	s := &DHCPServer{
+		subnets:      subnets,
+		leaseTime:    leaseTime,
+		reservations: reservations,
+		reservedIPs:  make(map[string]string, len(reservations)),
+		leaseFile:    settings.LeaseFile,
+		leases:       make(map[string]dhcpLease),
+		leasedIPs:    make(map[string]string),
+		declined:     make(map[string]time.Time),
+		now:          time.Now,
+	}
+	for mac, reservation := range reservations {
+		s.reservedIPs[reservation.IP.String()] = mac
+	}
+	if err := s.loadLeases(); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+func validateDHCPSettings(settings DHCPSettings, reservations map[string]DHCPReservation) error {
+	subnets, _, err := parseDHCPSettings(settings)
+	if err != nil {
+		return err
+	}
+	if !settings.Enabled {
+		return nil
+	}
+	for mac, reservation := range reservations {
+		if subnetFor(subnets, reservation.IP) == nil {
+			return fmt.Errorf("host '%s' has IP '%s' which is not in any server.dhcp.subnets", mac, reservation.IP)
+		}
+	}
+	return nil
+}
+
+// hostSubnets maps each host to the subnet named by its 'subnet', or else
+// the subnet containing its 'ip'.
+func hostSubnets(subnets []DHCPSubnet, names map[string]string, reservations map[string]DHCPReservation) (map[string]DHCPSubnet, error) {
+	hostToSubnet := make(map[string]DHCPSubnet)
+	for mac, name := range names {
+		found := false
+		for _, subnet := range subnets {
+			if subnet.Name == name {
+				hostToSubnet[mac] = subnet
+				found = true
+				break
+			}
+		}
+		if !found {
+			return nil, fmt.Errorf("host '%s' references unknown subnet '%s'", mac, name)
+		}
+	}
+	for mac, reservation := range reservations {
+		if _, ok := hostToSubnet[mac]; ok {
+			continue
+		}
+		for _, subnet := range subnets {
+			if _, network, err := net.ParseCIDR(subnet.CIDR); err == nil && network.Contains(reservation.IP) {
+				hostToSubnet[mac] = subnet
+				break
+			}
+		}
+	}
+	return hostToSubnet, nil
+}
+
+func parseDHCPSettings(settings DHCPSettings) ([]dhcpSubnet, time.Duration, error) {
+	leaseTime := defaultDHCPLeaseTime
+	if settings.LeaseTime != "" {
+		var err error
+		leaseTime, err = time.ParseDuration(settings.LeaseTime)
+		if err != nil {
+			return nil, 0, fmt.Errorf("invalid server.dhcp.lease_time: %s", err)
+		}
+	}
+	if settings.Enabled && len(settings.Subnets) == 0 {
+		return nil, 0, fmt.Errorf("server.dhcp requires at least one subnet")
+	}
+
+	subnets := make([]dhcpSubnet, 0, len(settings.Subnets))
+	names := make(map[string]bool)
+	for _, subnet := range settings.Subnets {
+		_, network, err := net.ParseCIDR(subnet.CIDR)
+		if err != nil || network.IP.To4() == nil {
+			return nil, 0, fmt.Errorf("invalid DHCP subnet '%s': cidr must be an IPv4 network", subnet.CIDR)
+		}
+		if subnet.Name != "" {
+			if names[subnet.Name] {
+				return nil, 0, fmt.Errorf("DHCP subnet name '%s' is used more than once", subnet.Name)
+			}
+			names[subnet.Name] = true
+		}
+		parsed := dhcpSubnet{
+			network: network,
+			domain:  subnet.Domain,
+		}
+
+		if subnet.ServerAddress != "" {
+			parsed.serverAddress = net.ParseIP(subnet.ServerAddress).To4()
+			if parsed.serverAddress == nil {
+				return nil, 0, fmt.Errorf("invalid DHCP subnet '%s': invalid server_address '%s'", subnet.CIDR, subnet.ServerAddress)
+			}
+		}
+
+		if settings.Enabled || subnet.RangeStart != "" || subnet.RangeEnd != "" {
+			rangeStart := net.ParseIP(subnet.RangeStart).To4()
+			rangeEnd := net.ParseIP(subnet.RangeEnd).To4()
+			if rangeStart == nil || rangeEnd == nil {
+				return nil, 0, fmt.Errorf("invalid DHCP subnet '%s': range_start and range_end must be IPv4 addresses", subnet.CIDR)
+			}
+			if !network.Contains(rangeStart) || !network.Contains(rangeEnd) {
+				return nil, 0, fmt.Errorf("invalid DHCP subnet '%s': range_start and range_end must be inside the subnet", subnet.CIDR)
+			}
+			parsed.rangeStart = ipToUint32(rangeStart)
+			parsed.rangeEnd = ipToUint32(rangeEnd)
+			if parsed.rangeStart > parsed.rangeEnd {
+				return nil, 0, fmt.Errorf("invalid DHCP subnet '%s': range_start is after range_end", subnet.CIDR)
+			}
+		}
+
+		if subnet.Gateway != "" {
+			parsed.gateway = net.ParseIP(subnet.Gateway).To4()
+			if parsed.gateway == nil {
+				return nil, 0, fmt.Errorf("invalid DHCP subnet '%s': invalid gateway '%s'", subnet.CIDR, subnet.Gateway)
+			}
+		}
+		for _, dns := range subnet.DNS {
+			dnsIP := net.ParseIP(dns).To4()
+			if dnsIP == nil {
+				return nil, 0, fmt.Errorf("invalid DHCP subnet '%s': invalid dns '%s'", subnet.CIDR, dns)
+			}
+			parsed.dns = append(parsed.dns, dnsIP)
+		}
+		subnets = append(subnets, parsed)
+	}
+	return subnets, leaseTime, nil
+}
+
+// Serve answers DHCP requests on port 67 of the interfaces with the given
+// addresses, or of every interface if any address is empty or unspecified.
+// Port 67 can only be bound once, so a single socket serves all of them and
+// Pixiecore must run with DHCPNoBind.
+func (s *DHCPServer) Serve(addresses []string) error {
+	ifIndexes, err := interfaceIndexes(addresses)
+	if err != nil {
+		return err
+	}
+	conn, err := dhcp4.NewConn("0.0.0.0:67")
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	for {
+		pkt, intf, err := conn.RecvDHCP()
+		if err != nil {
+			return fmt.Errorf("Receiving DHCP packet: %s", err)
+		}
+		if ifIndexes != nil && !ifIndexes[intf.Index] {
+			continue
+		}
+		localIP, err := s.interfaceIP(intf)
+		if err != nil {
+			s.log("DHCP", "Ignoring packet from %s on %s: %s", pkt.HardwareAddr, intf.Name, err)
+			continue
+		}
+		resp, err := s.Respond(pkt, localIP)
+		if err != nil {
+			s.log("DHCP", "Failed to handle %s from %s: %s", pkt.Type, pkt.HardwareAddr, err)
+			continue
+		}
+		if resp == nil {
+			continue
+		}
+		if err := conn.SendDHCP(resp, intf); err != nil {
+			s.log("DHCP", "Failed to send %s to %s: %s", resp.Type, pkt.HardwareAddr, err)
+			continue
+		}
+		s.log("DHCP", "Sent %s for %s to %s", resp.Type, resp.YourAddr, pkt.HardwareAddr)
+	}
+}
+
+// Respond builds the reply to pkt, received on the interface with address
+// localIP, or returns nil if pkt should be ignored. Relayed packets are
+// answered from the subnet named by the relay rather than localIP's.
+func (s *DHCPServer) Respond(pkt *dhcp4.Packet, localIP net.IP) (*dhcp4.Packet, error) {
+	subnet := subnetFor(s.subnets, clientLink(pkt, localIP))
+	if subnet == nil {
+		return nil, nil
+	}
+	if subnet.serverAddress != nil {
+		localIP = subnet.serverAddress
+	}
+	mac := pkt.HardwareAddr.String()
+	if s.Identities != nil {
+		s.Identities.ObserveDHCP(pkt)
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.expireLeases()
+
+	switch pkt.Type {
+	case dhcp4.MsgDiscover:
+		requestedIP, _ := pkt.Options.IP(dhcp4.OptRequestedIP)
+		ip := s.allocate(mac, subnet, requestedIP)
+		if ip == nil {
+			s.log("DHCP", "No free address in %s for %s", subnet.network, mac)
+			return nil, nil
+		}
+		// hold the offer without cutting short an existing lease
+		offerExpires := s.now().Add(dhcpOfferTimeout)
+		if lease, ok := s.leases[mac]; !ok || !lease.IP.Equal(ip) || lease.Expires.Before(offerExpires) {
+			s.setLease(mac, dhcpLease{IP: ip, Expires: offerExpires})
+			if err := s.saveLeases(); err != nil {
+				return nil, err
+			}
+		}
+		return s.reply(pkt, dhcp4.MsgOffer, ip, subnet, localIP), nil
+
+	case dhcp4.MsgRequest:
+		if serverID, err := pkt.Options.IP(dhcp4.OptServerIdentifier); err == nil && !serverID.Equal(localIP) {
+			// the client accepted another server's offer
+			return nil, nil
+		}
+		ip, err := pkt.Options.IP(dhcp4.OptRequestedIP)
+		if err != nil {
+			ip = pkt.ClientAddr
+		}
+		if ip == nil || ip.IsUnspecified() {
+			return nil, nil
+		}
+		if !s.canLease(mac, subnet, ip) {
+			return s.nak(pkt, localIP), nil
+		}
+		s.setLease(mac, dhcpLease{IP: ip.To4(), Expires: s.now().Add(s.leaseTime)})
+		if err := s.saveLeases(); err != nil {
+			return nil, err
+		}
+		if s.OnAck != nil {
+			s.OnAck(mac, ip)
+		}
+		return s.reply(pkt, dhcp4.MsgAck, ip.To4(), subnet, localIP), nil
+
+	case dhcp4.MsgRelease:
+		if lease, ok := s.leases[mac]; ok && lease.IP.Equal(pkt.ClientAddr) {
+			s.deleteLease(mac)
+			return nil, s.saveLeases()
+		}
+
+	case dhcp4.MsgDecline:
+		// the client found its address already in use, so it is held back
+		// from the pool for a lease time, see RFC 2131 section 4.3.3
+		if serverID, err := pkt.Options.IP(dhcp4.OptServerIdentifier); err == nil && !serverID.Equal(localIP) {
+			return nil, nil
+		}
+		ip, err := pkt.Options.IP(dhcp4.OptRequestedIP)
+		if err != nil {
+			return nil, nil
+		}
+		lease, ok := s.leases[mac]
+		if !ok || !lease.IP.Equal(ip) {
+			return nil, nil
+		}
+		s.log("DHCP", "%s declined %s as it is already in use", mac, ip)
+		s.declined[ip.String()] = s.now().Add(s.leaseTime)
+		s.deleteLease(mac)
+		return nil, s.saveLeases()
+	}
+	return nil, nil
+}
+
+func (s *DHCPServer) setLease(mac string, lease dhcpLease) {
+	s.deleteLease(mac)
+	s.leases[mac] = lease
+	s.leasedIPs[lease.IP.String()] = mac
+}
+
+func (s *DHCPServer) deleteLease(mac string) {
+	lease, ok := s.leases[mac]
+	if !ok {
+		return
+	}
+	delete(s.leases, mac)
+	if s.leasedIPs[lease.IP.String()] == mac {
+		delete(s.leasedIPs, lease.IP.String())
+	}
+}
+
+// expireLeases returns expired leases and declined addresses to the pool.
+// Expired leases are removed from the lease file the next time it's saved.
+func (s *DHCPServer) expireLeases() {
+	now := s.now()
+	for mac, lease := range s.leases {
+		if !lease.Expires.After(now) {
+			s.deleteLease(mac)
+		}
+	}
+	for ip, expires := range s.declined {
+		if !expires.After(now) {
+			delete(s.declined, ip)
+		}
+	}
+}
+
+// allocate picks the host's reserved address, its previous address or the
+// requested address if still free, or else the first free address in the
+// pool.
+func (s *DHCPServer) allocate(mac string, subnet *dhcpSubnet, requestedIP net.IP) net.IP {
+	if reservation, ok := s.reservations[mac]; ok {
+		if subnet.network.Contains(reservation.IP) {
+			return reservation.IP.To4()
+		}
+		return nil
+	}
+	if lease, ok := s.leases[mac]; ok && s.canLease(mac, subnet, lease.IP) {
+		return lease.IP
+	}
+	if requestedIP != nil && s.canLease(mac, subnet, requestedIP) {
+		return requestedIP.To4()
+	}
+	for i := uint64(subnet.rangeStart); i <= uint64(subnet.rangeEnd); i++ {
+		ip := uint32ToIP(uint32(i))
+		if s.canLease(mac, subnet, ip) {
+			return ip
+		}
+	}
+	return nil
+}
+
+// canLease checks ip is the host's reservation, or a pool address not
+// reserved or leased by any other host.
+func (s *DHCPServer) canLease(mac string, subnet *dhcpSubnet, ip net.IP) bool {
+	if reservation, ok := s.reservations[mac]; ok {
+		return reservation.IP.Equal(ip)
+	}
+	ip = ip.To4()
+	if ip == nil || !subnet.network.Contains(ip) {
+		return false
+	}
+	if n := ipToUint32(ip); n < subnet.rangeStart || n > subnet.rangeEnd {
+		return false
+	}
+	if ip.Equal(subnet.gateway) {
+		return false
+	}
+	if otherMac, ok := s.reservedIPs[ip.String()]; ok && otherMac != mac {
+		return false
+	}
+	if _, ok := s.declined[ip.String()]; ok {
+		return false
+	}
+	if otherMac, ok := s.leasedIPs[ip.String()]; ok && otherMac != mac {
+		return false
+	}
+	return true
+}
+
+func (s *DHCPServer) reply(req *dhcp4.Packet, msgType dhcp4.MessageType, ip net.IP, subnet *dhcpSubnet, localIP net.IP) *dhcp4.Packet {
+	resp := &dhcp4.Packet{
+		Type:          msgType,
+		TransactionID: req.TransactionID,
+		Broadcast:     req.Broadcast,
+		HardwareAddr:  req.HardwareAddr,
+		ClientAddr:    req.ClientAddr,
+		YourAddr:      ip,
+		RelayAddr:     req.RelayAddr,
+		Options:       dhcp4.Options{},
+	}
+	if subnet.serverAddress != nil {
+		resp.ServerAddr = subnet.serverAddress
+	}
+	if relayInfo, ok := req.Options[optRelayAgentInfo]; ok {
+		resp.Options[optRelayAgentInfo] = relayInfo
+	}
+	leaseSeconds := make([]byte, 4)
+	binary.BigEndian.PutUint32(leaseSeconds, uint32(s.leaseTime/time.Second))
+	resp.Options[dhcp4.OptServerIdentifier] = localIP.To4()
+	resp.Options[dhcp4.OptLeaseTime] = leaseSeconds
+	resp.Options[dhcp4.OptSubnetMask] = []byte(subnet.network.Mask)
+	if subnet.gateway != nil {
+		resp.Options[dhcp4.OptRouters] = subnet.gateway
+	}
+	if len(subnet.dns) > 0 {
+		var dns []byte
+		for _, ip := range subnet.dns {
+			dns = append(dns, ip...)
+		}
+		resp.Options[dhcp4.OptDNSServers] = dns
+	}
+	if subnet.domain != "" {
+		resp.Options[dhcp4.OptDomainName] = []byte(subnet.domain)
+	}
+	if reservation, ok := s.reservations[req.HardwareAddr.String()]; ok && reservation.Hostname != "" {
+		resp.Options[dhcp4.OptHostname] = []byte(reservation.Hostname)
+	}
+	if s.UBoot != nil && s.UBoot.IsHost(req.HardwareAddr.String()) && resp.ServerAddr == nil {
+		// U-Boot fetches its config from the next server (siaddr)
+		resp.ServerAddr = localIP
+	}
+	if s.RaspberryPi != nil && s.RaspberryPi.isBootRequest(req) {
+		setRaspberryPiOptions(resp, localIP)
+	}
+	if m, ok := httpBootMachine(req); ok && s.HTTPBoot != nil {
+		bootURL, err := s.HTTPBoot.BootURL(m, s.HTTPBoot.URLs.ForIP(ip))
+		if err != nil {
+			s.log("DHCP", "Not sending a boot URL to %s: %s", req.HardwareAddr, err)
+		} else {
+			setHTTPBootOptions(resp, bootURL)
+		}
+	}
+	return resp
+}
+
+func (s *DHCPServer) nak(req *dhcp4.Packet, localIP net.IP) *dhcp4.Packet {
+	resp := &dhcp4.Packet{
+		Type:          dhcp4.MsgNack,
+		TransactionID: req.TransactionID,
+		Broadcast:     true,
+		HardwareAddr:  req.HardwareAddr,
+		RelayAddr:     req.RelayAddr,
+		Options: dhcp4.Options{
+			dhcp4.OptServerIdentifier: localIP.To4(),
+		},
+	}
+	if relayInfo, ok := req.Options[optRelayAgentInfo]; ok {
+		resp.Options[optRelayAgentInfo] = relayInfo
+	}
+	return resp
+}
+
+// interfaceIP prefers an address in a configured subnet, relayed requests
+// may arrive on an interface outside all of them.
+func (s *DHCPServer) interfaceIP(intf *net.Interface) (net.IP, error) {
+	addrs, err := intf.Addrs()
+	if err != nil {
+		return nil, err
+	}
+	var fallback net.IP
+	for _, addr := range addrs {
+		ipNet, ok := addr.(*net.IPNet)
+		if !ok || ipNet.IP.To4() == nil {
+			continue
+		}
+		if subnetFor(s.subnets, ipNet.IP) != nil {
+			return ipNet.IP.To4(), nil
+		}
+		if fallback == nil {
+			fallback = ipNet.IP.To4()
+		}
+	}
+	if fallback == nil {
+		return nil, fmt.Errorf("interface has no IPv4 address")
+	}
+	return fallback, nil
+}
+
+func (s *DHCPServer) loadLeases() error {
+	if s.leaseFile == "" {
+		return nil
+	}
+	contents, err := ioutil.ReadFile(s.leaseFile)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if len(contents) == 0 {
+		return nil
+	}
+	leases := make(map[string]dhcpLease)
+	if err := json.Unmarshal(contents, &leases); err != nil {
+		return fmt.Errorf("lease file '%s' was not valid JSON: %s", s.leaseFile, err)
+	}
+	now := s.now()
+	for mac, lease := range leases {
+		if lease.Expires.After(now) {
+			s.setLease(mac, lease)
+		}
+	}
+	return nil
+}
+
+// saveLeases writes to a temp file first so a crash can't leave a
+// truncated lease file behind.
+func (s *DHCPServer) saveLeases() error {
+	if s.leaseFile == "" {
+		return nil
+	}
+	contents, err := json.MarshalIndent(s.leases, "", "  ")
+	if err != nil {
+		return err
+	}
+	tmpFile, err := ioutil.TempFile(filepath.Dir(s.leaseFile), ".pxeserver-leases")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmpFile.Name())
+	if _, err := tmpFile.Write(contents); err != nil {
+		tmpFile.Close()
+		return err
+	}
+	if err := tmpFile.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmpFile.Name(), s.leaseFile)
+}
+
+// interfaceIndexes returns the indexes of the interfaces with addresses, or
+// nil if an address is empty or unspecified to match every interface.
+func interfaceIndexes(addresses []string) (map[int]bool, error) {
+	indexes := make(map[int]bool)
+	for _, address := range addresses {
+		ip := net.ParseIP(address)
+		if ip == nil || ip.IsUnspecified() {
+			return nil, nil
+		}
+		found := false
+		intfs, err := net.Interfaces()
+		if err != nil {
+			return nil, err
+		}
+		for _, intf := range intfs {
+			addrs, err := intf.Addrs()
+			if err != nil {
+				return nil, err
+			}
+			for _, addr := range addrs {
+				if ipNet, ok := addr.(*net.IPNet); ok && ipNet.IP.Equal(ip) {
+					indexes[intf.Index] = true
+					found = true
+				}
+			}
+		}
+		if !found {
+			return nil, fmt.Errorf("IP %s not found on any local interface", ip)
+		}
+	}
+	return indexes, nil
+}
+
+func (s *DHCPServer) log(subsys string, format string, args ...interface{}) {
+	if s.LogFunc == nil {
+		return
+	}
+	s.LogFunc(subsys, fmt.Sprintf(format, args...))
+}
+
+// clientLink is the address identifying the client's subnet: the relay's
+// link selection sub-option, then giaddr, then the receiving interface.
+func clientLink(pkt *dhcp4.Packet, localIP net.IP) net.IP {
+	relayInfo := pkt.Options[optRelayAgentInfo]
+	for len(relayInfo) >= 2 {
+		code, length := relayInfo[0], int(relayInfo[1])
+		if len(relayInfo) < 2+length {
+			break
+		}
+		if code == subOptLinkSelection && length == net.IPv4len {
+			return net.IP(relayInfo[2 : 2+length])
+		}
+		relayInfo = relayInfo[2+length:]
+	}
+	if pkt.RelayAddr != nil && !pkt.RelayAddr.IsUnspecified() {
+		return pkt.RelayAddr
+	}
+	return localIP
+}
+
+func subnetFor(subnets []dhcpSubnet, ip net.IP) *dhcpSubnet {
+	for i := range subnets {
+		if subnets[i].network.Contains(ip) {
+			return &subnets[i]
+		}
+	}
+	return nil
+}
+
+func ipToUint32(ip net.IP) uint32 {
+	return binary.BigEndian.Uint32(ip.To4())
+}
+
+func uint32ToIP(n uint32) net.IP {
+	ip := make(net.IP, 4)
+	binary.BigEndian.PutUint32(ip, n)
+	return ip
+}
@@ -0,0 +1,307 @@
+package pxeserver_test
+
+import (
+	"encoding/binary"
+	"io/ioutil"
+	"net"
+	"os"
+	"path"
+	"testing"
+
+	"github.com/ljfranklin/pxeserver"
+	"github.com/stretchr/testify/assert"
+	"go.universe.tf/netboot/dhcp4"
+)
+
+func testDHCPSettings() pxeserver.DHCPSettings {
+	return pxeserver.DHCPSettings{
+		Enabled:   true,
+		LeaseTime: "1h",
+		Subnets: []pxeserver.DHCPSubnet{
+			{
+				CIDR:       "10.0.0.0/24",
+				RangeStart: "10.0.0.100",
+				RangeEnd:   "10.0.0.101",
+				Gateway:    "10.0.0.1",
+				DNS:        []string{"10.0.0.2", "10.0.0.3"},
+				Domain:     "lab",
+			},
+		},
+	}
+}
+
+func dhcpPacket(msgType dhcp4.MessageType, mac string, options dhcp4.Options) *dhcp4.Packet {
+	hwAddr, _ := net.ParseMAC(mac)
+	if options == nil {
+		options = dhcp4.Options{}
+	}
+	return &dhcp4.Packet{
+		Type:          msgType,
+		TransactionID: []byte{1, 2, 3, 4},
+		HardwareAddr:  hwAddr,
+		Options:       options,
+	}
+}
+
+func requestPacket(mac string, ip string) *dhcp4.Packet {
+	return dhcpPacket(dhcp4.MsgRequest, mac, dhcp4.Options{
+		dhcp4.OptRequestedIP:      net.ParseIP(ip).To4(),
+		dhcp4.OptServerIdentifier: net.ParseIP("10.0.0.1").To4(),
+	})
+}
+
+func TestDHCPOffersFromPool(t *testing.T) {
+	assert := assert.New(t)
+
+	server, err := pxeserver.NewDHCPServer(testDHCPSettings(), nil)
+	assert.NoError(err)
+
+	offer, err := server.Respond(dhcpPacket(dhcp4.MsgDiscover, "52:54:00:00:00:01", nil), net.ParseIP("10.0.0.1"))
+	assert.NoError(err)
+	assert.Equal(dhcp4.MsgOffer, offer.Type)
+	assert.Equal("10.0.0.100", offer.YourAddr.String())
+	assert.Equal([]byte(net.ParseIP("10.0.0.1").To4()), offer.Options[dhcp4.OptServerIdentifier])
+	assert.Equal([]byte{255, 255, 255, 0}, offer.Options[dhcp4.OptSubnetMask])
+	assert.Equal([]byte{10, 0, 0, 1}, offer.Options[dhcp4.OptRouters])
+	assert.Equal([]byte{10, 0, 0, 2, 10, 0, 0, 3}, offer.Options[dhcp4.OptDNSServers])
+	assert.Equal([]byte("lab"), offer.Options[dhcp4.OptDomainName])
+	assert.Equal(uint32(3600), binary.BigEndian.Uint32(offer.Options[dhcp4.OptLeaseTime]))
+	_, err = offer.Marshal()
+	assert.NoError(err)
+
+	// the offered address is held for the first client
+	offer, err = server.Respond(dhcpPacket(dhcp4.MsgDiscover, "52:54:00:00:00:02", nil), net.ParseIP("10.0.0.1"))
+	assert.NoError(err)
+	assert.Equal("10.0.0.101", offer.YourAddr.String())
+
+	// and the pool is now exhausted
+	offer, err = server.Respond(dhcpPacket(dhcp4.MsgDiscover, "52:54:00:00:00:03", nil), net.ParseIP("10.0.0.1"))
+	assert.NoError(err)
+	assert.Nil(offer)
+}
+
+func TestDHCPAcksRequestAndReportsLease(t *testing.T) {
+	assert := assert.New(t)
+
+	server, err := pxeserver.NewDHCPServer(testDHCPSettings(), nil)
+	assert.NoError(err)
+	acked := map[string]string{}
+	server.OnAck = func(mac string, ip net.IP) {
+		acked[mac] = ip.String()
+	}
+
+	ack, err := server.Respond(requestPacket("52:54:00:00:00:01", "10.0.0.101"), net.ParseIP("10.0.0.1"))
+	assert.NoError(err)
+	assert.Equal(dhcp4.MsgAck, ack.Type)
+	assert.Equal("10.0.0.101", ack.YourAddr.String())
+	assert.Equal(map[string]string{"52:54:00:00:00:01": "10.0.0.101"}, acked)
+
+	// another client can't take the same address
+	nak, err := server.Respond(requestPacket("52:54:00:00:00:02", "10.0.0.101"), net.ParseIP("10.0.0.1"))
+	assert.NoError(err)
+	assert.Equal(dhcp4.MsgNack, nak.Type)
+
+	// nor one outside the pool
+	nak, err = server.Respond(requestPacket("52:54:00:00:00:02", "10.0.0.50"), net.ParseIP("10.0.0.1"))
+	assert.NoError(err)
+	assert.Equal(dhcp4.MsgNack, nak.Type)
+}
+
+func TestDHCPIgnoresRequestsForOtherServers(t *testing.T) {
+	assert := assert.New(t)
+
+	server, err := pxeserver.NewDHCPServer(testDHCPSettings(), nil)
+	assert.NoError(err)
+
+	pkt := requestPacket("52:54:00:00:00:01", "10.0.0.100")
+	pkt.Options[dhcp4.OptServerIdentifier] = net.ParseIP("10.0.0.254").To4()
+	resp, err := server.Respond(pkt, net.ParseIP("10.0.0.1"))
+	assert.NoError(err)
+	assert.Nil(resp)
+}
+
+func TestDHCPStaticReservations(t *testing.T) {
+	assert := assert.New(t)
+
+	server, err := pxeserver.NewDHCPServer(testDHCPSettings(), map[string]pxeserver.DHCPReservation{
+		"52:54:00:00:00:01": {IP: net.ParseIP("10.0.0.10"), Hostname: "node-1"},
+		"52:54:00:00:00:02": {IP: net.ParseIP("10.0.0.100")},
+	})
+	assert.NoError(err)
+
+	offer, err := server.Respond(dhcpPacket(dhcp4.MsgDiscover, "52:54:00:00:00:01", nil), net.ParseIP("10.0.0.1"))
+	assert.NoError(err)
+	assert.Equal("10.0.0.10", offer.YourAddr.String())
+	assert.Equal([]byte("node-1"), offer.Options[dhcp4.OptHostname])
+
+	// reserved addresses are skipped when assigning from the pool
+	offer, err = server.Respond(dhcpPacket(dhcp4.MsgDiscover, "52:54:00:00:00:03", nil), net.ParseIP("10.0.0.1"))
+	assert.NoError(err)
+	assert.Equal("10.0.0.101", offer.YourAddr.String())
+
+	// a reserved host may only request its own address
+	nak, err := server.Respond(requestPacket("52:54:00:00:00:01", "10.0.0.101"), net.ParseIP("10.0.0.1"))
+	assert.NoError(err)
+	assert.Equal(dhcp4.MsgNack, nak.Type)
+	ack, err := server.Respond(requestPacket("52:54:00:00:00:01", "10.0.0.10"), net.ParseIP("10.0.0.1"))
+	assert.NoError(err)
+	assert.Equal(dhcp4.MsgAck, ack.Type)
+}
+
+func TestDHCPPersistsLeases(t *testing.T) {
+	assert := assert.New(t)
+
+	tmpdir, err := ioutil.TempDir("", "pxeserver-dhcp")
+	assert.NoError(err)
+	defer os.RemoveAll(tmpdir)
+	settings := testDHCPSettings()
+	settings.LeaseFile = path.Join(tmpdir, "leases.json")
+
+	server, err := pxeserver.NewDHCPServer(settings, nil)
+	assert.NoError(err)
+	ack, err := server.Respond(requestPacket("52:54:00:00:00:01", "10.0.0.101"), net.ParseIP("10.0.0.1"))
+	assert.NoError(err)
+	assert.Equal(dhcp4.MsgAck, ack.Type)
+
+	server, err = pxeserver.NewDHCPServer(settings, nil)
+	assert.NoError(err)
+	offer, err := server.Respond(dhcpPacket(dhcp4.MsgDiscover, "52:54:00:00:00:01", nil), net.ParseIP("10.0.0.1"))
+	assert.NoError(err)
+	assert.Equal("10.0.0.101", offer.YourAddr.String())
+	nak, err := server.Respond(requestPacket("52:54:00:00:00:02", "10.0.0.101"), net.ParseIP("10.0.0.1"))
+	assert.NoError(err)
+	assert.Equal(dhcp4.MsgNack, nak.Type)
+
+	// releasing frees the address for other clients
+	release := dhcpPacket(dhcp4.MsgRelease, "52:54:00:00:00:01", nil)
+	release.ClientAddr = net.ParseIP("10.0.0.101")
+	_, err = server.Respond(release, net.ParseIP("10.0.0.1"))
+	assert.NoError(err)
+	server, err = pxeserver.NewDHCPServer(settings, nil)
+	assert.NoError(err)
+	ack, err = server.Respond(requestPacket("52:54:00:00:00:02", "10.0.0.101"), net.ParseIP("10.0.0.1"))
+	assert.NoError(err)
+	assert.Equal(dhcp4.MsgAck, ack.Type)
+}
+
+func TestDHCPDropsExpiredLeases(t *testing.T) {
+	assert := assert.New(t)
+
+	tmpdir, err := ioutil.TempDir("", "pxeserver-dhcp")
+	assert.NoError(err)
+	defer os.RemoveAll(tmpdir)
+	settings := testDHCPSettings()
+	settings.LeaseFile = path.Join(tmpdir, "leases.json")
+	assert.NoError(ioutil.WriteFile(settings.LeaseFile, []byte(`{
+  "52:54:00:00:00:01": {"ip": "10.0.0.100", "expires": "2000-01-01T00:00:00Z"}
+}`), 0600))
+
+	server, err := pxeserver.NewDHCPServer(settings, nil)
+	assert.NoError(err)
+	ack, err := server.Respond(requestPacket("52:54:00:00:00:02", "10.0.0.100"), net.ParseIP("10.0.0.1"))
+	assert.NoError(err)
+	assert.Equal(dhcp4.MsgAck, ack.Type)
+
+	contents, err := ioutil.ReadFile(settings.LeaseFile)
+	assert.NoError(err)
+	assert.NotContains(string(contents), "52:54:00:00:00:01")
+	assert.Contains(string(contents), "52:54:00:00:00:02")
+}
+
+func TestDHCPHoldsDeclinedAddresses(t *testing.T) {
+	assert := assert.New(t)
+
+	server, err := pxeserver.NewDHCPServer(testDHCPSettings(), nil)
+	assert.NoError(err)
+	ack, err := server.Respond(requestPacket("52:54:00:00:00:01", "10.0.0.100"), net.ParseIP("10.0.0.1"))
+	assert.NoError(err)
+	assert.Equal(dhcp4.MsgAck, ack.Type)
+
+	decline := dhcpPacket(dhcp4.MsgDecline, "52:54:00:00:00:01", dhcp4.Options{
+		dhcp4.OptRequestedIP:      net.ParseIP("10.0.0.100").To4(),
+		dhcp4.OptServerIdentifier: net.ParseIP("10.0.0.1").To4(),
+	})
+	resp, err := server.Respond(decline, net.ParseIP("10.0.0.1"))
+	assert.NoError(err)
+	assert.Nil(resp)
+
+	// the client is offered another address and no one gets the declined one
+	offer, err := server.Respond(dhcpPacket(dhcp4.MsgDiscover, "52:54:00:00:00:01", nil), net.ParseIP("10.0.0.1"))
+	assert.NoError(err)
+	assert.Equal("10.0.0.101", offer.YourAddr.String())
+	offer, err = server.Respond(dhcpPacket(dhcp4.MsgDiscover, "52:54:00:00:00:02", nil), net.ParseIP("10.0.0.1"))
+	assert.NoError(err)
+	assert.Nil(offer)
+	nak, err := server.Respond(requestPacket("52:54:00:00:00:02", "10.0.0.100"), net.ParseIP("10.0.0.1"))
+	assert.NoError(err)
+	assert.Equal(dhcp4.MsgNack, nak.Type)
+}
+
+func testRelayDHCPSettings() pxeserver.DHCPSettings {
+	settings := testDHCPSettings()
+	settings.Subnets = append(settings.Subnets, pxeserver.DHCPSubnet{
+		Name:          "rack-2",
+		CIDR:          "10.0.1.0/24",
+		ServerAddress: "192.168.0.10",
+		RangeStart:    "10.0.1.100",
+		RangeEnd:      "10.0.1.101",
+		Gateway:       "10.0.1.1",
+	})
+	return settings
+}
+
+func TestDHCPAnswersRelayedRequests(t *testing.T) {
+	assert := assert.New(t)
+
+	server, err := pxeserver.NewDHCPServer(testRelayDHCPSettings(), nil)
+	assert.NoError(err)
+
+	// circuit ID sub-option
+	relayInfo := []byte{1, 3, 'e', 't', '1'}
+	discover := dhcpPacket(dhcp4.MsgDiscover, "52:54:00:00:00:01", dhcp4.Options{
+		82: relayInfo,
+	})
+	discover.RelayAddr = net.ParseIP("10.0.1.1").To4()
+	offer, err := server.Respond(discover, net.ParseIP("192.168.0.10"))
+	assert.NoError(err)
+	assert.Equal(dhcp4.MsgOffer, offer.Type)
+	assert.Equal("10.0.1.100", offer.YourAddr.String())
+	assert.True(offer.RelayAddr.Equal(net.ParseIP("10.0.1.1")))
+	assert.True(offer.ServerAddr.Equal(net.ParseIP("192.168.0.10")))
+	assert.Equal(relayInfo, offer.Options[82])
+	serverID, err := offer.Options.IP(dhcp4.OptServerIdentifier)
+	assert.NoError(err)
+	assert.Equal("192.168.0.10", serverID.String())
+
+	request := dhcpPacket(dhcp4.MsgRequest, "52:54:00:00:00:01", dhcp4.Options{
+		dhcp4.OptRequestedIP:      net.ParseIP("10.0.1.100").To4(),
+		dhcp4.OptServerIdentifier: net.ParseIP("192.168.0.10").To4(),
+	})
+	request.RelayAddr = net.ParseIP("10.0.1.1").To4()
+	ack, err := server.Respond(request, net.ParseIP("172.16.0.5"))
+	assert.NoError(err)
+	assert.Equal(dhcp4.MsgAck, ack.Type)
+}
+
+func TestDHCPUsesRelayLinkSelection(t *testing.T) {
+	assert := assert.New(t)
+
+	server, err := pxeserver.NewDHCPServer(testRelayDHCPSettings(), nil)
+	assert.NoError(err)
+
+	// the relay's own address is outside the client's subnet
+	discover := dhcpPacket(dhcp4.MsgDiscover, "52:54:00:00:00:01", dhcp4.Options{
+		82: []byte{1, 3, 'e', 't', '1', 5, 4, 10, 0, 1, 0},
+	})
+	discover.RelayAddr = net.ParseIP("172.16.0.1").To4()
+	offer, err := server.Respond(discover, net.ParseIP("192.168.0.10"))
+	assert.NoError(err)
+	assert.Equal("10.0.1.100", offer.YourAddr.String())
+
+	// relays from unknown subnets are ignored
+	discover = dhcpPacket(dhcp4.MsgDiscover, "52:54:00:00:00:01", nil)
+	discover.RelayAddr = net.ParseIP("172.16.0.1").To4()
+	offer, err = server.Respond(discover, net.ParseIP("10.0.0.1"))
+	assert.NoError(err)
+	assert.Nil(offer)
+}
@@ -0,0 +1,203 @@
+package pxeserver
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"sort"
+	"strings"
+
+	"go.universe.tf/netboot/pixiecore"
+)
+
+// DHCPSnippetFormats are the DHCP servers WriteDHCPSnippets writes config
+// for.
+var DHCPSnippetFormats = []string{"dnsmasq", "kea", "isc"}
+
+// dhcpClientArchs are the client architectures, DHCP option 93, of PXE
+// firmware and the iPXE build each is sent.
+var dhcpClientArchs = []struct {
+	arch   uint16
+	name   string
+	fwtype pixiecore.Firmware
+}{
+	{0, "x86pc", pixiecore.FirmwareX86PC},
+	{6, "efi32", pixiecore.FirmwareEFI32},
+	{7, "efi64", pixiecore.FirmwareEFI64},
+	{9, "efibc", pixiecore.FirmwareEFIBC},
+	{10, "efiarm32", pixiecore.FirmwareEFIArm32},
+	{11, "efiarm64", pixiecore.FirmwareEFIArm64},
+}
+
+const dhcpSnippetHeader = "Generated by 'pxeserver dhcp-snippets', chains each host to pxeserver"
+
+type dhcpSnippetHost struct {
+	mac      string
+	serverIP string
+	bootURL  string
+}
+
+// name identifies the host in DHCP server tags and classes, which don't
+// allow the MAC's separators.
+func (h dhcpSnippetHost) name() string {
+	return fmt.Sprintf("pxeserver-%s", strings.Replace(h.mac, ":", "", -1))
+}
+
+func (h dhcpSnippetHost) firmwarePath(fwtype pixiecore.Firmware) string {
+	return fmt.Sprintf("%s/%d", h.mac, fwtype)
+}
+
+// WriteDHCPSnippets writes config for an existing DHCP server, one of
+// DHCPSnippetFormats, to boot the hosts in cfg with server.dhcp_mode
+// 'none'. PXE firmware is sent the host's iPXE build over TFTP, which then
+// loads /boot/<mac>.ipxe from server.http_address. Hosts with bootloader
+// 'uboot' or 'raspberrypi' are left out as they need pxeserver's DHCP.
+func WriteDHCPSnippets(w io.Writer, cfg Config, format string) error {
+	settings := cfg.ServerSettings()
+	if settings.HTTPAddress == "" {
+		return fmt.Errorf("dhcp snippets require server.http_address to be set")
+	}
+	macs := make([]string, 0, len(cfg.Pixiecore()))
+	for mac := range cfg.Pixiecore() {
+		macs = append(macs, string(mac))
+	}
+	sort.Strings(macs)
+
+	hosts := []dhcpSnippetHost{}
+	skipped := []string{}
+	for _, mac := range macs {
+		if _, ok := cfg.UBootHosts()[mac]; ok {
+			skipped = append(skipped, mac)
+			continue
+		}
+		if _, ok := cfg.RaspberryPiHosts()[mac]; ok {
+			skipped = append(skipped, mac)
+			continue
+		}
+		subnet := cfg.HostSubnets()[mac]
+		serverIP, err := settings.tftpServerIP(subnet)
+		if err != nil {
+			return err
+		}
+		hosts = append(hosts, dhcpSnippetHost{
+			mac:      mac,
+			serverIP: serverIP,
+			bootURL:  fmt.Sprintf("%s/boot/%s.ipxe", settings.SubnetBaseURL(subnet), mac),
+		})
+	}
+
+	switch format {
+	case "dnsmasq":
+		return writeDnsmasqSnippet(w, hosts, skipped)
+	case "kea":
+		return writeKeaSnippet(w, hosts)
+	case "isc":
+		return writeISCSnippet(w, hosts, skipped)
+	}
+	return fmt.Errorf("invalid format '%s': must be one of %s", format, strings.Join(DHCPSnippetFormats, ", "))
+}
+
+// tftpServerIP is the address hosts in subnet reach pxeserver's TFTP server
+// on, the host in HTTPAddress unless replaced.
+func (s ServerSettings) tftpServerIP(subnet DHCPSubnet) (string, error) {
+	if subnet.ServerAddress != "" {
+		return subnet.ServerAddress, nil
+	}
+	if s.AdvertiseAddress != "" {
+		return s.AdvertiseAddress, nil
+	}
+	host, _, err := net.SplitHostPort(s.HTTPAddress)
+	if err != nil {
+		return "", fmt.Errorf("invalid server.http_address '%s': %s", s.HTTPAddress, err)
+	}
+	ip := net.ParseIP(host)
+	if ip == nil || ip.IsUnspecified() {
+		return "", fmt.Errorf("dhcp snippets require server.advertise_address when server.http_address '%s' isn't a specific IP address", s.HTTPAddress)
+	}
+	return ip.String(), nil
+}
+
+func writeSkippedHosts(w io.Writer, skipped []string) {
+	for _, mac := range skipped {
+		fmt.Fprintf(w, "# %s skipped, bootloaders 'uboot' and 'raspberrypi' need pxeserver's DHCP\n", mac)
+	}
+}
+
+func writeDnsmasqSnippet(w io.Writer, hosts []dhcpSnippetHost, skipped []string) error {
+	fmt.Fprintf(w, "# %s\n", dhcpSnippetHeader)
+	fmt.Fprintln(w, "dhcp-match=set:pxeserver-ipxe,175")
+	for _, a := range dhcpClientArchs {
+		fmt.Fprintf(w, "dhcp-match=set:pxeserver-%s,option:client-arch,%d\n", a.name, a.arch)
+	}
+	for _, h := range hosts {
+		fmt.Fprintf(w, "\n# %s\n", h.mac)
+		fmt.Fprintf(w, "dhcp-mac=set:%s,%s\n", h.name(), h.mac)
+		fmt.Fprintf(w, "dhcp-boot=tag:%s,tag:pxeserver-ipxe,%s\n", h.name(), h.bootURL)
+		for _, a := range dhcpClientArchs {
+			fmt.Fprintf(w, "dhcp-boot=tag:%s,tag:!pxeserver-ipxe,tag:pxeserver-%s,%s,,%s\n", h.name(), a.name, h.firmwarePath(a.fwtype), h.serverIP)
+		}
+	}
+	if len(skipped) > 0 {
+		fmt.Fprintln(w)
+		writeSkippedHosts(w, skipped)
+	}
+	return nil
+}
+
+type keaClientClass struct {
+	Name         string `json:"name"`
+	Test         string `json:"test"`
+	NextServer   string `json:"next-server,omitempty"`
+	BootFileName string `json:"boot-file-name"`
+}
+
+// writeKeaSnippet writes the client-classes to add to Kea's Dhcp4 config,
+// JSON has no comments to list skipped hosts in.
+func writeKeaSnippet(w io.Writer, hosts []dhcpSnippetHost) error {
+	classes := []keaClientClass{}
+	for _, h := range hosts {
+		macTest := fmt.Sprintf("pkt4.mac == 0x%s", strings.Replace(h.mac, ":", "", -1))
+		classes = append(classes, keaClientClass{
+			Name:         h.name() + "-ipxe",
+			Test:         macTest + " and option[175].exists",
+			BootFileName: h.bootURL,
+		})
+		for _, a := range dhcpClientArchs {
+			classes = append(classes, keaClientClass{
+				Name:         fmt.Sprintf("%s-%s", h.name(), a.name),
+				Test:         fmt.Sprintf("%s and not option[175].exists and option[93].hex == 0x%04x", macTest, a.arch),
+				NextServer:   h.serverIP,
+				BootFileName: h.firmwarePath(a.fwtype),
+			})
+		}
+	}
+	b, err := json.MarshalIndent(map[string]interface{}{"client-classes": classes}, "", "  ")
+	if err != nil {
+		return err
+	}
+	_, err = fmt.Fprintf(w, "%s\n", b)
+	return err
+}
+
+func writeISCSnippet(w io.Writer, hosts []dhcpSnippetHost, skipped []string) error {
+	fmt.Fprintf(w, "# %s\n", dhcpSnippetHeader)
+	fmt.Fprintln(w, "option pxeserver-arch code 93 = unsigned integer 16;")
+	fmt.Fprintln(w, "option pxeserver-ipxe code 175 = string;")
+	for _, h := range hosts {
+		fmt.Fprintf(w, "\nhost %s {\n", h.name())
+		fmt.Fprintf(w, "  hardware ethernet %s;\n", h.mac)
+		fmt.Fprintf(w, "  next-server %s;\n", h.serverIP)
+		fmt.Fprintf(w, "  if exists pxeserver-ipxe {\n    filename \"%s\";\n", h.bootURL)
+		for _, a := range dhcpClientArchs {
+			fmt.Fprintf(w, "  } elsif option pxeserver-arch = %02x:%02x {\n    filename \"%s\";\n", a.arch>>8, a.arch&0xff, h.firmwarePath(a.fwtype))
+		}
+		fmt.Fprintln(w, "  }")
+		fmt.Fprintln(w, "}")
+	}
+	if len(skipped) > 0 {
+		fmt.Fprintln(w)
+		writeSkippedHosts(w, skipped)
+	}
+	return nil
+}
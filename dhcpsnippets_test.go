@@ -0,0 +1,103 @@
+package pxeserver_test
+
+import (
+	"bytes"
+	"encoding/json"
+	"strings"
+	"testing"
+
+	"github.com/ljfranklin/pxeserver"
+	"github.com/stretchr/testify/assert"
+)
+
+func loadSnippetsConfig(assert *assert.Assertions, server string) pxeserver.Config {
+	cfg, err := pxeserver.LoadConfig(strings.NewReader(`
+server:
+` + server + `
+  dhcp_mode: none
+  dhcp:
+    subnets:
+    - name: remote
+      cidr: 10.0.1.0/24
+      server_address: 10.0.1.1
+hosts:
+- mac: "52:54:00:12:34:56"
+- mac: "52:54:00:65:43:21"
+  subnet: remote
+- mac: "52:54:00:00:00:01"
+  bootloader: uboot
+`))
+	assert.NoError(err)
+	return cfg
+}
+
+func TestDnsmasqSnippet(t *testing.T) {
+	assert := assert.New(t)
+
+	cfg := loadSnippetsConfig(assert, "  http_address: 10.0.0.1:8080")
+	var b bytes.Buffer
+	assert.NoError(pxeserver.WriteDHCPSnippets(&b, cfg, "dnsmasq"))
+	snippet := b.String()
+
+	assert.Contains(snippet, "dhcp-match=set:pxeserver-ipxe,175\n")
+	assert.Contains(snippet, "dhcp-match=set:pxeserver-efi64,option:client-arch,7\n")
+	assert.Contains(snippet, "dhcp-mac=set:pxeserver-525400123456,52:54:00:12:34:56\n")
+	assert.Contains(snippet, "dhcp-boot=tag:pxeserver-525400123456,tag:pxeserver-ipxe,http://10.0.0.1:8080/boot/52:54:00:12:34:56.ipxe\n")
+	assert.Contains(snippet, "dhcp-boot=tag:pxeserver-525400123456,tag:!pxeserver-ipxe,tag:pxeserver-efi64,52:54:00:12:34:56/2,,10.0.0.1\n")
+	assert.Contains(snippet, "dhcp-boot=tag:pxeserver-525400654321,tag:pxeserver-ipxe,http://10.0.1.1:8080/boot/52:54:00:65:43:21.ipxe\n")
+	assert.Contains(snippet, "dhcp-boot=tag:pxeserver-525400654321,tag:!pxeserver-ipxe,tag:pxeserver-x86pc,52:54:00:65:43:21/0,,10.0.1.1\n")
+	assert.Contains(snippet, "# 52:54:00:00:00:01 skipped")
+	assert.NotContains(snippet, "dhcp-mac=set:pxeserver-525400000001")
+}
+
+func TestKeaSnippet(t *testing.T) {
+	assert := assert.New(t)
+
+	cfg := loadSnippetsConfig(assert, "  http_address: 10.0.0.1:8080")
+	var b bytes.Buffer
+	assert.NoError(pxeserver.WriteDHCPSnippets(&b, cfg, "kea"))
+
+	var snippet struct {
+		Classes []map[string]string `json:"client-classes"`
+	}
+	assert.NoError(json.Unmarshal(b.Bytes(), &snippet))
+	assert.Len(snippet.Classes, 14)
+	assert.Contains(snippet.Classes, map[string]string{
+		"name":           "pxeserver-525400123456-ipxe",
+		"test":           "pkt4.mac == 0x525400123456 and option[175].exists",
+		"boot-file-name": "http://10.0.0.1:8080/boot/52:54:00:12:34:56.ipxe",
+	})
+	assert.Contains(snippet.Classes, map[string]string{
+		"name":           "pxeserver-525400123456-efiarm64",
+		"test":           "pkt4.mac == 0x525400123456 and not option[175].exists and option[93].hex == 0x000b",
+		"next-server":    "10.0.0.1",
+		"boot-file-name": "52:54:00:12:34:56/7",
+	})
+}
+
+func TestISCSnippet(t *testing.T) {
+	assert := assert.New(t)
+
+	cfg := loadSnippetsConfig(assert, "  http_address: 0.0.0.0:8080\n  advertise_address: 10.0.0.2")
+	var b bytes.Buffer
+	assert.NoError(pxeserver.WriteDHCPSnippets(&b, cfg, "isc"))
+	snippet := b.String()
+
+	assert.Contains(snippet, "option pxeserver-arch code 93 = unsigned integer 16;\n")
+	assert.Contains(snippet, "host pxeserver-525400123456 {\n  hardware ethernet 52:54:00:12:34:56;\n  next-server 10.0.0.2;\n")
+	assert.Contains(snippet, "  if exists pxeserver-ipxe {\n    filename \"http://10.0.0.2:8080/boot/52:54:00:12:34:56.ipxe\";\n")
+	assert.Contains(snippet, "  } elsif option pxeserver-arch = 00:09 {\n    filename \"52:54:00:12:34:56/3\";\n")
+	assert.Contains(snippet, "# 52:54:00:00:00:01 skipped")
+}
+
+func TestErrorOnInvalidDHCPSnippets(t *testing.T) {
+	assert := assert.New(t)
+
+	cfg := loadSnippetsConfig(assert, "  http_address: 10.0.0.1:8080")
+	assert.NotNil(pxeserver.WriteDHCPSnippets(&bytes.Buffer{}, cfg, "dhcpcd"))
+
+	cfg = loadSnippetsConfig(assert, "  http_address: :8080")
+	err := pxeserver.WriteDHCPSnippets(&bytes.Buffer{}, cfg, "dnsmasq")
+	assert.NotNil(err)
+	assert.Contains(err.Error(), "server.advertise_address")
+}
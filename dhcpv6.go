@@ -0,0 +1,290 @@
+package pxeserver
+
+import (
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net"
+	"sync"
+	"time"
+
+	"go.universe.tf/netboot/dhcp6"
+	"go.universe.tf/netboot/pixiecore"
+)
+
+const (
+	defaultDHCPv6LeaseTime = 12 * time.Hour
+	// dhcpv6HTTPClient is the x64 UEFI HTTP Boot client architecture, the
+	// only HTTP client the vendored packet builder tags with a vendor class
+	dhcpv6HTTPClient = 0x10
+)
+
+// dhcpv6Archs maps DHCPv6 client architecture types, see RFC 4578, to the
+// architectures Pixiecore knows how to boot.
+var dhcpv6Archs = map[uint16]pixiecore.Architecture{
+	0x00: pixiecore.ArchIA32,
+	0x06: pixiecore.ArchIA32,
+	0x07: pixiecore.ArchX64,
+	0x09: pixiecore.ArchX64,
+	0x0a: pixiecore.ArchArm32,
+	0x0b: pixiecore.ArchArm64,
+	0x10: pixiecore.ArchX64,
+}
+
+type DHCPv6Settings struct {
+	Enabled bool `json:"enabled"`
+	// Address is the IPv6 address of the interface to answer DHCPv6 on,
+	// Server.IPv6Address takes precedence if set
+	Address string `json:"address"`
+	// RangeStart and RangeEnd bound the pool of assigned addresses and must
+	// share the same /64 prefix
+	RangeStart string `json:"range_start"`
+	RangeEnd   string `json:"range_end"`
+	// LeaseTime is a Go duration, e.g. 12h
+	LeaseTime string   `json:"lease_time"`
+	DNS       []string `json:"dns"`
+}
+
+func validateDHCPv6Settings(settings DHCPv6Settings) error {
+	_, err := NewDHCPv6AddressPool(settings)
+	if err != nil {
+		return err
+	}
+	if settings.Address != "" {
+		if ip := net.ParseIP(settings.Address); ip == nil || ip.To4() != nil {
+			return fmt.Errorf("invalid server.dhcpv6.address '%s': must be an IPv6 address", settings.Address)
+		}
+	}
+	_, err = dhcpv6DNS(settings)
+	return err
+}
+
+func dhcpv6LeaseTime(settings DHCPv6Settings) (time.Duration, error) {
+	if settings.LeaseTime == "" {
+		return defaultDHCPv6LeaseTime, nil
+	}
+	leaseTime, err := time.ParseDuration(settings.LeaseTime)
+	if err != nil {
+		return 0, fmt.Errorf("invalid server.dhcpv6.lease_time: %s", err)
+	}
+	return leaseTime, nil
+}
+
+func dhcpv6DNS(settings DHCPv6Settings) ([]net.IP, error) {
+	dns := make([]net.IP, 0, len(settings.DNS))
+	for _, address := range settings.DNS {
+		ip := net.ParseIP(address)
+		if ip == nil || ip.To4() != nil {
+			return nil, fmt.Errorf("invalid server.dhcpv6.dns '%s': must be an IPv6 address", address)
+		}
+		dns = append(dns, ip)
+	}
+	return dns, nil
+}
+
+// NewDHCPv6Server returns a Pixiecore DHCPv6 server which points clients at
+// the HTTP server at baseURL and assigns addresses from pool.
+func NewDHCPv6Server(settings DHCPv6Settings, baseURL string, httpBoot HTTPBootConfiguration, pool *DHCPv6AddressPool) (*pixiecore.ServerV6, error) {
+	leaseTime, err := dhcpv6LeaseTime(settings)
+	if err != nil {
+		return nil, err
+	}
+	dns, err := dhcpv6DNS(settings)
+	if err != nil {
+		return nil, err
+	}
+
+	server := pixiecore.NewServerV6()
+	server.Address = settings.Address
+	server.BootConfig = DHCPv6BootConfiguration{
+		BaseURL:  baseURL,
+		HTTPBoot: httpBoot,
+		DNS:      dns,
+	}
+	lifetime := uint32(leaseTime / time.Second)
+	server.PacketBuilder = dhcp6.MakePacketBuilder(lifetime, lifetime)
+	server.AddressPool = pool
+	return server, nil
+}
+
+// DHCPv6BootConfiguration hands out boot file URLs on pxeserver's HTTP
+// server. UEFI HTTP Boot clients are sent the URL picked by HTTPBoot, other
+// clients are pointed at the host's boot script.
+type DHCPv6BootConfiguration struct {
+	BaseURL  string
+	HTTPBoot HTTPBootConfiguration
+	DNS      []net.IP
+}
+
+// GetBootURL is given the link-layer address from the client's DUID, which
+// is only a MAC for DUID-LL and DUID-LLT clients.
+func (c DHCPv6BootConfiguration) GetBootURL(id []byte, clientArchType uint16) ([]byte, error) {
+	if len(id) != 6 {
+		return nil, fmt.Errorf("client DUID '%x' does not contain a MAC address", id)
+	}
+	mac := net.HardwareAddr(id)
+	arch, ok := dhcpv6Archs[clientArchType]
+	if !ok {
+		return nil, fmt.Errorf("unsupported client architecture %d for %s", clientArchType, mac)
+	}
+	m := pixiecore.Machine{MAC: mac, Arch: arch}
+	if clientArchType == dhcpv6HTTPClient {
+		bootURL, err := c.HTTPBoot.BootURL(m, c.BaseURL)
+		if err != nil {
+			return nil, err
+		}
+		return []byte(bootURL), nil
+	}
+	if _, err := c.HTTPBoot.Booter.BootSpec(m); err != nil {
+		return nil, err
+	}
+	return []byte(fmt.Sprintf("%s/_/ipxe?mac=%s&arch=%d", c.BaseURL, mac, arch)), nil
+}
+
+// GetPreference returns nil so no preference option is sent.
+func (c DHCPv6BootConfiguration) GetPreference() []byte {
+	return nil
+}
+
+func (c DHCPv6BootConfiguration) GetRecursiveDNS() []net.IP {
+	return c.DNS
+}
+
+// DHCPv6AddressPool assigns each of a client's interfaces an address from
+// the configured range. Addresses are only kept in memory, clients which
+// renew after a restart may be given a new address.
+type DHCPv6AddressPool struct {
+	prefix       []byte
+	rangeStart   uint64
+	rangeEnd     uint64
+	leaseTime    time.Duration
+	associations map[string]*dhcp6.IdentityAssociation
+	now          func() time.Time
+	mu           sync.Mutex
+
+	// OnReserve is called with each address assigned to a client whose DUID
+	// contains a MAC, if non-nil
+	OnReserve func(mac string, ip net.IP)
+}
+
+func NewDHCPv6AddressPool(settings DHCPv6Settings) (*DHCPv6AddressPool, error) {
+	leaseTime, err := dhcpv6LeaseTime(settings)
+	if err != nil {
+		return nil, err
+	}
+	rangeStart := net.ParseIP(settings.RangeStart)
+	rangeEnd := net.ParseIP(settings.RangeEnd)
+	if rangeStart == nil || rangeEnd == nil || rangeStart.To4() != nil || rangeEnd.To4() != nil {
+		return nil, errors.New("server.dhcpv6 range_start and range_end must be IPv6 addresses")
+	}
+	if !net.IP(rangeStart[:8]).Equal(net.IP(rangeEnd[:8])) {
+		return nil, errors.New("server.dhcpv6 range_start and range_end must be in the same /64")
+	}
+	pool := &DHCPv6AddressPool{
+		prefix:       rangeStart[:8],
+		rangeStart:   binary.BigEndian.Uint64(rangeStart[8:]),
+		rangeEnd:     binary.BigEndian.Uint64(rangeEnd[8:]),
+		leaseTime:    leaseTime,
+		associations: make(map[string]*dhcp6.IdentityAssociation),
+		now:          time.Now,
+	}
+	if pool.rangeStart > pool.rangeEnd {
+		return nil, errors.New("server.dhcpv6 range_start is after range_end")
+	}
+	return pool, nil
+}
+
+// ReserveAddresses returns an error alongside the addresses it could
+// assign if the pool runs out.
+func (p *DHCPv6AddressPool) ReserveAddresses(clientID []byte, interfaceIDs [][]byte) ([]*dhcp6.IdentityAssociation, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	now := p.now()
+	associations := []*dhcp6.IdentityAssociation{}
+	for _, interfaceID := range interfaceIDs {
+		key := dhcpv6AssociationKey(clientID, interfaceID)
+		association, ok := p.associations[key]
+		if !ok || p.expired(association, now) {
+			ip := p.nextFree(now)
+			if ip == nil {
+				return associations, errors.New("no addresses available")
+			}
+			association = &dhcp6.IdentityAssociation{
+				IPAddress:   ip,
+				ClientID:    clientID,
+				InterfaceID: interfaceID,
+			}
+			p.associations[key] = association
+		}
+		association.CreatedAt = now
+		associations = append(associations, association)
+
+		if mac, ok := duidMAC(clientID); ok && p.OnReserve != nil {
+			p.OnReserve(mac.String(), association.IPAddress)
+		}
+	}
+	return associations, nil
+}
+
+func (p *DHCPv6AddressPool) ReleaseAddresses(clientID []byte, interfaceIDs [][]byte) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	for _, interfaceID := range interfaceIDs {
+		delete(p.associations, dhcpv6AssociationKey(clientID, interfaceID))
+	}
+}
+
+func (p *DHCPv6AddressPool) nextFree(now time.Time) net.IP {
+	inUse := make(map[uint64]bool)
+	for key, association := range p.associations {
+		if p.expired(association, now) {
+			delete(p.associations, key)
+			continue
+		}
+		inUse[binary.BigEndian.Uint64(association.IPAddress[8:])] = true
+	}
+	for i := p.rangeStart; ; i++ {
+		if !inUse[i] {
+			ip := make(net.IP, net.IPv6len)
+			copy(ip, p.prefix)
+			binary.BigEndian.PutUint64(ip[8:], i)
+			return ip
+		}
+		if i == p.rangeEnd {
+			return nil
+		}
+	}
+}
+
+func (p *DHCPv6AddressPool) expired(association *dhcp6.IdentityAssociation, now time.Time) bool {
+	return now.After(association.CreatedAt.Add(p.leaseTime))
+}
+
+func dhcpv6AssociationKey(clientID []byte, interfaceID []byte) string {
+	return hex.EncodeToString(clientID) + "/" + hex.EncodeToString(interfaceID)
+}
+
+// duidMAC returns the MAC in a DUID-LLT or DUID-LL, see RFC 3315 section 9.
+func duidMAC(duid []byte) (net.HardwareAddr, bool) {
+	if len(duid) < 2 {
+		return nil, false
+	}
+	var ll []byte
+	switch binary.BigEndian.Uint16(duid[0:2]) {
+	case 1:
+		if len(duid) > 8 {
+			ll = duid[8:]
+		}
+	case 3:
+		if len(duid) > 4 {
+			ll = duid[4:]
+		}
+	}
+	if len(ll) != 6 {
+		return nil, false
+	}
+	return net.HardwareAddr(ll), true
+}
@@ -0,0 +1,158 @@
+package pxeserver_test
+
+import (
+	"net"
+	"testing"
+
+	"github.com/ljfranklin/pxeserver"
+	"github.com/stretchr/testify/assert"
+)
+
+func newTestDHCPv6BootConfiguration(assert *assert.Assertions) pxeserver.DHCPv6BootConfiguration {
+	booter, err := pxeserver.ConfigBooter(pxeserver.Pixiecore{
+		"52:54:00:12:34:56": {
+			Kernel: "52:54:00:12:34:56-__kernel__",
+		},
+	}, pxeserver.Files{}, nil, nil)
+	assert.NoError(err)
+
+	return pxeserver.DHCPv6BootConfiguration{
+		BaseURL:  "http://[2001:db8::1]:8080",
+		HTTPBoot: pxeserver.HTTPBootConfiguration{Booter: booter},
+		DNS:      []net.IP{net.ParseIP("2001:db8::53")},
+	}
+}
+
+func TestDHCPv6BootURLForIpxe(t *testing.T) {
+	assert := assert.New(t)
+
+	bootConfig := newTestDHCPv6BootConfiguration(assert)
+	url, err := bootConfig.GetBootURL([]byte{0x52, 0x54, 0x00, 0x12, 0x34, 0x56}, 0x07)
+	assert.NoError(err)
+	assert.Equal("http://[2001:db8::1]:8080/_/ipxe?mac=52:54:00:12:34:56&arch=1", string(url))
+	assert.Equal([]net.IP{net.ParseIP("2001:db8::53")}, bootConfig.GetRecursiveDNS())
+	assert.Nil(bootConfig.GetPreference())
+}
+
+func TestDHCPv6BootURLForUEFIHTTPBoot(t *testing.T) {
+	assert := assert.New(t)
+
+	bootConfig := newTestDHCPv6BootConfiguration(assert)
+	url, err := bootConfig.GetBootURL([]byte{0x52, 0x54, 0x00, 0x12, 0x34, 0x56}, 0x10)
+	assert.NoError(err)
+	assert.Equal("http://[2001:db8::1]:8080/_/ipxe.efi?arch=1&mac=52:54:00:12:34:56", string(url))
+
+	bootConfig.HTTPBoot.Modes = map[string]string{"52:54:00:12:34:56": pxeserver.HTTPBootKernel}
+	url, err = bootConfig.GetBootURL([]byte{0x52, 0x54, 0x00, 0x12, 0x34, 0x56}, 0x10)
+	assert.NoError(err)
+	assert.Equal("http://[2001:db8::1]:8080/_/file?name=52%3A54%3A00%3A12%3A34%3A56-__kernel__", string(url))
+}
+
+func TestDHCPv6BootURLErrors(t *testing.T) {
+	assert := assert.New(t)
+
+	bootConfig := newTestDHCPv6BootConfiguration(assert)
+	_, err := bootConfig.GetBootURL([]byte{0x52, 0x54, 0x00, 0x65, 0x43, 0x21}, 0x07)
+	assert.NotNil(err)
+
+	// e.g. a DUID-UUID
+	_, err = bootConfig.GetBootURL([]byte{0x01, 0x02, 0x03, 0x04, 0x05, 0x06, 0x07, 0x08}, 0x07)
+	assert.NotNil(err)
+	assert.Contains(err.Error(), "MAC")
+
+	_, err = bootConfig.GetBootURL([]byte{0x52, 0x54, 0x00, 0x12, 0x34, 0x56}, 0xff)
+	assert.NotNil(err)
+	assert.Contains(err.Error(), "architecture")
+}
+
+func TestDHCPv6AddressPoolReservesAddresses(t *testing.T) {
+	assert := assert.New(t)
+
+	pool, err := pxeserver.NewDHCPv6AddressPool(pxeserver.DHCPv6Settings{
+		RangeStart: "2001:db8::100",
+		RangeEnd:   "2001:db8::1ff",
+	})
+	assert.NoError(err)
+	reserved := map[string]net.IP{}
+	pool.OnReserve = func(mac string, ip net.IP) {
+		reserved[mac] = ip
+	}
+
+	// DUID-LL
+	clientID := []byte{0x00, 0x03, 0x00, 0x01, 0x52, 0x54, 0x00, 0x12, 0x34, 0x56}
+	associations, err := pool.ReserveAddresses(clientID, [][]byte{{0, 0, 0, 1}})
+	assert.NoError(err)
+	assert.Len(associations, 1)
+	assert.True(associations[0].IPAddress.Equal(net.ParseIP("2001:db8::100")))
+	assert.True(reserved["52:54:00:12:34:56"].Equal(net.ParseIP("2001:db8::100")))
+
+	associations, err = pool.ReserveAddresses(clientID, [][]byte{{0, 0, 0, 1}})
+	assert.NoError(err)
+	assert.True(associations[0].IPAddress.Equal(net.ParseIP("2001:db8::100")))
+
+	otherClientID := []byte{0x00, 0x03, 0x00, 0x01, 0x52, 0x54, 0x00, 0x65, 0x43, 0x21}
+	associations, err = pool.ReserveAddresses(otherClientID, [][]byte{{0, 0, 0, 1}})
+	assert.NoError(err)
+	assert.True(associations[0].IPAddress.Equal(net.ParseIP("2001:db8::101")))
+}
+
+func TestDHCPv6AddressPoolExhausted(t *testing.T) {
+	assert := assert.New(t)
+
+	pool, err := pxeserver.NewDHCPv6AddressPool(pxeserver.DHCPv6Settings{
+		RangeStart: "2001:db8::100",
+		RangeEnd:   "2001:db8::100",
+	})
+	assert.NoError(err)
+
+	clientID := []byte{0x00, 0x03, 0x00, 0x01, 0x52, 0x54, 0x00, 0x12, 0x34, 0x56}
+	otherClientID := []byte{0x00, 0x03, 0x00, 0x01, 0x52, 0x54, 0x00, 0x65, 0x43, 0x21}
+	_, err = pool.ReserveAddresses(clientID, [][]byte{{0, 0, 0, 1}})
+	assert.NoError(err)
+
+	associations, err := pool.ReserveAddresses(otherClientID, [][]byte{{0, 0, 0, 1}})
+	assert.NotNil(err)
+	assert.Empty(associations)
+
+	pool.ReleaseAddresses(clientID, [][]byte{{0, 0, 0, 1}})
+	associations, err = pool.ReserveAddresses(otherClientID, [][]byte{{0, 0, 0, 1}})
+	assert.NoError(err)
+	assert.True(associations[0].IPAddress.Equal(net.ParseIP("2001:db8::100")))
+}
+
+func TestDHCPv6AddressPoolRejectsInvalidRange(t *testing.T) {
+	assert := assert.New(t)
+
+	_, err := pxeserver.NewDHCPv6AddressPool(pxeserver.DHCPv6Settings{
+		RangeStart: "2001:db8::100",
+		RangeEnd:   "2001:db8:0:1::100",
+	})
+	assert.NotNil(err)
+	assert.Contains(err.Error(), "/64")
+
+	_, err = pxeserver.NewDHCPv6AddressPool(pxeserver.DHCPv6Settings{
+		RangeStart: "10.0.0.100",
+		RangeEnd:   "10.0.0.200",
+	})
+	assert.NotNil(err)
+}
+
+func TestDHCPv6ServerUsesSettings(t *testing.T) {
+	assert := assert.New(t)
+
+	settings := pxeserver.DHCPv6Settings{
+		Address:    "2001:db8::1",
+		RangeStart: "2001:db8::100",
+		RangeEnd:   "2001:db8::1ff",
+		LeaseTime:  "1h",
+	}
+	pool, err := pxeserver.NewDHCPv6AddressPool(settings)
+	assert.NoError(err)
+	server, err := pxeserver.NewDHCPv6Server(settings, "http://[2001:db8::1]:8080", pxeserver.HTTPBootConfiguration{}, pool)
+	assert.NoError(err)
+
+	assert.Equal("2001:db8::1", server.Address)
+	assert.Equal("547", server.Port)
+	assert.Equal(uint32(3600), server.PacketBuilder.ValidLifetime)
+	assert.IsType(pxeserver.DHCPv6BootConfiguration{}, server.BootConfig)
+}
@@ -41,6 +41,11 @@ func LoadFiles(files []File, renderer renderer) (Files, error) {
 	return f, nil
 }
 
+func (f Files) Lookup(id string) (File, bool) {
+	file, ok := f.availableFiles[id]
+	return file, ok
+}
+
 func (f Files) SHA256(id string) (string, error) {
 	inputFile, _, err := f.Read(id)
 	if err != nil {
@@ -76,7 +81,22 @@ func (f Files) Read(id string) (io.ReadCloser, int64, error) {
 	if !ok {
 		return nil, -1, fmt.Errorf("Could not find file with ID '%s'", id)
 	}
+	return f.read(file)
+}
+
+// ReadWithVars reads the file with ID id, rendering templates for the named
+// host, which may be empty, with vars in place of the file's own.
+func (f Files) ReadWithVars(id string, host string, vars map[string]interface{}) (io.ReadCloser, int64, error) {
+	file, ok := f.availableFiles[id]
+	if !ok {
+		return nil, -1, fmt.Errorf("Could not find file with ID '%s'", id)
+	}
+	file.Host = host
+	file.Vars = vars
+	return f.read(file)
+}
 
+func (f Files) read(file File) (io.ReadCloser, int64, error) {
 	var fileReader io.ReadCloser
 	var fileSize int64
 	var fileErr error
@@ -121,7 +141,8 @@ func (f Files) readLocalFile(file File) (io.ReadCloser, int64, error) {
 	inputFile.Close()
 
 	rendererContent, err := f.renderer.RenderFile(RenderFileArgs{
-		Mac:      file.Mac,
+		Host:     file.Host,
+		FileID:   file.ID,
 		Template: string(templateContent),
 		Vars:     file.Vars,
 	})
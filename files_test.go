@@ -64,6 +64,7 @@ func TestVarsRead(t *testing.T) {
 
 	mockRenderer.On("RenderPath", fixturePath).Return(fixturePath, nil)
 	expectedFileArgs := pxeserver.RenderFileArgs{
+		FileID:   "some-id",
 		Template: "some-text\n{{ .vars.some_var }}\n",
 		Vars: map[string]interface{}{
 			"some_var": "some-templated-text",
@@ -267,6 +268,7 @@ func TestVarsSHA256(t *testing.T) {
 
 	mockRenderer.On("RenderPath", fixturePath).Return(fixturePath, nil)
 	expectedFileArgs := pxeserver.RenderFileArgs{
+		FileID:   "some-id",
 		Template: "some-text\n{{ .vars.some_var }}\n",
 		Vars: map[string]interface{}{
 			"some_var": "some-templated-text",
@@ -339,6 +341,7 @@ func TestVarsMD5(t *testing.T) {
 
 	mockRenderer.On("RenderPath", fixturePath).Return(fixturePath, nil)
 	expectedFileArgs := pxeserver.RenderFileArgs{
+		FileID:   "some-id",
 		Template: "some-text\n{{ .vars.some_var }}\n",
 		Vars: map[string]interface{}{
 			"some_var": "some-templated-text",
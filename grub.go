@@ -0,0 +1,224 @@
+package pxeserver
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/url"
+	"path"
+	"strconv"
+	"strings"
+	"text/template"
+	"unicode"
+
+	"go.universe.tf/netboot/pixiecore"
+)
+
+const (
+	// BootloaderIpxe chainloads Pixiecore's iPXE, the default
+	BootloaderIpxe = "ipxe"
+	// BootloaderGrub loads the signed shim and GRUB in server.grub, for
+	// machines with Secure Boot enabled
+	BootloaderGrub = "grub"
+
+	grubConfigName = "grub.cfg"
+	// grubConfigPrefix is how GRUB names per-MAC configs when searching
+	// for its config over the network, e.g. grub.cfg-01-52-54-00-12-34-56
+	grubConfigPrefix = "grub.cfg-01-"
+)
+
+type GrubSettings struct {
+	// Shim is the path to the signed shim EFI binary, e.g. shimx64.efi
+	Shim string `json:"shim"`
+	// Grub is the path to the GRUB EFI binary signed with a key shim
+	// trusts, e.g. grubx64.efi
+	Grub string `json:"grub"`
+}
+
+func validateBootloader(bootloader string) error {
+	switch bootloader {
+	case "", BootloaderIpxe, BootloaderGrub, BootloaderUBoot, BootloaderRaspberryPi:
+		return nil
+	}
+	return fmt.Errorf("invalid bootloader '%s': must be one of %s, %s, %s, %s", bootloader, BootloaderIpxe, BootloaderGrub, BootloaderUBoot, BootloaderRaspberryPi)
+}
+
+// Grub serves each host with bootloader 'grub' its shim, GRUB and a
+// grub.cfg built from its kernel, initrds and boot_args. Files live below a
+// directory named after the host's MAC, so shim finds GRUB and GRUB finds
+// its config next to the file the firmware loaded.
+type Grub struct {
+	shim     []byte
+	shimName string
+	grub     []byte
+	hosts    map[string]bool
+
+	Booter           pixiecore.Booter
+	CmdlineTransform func(tpl string, mac string, funcs template.FuncMap) (string, error)
+}
+
+// LoadGrub reads the binaries in settings to boot the given hosts.
+func LoadGrub(settings GrubSettings, macs []string) (*Grub, error) {
+	shim, err := ioutil.ReadFile(settings.Shim)
+	if err != nil {
+		return nil, fmt.Errorf("reading server.grub.shim: %s", err)
+	}
+	grub, err := ioutil.ReadFile(settings.Grub)
+	if err != nil {
+		return nil, fmt.Errorf("reading server.grub.grub: %s", err)
+	}
+	hosts := make(map[string]bool)
+	for _, mac := range macs {
+		hosts[mac] = true
+	}
+	return &Grub{
+		shim:     shim,
+		shimName: path.Base(settings.Shim),
+		grub:     grub,
+		hosts:    hosts,
+	}, nil
+}
+
+// IsHost reports whether the host with the given MAC boots with GRUB.
+func (g *Grub) IsHost(mac string) bool {
+	return g.hosts[mac]
+}
+
+// OnlyHosts returns a copy of g which serves just the hosts with the given
+// MACs, e.g. those on one interface.
+func (g *Grub) OnlyHosts(macs []string) *Grub {
+	only := *g
+	only.hosts = make(map[string]bool)
+	for _, mac := range macs {
+		if g.hosts[mac] {
+			only.hosts[mac] = true
+		}
+	}
+	return &only
+}
+
+// ShimPath is the path of mac's shim below the GRUB root.
+func (g *Grub) ShimPath(mac string) string {
+	return fmt.Sprintf("%s/%s", mac, g.shimName)
+}
+
+// Open returns the file at p, a path relative to the GRUB root, or false if
+// p isn't a GRUB path. Pixiecore's "<mac>/<fwtype>" boot file is replaced
+// by shim for UEFI clients. fileURL links files referenced in boot_args.
+func (g *Grub) Open(p string, fileURL func(id string) string) (io.ReadCloser, int64, bool, error) {
+	dir, name := path.Split(strings.TrimPrefix(p, "/"))
+	if strings.HasPrefix(name, grubConfigPrefix) {
+		mac, err := net.ParseMAC(strings.TrimPrefix(name, grubConfigPrefix))
+		if err != nil || !g.IsHost(mac.String()) {
+			return nil, 0, false, nil
+		}
+		return g.open(g.config(mac, fileURL))
+	}
+
+	macDir := strings.SplitN(dir, "/", 2)
+	mac, err := net.ParseMAC(macDir[0])
+	if err != nil {
+		if name == grubConfigName {
+			// GRUB images with a built-in prefix look for their config
+			// outside the host's directory
+			return g.open([]byte("configfile $cmdpath/grub.cfg\n"), nil)
+		}
+		return nil, 0, false, nil
+	}
+	if !g.IsHost(mac.String()) {
+		return nil, 0, false, nil
+	}
+
+	switch {
+	case macDir[1] == "file/":
+		id, err := url.PathUnescape(name)
+		if err != nil {
+			return nil, 0, true, err
+		}
+		f, size, err := g.Booter.ReadBootFile(pixiecore.ID(id))
+		return f, size, true, err
+	case macDir[1] != "":
+		return nil, 0, false, nil
+	case name == grubConfigName:
+		return g.open(g.config(mac, fileURL))
+	case name == g.shimName:
+		return g.open(g.shim, nil)
+	case strings.HasSuffix(name, ".efi"):
+		// shim loads its second stage, e.g. grubx64.efi, from its own
+		// directory
+		return g.open(g.grub, nil)
+	}
+	if fwtype, err := strconv.Atoi(name); err == nil && isEFIFirmware(pixiecore.Firmware(fwtype)) {
+		return g.open(g.shim, nil)
+	}
+	return nil, 0, false, nil
+}
+
+func (g *Grub) open(contents []byte, err error) (io.ReadCloser, int64, bool, error) {
+	if err != nil {
+		return nil, 0, true, err
+	}
+	return ioutil.NopCloser(bytes.NewReader(contents)), int64(len(contents)), true, nil
+}
+
+// config boots the host's kernel and initrds from the same server and
+// protocol GRUB was loaded with.
+func (g *Grub) config(mac net.HardwareAddr, fileURL func(id string) string) ([]byte, error) {
+	spec, err := g.Booter.BootSpec(pixiecore.Machine{MAC: mac, Arch: pixiecore.ArchX64})
+	if err != nil {
+		return nil, err
+	}
+	if spec == nil || spec.Kernel == "" {
+		return nil, fmt.Errorf("no kernel for %s", mac)
+	}
+	cmdline, err := g.CmdlineTransform(spec.Cmdline, mac.String(), template.FuncMap{"ID": fileURL})
+	if err != nil {
+		return nil, fmt.Errorf("expanding cmdline %q: %s", spec.Cmdline, err)
+	}
+
+	quoted, err := grubQuote(cmdline)
+	if err != nil {
+		return nil, err
+	}
+
+	var b bytes.Buffer
+	b.WriteString("set timeout=0\n")
+	b.WriteString("menuentry \"pxeserver\" {\n")
+	fmt.Fprintf(&b, "\tlinux $cmdpath/file/%s %s\n", url.PathEscape(string(spec.Kernel)), quoted)
+	if len(spec.Initrd) > 0 {
+		b.WriteString("\tinitrd")
+		for _, initrd := range spec.Initrd {
+			fmt.Fprintf(&b, " $cmdpath/file/%s", url.PathEscape(string(initrd)))
+		}
+		b.WriteByte('\n')
+	}
+	b.WriteString("}\n")
+	return b.Bytes(), nil
+}
+
+// grubQuote single quotes each argument of the cmdline so GRUB takes
+// rendered values, e.g. secrets, literally rather than expanding variables
+// or running commands after a ';'. GRUB can't pass quotes, backslashes or
+// control characters through to the kernel unchanged, so those are refused.
+func grubQuote(cmdline string) (string, error) {
+	for _, c := range cmdline {
+		if c == '\'' || c == '"' || c == '\\' || unicode.IsControl(c) {
+			return "", fmt.Errorf("cmdline %q has character %q which GRUB can't pass to the kernel", cmdline, c)
+		}
+	}
+	args := strings.Fields(cmdline)
+	for i, arg := range args {
+		args[i] = "'" + arg + "'"
+	}
+	return strings.Join(args, " "), nil
+}
+
+func isEFIFirmware(fwtype pixiecore.Firmware) bool {
+	switch fwtype {
+	case pixiecore.FirmwareEFI32, pixiecore.FirmwareEFI64, pixiecore.FirmwareEFIBC, pixiecore.FirmwareEFIArm32, pixiecore.FirmwareEFIArm64:
+		return true
+	}
+	return false
+}
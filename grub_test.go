@@ -0,0 +1,235 @@
+package pxeserver_test
+
+import (
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"path"
+	"strings"
+	"testing"
+	"text/template"
+
+	"github.com/ljfranklin/pxeserver"
+	"github.com/stretchr/testify/assert"
+)
+
+func newTestGrub(assert *assert.Assertions, handler pxeserver.HTTPHandler) *pxeserver.Grub {
+	grub, err := pxeserver.LoadGrub(pxeserver.GrubSettings{
+		Shim: path.Join(fixturesDir(), "grub", "shimx64.efi"),
+		Grub: path.Join(fixturesDir(), "grub", "grubx64.efi"),
+	}, []string{"52:54:00:12:34:56"})
+	assert.NoError(err)
+	grub.Booter = handler.Booter
+	grub.CmdlineTransform = handler.CmdlineTransform
+	return grub
+}
+
+func readGrubFile(assert *assert.Assertions, grub *pxeserver.Grub, p string) (string, bool) {
+	f, _, ok, err := grub.Open(p, func(id string) string { return "http://10.0.0.1:8080/" + id })
+	if !ok {
+		return "", false
+	}
+	assert.NoError(err)
+	contents, err := ioutil.ReadAll(f)
+	assert.NoError(err)
+	return string(contents), true
+}
+
+func TestGrubServesShimAndGrub(t *testing.T) {
+	assert := assert.New(t)
+
+	logs := []string{}
+	grub := newTestGrub(assert, newTestHTTPHandler(assert, nil, &logs))
+
+	contents, ok := readGrubFile(assert, grub, "52:54:00:12:34:56/7")
+	assert.True(ok)
+	assert.Equal("some-shim\n", contents)
+	contents, ok = readGrubFile(assert, grub, "52:54:00:12:34:56/shimx64.efi")
+	assert.True(ok)
+	assert.Equal("some-shim\n", contents)
+	contents, ok = readGrubFile(assert, grub, "/52:54:00:12:34:56/grubx64.efi")
+	assert.True(ok)
+	assert.Equal("some-grub\n", contents)
+	assert.Equal("52:54:00:12:34:56/shimx64.efi", grub.ShimPath("52:54:00:12:34:56"))
+
+	// BIOS clients and other hosts are left to iPXE
+	_, ok = readGrubFile(assert, grub, "52:54:00:12:34:56/0")
+	assert.False(ok)
+	_, ok = readGrubFile(assert, grub, "52:54:00:65:43:21/7")
+	assert.False(ok)
+}
+
+func TestGrubConfig(t *testing.T) {
+	assert := assert.New(t)
+
+	logs := []string{}
+	grub := newTestGrub(assert, newTestHTTPHandler(assert, nil, &logs))
+
+	config, ok := readGrubFile(assert, grub, "52:54:00:12:34:56/grub.cfg")
+	assert.True(ok)
+	assert.Contains(config, "linux $cmdpath/file/52:54:00:12:34:56-__kernel__~")
+	assert.Contains(config, "some_arg=http://10.0.0.1:8080/52:54:00:12:34:56-some-image~")
+
+	config, ok = readGrubFile(assert, grub, "grub/grub.cfg-01-52-54-00-12-34-56")
+	assert.True(ok)
+	assert.Contains(config, "linux $cmdpath/file/52:54:00:12:34:56-__kernel__~")
+
+	config, ok = readGrubFile(assert, grub, "grub/grub.cfg")
+	assert.True(ok)
+	assert.Equal("configfile $cmdpath/grub.cfg\n", config)
+}
+
+func TestGrubOnlyHosts(t *testing.T) {
+	assert := assert.New(t)
+
+	logs := []string{}
+	grub := newTestGrub(assert, newTestHTTPHandler(assert, nil, &logs))
+
+	only := grub.OnlyHosts([]string{"52:54:00:65:43:21"})
+	for _, p := range []string{"52:54:00:12:34:56/grub.cfg", "grub/grub.cfg-01-52-54-00-12-34-56", "52:54:00:12:34:56/shimx64.efi"} {
+		_, ok := readGrubFile(assert, only, p)
+		assert.False(ok, p)
+	}
+	_, ok := readGrubFile(assert, grub.OnlyHosts([]string{"52:54:00:12:34:56"}), "52:54:00:12:34:56/grub.cfg")
+	assert.True(ok)
+}
+
+func TestGrubConfigQuotesCmdline(t *testing.T) {
+	assert := assert.New(t)
+
+	logs := []string{}
+	grub := newTestGrub(assert, newTestHTTPHandler(assert, nil, &logs))
+
+	cmdline := "password=$secret;reboot console=ttyS0"
+	grub.CmdlineTransform = func(tpl string, mac string, funcs template.FuncMap) (string, error) {
+		return cmdline, nil
+	}
+	config, ok := readGrubFile(assert, grub, "52:54:00:12:34:56/grub.cfg")
+	assert.True(ok)
+	assert.Contains(config, "__kernel__~")
+	assert.Contains(config, " 'password=$secret;reboot' 'console=ttyS0'\n")
+
+	for _, cmdline = range []string{"a='b'", "a=\"b c\"", "a=b\nreboot", "a=b\\"} {
+		_, _, ok, err := grub.Open("52:54:00:12:34:56/grub.cfg", nil)
+		assert.True(ok)
+		assert.NotNil(err, cmdline)
+	}
+}
+
+func TestGrubServesFiles(t *testing.T) {
+	assert := assert.New(t)
+
+	logs := []string{}
+	handler := newTestHTTPHandler(assert, nil, &logs)
+	grub := newTestGrub(assert, handler)
+
+	signedID := handler.Tokens.Sign("52:54:00:12:34:56-__kernel__")
+	contents, ok := readGrubFile(assert, grub, "52:54:00:12:34:56/file/"+signedID)
+	assert.True(ok)
+	assert.Equal("some-text\n", contents)
+
+	_, _, ok, err := grub.Open("52:54:00:12:34:56/file/52:54:00:12:34:56-__kernel__", nil)
+	assert.True(ok)
+	assert.NotNil(err)
+}
+
+func TestHTTPServesGrub(t *testing.T) {
+	assert := assert.New(t)
+
+	logs := []string{}
+	handler := newTestHTTPHandler(assert, nil, &logs)
+	handler.Grub = newTestGrub(assert, handler)
+
+	req := httptest.NewRequest("GET", "/_/grub/52:54:00:12:34:56/grub.cfg", nil)
+	recorder := httptest.NewRecorder()
+	handler.ServeHTTP(recorder, req)
+	assert.Equal(http.StatusOK, recorder.Code)
+	assert.Contains(recorder.Body.String(), "some_arg=http://10.0.0.1:8080/_/file?name=")
+
+	signedID := handler.Tokens.Sign("52:54:00:12:34:56-__kernel__")
+	req = httptest.NewRequest("GET", "/_/grub/52:54:00:12:34:56/file/"+strings.ReplaceAll(signedID, "~", "%7E"), nil)
+	recorder = httptest.NewRecorder()
+	handler.ServeHTTP(recorder, req)
+	assert.Equal(http.StatusOK, recorder.Code)
+	assert.Equal("some-text\n", recorder.Body.String())
+
+	req = httptest.NewRequest("GET", "/_/grub/52:54:00:12:34:56/file/52:54:00:12:34:56-__kernel__", nil)
+	recorder = httptest.NewRecorder()
+	handler.ServeHTTP(recorder, req)
+	assert.Equal(http.StatusForbidden, recorder.Code)
+
+	req = httptest.NewRequest("GET", "/_/grub/52:54:00:65:43:21/grub.cfg", nil)
+	recorder = httptest.NewRecorder()
+	handler.ServeHTTP(recorder, req)
+	assert.Equal(http.StatusNotFound, recorder.Code)
+}
+
+func TestHTTPBindsGrubConfigToLease(t *testing.T) {
+	assert := assert.New(t)
+
+	leases := pxeserver.NewLeases()
+	logs := []string{}
+	handler := newTestHTTPHandler(assert, leases, &logs)
+	handler.Grub = newTestGrub(assert, handler)
+
+	req := httptest.NewRequest("GET", "/_/grub/52:54:00:12:34:56/grub.cfg", nil)
+	req.RemoteAddr = "10.0.0.20:1234"
+	recorder := httptest.NewRecorder()
+	handler.ServeHTTP(recorder, req)
+	assert.Equal(http.StatusForbidden, recorder.Code)
+
+	leases.Set("52:54:00:12:34:56", net.ParseIP("10.0.0.20"))
+	recorder = httptest.NewRecorder()
+	handler.ServeHTTP(recorder, req)
+	assert.Equal(http.StatusOK, recorder.Code)
+}
+
+func TestHTTPBootURLForGrub(t *testing.T) {
+	assert := assert.New(t)
+
+	logs := []string{}
+	httpBoot := newTestHTTPBootConfiguration(assert)
+	httpBoot.Grub = newTestGrub(assert, newTestHTTPHandler(assert, nil, &logs))
+
+	proxy := pxeserver.HTTPBootProxy{HTTPBoot: httpBoot}
+	offer, err := proxy.Respond(httpBootDiscover("52:54:00:12:34:56", 0x10), nil)
+	assert.NoError(err)
+	assert.Equal("http://10.0.0.1:8080/_/grub/52:54:00:12:34:56/shimx64.efi", offer.BootFilename)
+}
+
+func TestErrorOnInvalidBootloader(t *testing.T) {
+	assert := assert.New(t)
+
+	input := strings.NewReader(`
+hosts:
+- mac: "52:54:00:00:00:01"
+  bootloader: grub
+`)
+	_, err := pxeserver.LoadConfig(input)
+	assert.NotNil(err)
+	assert.Contains(err.Error(), "server.grub")
+
+	input = strings.NewReader(`
+hosts:
+- mac: "52:54:00:00:00:01"
+  bootloader: syslinux
+`)
+	_, err = pxeserver.LoadConfig(input)
+	assert.NotNil(err)
+	assert.Contains(err.Error(), "bootloader")
+
+	input = strings.NewReader(`
+server:
+  grub:
+    shim: /boot/efi/shimx64.efi
+    grub: /boot/efi/grubx64.efi
+hosts:
+- mac: "52:54:00:00:00:01"
+  bootloader: grub
+- mac: "52:54:00:00:00:02"
+`)
+	cfg, err := pxeserver.LoadConfig(input)
+	assert.NoError(err)
+	assert.Equal([]string{"52:54:00:00:00:01"}, cfg.GrubHosts())
+}
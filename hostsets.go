@@ -0,0 +1,175 @@
+package pxeserver
+
+import (
+	"bytes"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"text/template"
+
+	"github.com/ghodss/yaml"
+)
+
+// HostSet generates a host from Host for each index from Start, either
+// Count of them or one for each row of Inventory. Host's name, mac, macs,
+// ip, hostname, subnet, serial and smbios are templates rendered with
+// .index and the row's columns in .row, e.g.
+// "worker-{{ .index | printf \"%02d\" }}". Each row's columns are also
+// added to the host's vars.
+type HostSet struct {
+	Count int
+	// Start is the index of the first host, defaults to 1
+	Start int
+	// Inventory is a CSV file with a header row, or a YAML or JSON list of
+	// maps
+	Inventory string
+	Host      Host
+}
+
+var hostSetFuncs = template.FuncMap{
+	"add": func(a, b int) int { return a + b },
+}
+
+// expandHostSets returns the hosts generated by sets, which are validated
+// along with the rest of the config's hosts.
+func expandHostSets(sets []HostSet) ([]Host, error) {
+	hosts := []Host{}
+	for i, set := range sets {
+		rows, err := set.rows()
+		if err != nil {
+			return nil, fmt.Errorf("host set %d %s", i, err)
+		}
+		// each host decodes its own copy so hosts don't share vars
+		hostJSON, err := json.Marshal(set.Host)
+		if err != nil {
+			return nil, err
+		}
+		start := set.Start
+		if start == 0 {
+			start = 1
+		}
+		for n, row := range rows {
+			var host Host
+			if err := json.Unmarshal(hostJSON, &host); err != nil {
+				return nil, err
+			}
+			if err := renderHostSetFields(&host, start+n, row); err != nil {
+				return nil, fmt.Errorf("host set %d has invalid host %d: %s", i, start+n, err)
+			}
+			if len(row) > 0 && host.Vars == nil {
+				host.Vars = make(map[string]interface{})
+			}
+			for k, v := range row {
+				host.Vars[k] = v
+			}
+			hosts = append(hosts, host)
+		}
+	}
+	return hosts, nil
+}
+
+func (s HostSet) rows() ([]map[string]interface{}, error) {
+	if s.Count < 0 {
+		return nil, fmt.Errorf("has invalid count %d", s.Count)
+	}
+	if s.Inventory != "" && s.Count > 0 {
+		return nil, fmt.Errorf("can't have both a 'count' and an 'inventory'")
+	}
+	if s.Inventory != "" {
+		return loadInventory(s.Inventory)
+	}
+	if s.Count == 0 {
+		return nil, fmt.Errorf("is missing a 'count' or 'inventory'")
+	}
+	rows := make([]map[string]interface{}, s.Count)
+	for i := range rows {
+		rows[i] = map[string]interface{}{}
+	}
+	return rows, nil
+}
+
+func loadInventory(inventoryPath string) ([]map[string]interface{}, error) {
+	contents, err := ioutil.ReadFile(inventoryPath)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, fmt.Errorf("has missing inventory '%s'", inventoryPath)
+		}
+		return nil, err
+	}
+	if strings.ToLower(filepath.Ext(inventoryPath)) != ".csv" {
+		rows := []map[string]interface{}{}
+		if err := yaml.Unmarshal(contents, &rows); err != nil {
+			return nil, fmt.Errorf("has inventory '%s' which is not a YAML/JSON list of maps: %s", inventoryPath, err)
+		}
+		return rows, nil
+	}
+
+	records, err := csv.NewReader(bytes.NewReader(contents)).ReadAll()
+	if err != nil {
+		return nil, fmt.Errorf("has invalid CSV inventory '%s': %s", inventoryPath, err)
+	}
+	if len(records) == 0 {
+		return nil, fmt.Errorf("has CSV inventory '%s' which is missing a header row", inventoryPath)
+	}
+	header := records[0]
+	rows := make([]map[string]interface{}, 0, len(records)-1)
+	for _, record := range records[1:] {
+		row := make(map[string]interface{}, len(header))
+		for i, column := range header {
+			row[strings.TrimSpace(column)] = record[i]
+		}
+		rows = append(rows, row)
+	}
+	return rows, nil
+}
+
+// renderHostSetFields renders the host's templated fields, leaving out
+// macs which render empty, e.g. from a row without a second NIC.
+func renderHostSetFields(host *Host, index int, row map[string]interface{}) error {
+	data := map[string]interface{}{
+		"index": index,
+		"row":   row,
+	}
+	fields := []*string{
+		&host.Name,
+		&host.Mac,
+		&host.IP,
+		&host.Hostname,
+		&host.Subnet,
+		&host.Serial,
+		&host.SMBIOS.UUID,
+		&host.SMBIOS.Serial,
+		&host.SMBIOS.Asset,
+		&host.SMBIOS.Product,
+	}
+	for i := range host.Macs {
+		fields = append(fields, &host.Macs[i])
+	}
+	for _, field := range fields {
+		tmpl, err := template.New("host_set").
+			Funcs(hostSetFuncs).
+			Option("missingkey=error").
+			Parse(*field)
+		if err != nil {
+			return err
+		}
+		var rendered bytes.Buffer
+		if err := tmpl.Execute(&rendered, data); err != nil {
+			return err
+		}
+		*field = strings.TrimSpace(rendered.String())
+	}
+
+	macs := []string{}
+	for _, mac := range host.Macs {
+		if mac != "" {
+			macs = append(macs, mac)
+		}
+	}
+	host.Macs = macs
+	return nil
+}
@@ -0,0 +1,110 @@
+package pxeserver_test
+
+import (
+	"fmt"
+	"net"
+	"path"
+	"strings"
+	"testing"
+
+	"github.com/ljfranklin/pxeserver"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestHostSetFromCount(t *testing.T) {
+	assert := assert.New(t)
+
+	cfg, err := pxeserver.LoadConfig(strings.NewReader(`
+host_sets:
+- count: 3
+  host:
+    name: 'worker-{{ .index | printf "%02d" }}'
+    mac: '52:54:00:00:00:{{ .index | printf "%02x" }}'
+    ip: '10.0.0.{{ add 100 .index }}'
+    kernel:
+      path: /srv/vmlinuz
+    vars:
+      role: worker
+    files:
+    - id: cloud-config
+      path: /srv/cloud-config.yaml
+      template: true
+`))
+	assert.NoError(err)
+
+	assert.Equal([]string{"worker-01", "worker-02", "worker-03"}, cfg.HostNames())
+	assert.Equal([]string{"52:54:00:00:00:03"}, cfg.HostMACs()["worker-03"])
+	assert.Equal(net.ParseIP("10.0.0.103").To4(), cfg.DHCPReservations()["52:54:00:00:00:03"].IP)
+	assert.Equal("worker-02-__kernel__", cfg.Pixiecore()["52:54:00:00:00:02"].Kernel)
+
+	vars, err := cfg.VarsForHost("worker-01")
+	assert.NoError(err)
+	assert.Equal("worker", vars["role"])
+	ids := []string{}
+	for _, f := range cfg.Files() {
+		ids = append(ids, f.ID)
+	}
+	assert.Contains(ids, "worker-01-cloud-config")
+	assert.Contains(ids, "worker-03-cloud-config")
+}
+
+func TestHostSetFromInventory(t *testing.T) {
+	assert := assert.New(t)
+
+	cfg, err := pxeserver.LoadConfig(strings.NewReader(fmt.Sprintf(`
+host_sets:
+- inventory: %s
+  host:
+    name: '{{ .row.name }}'
+    mac: '{{ .row.mac }}'
+    ip: '{{ .row.ip }}'
+    hostname: '{{ .row.name }}.example.com'
+    vars:
+      rack: unknown
+      role: db
+- inventory: %s
+  start: 10
+  host:
+    name: 'storage-{{ .index }}'
+    mac: '{{ .row.mac }}'
+    macs: ['{{ .row.mac2 }}']
+`, path.Join(fixturesDir(), "hostsets", "inventory.csv"), path.Join(fixturesDir(), "hostsets", "inventory.yaml"))))
+	assert.NoError(err)
+
+	assert.Equal([]string{"db-1", "db-2", "storage-10", "storage-11"}, cfg.HostNames())
+	assert.Equal(pxeserver.DHCPReservation{
+		IP:       net.ParseIP("10.0.0.122").To4(),
+		Hostname: "db-2.example.com",
+	}, cfg.DHCPReservations()["52:54:00:00:01:02"])
+	vars, err := cfg.VarsForHost("db-2")
+	assert.NoError(err)
+	assert.Equal("r2", vars["rack"])
+	assert.Equal("db", vars["role"])
+	assert.Equal("db-2", vars["name"])
+
+	assert.Equal([]string{"52:54:00:00:02:01", "52:54:00:00:02:81"}, cfg.HostMACs()["storage-10"])
+	assert.Equal([]string{"52:54:00:00:02:02"}, cfg.HostMACs()["storage-11"])
+	vars, err = cfg.VarsForHost("storage-11")
+	assert.NoError(err)
+	assert.Equal("/dev/nvme0n1", vars["disk"])
+}
+
+func TestErrorOnInvalidHostSets(t *testing.T) {
+	assert := assert.New(t)
+
+	inventory := path.Join(fixturesDir(), "hostsets", "inventory.csv")
+	for _, cfg := range []string{
+		"host_sets:\n- host:\n    mac: '52:54:00:00:00:01'\n",
+		"host_sets:\n- count: -1\n  host:\n    mac: '52:54:00:00:00:01'\n",
+		fmt.Sprintf("host_sets:\n- count: 2\n  inventory: %s\n  host:\n    mac: '{{ .row.mac }}'\n", inventory),
+		"host_sets:\n- inventory: /missing/inventory.csv\n  host:\n    mac: '{{ .row.mac }}'\n",
+		fmt.Sprintf("host_sets:\n- inventory: %s\n  host:\n    mac: '{{ .row.serial }}'\n", inventory),
+		"host_sets:\n- count: 2\n  host:\n    mac: '{{ .index'\n",
+		// generated hosts are validated like any other
+		"host_sets:\n- count: 2\n  host:\n    mac: '52:54:00:00:00:01'\n",
+		"hosts:\n- mac: '52:54:00:00:00:01'\nhost_sets:\n- count: 1\n  host:\n    mac: '52:54:00:00:00:{{ .index | printf \"%02x\" }}'\n",
+	} {
+		_, err := pxeserver.LoadConfig(strings.NewReader(cfg))
+		assert.NotNil(err, cfg)
+	}
+}
@@ -0,0 +1,513 @@
+package pxeserver
+
+import (
+	"bytes"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"text/template"
+
+	"go.universe.tf/netboot/pixiecore"
+)
+
+// HTTPHandler serves iPXE boot scripts and files from pxeserver itself
+// rather than Pixiecore, so requests can be checked against the client's
+// address. Pixiecore hands clients off to it via ChainBooter.
+type HTTPHandler struct {
+	// BaseURL is the scheme and host:port clients use to reach this handler,
+	// e.g. https://10.0.0.1:8443
+	BaseURL string
+	// URLs replaces BaseURL with the one for the client's subnet, if non-nil
+	URLs             *SubnetURLs
+	Booter           pixiecore.Booter
+	Files            Files
+	Tokens           *FileTokens
+	CmdlineTransform func(tpl string, mac string, funcs template.FuncMap) (string, error)
+	// Leases restricts boot scripts and GRUB configs, which hand out tokens
+	// for the host's files, to the IP the host leased, if non-nil
+	Leases *Leases
+	// BindFilesToLease also restricts each host's files to the IP it
+	// leased, requires Leases
+	BindFilesToLease bool
+	// InterfaceHosts maps local addresses to the only hosts served on them
+	InterfaceHosts map[string][]string
+	// Signer adds imgverify checks of the kernel and initrds to iPXE
+	// scripts, if non-nil
+	Signer *CodeSigner
+	// Firmware is served to UEFI HTTP Boot clients, which load iPXE
+	// before fetching their boot script
+	Firmware *IpxeFirmware
+	// Grub serves hosts booting with GRUB, if non-nil
+	Grub *Grub
+	// Identities resolves MACs to their host's name and boots machines
+	// which report a host's smbios to /_/identify as that host, if non-nil
+	Identities *Identities
+	Audit      *AuditLog
+	LogFunc    func(subsys, msg string)
+}
+
+func (h HTTPHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	switch r.URL.Path {
+	case "/_/ipxe":
+		h.handleIpxe(w, r)
+	case "/_/file":
+		h.handleFile(w, r)
+	case "/_/signature":
+		h.handleSignature(w, r)
+	case "/_/ipxe.efi":
+		h.handleFirmware(w, r)
+	case "/_/identify":
+		h.handleIdentify(w, r)
+	case "/boot":
+		h.handleBoot(w, r)
+	default:
+		if strings.HasPrefix(r.URL.Path, "/boot/") {
+			h.handleBoot(w, r)
+			return
+		}
+		if strings.HasPrefix(r.URL.Path, "/_/grub/") {
+			h.handleGrub(w, r)
+			return
+		}
+		http.NotFound(w, r)
+	}
+}
+
+func (h HTTPHandler) handleIpxe(w http.ResponseWriter, r *http.Request) {
+	mac, err := net.ParseMAC(r.URL.Query().Get("mac"))
+	if err != nil {
+		http.Error(w, "invalid MAC address", http.StatusBadRequest)
+		return
+	}
+	arch, err := strconv.Atoi(r.URL.Query().Get("arch"))
+	if err != nil {
+		http.Error(w, "invalid architecture", http.StatusBadRequest)
+		return
+	}
+	h.serveBootScript(w, r, mac, pixiecore.Architecture(arch))
+}
+
+// ipxeBuildArchs maps iPXE's ${buildarch} to the architectures Pixiecore
+// knows how to boot.
+var ipxeBuildArchs = map[string]pixiecore.Architecture{
+	"i386":   pixiecore.ArchIA32,
+	"x86_64": pixiecore.ArchX64,
+	"arm32":  pixiecore.ArchArm32,
+	"arm64":  pixiecore.ArchArm64,
+}
+
+// handleBoot serves the boot script at /boot/<mac>.ipxe or
+// /boot?mac=<mac>, for iPXE chained by a DHCP server other than pxeserver
+// or Pixiecore. The optional 'arch' is iPXE's ${buildarch} or a Pixiecore
+// architecture, and defaults to x86_64.
+func (h HTTPHandler) handleBoot(w http.ResponseWriter, r *http.Request) {
+	macParam := r.URL.Query().Get("mac")
+	if r.URL.Path != "/boot" {
+		name := strings.TrimPrefix(r.URL.Path, "/boot/")
+		if !strings.HasSuffix(name, ".ipxe") {
+			http.NotFound(w, r)
+			return
+		}
+		macParam = strings.TrimSuffix(name, ".ipxe")
+	}
+	mac, err := net.ParseMAC(macParam)
+	if err != nil {
+		http.Error(w, "invalid MAC address", http.StatusBadRequest)
+		return
+	}
+	arch := pixiecore.ArchX64
+	if archParam := r.URL.Query().Get("arch"); archParam != "" {
+		var ok bool
+		arch, ok = ipxeBuildArchs[archParam]
+		if !ok {
+			n, err := strconv.Atoi(archParam)
+			if err != nil {
+				http.Error(w, "invalid architecture", http.StatusBadRequest)
+				return
+			}
+			arch = pixiecore.Architecture(n)
+		}
+	}
+	h.serveBootScript(w, r, mac, arch)
+}
+
+// handleIdentify boots the host whose smbios matches the identity iPXE
+// reports, sent by IdentityBooter to machines booting from an unknown MAC.
+func (h HTTPHandler) handleIdentify(w http.ResponseWriter, r *http.Request) {
+	if h.Identities == nil {
+		http.NotFound(w, r)
+		return
+	}
+	query := r.URL.Query()
+	mac, err := net.ParseMAC(query.Get("mac"))
+	if err != nil {
+		http.Error(w, "invalid MAC address", http.StatusBadRequest)
+		return
+	}
+	arch, err := strconv.Atoi(query.Get("arch"))
+	if err != nil {
+		http.Error(w, "invalid architecture", http.StatusBadRequest)
+		return
+	}
+	reported := SMBIOS{
+		UUID:    query.Get("uuid"),
+		Serial:  query.Get("serial"),
+		Asset:   query.Get("asset"),
+		Product: query.Get("product"),
+	}
+	host, ok := h.Identities.Identify(mac.String(), reported)
+	if !ok {
+		h.log("HTTP", "No host matches %s (from %s) with uuid '%s', serial '%s', asset '%s', product '%s'", mac, r.RemoteAddr, reported.UUID, reported.Serial, reported.Asset, reported.Product)
+		http.Error(w, "no matching host", http.StatusNotFound)
+		return
+	}
+	h.log("HTTP", "Identified %s (from %s) as host '%s'", mac, r.RemoteAddr, host)
+	h.serveBootScript(w, r, mac, pixiecore.Architecture(arch))
+}
+
+// serveBootScript boots the host identified as mac.
+func (h HTTPHandler) serveBootScript(w http.ResponseWriter, r *http.Request, mac net.HardwareAddr, arch pixiecore.Architecture) {
+	if bootMAC := h.Identities.BootMAC(mac.String()); bootMAC != mac.String() {
+		hostMAC, err := net.ParseMAC(bootMAC)
+		if err != nil {
+			http.Error(w, "invalid MAC address", http.StatusInternalServerError)
+			return
+		}
+		mac = hostMAC
+	}
+	if err := h.checkInterface(mac.String(), r); err != nil {
+		h.log("Security", "Denied boot script for %s to %s: %s", mac, r.RemoteAddr, err)
+		http.Error(w, "forbidden", http.StatusForbidden)
+		return
+	}
+	// the script signs the host's file URLs and may hold rendered secrets
+	if h.Leases != nil {
+		if err := h.checkLease(h.Identities.Resolve(mac.String()), r.RemoteAddr); err != nil {
+			h.log("Security", "Denied boot script for %s to %s: %s", mac, r.RemoteAddr, err)
+			http.Error(w, "forbidden", http.StatusForbidden)
+			return
+		}
+	}
+
+	h.useClientBaseURL(r)
+
+	spec, err := h.Booter.BootSpec(pixiecore.Machine{
+		MAC:  mac,
+		Arch: arch,
+	})
+	if err != nil || spec == nil {
+		h.log("HTTP", "Couldn't get a bootspec for %s (from %s): %v", mac, r.RemoteAddr, err)
+		http.Error(w, "couldn't get a bootspec", http.StatusNotFound)
+		return
+	}
+
+	script, err := h.ipxeScript(mac.String(), spec)
+	if err != nil {
+		h.log("HTTP", "Failed to assemble ipxe script for %s (from %s): %s", mac, r.RemoteAddr, err)
+		http.Error(w, "couldn't get a boot script", http.StatusInternalServerError)
+		return
+	}
+
+	h.log("HTTP", "Sending ipxe boot script to %s", r.RemoteAddr)
+	w.Header().Set("Content-Type", "text/plain")
+	w.Write(script)
+}
+
+func (h HTTPHandler) handleFirmware(w http.ResponseWriter, r *http.Request) {
+	arch, err := strconv.Atoi(r.URL.Query().Get("arch"))
+	if err != nil {
+		http.Error(w, "invalid architecture", http.StatusBadRequest)
+		return
+	}
+	fwtype, ok := httpBootFirmware[pixiecore.Architecture(arch)]
+	if !ok || h.Firmware == nil {
+		http.Error(w, "no iPXE firmware for architecture", http.StatusNotFound)
+		return
+	}
+	// the MAC is optional, hosts without one get server.ipxe or the
+	// builtin firmware
+	mac := ""
+	if r.URL.Query().Get("mac") != "" {
+		hwAddr, err := net.ParseMAC(r.URL.Query().Get("mac"))
+		if err != nil {
+			http.Error(w, "invalid MAC address", http.StatusBadRequest)
+			return
+		}
+		mac = h.Identities.Resolve(hwAddr.String())
+	}
+	firmware, size, err := h.Firmware.Open(mac, fwtype, r.RemoteAddr)
+	if err != nil {
+		h.log("HTTP", "No iPXE firmware for %s (from %s): %s", mac, r.RemoteAddr, err)
+		http.Error(w, "no iPXE firmware for architecture", http.StatusNotFound)
+		return
+	}
+	defer firmware.Close()
+
+	h.log("HTTP", "Sending iPXE firmware to %s", r.RemoteAddr)
+	w.Header().Set("Content-Type", "application/efi")
+	w.Header().Set("Content-Length", strconv.FormatInt(size, 10))
+	io.Copy(w, firmware)
+}
+
+// handleGrub serves hosts booting with GRUB over UEFI HTTP Boot, with the
+// same paths below /_/grub/ as over TFTP.
+func (h HTTPHandler) handleGrub(w http.ResponseWriter, r *http.Request) {
+	if h.Grub == nil {
+		http.NotFound(w, r)
+		return
+	}
+	grubPath := strings.TrimPrefix(r.URL.EscapedPath(), "/_/grub/")
+	elems := strings.Split(grubPath, "/")
+	if len(elems) == 3 && elems[1] == "file" {
+		id, err := url.PathUnescape(elems[2])
+		if err != nil {
+			http.Error(w, "invalid filename", http.StatusBadRequest)
+			return
+		}
+		query := r.URL.Query()
+		query.Set("name", id)
+		r.URL.RawQuery = query.Encode()
+		h.handleFile(w, r)
+		return
+	}
+	if mac, err := net.ParseMAC(elems[0]); err == nil {
+		if err := h.checkInterface(mac.String(), r); err != nil {
+			h.log("Security", "Denied GRUB file for %s to %s: %s", mac, r.RemoteAddr, err)
+			http.Error(w, "forbidden", http.StatusForbidden)
+			return
+		}
+		if h.Leases != nil {
+			if err := h.checkLease(h.Identities.Resolve(mac.String()), r.RemoteAddr); err != nil {
+				h.log("Security", "Denied GRUB file for %s to %s: %s", mac, r.RemoteAddr, err)
+				http.Error(w, "forbidden", http.StatusForbidden)
+				return
+			}
+		}
+	}
+	h.useClientBaseURL(r)
+
+	f, size, ok, err := h.Grub.Open(grubPath, h.fileURL)
+	if !ok {
+		http.NotFound(w, r)
+		return
+	}
+	if err != nil {
+		h.log("HTTP", "Error getting GRUB file %q (from %s): %s", grubPath, r.RemoteAddr, err)
+		http.Error(w, "couldn't get file", http.StatusInternalServerError)
+		return
+	}
+	defer f.Close()
+	w.Header().Set("Content-Length", strconv.FormatInt(size, 10))
+	if _, err := io.Copy(w, f); err != nil {
+		h.log("HTTP", "Copy of GRUB file %q to %s failed: %s", grubPath, r.RemoteAddr, err)
+		return
+	}
+	h.log("HTTP", "Sent GRUB file %q to %s", grubPath, r.RemoteAddr)
+}
+
+func (h HTTPHandler) handleFile(w http.ResponseWriter, r *http.Request) {
+	id, file, ok := h.authorizeFile(w, r)
+	if !ok {
+		return
+	}
+
+	f, size, err := h.Files.Read(id)
+	if err != nil {
+		h.log("HTTP", "Error getting file %q (from %s): %s", id, r.RemoteAddr, err)
+		http.Error(w, "couldn't get file", http.StatusInternalServerError)
+		return
+	}
+	defer f.Close()
+	// like TFTP, files aren't served unless serving them was recorded
+	if err := h.Audit.Record(AuditEvent{
+		Event:  AuditFileServe,
+		Host:   file.Host,
+		FileID: id,
+		Client: r.RemoteAddr,
+	}); err != nil {
+		h.log("Audit", "Failed to record serving %q to %s: %s", id, r.RemoteAddr, err)
+		http.Error(w, "couldn't get file", http.StatusInternalServerError)
+		return
+	}
+	if size >= 0 {
+		w.Header().Set("Content-Length", strconv.FormatInt(size, 10))
+	}
+	if _, err = io.Copy(w, f); err != nil {
+		h.log("HTTP", "Copy of %q to %s failed: %s", id, r.RemoteAddr, err)
+		return
+	}
+	h.log("HTTP", "Sent file %q to %s", id, r.RemoteAddr)
+}
+
+func (h HTTPHandler) handleSignature(w http.ResponseWriter, r *http.Request) {
+	if h.Signer == nil {
+		http.NotFound(w, r)
+		return
+	}
+	id, _, ok := h.authorizeFile(w, r)
+	if !ok {
+		return
+	}
+
+	checksum, err := h.Files.SHA256(id)
+	if err != nil {
+		h.log("HTTP", "Error getting file %q (from %s): %s", id, r.RemoteAddr, err)
+		http.Error(w, "couldn't get file", http.StatusInternalServerError)
+		return
+	}
+	digest, err := hex.DecodeString(checksum)
+	if err != nil {
+		http.Error(w, "couldn't get file", http.StatusInternalServerError)
+		return
+	}
+	signature, err := h.Signer.Sign(digest)
+	if err != nil {
+		h.log("HTTP", "Error signing file %q (from %s): %s", id, r.RemoteAddr, err)
+		http.Error(w, "couldn't sign file", http.StatusInternalServerError)
+		return
+	}
+
+	h.log("HTTP", "Sent signature for file %q to %s", id, r.RemoteAddr)
+	w.Header().Set("Content-Type", "application/pkcs7-signature")
+	w.Header().Set("Content-Length", strconv.Itoa(len(signature)))
+	w.Write(signature)
+}
+
+// authorizeFile checks the access token and lease for the requested file,
+// writing an error response if the client may not read it.
+func (h HTTPHandler) authorizeFile(w http.ResponseWriter, r *http.Request) (string, File, bool) {
+	name := r.URL.Query().Get("name")
+	if name == "" {
+		http.Error(w, "missing filename", http.StatusBadRequest)
+		return "", File{}, false
+	}
+
+	id := name
+	if h.Tokens != nil {
+		var err error
+		id, err = h.Tokens.Verify(name)
+		if err != nil {
+			h.log("Security", "Denied file request from %s: %s", r.RemoteAddr, err)
+			http.Error(w, "forbidden", http.StatusForbidden)
+			return "", File{}, false
+		}
+	}
+
+	file, ok := h.Files.Lookup(id)
+	if !ok {
+		http.NotFound(w, r)
+		return "", File{}, false
+	}
+	if err := h.checkInterface(file.Host, r); err != nil {
+		h.log("Security", "Denied file '%s' to %s: %s", id, r.RemoteAddr, err)
+		http.Error(w, "forbidden", http.StatusForbidden)
+		return "", File{}, false
+	}
+	if h.BindFilesToLease && !file.Public {
+		if err := h.checkLease(file.Host, r.RemoteAddr); err != nil {
+			h.log("Security", "Denied file '%s' to %s: %s", id, r.RemoteAddr, err)
+			http.Error(w, "forbidden", http.StatusForbidden)
+			return "", File{}, false
+		}
+	}
+	return id, file, true
+}
+
+// checkInterface rejects hosts, by MAC or name, not listed for the
+// interface the request arrived on, if that interface restricts its hosts.
+func (h HTTPHandler) checkInterface(host string, r *http.Request) error {
+	localAddr, ok := r.Context().Value(http.LocalAddrContextKey).(net.Addr)
+	if !ok || len(h.InterfaceHosts) == 0 {
+		return nil
+	}
+	localHost, _, err := net.SplitHostPort(localAddr.String())
+	if err != nil {
+		return err
+	}
+	hosts, ok := h.InterfaceHosts[net.ParseIP(localHost).String()]
+	if !ok {
+		return nil
+	}
+	for _, allowed := range hosts {
+		for _, mac := range h.Identities.MACs(host) {
+			if allowed == mac {
+				return nil
+			}
+		}
+	}
+	return fmt.Errorf("host '%s' is not served on %s", host, localHost)
+}
+
+func (h HTTPHandler) checkLease(name string, remoteAddr string) error {
+	clientHost, _, err := net.SplitHostPort(remoteAddr)
+	if err != nil {
+		return err
+	}
+	return h.Leases.CheckHost(name, h.Identities, net.ParseIP(clientHost))
+}
+
+// useClientBaseURL links files with the base URL for the client's subnet.
+func (h *HTTPHandler) useClientBaseURL(r *http.Request) {
+	if h.URLs == nil {
+		return
+	}
+	if clientHost, _, err := net.SplitHostPort(r.RemoteAddr); err == nil {
+		h.BaseURL = h.URLs.ForIP(net.ParseIP(clientHost))
+	}
+}
+
+func (h HTTPHandler) fileURL(id string) string {
+	return fmt.Sprintf("%s/_/file?name=%s", h.BaseURL, url.QueryEscape(id))
+}
+
+func (h HTTPHandler) signatureURL(id string) string {
+	return fmt.Sprintf("%s/_/signature?name=%s", h.BaseURL, url.QueryEscape(id))
+}
+
+func (h HTTPHandler) ipxeScript(mac string, spec *pixiecore.Spec) ([]byte, error) {
+	if spec.IpxeScript != "" {
+		return []byte(spec.IpxeScript), nil
+	}
+	if spec.Kernel == "" {
+		return nil, errors.New("spec is missing Kernel")
+	}
+
+	var b bytes.Buffer
+	b.WriteString("#!ipxe\n")
+	fmt.Fprintf(&b, "kernel --name kernel %s\n", h.fileURL(string(spec.Kernel)))
+	if h.Signer != nil {
+		fmt.Fprintf(&b, "imgverify kernel %s\n", h.signatureURL(string(spec.Kernel)))
+	}
+	for i, initrd := range spec.Initrd {
+		fmt.Fprintf(&b, "initrd --name initrd%d %s\n", i, h.fileURL(string(initrd)))
+		if h.Signer != nil {
+			fmt.Fprintf(&b, "imgverify initrd%d %s\n", i, h.signatureURL(string(initrd)))
+		}
+	}
+
+	b.WriteString("boot kernel ")
+	for i := range spec.Initrd {
+		fmt.Fprintf(&b, "initrd=initrd%d ", i)
+	}
+	cmdline, err := h.CmdlineTransform(spec.Cmdline, mac, template.FuncMap{"ID": h.fileURL})
+	if err != nil {
+		return nil, fmt.Errorf("expanding cmdline %q: %s", spec.Cmdline, err)
+	}
+	b.WriteString(cmdline)
+	b.WriteByte('\n')
+
+	return b.Bytes(), nil
+}
+
+func (h HTTPHandler) log(subsys string, format string, args ...interface{}) {
+	if h.LogFunc == nil {
+		return
+	}
+	h.LogFunc(subsys, fmt.Sprintf(format, args...))
+}
@@ -0,0 +1,431 @@
+package pxeserver_test
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path"
+	"testing"
+	"text/template"
+	"time"
+
+	"github.com/ljfranklin/pxeserver"
+	"github.com/stretchr/testify/assert"
+	"go.universe.tf/netboot/pixiecore"
+)
+
+func newTestHTTPHandler(assert *assert.Assertions, leases *pxeserver.Leases, logs *[]string) pxeserver.HTTPHandler {
+	fixturePath := path.Join(fixturesDir(), "files", "simple.txt")
+	mockRenderer := new(MockRenderer)
+	mockRenderer.On("RenderPath", fixturePath).Return(fixturePath, nil)
+	files, err := pxeserver.LoadFiles([]pxeserver.File{
+		{
+			ID:   "52:54:00:12:34:56-__kernel__",
+			Host: "52:54:00:12:34:56",
+			Path: fixturePath,
+		},
+		{
+			ID:   "52:54:00:12:34:56-some-image",
+			Host: "52:54:00:12:34:56",
+			Path: fixturePath,
+		},
+		{
+			ID:     "52:54:00:12:34:56-some-public-image",
+			Host:   "52:54:00:12:34:56",
+			Path:   fixturePath,
+			Public: true,
+		},
+	}, mockRenderer)
+	assert.NoError(err)
+
+	tokens := pxeserver.NewFileTokens([]byte("some-key"), time.Hour)
+	booter, err := pxeserver.ConfigBooter(pxeserver.Pixiecore{
+		"52:54:00:12:34:56": {
+			Kernel:  "52:54:00:12:34:56-__kernel__",
+			Cmdline: "some_arg={{ file_url \"some-image\" }}",
+		},
+	}, files, tokens, nil)
+	assert.NoError(err)
+
+	return pxeserver.HTTPHandler{
+		BaseURL: "http://10.0.0.1:8080",
+		Booter:  booter,
+		Files:   files,
+		Tokens:  tokens,
+		CmdlineTransform: func(tpl string, mac string, funcs template.FuncMap) (string, error) {
+			return pxeserver.Renderer{FileTokens: tokens}.RenderCmdline(pxeserver.RenderCmdlineArgs{
+				Template:   tpl,
+				Host:       mac,
+				Vars:       map[string]interface{}{},
+				ExtraFuncs: funcs,
+			})
+		},
+		Leases:           leases,
+		BindFilesToLease: leases != nil,
+		LogFunc: func(subsys, msg string) {
+			*logs = append(*logs, fmt.Sprintf("[%s] %s", subsys, msg))
+		},
+	}
+}
+
+func fileRequest(handler pxeserver.HTTPHandler, id string, remoteAddr string) *httptest.ResponseRecorder {
+	signedID := handler.Tokens.Sign(id)
+	req := httptest.NewRequest("GET", fmt.Sprintf("/_/file?name=%s", url.QueryEscape(signedID)), nil)
+	req.RemoteAddr = remoteAddr
+	recorder := httptest.NewRecorder()
+	handler.ServeHTTP(recorder, req)
+	return recorder
+}
+
+func TestHTTPServesIpxeScript(t *testing.T) {
+	assert := assert.New(t)
+
+	logs := []string{}
+	handler := newTestHTTPHandler(assert, nil, &logs)
+
+	req := httptest.NewRequest("GET", "/_/ipxe?mac=52:54:00:12:34:56&arch=1", nil)
+	recorder := httptest.NewRecorder()
+	handler.ServeHTTP(recorder, req)
+
+	assert.Equal(http.StatusOK, recorder.Code)
+	script := recorder.Body.String()
+	assert.Regexp("^#!ipxe\n", script)
+	assert.Contains(script, "kernel --name kernel http://10.0.0.1:8080/_/file?name=52%3A54%3A00%3A12%3A34%3A56-__kernel__~")
+	assert.Contains(script, "boot kernel some_arg=http://10.0.0.1:8080/_/file?name=52%3A54%3A00%3A12%3A34%3A56-some-image~")
+}
+
+func TestHTTPServesBootScriptForChainedIpxe(t *testing.T) {
+	assert := assert.New(t)
+
+	logs := []string{}
+	handler := newTestHTTPHandler(assert, nil, &logs)
+
+	for _, p := range []string{
+		"/boot/52:54:00:12:34:56.ipxe",
+		"/boot/52:54:00:12:34:56.ipxe?arch=arm64",
+		"/boot?mac=52:54:00:12:34:56&arch=x86_64",
+		"/boot?mac=52-54-00-12-34-56&arch=1",
+	} {
+		req := httptest.NewRequest("GET", p, nil)
+		recorder := httptest.NewRecorder()
+		handler.ServeHTTP(recorder, req)
+
+		assert.Equal(http.StatusOK, recorder.Code, p)
+		script := recorder.Body.String()
+		assert.Regexp("^#!ipxe\n", script, p)
+		assert.Contains(script, "kernel --name kernel http://10.0.0.1:8080/_/file?name=52%3A54%3A00%3A12%3A34%3A56-__kernel__~", p)
+	}
+
+	for p, code := range map[string]int{
+		"/boot/52:54:00:65:43:21.ipxe":            http.StatusNotFound,
+		"/boot/52:54:00:12:34:56":                 http.StatusNotFound,
+		"/boot/not-a-mac.ipxe":                    http.StatusBadRequest,
+		"/boot?mac=52:54:00:12:34:56&arch=mips64": http.StatusBadRequest,
+	} {
+		req := httptest.NewRequest("GET", p, nil)
+		recorder := httptest.NewRecorder()
+		handler.ServeHTTP(recorder, req)
+		assert.Equal(code, recorder.Code, p)
+	}
+}
+
+func TestHTTPServesIpxeScriptOverHTTPS(t *testing.T) {
+	assert := assert.New(t)
+
+	logs := []string{}
+	handler := newTestHTTPHandler(assert, nil, &logs)
+	handler.BaseURL = "https://10.0.0.1:8443"
+
+	req := httptest.NewRequest("GET", "/_/ipxe?mac=52:54:00:12:34:56&arch=1", nil)
+	recorder := httptest.NewRecorder()
+	handler.ServeHTTP(recorder, req)
+
+	assert.Equal(http.StatusOK, recorder.Code)
+	script := recorder.Body.String()
+	assert.Contains(script, "kernel --name kernel https://10.0.0.1:8443/_/file?name=")
+	assert.Contains(script, "boot kernel some_arg=https://10.0.0.1:8443/_/file?name=")
+	assert.NotContains(script, "http://")
+}
+
+func TestHTTPServesIpxeScriptWithImgverify(t *testing.T) {
+	assert := assert.New(t)
+
+	logs := []string{}
+	handler := newTestHTTPHandler(assert, nil, &logs)
+	signer, cleanup := testCodeSigner(assert)
+	defer cleanup()
+	handler.Signer = signer
+
+	req := httptest.NewRequest("GET", "/_/ipxe?mac=52:54:00:12:34:56&arch=1", nil)
+	recorder := httptest.NewRecorder()
+	handler.ServeHTTP(recorder, req)
+
+	assert.Equal(http.StatusOK, recorder.Code)
+	assert.Regexp("kernel --name kernel http://10.0.0.1:8080/_/file\\?name=\\S+\nimgverify kernel http://10.0.0.1:8080/_/signature\\?name=52%3A54%3A00%3A12%3A34%3A56-__kernel__~", recorder.Body.String())
+}
+
+func TestHTTPServesFileSignature(t *testing.T) {
+	assert := assert.New(t)
+
+	logs := []string{}
+	handler := newTestHTTPHandler(assert, nil, &logs)
+	signer, cleanup := testCodeSigner(assert)
+	defer cleanup()
+	handler.Signer = signer
+
+	signedID := handler.Tokens.Sign("52:54:00:12:34:56-some-image")
+	req := httptest.NewRequest("GET", fmt.Sprintf("/_/signature?name=%s", url.QueryEscape(signedID)), nil)
+	recorder := httptest.NewRecorder()
+	handler.ServeHTTP(recorder, req)
+	assert.Equal(http.StatusOK, recorder.Code)
+	assert.Equal("application/pkcs7-signature", recorder.Header().Get("Content-Type"))
+	assert.NotEmpty(recorder.Body.Bytes())
+
+	req = httptest.NewRequest("GET", "/_/signature?name=52%3A54%3A00%3A12%3A34%3A56-some-image", nil)
+	recorder = httptest.NewRecorder()
+	handler.ServeHTTP(recorder, req)
+	assert.Equal(http.StatusForbidden, recorder.Code)
+}
+
+func TestHTTPServesFileWithValidToken(t *testing.T) {
+	assert := assert.New(t)
+
+	logs := []string{}
+	handler := newTestHTTPHandler(assert, nil, &logs)
+
+	recorder := fileRequest(handler, "52:54:00:12:34:56-some-image", "10.0.0.20:1234")
+	assert.Equal(http.StatusOK, recorder.Code)
+	assert.Equal("some-text\n", recorder.Body.String())
+}
+
+func TestHTTPRecordsFileServeInAuditLog(t *testing.T) {
+	assert := assert.New(t)
+
+	tmpdir, err := ioutil.TempDir("", "pxeserver-audit")
+	assert.NoError(err)
+	defer os.RemoveAll(tmpdir)
+	logPath := path.Join(tmpdir, "audit.log")
+	audit, err := pxeserver.OpenAuditLog(logPath, 0, 0)
+	assert.NoError(err)
+
+	logs := []string{}
+	handler := newTestHTTPHandler(assert, nil, &logs)
+	handler.Audit = audit
+
+	recorder := fileRequest(handler, "52:54:00:12:34:56-some-image", "10.0.0.20:1234")
+	assert.Equal(http.StatusOK, recorder.Code)
+	assert.NoError(audit.Close())
+
+	events, err := pxeserver.QueryAuditLog(logPath, pxeserver.AuditFilter{})
+	assert.NoError(err)
+	assert.Len(events, 1)
+	assert.Equal(pxeserver.AuditFileServe, events[0].Event)
+	assert.Equal("52:54:00:12:34:56", events[0].Host)
+	assert.Equal("52:54:00:12:34:56-some-image", events[0].FileID)
+	assert.Equal("10.0.0.20:1234", events[0].Client)
+
+	// files aren't served without a record of it
+	recorder = fileRequest(handler, "52:54:00:12:34:56-some-image", "10.0.0.20:1234")
+	assert.Equal(http.StatusInternalServerError, recorder.Code)
+	assert.NotContains(recorder.Body.String(), "some-text")
+}
+
+func TestHTTPDeniesFileWithoutToken(t *testing.T) {
+	assert := assert.New(t)
+
+	logs := []string{}
+	handler := newTestHTTPHandler(assert, nil, &logs)
+
+	req := httptest.NewRequest("GET", "/_/file?name=52%3A54%3A00%3A12%3A34%3A56-some-image", nil)
+	recorder := httptest.NewRecorder()
+	handler.ServeHTTP(recorder, req)
+
+	assert.Equal(http.StatusForbidden, recorder.Code)
+	assert.Len(logs, 1)
+	assert.Contains(logs[0], "[Security]")
+}
+
+func TestHTTPBindsFilesToLease(t *testing.T) {
+	assert := assert.New(t)
+
+	leases := pxeserver.NewLeases()
+	leases.Set("52:54:00:12:34:56", net.ParseIP("10.0.0.20"))
+	logs := []string{}
+	handler := newTestHTTPHandler(assert, leases, &logs)
+
+	recorder := fileRequest(handler, "52:54:00:12:34:56-some-image", "10.0.0.20:1234")
+	assert.Equal(http.StatusOK, recorder.Code)
+
+	recorder = fileRequest(handler, "52:54:00:12:34:56-some-image", "10.0.0.99:1234")
+	assert.Equal(http.StatusForbidden, recorder.Code)
+	assert.Contains(logs[len(logs)-1], "[Security]")
+	assert.Contains(logs[len(logs)-1], "10.0.0.99")
+
+	recorder = fileRequest(handler, "52:54:00:12:34:56-some-public-image", "10.0.0.99:1234")
+	assert.Equal(http.StatusOK, recorder.Code)
+}
+
+func TestHTTPDeniesFilesWithoutLease(t *testing.T) {
+	assert := assert.New(t)
+
+	logs := []string{}
+	handler := newTestHTTPHandler(assert, pxeserver.NewLeases(), &logs)
+
+	recorder := fileRequest(handler, "52:54:00:12:34:56-some-image", "10.0.0.20:1234")
+	assert.Equal(http.StatusForbidden, recorder.Code)
+	assert.Contains(logs[len(logs)-1], "no DHCP lease")
+}
+
+func TestHTTPBindsBootScriptToLease(t *testing.T) {
+	assert := assert.New(t)
+
+	leases := pxeserver.NewLeases()
+	logs := []string{}
+	handler := newTestHTTPHandler(assert, leases, &logs)
+
+	for _, target := range []string{"/_/ipxe?mac=52:54:00:12:34:56&arch=1", "/boot/52:54:00:12:34:56.ipxe"} {
+		req := httptest.NewRequest("GET", target, nil)
+		req.RemoteAddr = "10.0.0.20:1234"
+		recorder := httptest.NewRecorder()
+		handler.ServeHTTP(recorder, req)
+		assert.Equal(http.StatusForbidden, recorder.Code)
+		assert.Contains(logs[len(logs)-1], "no DHCP lease")
+	}
+
+	leases.Set("52:54:00:12:34:56", net.ParseIP("10.0.0.20"))
+	req := httptest.NewRequest("GET", "/_/ipxe?mac=52:54:00:12:34:56&arch=1", nil)
+	req.RemoteAddr = "10.0.0.20:1234"
+	recorder := httptest.NewRecorder()
+	handler.ServeHTTP(recorder, req)
+	assert.Equal(http.StatusOK, recorder.Code)
+
+	req = httptest.NewRequest("GET", "/_/ipxe?mac=52:54:00:12:34:56&arch=1", nil)
+	req.RemoteAddr = "10.0.0.99:1234"
+	recorder = httptest.NewRecorder()
+	handler.ServeHTTP(recorder, req)
+	assert.Equal(http.StatusForbidden, recorder.Code)
+}
+
+func TestHTTPIssuesFileTokensOnlyToLeasedHost(t *testing.T) {
+	assert := assert.New(t)
+
+	leases := pxeserver.NewLeases()
+	leases.Set("52:54:00:12:34:56", net.ParseIP("10.0.0.20"))
+	logs := []string{}
+	handler := newTestHTTPHandler(assert, leases, &logs)
+	handler.BindFilesToLease = false
+
+	for _, target := range []string{"/_/ipxe?mac=52:54:00:12:34:56&arch=1", "/boot/52:54:00:12:34:56.ipxe"} {
+		req := httptest.NewRequest("GET", target, nil)
+		req.RemoteAddr = "10.0.0.99:1234"
+		recorder := httptest.NewRecorder()
+		handler.ServeHTTP(recorder, req)
+		assert.Equal(http.StatusForbidden, recorder.Code)
+		assert.NotContains(recorder.Body.String(), "52:54:00:12:34:56-some-image")
+		assert.Contains(logs[len(logs)-1], "[Security]")
+
+		req = httptest.NewRequest("GET", target, nil)
+		req.RemoteAddr = "10.0.0.20:1234"
+		recorder = httptest.NewRecorder()
+		handler.ServeHTTP(recorder, req)
+		assert.Equal(http.StatusOK, recorder.Code)
+		assert.Contains(recorder.Body.String(), "52%3A54%3A00%3A12%3A34%3A56-some-image")
+	}
+}
+
+func TestHTTPBindsFilesToIPv6Lease(t *testing.T) {
+	assert := assert.New(t)
+
+	leases := pxeserver.NewLeases()
+	leases.Set("52:54:00:12:34:56", net.ParseIP("10.0.0.20"))
+	leases.Set("52:54:00:12:34:56", net.ParseIP("2001:db8::100"))
+	logs := []string{}
+	handler := newTestHTTPHandler(assert, leases, &logs)
+
+	recorder := fileRequest(handler, "52:54:00:12:34:56-some-image", "[2001:db8::100]:1234")
+	assert.Equal(http.StatusOK, recorder.Code)
+
+	recorder = fileRequest(handler, "52:54:00:12:34:56-some-image", "10.0.0.20:1234")
+	assert.Equal(http.StatusOK, recorder.Code)
+
+	recorder = fileRequest(handler, "52:54:00:12:34:56-some-image", "[2001:db8::199]:1234")
+	assert.Equal(http.StatusForbidden, recorder.Code)
+}
+
+func TestHTTPServesIpxeFirmware(t *testing.T) {
+	assert := assert.New(t)
+
+	logs := []string{}
+	handler := newTestHTTPHandler(assert, nil, &logs)
+	handler.Firmware = pxeserver.NewIpxeFirmware(map[pixiecore.Firmware][]byte{
+		pixiecore.FirmwareEFI64: []byte("some-ipxe-efi"),
+	}, nil)
+
+	req := httptest.NewRequest("GET", fmt.Sprintf("/_/ipxe.efi?arch=%d", pixiecore.ArchX64), nil)
+	recorder := httptest.NewRecorder()
+	handler.ServeHTTP(recorder, req)
+	assert.Equal(http.StatusOK, recorder.Code)
+	assert.Equal("some-ipxe-efi", recorder.Body.String())
+
+	req = httptest.NewRequest("GET", fmt.Sprintf("/_/ipxe.efi?arch=%d", pixiecore.ArchArm64), nil)
+	recorder = httptest.NewRecorder()
+	handler.ServeHTTP(recorder, req)
+	assert.Equal(http.StatusNotFound, recorder.Code)
+}
+
+func TestHTTPServesIpxeScriptWithSubnetURLs(t *testing.T) {
+	assert := assert.New(t)
+
+	logs := []string{}
+	handler := newTestHTTPHandler(assert, nil, &logs)
+	urls, err := pxeserver.NewSubnetURLs(pxeserver.ServerSettings{
+		HTTPAddress: "10.0.0.1:8080",
+		DHCP: pxeserver.DHCPSettings{
+			Subnets: []pxeserver.DHCPSubnet{
+				{
+					CIDR:          "10.0.1.0/24",
+					ServerAddress: "192.168.0.10",
+				},
+			},
+		},
+	}, nil, nil)
+	assert.NoError(err)
+	handler.URLs = urls
+
+	req := httptest.NewRequest("GET", "/_/ipxe?mac=52:54:00:12:34:56&arch=1", nil)
+	req.RemoteAddr = "10.0.1.20:1234"
+	recorder := httptest.NewRecorder()
+	handler.ServeHTTP(recorder, req)
+
+	assert.Equal(http.StatusOK, recorder.Code)
+	assert.Contains(recorder.Body.String(), "kernel --name kernel http://192.168.0.10:8080/_/file?name=")
+}
+
+func TestHTTPRestrictsHostsByInterface(t *testing.T) {
+	assert := assert.New(t)
+
+	logs := []string{}
+	handler := newTestHTTPHandler(assert, nil, &logs)
+	handler.InterfaceHosts = map[string][]string{
+		"10.0.1.1": {"52:54:00:00:00:99"},
+	}
+
+	request := func(localAddr string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest("GET", fmt.Sprintf("/_/file?name=%s", url.QueryEscape(handler.Tokens.Sign("52:54:00:12:34:56-some-image"))), nil)
+		addr, err := net.ResolveTCPAddr("tcp", localAddr)
+		assert.NoError(err)
+		req = req.WithContext(context.WithValue(req.Context(), http.LocalAddrContextKey, addr))
+		recorder := httptest.NewRecorder()
+		handler.ServeHTTP(recorder, req)
+		return recorder
+	}
+
+	assert.Equal(http.StatusOK, request("10.0.0.1:80").Code)
+	assert.Equal(http.StatusForbidden, request("10.0.1.1:80").Code)
+	assert.Contains(logs[len(logs)-1], "not served on 10.0.1.1")
+}
@@ -0,0 +1,143 @@
+package pxeserver
+
+import (
+	"fmt"
+	"net"
+	"net/url"
+	"strings"
+
+	"go.universe.tf/netboot/dhcp4"
+	"go.universe.tf/netboot/pixiecore"
+)
+
+const (
+	// HTTPBootIpxe sends UEFI HTTP Boot clients iPXE, which then fetches
+	// the host's boot script as usual. This is the default.
+	HTTPBootIpxe = "ipxe"
+	// HTTPBootKernel sends UEFI HTTP Boot clients the host's kernel, which
+	// must be an EFI executable with its cmdline and initrd built in, e.g. a
+	// unified kernel image.
+	HTTPBootKernel = "kernel"
+
+	optClientArch       dhcp4.Option = 93
+	httpBootVendorClass              = "HTTPClient"
+)
+
+// httpBootArchs maps the UEFI HTTP Boot client architecture types, see the
+// IANA Processor Architecture Types registry, to the architectures Pixiecore
+// knows how to boot. Pixiecore ignores these clients.
+var httpBootArchs = map[uint16]pixiecore.Architecture{
+	0x0f: pixiecore.ArchIA32,
+	0x10: pixiecore.ArchX64,
+	0x12: pixiecore.ArchArm32,
+	0x13: pixiecore.ArchArm64,
+}
+
+// httpBootFirmware is the iPXE firmware type loaded by HTTP Boot clients of
+// each architecture.
+var httpBootFirmware = map[pixiecore.Architecture]pixiecore.Firmware{
+	pixiecore.ArchIA32:  pixiecore.FirmwareEFI32,
+	pixiecore.ArchX64:   pixiecore.FirmwareEFI64,
+	pixiecore.ArchArm32: pixiecore.FirmwareEFIArm32,
+	pixiecore.ArchArm64: pixiecore.FirmwareEFIArm64,
+}
+
+func validateHTTPBootMode(mode string) error {
+	switch mode {
+	case "", HTTPBootIpxe, HTTPBootKernel:
+		return nil
+	}
+	return fmt.Errorf("invalid http_boot '%s': must be one of %s, %s", mode, HTTPBootIpxe, HTTPBootKernel)
+}
+
+// HTTPBootConfiguration picks the URL UEFI HTTP Boot clients load directly
+// from pxeserver's HTTP server, in place of chainloading iPXE over TFTP.
+type HTTPBootConfiguration struct {
+	Booter pixiecore.Booter
+	// URLs picks the base URL for IPv4 clients
+	URLs *SubnetURLs
+	// Modes maps host MACs to their http_boot setting
+	Modes map[string]string
+	// Grub sends hosts booting with GRUB shim instead, if non-nil
+	Grub *Grub
+}
+
+// BootURL returns the URL of the file machine m boots on the HTTP server at
+// baseURL, or an error if it isn't a known host.
+func (c HTTPBootConfiguration) BootURL(m pixiecore.Machine, baseURL string) (string, error) {
+	spec, err := c.Booter.BootSpec(m)
+	if err != nil {
+		return "", err
+	}
+	if spec == nil {
+		return "", fmt.Errorf("no boot spec for %s", m.MAC)
+	}
+	if c.Grub != nil && c.Grub.IsHost(m.MAC.String()) {
+		return fmt.Sprintf("%s/_/grub/%s", baseURL, c.Grub.ShimPath(m.MAC.String())), nil
+	}
+	if c.Modes[m.MAC.String()] == HTTPBootKernel {
+		return fmt.Sprintf("%s/_/file?name=%s", baseURL, url.QueryEscape(string(spec.Kernel))), nil
+	}
+	return fmt.Sprintf("%s/_/ipxe.efi?arch=%d&mac=%s", baseURL, m.Arch, m.MAC), nil
+}
+
+// httpBootMachine identifies UEFI HTTP Boot clients by their vendor class
+// and architecture.
+func httpBootMachine(pkt *dhcp4.Packet) (pixiecore.Machine, bool) {
+	vendorClass, err := pkt.Options.String(dhcp4.OptVendorIdentifier)
+	if err != nil || !strings.HasPrefix(vendorClass, httpBootVendorClass) {
+		return pixiecore.Machine{}, false
+	}
+	clientArch, err := pkt.Options.Uint16(optClientArch)
+	if err != nil {
+		return pixiecore.Machine{}, false
+	}
+	arch, ok := httpBootArchs[clientArch]
+	if !ok {
+		return pixiecore.Machine{}, false
+	}
+	return pixiecore.Machine{MAC: pkt.HardwareAddr, Arch: arch}, true
+}
+
+// setHTTPBootOptions points resp at bootURL, as HTTP Boot clients only
+// accept offers which echo their vendor class.
+func setHTTPBootOptions(resp *dhcp4.Packet, bootURL string) {
+	resp.Options[dhcp4.OptVendorIdentifier] = []byte(httpBootVendorClass)
+	resp.BootFilename = bootURL
+}
+
+// HTTPBootProxy answers UEFI HTTP Boot clients as ProxyDHCP, alongside the
+// DHCP server which hands out addresses, for when the built-in DHCP server
+// isn't enabled.
+type HTTPBootProxy struct {
+	HTTPBoot HTTPBootConfiguration
+	LogFunc  func(subsys, msg string)
+}
+
+// Serve answers HTTP Boot requests on address.
+func (p *HTTPBootProxy) Serve(address string) error {
+	return serveProxyDHCP(address, "HTTPBoot", func(pkt *dhcp4.Packet) bool {
+		_, ok := httpBootMachine(pkt)
+		return ok
+	}, p.Respond, p.LogFunc)
+}
+
+// Respond builds the ProxyDHCP offer for pkt, received on the interface with
+// address localIP, or returns nil if pkt isn't an HTTP Boot DISCOVER.
+func (p *HTTPBootProxy) Respond(pkt *dhcp4.Packet, localIP net.IP) (*dhcp4.Packet, error) {
+	if pkt.Type != dhcp4.MsgDiscover {
+		return nil, nil
+	}
+	m, ok := httpBootMachine(pkt)
+	if !ok {
+		return nil, nil
+	}
+	bootURL, err := p.HTTPBoot.BootURL(m, p.HTTPBoot.URLs.ForHost(m.MAC.String()))
+	if err != nil {
+		return nil, err
+	}
+
+	resp := proxyOffer(pkt, localIP)
+	setHTTPBootOptions(resp, bootURL)
+	return resp, nil
+}
@@ -0,0 +1,143 @@
+package pxeserver_test
+
+import (
+	"net"
+	"strings"
+	"testing"
+
+	"github.com/ljfranklin/pxeserver"
+	"github.com/stretchr/testify/assert"
+	"go.universe.tf/netboot/dhcp4"
+)
+
+func newTestHTTPBootConfiguration(assert *assert.Assertions) pxeserver.HTTPBootConfiguration {
+	booter, err := pxeserver.ConfigBooter(pxeserver.Pixiecore{
+		"52:54:00:12:34:56": {
+			Kernel: "52:54:00:12:34:56-__kernel__",
+		},
+	}, pxeserver.Files{}, nil, nil)
+	assert.NoError(err)
+
+	urls, err := pxeserver.NewSubnetURLs(pxeserver.ServerSettings{
+		HTTPAddress: "10.0.0.1:8080",
+	}, nil, nil)
+	assert.NoError(err)
+
+	return pxeserver.HTTPBootConfiguration{
+		Booter: booter,
+		URLs:   urls,
+	}
+}
+
+func httpBootDiscover(mac string, clientArch uint16) *dhcp4.Packet {
+	return dhcpPacket(dhcp4.MsgDiscover, mac, dhcp4.Options{
+		dhcp4.OptVendorIdentifier: []byte("HTTPClient:Arch:00016:UNDI:003001"),
+		93:                        []byte{byte(clientArch >> 8), byte(clientArch)},
+	})
+}
+
+func TestHTTPBootProxyOffersIpxe(t *testing.T) {
+	assert := assert.New(t)
+
+	proxy := pxeserver.HTTPBootProxy{HTTPBoot: newTestHTTPBootConfiguration(assert)}
+	offer, err := proxy.Respond(httpBootDiscover("52:54:00:12:34:56", 0x10), net.ParseIP("10.0.0.1"))
+	assert.NoError(err)
+	assert.Equal(dhcp4.MsgOffer, offer.Type)
+	assert.Nil(offer.YourAddr)
+	assert.Equal("http://10.0.0.1:8080/_/ipxe.efi?arch=1&mac=52:54:00:12:34:56", offer.BootFilename)
+	assert.Equal([]byte("HTTPClient"), offer.Options[dhcp4.OptVendorIdentifier])
+	assert.Equal([]byte(net.ParseIP("10.0.0.1").To4()), offer.Options[dhcp4.OptServerIdentifier])
+	_, err = offer.Marshal()
+	assert.NoError(err)
+}
+
+func TestHTTPBootProxyOffersKernel(t *testing.T) {
+	assert := assert.New(t)
+
+	httpBoot := newTestHTTPBootConfiguration(assert)
+	httpBoot.Modes = map[string]string{"52:54:00:12:34:56": pxeserver.HTTPBootKernel}
+	proxy := pxeserver.HTTPBootProxy{HTTPBoot: httpBoot}
+	offer, err := proxy.Respond(httpBootDiscover("52:54:00:12:34:56", 0x13), net.ParseIP("10.0.0.1"))
+	assert.NoError(err)
+	assert.Equal("http://10.0.0.1:8080/_/file?name=52%3A54%3A00%3A12%3A34%3A56-__kernel__", offer.BootFilename)
+}
+
+func TestHTTPBootProxyIgnoresOtherClients(t *testing.T) {
+	assert := assert.New(t)
+
+	proxy := pxeserver.HTTPBootProxy{HTTPBoot: newTestHTTPBootConfiguration(assert)}
+
+	pxeDiscover := dhcpPacket(dhcp4.MsgDiscover, "52:54:00:12:34:56", dhcp4.Options{
+		dhcp4.OptVendorIdentifier: []byte("PXEClient:Arch:00007:UNDI:003016"),
+		93:                        []byte{0, 7},
+	})
+	offer, err := proxy.Respond(pxeDiscover, net.ParseIP("10.0.0.1"))
+	assert.NoError(err)
+	assert.Nil(offer)
+
+	request := httpBootDiscover("52:54:00:12:34:56", 0x10)
+	request.Type = dhcp4.MsgRequest
+	offer, err = proxy.Respond(request, net.ParseIP("10.0.0.1"))
+	assert.NoError(err)
+	assert.Nil(offer)
+
+	_, err = proxy.Respond(httpBootDiscover("52:54:00:65:43:21", 0x10), net.ParseIP("10.0.0.1"))
+	assert.NotNil(err)
+}
+
+func TestDHCPSendsHTTPBootURL(t *testing.T) {
+	assert := assert.New(t)
+
+	server, err := pxeserver.NewDHCPServer(testDHCPSettings(), nil)
+	assert.NoError(err)
+	httpBoot := newTestHTTPBootConfiguration(assert)
+	server.HTTPBoot = &httpBoot
+
+	offer, err := server.Respond(httpBootDiscover("52:54:00:12:34:56", 0x10), net.ParseIP("10.0.0.1"))
+	assert.NoError(err)
+	assert.Equal("10.0.0.100", offer.YourAddr.String())
+	assert.Equal("http://10.0.0.1:8080/_/ipxe.efi?arch=1&mac=52:54:00:12:34:56", offer.BootFilename)
+	assert.Equal([]byte("HTTPClient"), offer.Options[dhcp4.OptVendorIdentifier])
+
+	offer, err = server.Respond(dhcpPacket(dhcp4.MsgDiscover, "52:54:00:12:34:57", nil), net.ParseIP("10.0.0.1"))
+	assert.NoError(err)
+	assert.Equal("", offer.BootFilename)
+	assert.Nil(offer.Options[dhcp4.OptVendorIdentifier])
+}
+
+func TestErrorOnInvalidHTTPBoot(t *testing.T) {
+	assert := assert.New(t)
+
+	input := strings.NewReader(`
+hosts:
+- mac: "52:54:00:00:00:01"
+  http_boot: grub
+`)
+	_, err := pxeserver.LoadConfig(input)
+	assert.NotNil(err)
+	assert.Contains(err.Error(), "http_boot")
+
+	input = strings.NewReader(`
+hosts:
+- mac: "52:54:00:00:00:01"
+  http_boot: kernel
+  boot_args: ["console=ttyS0"]
+`)
+	_, err = pxeserver.LoadConfig(input)
+	assert.NotNil(err)
+	assert.Contains(err.Error(), "boot_args")
+}
+
+func TestHTTPBootModes(t *testing.T) {
+	assert := assert.New(t)
+
+	input := strings.NewReader(`
+hosts:
+- mac: "52:54:00:00:00:01"
+  http_boot: kernel
+- mac: "52:54:00:00:00:02"
+`)
+	cfg, err := pxeserver.LoadConfig(input)
+	assert.NoError(err)
+	assert.Equal(map[string]string{"52:54:00:00:00:01": "kernel"}, cfg.HTTPBootModes())
+}
@@ -0,0 +1,281 @@
+package pxeserver
+
+import (
+	"encoding/hex"
+	"fmt"
+	"net"
+	"strings"
+	"sync"
+
+	"go.universe.tf/netboot/dhcp4"
+	"go.universe.tf/netboot/pixiecore"
+)
+
+// optClientMachineID is DHCP option 97, the client's SMBIOS UUID
+const optClientMachineID = 97
+
+// SMBIOS identifies a machine by what its firmware reports rather than the
+// MAC of the NIC it boots from. A host's smbios matches a machine if every
+// non-empty field is equal.
+type SMBIOS struct {
+	UUID    string `json:"uuid"`
+	Serial  string `json:"serial"`
+	Asset   string `json:"asset"`
+	Product string `json:"product"`
+}
+
+func (s SMBIOS) empty() bool {
+	return s == SMBIOS{}
+}
+
+func (s SMBIOS) matches(reported SMBIOS) bool {
+	if s.UUID != "" && !strings.EqualFold(s.UUID, reported.UUID) {
+		return false
+	}
+	for _, field := range [][2]string{
+		{s.Serial, reported.Serial},
+		{s.Asset, reported.Asset},
+		{s.Product, reported.Product},
+	} {
+		if field[0] != "" && field[0] != strings.TrimSpace(field[1]) {
+			return false
+		}
+	}
+	return true
+}
+
+// overlaps is true if s and other identify a machine by the same uuid or
+// serial and no other field set in both tells them apart, so a machine
+// reporting one would match both. Hosts identified by different fields are
+// taken to be different machines.
+func (s SMBIOS) overlaps(other SMBIOS) bool {
+	shared := false
+	for _, field := range [][2]string{
+		{strings.ToLower(s.UUID), strings.ToLower(other.UUID)},
+		{s.Serial, other.Serial},
+	} {
+		if field[0] != "" && field[1] != "" {
+			if field[0] != field[1] {
+				return false
+			}
+			shared = true
+		}
+	}
+	for _, field := range [][2]string{
+		{s.Asset, other.Asset},
+		{s.Product, other.Product},
+	} {
+		if field[0] != "" && field[1] != "" && field[0] != field[1] {
+			return false
+		}
+	}
+	return shared
+}
+
+// validateSMBIOS requires a uuid or serial, as asset tags and product
+// names alone are shared by many machines.
+func validateSMBIOS(s SMBIOS) error {
+	if s.UUID == "" && s.Serial == "" {
+		return fmt.Errorf("smbios without a uuid or serial, which is required to tell machines apart")
+	}
+	if s.UUID == "" {
+		return nil
+	}
+	b, err := hex.DecodeString(strings.Replace(s.UUID, "-", "", -1))
+	if err != nil || len(b) != 16 || len(s.UUID) != 36 {
+		return fmt.Errorf("invalid smbios.uuid '%s': must be formatted as 01234567-89ab-cdef-0123-456789abcdef", s.UUID)
+	}
+	return nil
+}
+
+// clientMachineUUIDs formats the UUID in option 97 as both SMBIOS and
+// PXE clients lay it out, as firmware disagrees on the byte order of the
+// first three fields.
+func clientMachineUUIDs(pkt *dhcp4.Packet) []string {
+	b := pkt.Options[optClientMachineID]
+	if len(b) != 17 || b[0] != 0 {
+		return nil
+	}
+	uuid := b[1:]
+	swapped := []byte{
+		uuid[3], uuid[2], uuid[1], uuid[0],
+		uuid[5], uuid[4],
+		uuid[7], uuid[6],
+	}
+	swapped = append(swapped, uuid[8:]...)
+	return []string{formatUUID(uuid), formatUUID(swapped)}
+}
+
+func formatUUID(b []byte) string {
+	s := hex.EncodeToString(b)
+	return fmt.Sprintf("%s-%s-%s-%s-%s", s[0:8], s[8:12], s[12:16], s[16:20], s[20:32])
+}
+
+type identityHost struct {
+	name   string
+	smbios SMBIOS
+}
+
+// Identities ties the MACs machines boot from to the name of their host in
+// the config, by the host's macs or the smbios they report over DHCP option
+// 97 or by calling back from iPXE. Files, vars and secrets are keyed by the
+// host's name.
+type Identities struct {
+	hosts      []identityHost
+	macToName  map[string]string
+	nameToMACs map[string][]string
+	macToHost  map[string]string
+	mu         sync.Mutex
+}
+
+// NewIdentities resolves the MACs in hostMACs, keyed by host name, to their
+// host and matches other machines against the hosts in smbios, checked in
+// the order of names.
+func NewIdentities(names []string, hostMACs map[string][]string, smbios map[string]SMBIOS) *Identities {
+	i := &Identities{
+		macToName:  make(map[string]string),
+		nameToMACs: hostMACs,
+		macToHost:  make(map[string]string),
+	}
+	for _, name := range names {
+		for _, mac := range hostMACs[name] {
+			i.macToName[mac] = name
+		}
+		if s, ok := smbios[name]; ok {
+			i.hosts = append(i.hosts, identityHost{name: name, smbios: s})
+		}
+	}
+	return i
+}
+
+// Resolve returns the name of the host mac belongs to, or mac itself if it
+// isn't known to be a host.
+func (i *Identities) Resolve(mac string) string {
+	if i == nil {
+		return mac
+	}
+	if name, ok := i.macToName[mac]; ok {
+		return name
+	}
+	i.mu.Lock()
+	defer i.mu.Unlock()
+	if name, ok := i.macToHost[mac]; ok {
+		return name
+	}
+	return mac
+}
+
+// BootMAC returns the MAC to look up the boot spec of the machine with mac
+// by, the first of its host's macs if it was identified by smbios.
+func (i *Identities) BootMAC(mac string) string {
+	if i == nil {
+		return mac
+	}
+	if _, ok := i.macToName[mac]; ok {
+		return mac
+	}
+	if macs := i.nameToMACs[i.Resolve(mac)]; len(macs) > 0 {
+		return macs[0]
+	}
+	return mac
+}
+
+// MACs returns the configured MACs of the named host, or name itself if it
+// isn't a host, e.g. MACs of hosts without a name.
+func (i *Identities) MACs(name string) []string {
+	if i == nil || len(i.nameToMACs[name]) == 0 {
+		return []string{name}
+	}
+	return i.nameToMACs[name]
+}
+
+// ClientMACs returns the MACs identified by smbios as the named host.
+func (i *Identities) ClientMACs(name string) []string {
+	if i == nil {
+		return nil
+	}
+	i.mu.Lock()
+	defer i.mu.Unlock()
+	macs := []string{}
+	for mac, h := range i.macToHost {
+		if h == name {
+			macs = append(macs, mac)
+		}
+	}
+	return macs
+}
+
+// Identify ties mac to the first host matching reported, returning its
+// name.
+func (i *Identities) Identify(mac string, reported SMBIOS) (string, bool) {
+	if name, ok := i.macToName[mac]; ok {
+		return name, true
+	}
+	for _, h := range i.hosts {
+		if !h.smbios.matches(reported) {
+			continue
+		}
+		i.mu.Lock()
+		i.macToHost[mac] = h.name
+		i.mu.Unlock()
+		return h.name, true
+	}
+	return "", false
+}
+
+// ObserveDHCP identifies the sender of pkt by its option 97 UUID, if any.
+func (i *Identities) ObserveDHCP(pkt *dhcp4.Packet) {
+	if len(i.hosts) == 0 {
+		return
+	}
+	for _, uuid := range clientMachineUUIDs(pkt) {
+		if _, ok := i.Identify(pkt.HardwareAddr.String(), SMBIOS{UUID: uuid}); ok {
+			return
+		}
+	}
+}
+
+// SnoopIdentities passively watches DHCP requests on address for option 97,
+// for when the built-in DHCP server isn't enabled.
+func SnoopIdentities(address string, identities *Identities, logFunc func(subsys, msg string)) error {
+	return serveProxyDHCP(address, "Identity", func(pkt *dhcp4.Packet) bool {
+		identities.ObserveDHCP(pkt)
+		return false
+	}, nil, logFunc)
+}
+
+type identityBooter struct {
+	pixiecore.Booter
+	identities *Identities
+	urls       *SubnetURLs
+}
+
+// IdentityBooter boots machines identified as a host with that host's
+// spec. Unknown machines are sent an iPXE script reporting their SMBIOS
+// identity to /_/identify on the HTTPHandler, which boots them if it
+// matches a host.
+func IdentityBooter(booter pixiecore.Booter, identities *Identities, urls *SubnetURLs) pixiecore.Booter {
+	return &identityBooter{
+		Booter:     booter,
+		identities: identities,
+		urls:       urls,
+	}
+}
+
+func (b *identityBooter) BootSpec(m pixiecore.Machine) (*pixiecore.Spec, error) {
+	mac := m.MAC.String()
+	if bootMAC := b.identities.BootMAC(mac); bootMAC != mac {
+		hostMAC, err := net.ParseMAC(bootMAC)
+		if err != nil {
+			return nil, err
+		}
+		m.MAC = hostMAC
+		return b.Booter.BootSpec(m)
+	}
+	if _, ok := b.identities.macToName[mac]; ok {
+		return b.Booter.BootSpec(m)
+	}
+	return &pixiecore.Spec{
+		IpxeScript: fmt.Sprintf("#!ipxe\nchain %s/_/identify?mac=%s&arch=%d&uuid=${uuid}&serial=${serial:uristring}&asset=${asset:uristring}&product=${product:uristring}\n", b.urls.ForHost(mac), mac, m.Arch),
+	}, nil
+}
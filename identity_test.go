@@ -0,0 +1,194 @@
+package pxeserver_test
+
+import (
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/ljfranklin/pxeserver"
+	"github.com/stretchr/testify/assert"
+	"go.universe.tf/netboot/dhcp4"
+	"go.universe.tf/netboot/pixiecore"
+)
+
+func newTestIdentities() *pxeserver.Identities {
+	return pxeserver.NewIdentities([]string{"52:54:00:12:34:56", "52:54:00:00:00:02"}, map[string][]string{
+		"52:54:00:12:34:56": {"52:54:00:12:34:56"},
+		"52:54:00:00:00:02": {"52:54:00:00:00:02"},
+	}, map[string]pxeserver.SMBIOS{
+		"52:54:00:12:34:56": {UUID: "4c4c4544-0042-3510-8052-b4c04f4e4d32"},
+		"52:54:00:00:00:02": {Serial: "CZ1234", Product: "ProLiant DL360"},
+	})
+}
+
+func TestIdentitiesFromDHCPClientUUID(t *testing.T) {
+	assert := assert.New(t)
+
+	identities := newTestIdentities()
+	// SMBIOS byte order, with the first three fields little-endian
+	uuid := []byte{0x00, 0x44, 0x45, 0x4c, 0x4c, 0x42, 0x00, 0x10, 0x35, 0x80, 0x52, 0xb4, 0xc0, 0x4f, 0x4e, 0x4d, 0x32}
+	identities.ObserveDHCP(dhcpPacket(dhcp4.MsgDiscover, "52:54:00:aa:bb:cc", dhcp4.Options{97: uuid}))
+	assert.Equal("52:54:00:12:34:56", identities.Resolve("52:54:00:aa:bb:cc"))
+	assert.Equal([]string{"52:54:00:aa:bb:cc"}, identities.ClientMACs("52:54:00:12:34:56"))
+
+	identities.ObserveDHCP(dhcpPacket(dhcp4.MsgDiscover, "52:54:00:aa:bb:cd", dhcp4.Options{97: make([]byte, 17)}))
+	assert.Equal("52:54:00:aa:bb:cd", identities.Resolve("52:54:00:aa:bb:cd"))
+}
+
+func TestIdentitiesFromIpxe(t *testing.T) {
+	assert := assert.New(t)
+
+	identities := newTestIdentities()
+	host, ok := identities.Identify("52:54:00:aa:bb:cc", pxeserver.SMBIOS{
+		UUID:    "00000000-0000-0000-0000-000000000000",
+		Serial:  "CZ1234 ",
+		Product: "ProLiant DL360",
+	})
+	assert.True(ok)
+	assert.Equal("52:54:00:00:00:02", host)
+	assert.Equal("52:54:00:00:00:02", identities.Resolve("52:54:00:aa:bb:cc"))
+
+	_, ok = identities.Identify("52:54:00:aa:bb:cd", pxeserver.SMBIOS{Serial: "CZ1234"})
+	assert.False(ok)
+	// configured MACs are always their own host
+	host, ok = identities.Identify("52:54:00:12:34:56", pxeserver.SMBIOS{Serial: "CZ1234", Product: "ProLiant DL360"})
+	assert.True(ok)
+	assert.Equal("52:54:00:12:34:56", host)
+}
+
+func newTestIdentityHandler(assert *assert.Assertions, leases *pxeserver.Leases) pxeserver.HTTPHandler {
+	logs := []string{}
+	handler := newTestHTTPHandler(assert, leases, &logs)
+	urls, err := pxeserver.NewSubnetURLs(pxeserver.ServerSettings{HTTPAddress: "10.0.0.1:8080"}, nil, nil)
+	assert.NoError(err)
+	handler.Identities = newTestIdentities()
+	handler.Booter = pxeserver.IdentityBooter(handler.Booter, handler.Identities, urls)
+	return handler
+}
+
+func TestIdentityBooterAsksUnknownMachines(t *testing.T) {
+	assert := assert.New(t)
+
+	handler := newTestIdentityHandler(assert, nil)
+	mac, _ := net.ParseMAC("52:54:00:aa:bb:cc")
+	spec, err := handler.Booter.BootSpec(pixiecore.Machine{MAC: mac, Arch: pixiecore.ArchX64})
+	assert.NoError(err)
+	assert.Equal("#!ipxe\nchain http://10.0.0.1:8080/_/identify?mac=52:54:00:aa:bb:cc&arch=1&uuid=${uuid}&serial=${serial:uristring}&asset=${asset:uristring}&product=${product:uristring}\n", spec.IpxeScript)
+
+	hostMAC, _ := net.ParseMAC("52:54:00:12:34:56")
+	spec, err = handler.Booter.BootSpec(pixiecore.Machine{MAC: hostMAC, Arch: pixiecore.ArchX64})
+	assert.NoError(err)
+	assert.Contains(string(spec.Kernel), "52:54:00:12:34:56-__kernel__~")
+
+	handler.Identities.Identify("52:54:00:aa:bb:cc", pxeserver.SMBIOS{UUID: "4C4C4544-0042-3510-8052-B4C04F4E4D32"})
+	spec, err = handler.Booter.BootSpec(pixiecore.Machine{MAC: mac, Arch: pixiecore.ArchX64})
+	assert.NoError(err)
+	assert.Contains(string(spec.Kernel), "52:54:00:12:34:56-__kernel__~")
+}
+
+func TestHTTPIdentifyBootsMatchingHost(t *testing.T) {
+	assert := assert.New(t)
+
+	leases := pxeserver.NewLeases()
+	handler := newTestIdentityHandler(assert, leases)
+
+	// files are bound to the lease of the MAC the host booted from
+	leases.Set("52:54:00:aa:bb:cc", net.ParseIP("10.0.0.30"))
+	req := httptest.NewRequest("GET", "/_/identify?mac=52:54:00:aa:bb:cc&arch=1&uuid=4c4c4544-0042-3510-8052-b4c04f4e4d32&serial=&asset=&product=", nil)
+	req.RemoteAddr = "10.0.0.30:1234"
+	recorder := httptest.NewRecorder()
+	handler.ServeHTTP(recorder, req)
+	assert.Equal(http.StatusOK, recorder.Code)
+	assert.Contains(recorder.Body.String(), "kernel --name kernel http://10.0.0.1:8080/_/file?name=52%3A54%3A00%3A12%3A34%3A56-__kernel__~")
+	assert.Contains(recorder.Body.String(), "boot kernel some_arg=")
+
+	recorder = fileRequest(handler, "52:54:00:12:34:56-some-image", "10.0.0.30:1234")
+	assert.Equal(http.StatusOK, recorder.Code)
+	recorder = fileRequest(handler, "52:54:00:12:34:56-some-image", "10.0.0.31:1234")
+	assert.Equal(http.StatusForbidden, recorder.Code)
+
+	req = httptest.NewRequest("GET", "/_/identify?mac=52:54:00:aa:bb:cd&arch=1&uuid=&serial=CZ9999&asset=&product=", nil)
+	recorder = httptest.NewRecorder()
+	handler.ServeHTTP(recorder, req)
+	assert.Equal(http.StatusNotFound, recorder.Code)
+}
+
+func TestSMBIOSHostsFromConfig(t *testing.T) {
+	assert := assert.New(t)
+
+	cfg, err := pxeserver.LoadConfig(strings.NewReader(`
+server:
+  http_address: 10.0.0.1:8080
+hosts:
+- mac: "52:54:00:00:00:01"
+  smbios:
+    uuid: 4C4C4544-0042-3510-8052-B4C04F4E4D32
+- mac: "52:54:00:00:00:02"
+  smbios:
+    serial: CZ1234
+    asset: rack-4
+- mac: "52:54:00:00:00:03"
+- mac: "52:54:00:00:00:04"
+  smbios:
+    serial: CZ1234
+    asset: rack-5
+`))
+	assert.NoError(err)
+	assert.Equal(map[string]pxeserver.SMBIOS{
+		"52:54:00:00:00:01": {UUID: "4c4c4544-0042-3510-8052-b4c04f4e4d32"},
+		"52:54:00:00:00:02": {Serial: "CZ1234", Asset: "rack-4"},
+		"52:54:00:00:00:04": {Serial: "CZ1234", Asset: "rack-5"},
+	}, cfg.SMBIOSHosts())
+	assert.Equal([]string{"52:54:00:00:00:01", "52:54:00:00:00:02", "52:54:00:00:00:03", "52:54:00:00:00:04"}, cfg.HostNames())
+}
+
+func TestErrorOnInvalidSMBIOS(t *testing.T) {
+	assert := assert.New(t)
+
+	for _, cfg := range []string{
+		"hosts:\n- mac: \"52:54:00:00:00:01\"\n  smbios:\n    serial: CZ1234\n",
+		"server:\n  http_address: 10.0.0.1:8080\nhosts:\n- mac: \"52:54:00:00:00:01\"\n  smbios:\n    uuid: 4c4c4544\n",
+		"server:\n  http_address: 10.0.0.1:8080\nhosts:\n- mac: \"52:54:00:00:00:01\"\n  bootloader: uboot\n  smbios:\n    serial: CZ1234\n",
+		"server:\n  http_address: 10.0.0.1:8080\nhosts:\n- mac: \"52:54:00:00:00:01\"\n  smbios:\n    serial: CZ1234\n- mac: \"52:54:00:00:00:02\"\n  smbios:\n    serial: CZ1234\n",
+		// asset tags and products alone are shared by many machines
+		"server:\n  http_address: 10.0.0.1:8080\nhosts:\n- mac: \"52:54:00:00:00:01\"\n  smbios:\n    asset: rack-4\n",
+		"server:\n  http_address: 10.0.0.1:8080\nhosts:\n- mac: \"52:54:00:00:00:01\"\n  smbios:\n    product: ProLiant DL360\n",
+		"server:\n  http_address: 10.0.0.1:8080\nhosts:\n- mac: \"52:54:00:00:00:01\"\n  smbios:\n    serial: CZ1234\n- mac: \"52:54:00:00:00:02\"\n  smbios:\n    serial: CZ1234\n    product: ProLiant DL360\n",
+	} {
+		_, err := pxeserver.LoadConfig(strings.NewReader(cfg))
+		assert.NotNil(err, cfg)
+	}
+}
+
+func TestIdentitiesResolveHostMACs(t *testing.T) {
+	assert := assert.New(t)
+
+	identities := pxeserver.NewIdentities([]string{"web-1"}, map[string][]string{
+		"web-1": {"52:54:00:12:34:56", "52:54:00:12:34:57"},
+	}, nil)
+	assert.Equal("web-1", identities.Resolve("52:54:00:12:34:56"))
+	assert.Equal("web-1", identities.Resolve("52:54:00:12:34:57"))
+	assert.Equal("52:54:00:aa:bb:cc", identities.Resolve("52:54:00:aa:bb:cc"))
+	assert.Equal("52:54:00:12:34:57", identities.BootMAC("52:54:00:12:34:57"))
+	assert.Equal([]string{"52:54:00:12:34:56", "52:54:00:12:34:57"}, identities.MACs("web-1"))
+	assert.Equal([]string{"52:54:00:aa:bb:cc"}, identities.MACs("52:54:00:aa:bb:cc"))
+}
+
+func TestHTTPBindsFilesToLeaseOfAnyHostMAC(t *testing.T) {
+	assert := assert.New(t)
+
+	leases := pxeserver.NewLeases()
+	logs := []string{}
+	handler := newTestHTTPHandler(assert, leases, &logs)
+	handler.Identities = pxeserver.NewIdentities([]string{"52:54:00:12:34:56"}, map[string][]string{
+		"52:54:00:12:34:56": {"52:54:00:12:34:56", "52:54:00:12:34:57"},
+	}, nil)
+
+	leases.Set("52:54:00:12:34:57", net.ParseIP("10.0.0.30"))
+	recorder := fileRequest(handler, "52:54:00:12:34:56-some-image", "10.0.0.30:1234")
+	assert.Equal(http.StatusOK, recorder.Code)
+	recorder = fileRequest(handler, "52:54:00:12:34:56-some-image", "10.0.0.31:1234")
+	assert.Equal(http.StatusForbidden, recorder.Code)
+}
@@ -0,0 +1,164 @@
+package pxeserver
+
+import (
+	"fmt"
+	"io"
+	"net"
+
+	"go.universe.tf/netboot/pixiecore"
+)
+
+type InterfaceSettings struct {
+	Name string `json:"name"`
+	// Hosts are the MACs of the only hosts booted on this interface, all
+	// hosts are booted if empty
+	Hosts []string `json:"hosts"`
+}
+
+// listener is an address pxeserver answers boot requests on.
+type listener struct {
+	Interface string
+	Address   string
+	IPv6      net.IP
+	Hosts     []string
+}
+
+// listeners resolves each configured interface to its addresses, or
+// returns a single listener on address if no interfaces are configured.
+func (s ServerSettings) listeners(address string) ([]listener, error) {
+	if len(s.Interfaces) == 0 {
+		return []listener{{Address: address}}, nil
+	}
+	listeners := make([]listener, 0, len(s.Interfaces))
+	for _, iface := range s.Interfaces {
+		ipv4, ipv6, err := InterfaceAddresses(iface.Name)
+		if err != nil {
+			return nil, err
+		}
+		l := listener{
+			Interface: iface.Name,
+			IPv6:      ipv6,
+			Hosts:     iface.Hosts,
+		}
+		if ipv4 != nil {
+			l.Address = ipv4.String()
+		}
+		listeners = append(listeners, l)
+	}
+	return listeners, nil
+}
+
+func (s ServerSettings) validateInterfaces() error {
+	names := make(map[string]bool)
+	for _, iface := range s.Interfaces {
+		if iface.Name == "" {
+			return fmt.Errorf("server.interfaces entry is missing a 'name'")
+		}
+		if names[iface.Name] {
+			return fmt.Errorf("server.interfaces lists '%s' more than once", iface.Name)
+		}
+		names[iface.Name] = true
+	}
+	return nil
+}
+
+// InterfaceAddresses returns the first IPv4 and global unicast IPv6
+// address of the named interface, either may be nil.
+func InterfaceAddresses(name string) (net.IP, net.IP, error) {
+	iface, err := net.InterfaceByName(name)
+	if err != nil {
+		return nil, nil, err
+	}
+	addrs, err := iface.Addrs()
+	if err != nil {
+		return nil, nil, err
+	}
+	var ipv4, ipv6 net.IP
+	for _, addr := range addrs {
+		ipNet, ok := addr.(*net.IPNet)
+		if !ok {
+			continue
+		}
+		if ipNet.IP.To4() != nil {
+			if ipv4 == nil {
+				ipv4 = ipNet.IP.To4()
+			}
+		} else if ipNet.IP.IsGlobalUnicast() && ipv6 == nil {
+			ipv6 = ipNet.IP
+		}
+	}
+	if ipv4 == nil && ipv6 == nil {
+		return nil, nil, fmt.Errorf("interface '%s' has no addresses", name)
+	}
+	return ipv4, ipv6, nil
+}
+
+type interfaceBooter struct {
+	pixiecore.Booter
+	hosts map[string]bool
+	// checkFiles limits ReadBootFile to the hosts' files
+	checkFiles bool
+	files      Files
+	tokens     *FileTokens
+	identities *Identities
+}
+
+// InterfaceBooter only boots the hosts with the given MACs, other hosts
+// are ignored as if they weren't in the config.
+func InterfaceBooter(booter pixiecore.Booter, macs []string) pixiecore.Booter {
+	hosts := make(map[string]bool)
+	for _, mac := range macs {
+		hosts[mac] = true
+	}
+	return &interfaceBooter{
+		Booter: booter,
+		hosts:  hosts,
+	}
+}
+
+// InterfaceFilesBooter is InterfaceBooter which also refuses to read files
+// of other hosts, for servers such as Pixiecore's and TFTP which read files
+// by ID alone. Public files are read for any host.
+func InterfaceFilesBooter(booter pixiecore.Booter, macs []string, files Files, tokens *FileTokens, identities *Identities) pixiecore.Booter {
+	b := InterfaceBooter(booter, macs).(*interfaceBooter)
+	b.checkFiles = true
+	b.files = files
+	b.tokens = tokens
+	b.identities = identities
+	return b
+}
+
+func (b *interfaceBooter) BootSpec(m pixiecore.Machine) (*pixiecore.Spec, error) {
+	if !b.hosts[m.MAC.String()] {
+		return nil, nil
+	}
+	return b.Booter.BootSpec(m)
+}
+
+func (b *interfaceBooter) ReadBootFile(id pixiecore.ID) (io.ReadCloser, int64, error) {
+	if !b.checkFiles {
+		return b.Booter.ReadBootFile(id)
+	}
+	fileID := string(id)
+	if b.tokens != nil {
+		var err error
+		fileID, err = b.tokens.Verify(fileID)
+		if err != nil {
+			return nil, -1, err
+		}
+	}
+	file, ok := b.files.Lookup(fileID)
+	if !ok {
+		return nil, -1, fmt.Errorf("unknown file '%s'", fileID)
+	}
+	if !file.Public {
+		served := false
+		for _, mac := range b.identities.MACs(file.Host) {
+			served = served || b.hosts[mac]
+		}
+		if !served {
+			return nil, -1, fmt.Errorf("file '%s' is for host '%s', which is not served on this interface", fileID, file.Host)
+		}
+	}
+	return b.Booter.ReadBootFile(id)
+}
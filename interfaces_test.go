@@ -0,0 +1,103 @@
+package pxeserver_test
+
+import (
+	"net"
+	"strings"
+	"testing"
+
+	"github.com/ljfranklin/pxeserver"
+	"github.com/stretchr/testify/assert"
+	"go.universe.tf/netboot/pixiecore"
+)
+
+type stubBooter struct {
+	pixiecore.Booter
+}
+
+func (b stubBooter) BootSpec(m pixiecore.Machine) (*pixiecore.Spec, error) {
+	return &pixiecore.Spec{Kernel: "some-kernel"}, nil
+}
+
+func TestInterfaceBooterIgnoresOtherHosts(t *testing.T) {
+	assert := assert.New(t)
+
+	booter := pxeserver.InterfaceBooter(stubBooter{}, []string{"52:54:00:00:00:01"})
+
+	mac, err := net.ParseMAC("52:54:00:00:00:01")
+	assert.NoError(err)
+	spec, err := booter.BootSpec(pixiecore.Machine{MAC: mac})
+	assert.NoError(err)
+	assert.NotNil(spec)
+
+	mac, err = net.ParseMAC("52:54:00:00:00:02")
+	assert.NoError(err)
+	spec, err = booter.BootSpec(pixiecore.Machine{MAC: mac})
+	assert.NoError(err)
+	assert.Nil(spec)
+}
+
+func TestInterfaceAddresses(t *testing.T) {
+	assert := assert.New(t)
+
+	ipv4, _, err := pxeserver.InterfaceAddresses("lo")
+	assert.NoError(err)
+	assert.Equal("127.0.0.1", ipv4.String())
+
+	_, _, err = pxeserver.InterfaceAddresses("does-not-exist")
+	assert.NotNil(err)
+}
+
+func TestInterfaceFilesBooterOnlyReadsHostFiles(t *testing.T) {
+	assert := assert.New(t)
+
+	logs := []string{}
+	handler := newTestHTTPHandler(assert, nil, &logs)
+	identities := pxeserver.NewIdentities(nil, nil, nil)
+
+	booter := pxeserver.InterfaceFilesBooter(handler.Booter, []string{"52:54:00:12:34:56"}, handler.Files, handler.Tokens, identities)
+	f, _, err := booter.ReadBootFile(pixiecore.ID(handler.Tokens.Sign("52:54:00:12:34:56-some-image")))
+	assert.NoError(err)
+	f.Close()
+
+	booter = pxeserver.InterfaceFilesBooter(handler.Booter, []string{"52:54:00:00:00:02"}, handler.Files, handler.Tokens, identities)
+	_, _, err = booter.ReadBootFile(pixiecore.ID(handler.Tokens.Sign("52:54:00:12:34:56-some-image")))
+	assert.NotNil(err)
+	assert.Contains(err.Error(), "not served on this interface")
+	_, _, err = booter.ReadBootFile("52:54:00:12:34:56-some-image")
+	assert.NotNil(err)
+
+	// public files are for any host
+	f, _, err = booter.ReadBootFile(pixiecore.ID(handler.Tokens.Sign("52:54:00:12:34:56-some-public-image")))
+	assert.NoError(err)
+	f.Close()
+}
+
+func TestErrorOnDuplicateInterface(t *testing.T) {
+	assert := assert.New(t)
+
+	input := strings.NewReader(`
+server:
+  interfaces:
+  - name: eth1
+  - name: eth1
+`)
+	_, err := pxeserver.LoadConfig(input)
+	assert.NotNil(err)
+	assert.Contains(err.Error(), "more than once")
+}
+
+func TestErrorOnUnknownInterfaceHost(t *testing.T) {
+	assert := assert.New(t)
+
+	input := strings.NewReader(`
+server:
+  interfaces:
+  - name: eth1
+    hosts: ["52:54:00:00:00:02"]
+hosts:
+- mac: "52:54:00:00:00:01"
+`)
+	_, err := pxeserver.LoadConfig(input)
+	assert.NotNil(err)
+	assert.Contains(err.Error(), "52:54:00:00:00:02")
+}
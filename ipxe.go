@@ -0,0 +1,136 @@
+package pxeserver
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"sort"
+	"strings"
+
+	"go.universe.tf/netboot/pixiecore"
+	"go.universe.tf/netboot/third_party/ipxe"
+)
+
+// ipxeFirmwareNames are the keys of server.ipxe and a host's ipxe, one per
+// firmware type Pixiecore detects.
+var ipxeFirmwareNames = map[string]pixiecore.Firmware{
+	// x86pc is loaded by BIOS PXE ROMs, e.g. undionly.kpxe
+	"x86pc": pixiecore.FirmwareX86PC,
+	// x86ipxe is loaded by BIOS clients already running iPXE, e.g. ipxe.pxe
+	"x86ipxe":  pixiecore.FirmwareX86Ipxe,
+	"efi32":    pixiecore.FirmwareEFI32,
+	"efi64":    pixiecore.FirmwareEFI64,
+	"efibc":    pixiecore.FirmwareEFIBC,
+	"efiarm32": pixiecore.FirmwareEFIArm32,
+	"efiarm64": pixiecore.FirmwareEFIArm64,
+}
+
+func validateIpxeFirmwareName(name string) (pixiecore.Firmware, error) {
+	fwtype, ok := ipxeFirmwareNames[name]
+	if !ok {
+		names := make([]string, 0, len(ipxeFirmwareNames))
+		for name := range ipxeFirmwareNames {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		return 0, fmt.Errorf("invalid ipxe firmware '%s': must be one of %s", name, strings.Join(names, ", "))
+	}
+	return fwtype, nil
+}
+
+// ipxeFirmwareID is the file ID of the named firmware in server.ipxe, if
+// host is empty, or in the host's ipxe.
+func ipxeFirmwareID(host string, name string) string {
+	if host == "" {
+		return fmt.Sprintf("__ipxe_%s__", name)
+	}
+	return fmt.Sprintf("%s-__ipxe_%s__", host, name)
+}
+
+// builtinIpxeFirmware are the iPXE builds embedded in pxeserver, there are
+// none for x86pc, efi32 and efiarm32.
+func builtinIpxeFirmware() (map[pixiecore.Firmware][]byte, error) {
+	x86_64, err := readAsset("bindeps/ipxe/x86_64/ipxe.efi")
+	if err != nil {
+		return nil, err
+	}
+	arm64, err := readAsset("bindeps/ipxe/arm64/ipxe.efi")
+	if err != nil {
+		return nil, err
+	}
+	return map[pixiecore.Firmware][]byte{
+		pixiecore.FirmwareEFI64:    x86_64,
+		pixiecore.FirmwareEFIBC:    x86_64,
+		pixiecore.FirmwareEFIArm64: arm64,
+		pixiecore.FirmwareX86Ipxe:  ipxe.MustAsset("ipxe.pxe"),
+	}, nil
+}
+
+// IpxeFirmware picks the iPXE build sent to each host, from the host's
+// ipxe, then server.ipxe, then the builtin firmware.
+type IpxeFirmware struct {
+	builtin map[pixiecore.Firmware][]byte
+	ids     map[string]map[pixiecore.Firmware]string
+
+	Files Files
+	Audit *AuditLog
+}
+
+// NewIpxeFirmware serves builtin along with the files in ids, which maps
+// host names, or "" for server.ipxe, to the file ID of each firmware type.
+func NewIpxeFirmware(builtin map[pixiecore.Firmware][]byte, ids map[string]map[pixiecore.Firmware]string) *IpxeFirmware {
+	return &IpxeFirmware{
+		builtin: builtin,
+		ids:     ids,
+	}
+}
+
+// Open returns the firmware of type fwtype for the host with the given MAC,
+// requested by client.
+func (f *IpxeFirmware) Open(mac string, fwtype pixiecore.Firmware, client string) (io.ReadCloser, int64, error) {
+	for _, key := range []string{mac, ""} {
+		id, ok := f.ids[key][fwtype]
+		if !ok {
+			continue
+		}
+		r, size, err := f.Files.Read(id)
+		if err != nil {
+			return nil, 0, err
+		}
+		if err := f.Audit.Record(AuditEvent{
+			Event:  AuditFileServe,
+			Host:   mac,
+			FileID: id,
+			Client: client,
+		}); err != nil {
+			r.Close()
+			return nil, 0, err
+		}
+		return r, size, nil
+	}
+	firmware, ok := f.builtin[fwtype]
+	if !ok {
+		return nil, 0, fmt.Errorf("no iPXE firmware for firmware type %d", fwtype)
+	}
+	return ioutil.NopCloser(bytes.NewReader(firmware)), int64(len(firmware)), nil
+}
+
+// PixiecoreFirmware is the firmware map for Pixiecore, which only checks a
+// type is present before answering on the PXE port as pxeserver serves the
+// binaries itself. Types only some hosts have files for are included, the
+// others fail when requested over TFTP.
+func (f *IpxeFirmware) PixiecoreFirmware() map[pixiecore.Firmware][]byte {
+	firmware := make(map[pixiecore.Firmware][]byte)
+	for fwtype, b := range f.builtin {
+		firmware[fwtype] = b
+	}
+	for _, ids := range f.ids {
+		for fwtype := range ids {
+			if _, ok := firmware[fwtype]; !ok {
+				firmware[fwtype] = []byte{}
+			}
+		}
+	}
+	return firmware
+}
@@ -0,0 +1,143 @@
+package pxeserver_test
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"path"
+	"strings"
+	"testing"
+
+	"github.com/ljfranklin/pxeserver"
+	"github.com/stretchr/testify/assert"
+	"go.universe.tf/netboot/pixiecore"
+)
+
+func newTestIpxeFirmware(assert *assert.Assertions) *pxeserver.IpxeFirmware {
+	input := strings.NewReader(fmt.Sprintf(`
+server:
+  ipxe:
+    x86pc:
+      path: %s
+hosts:
+- mac: "52:54:00:12:34:56"
+  ipxe:
+    efi64:
+      path: %s
+    efi32:
+      path: %s
+- mac: "52:54:00:65:43:21"
+`, path.Join(fixturesDir(), "ipxe", "undionly.kpxe"), path.Join(fixturesDir(), "ipxe", "snponly.efi"), path.Join(fixturesDir(), "ipxe", "snponly.efi")))
+	cfg, err := pxeserver.LoadConfig(input)
+	assert.NoError(err)
+	files, err := pxeserver.LoadFiles(cfg.Files(), pxeserver.Renderer{})
+	assert.NoError(err)
+
+	firmware := pxeserver.NewIpxeFirmware(map[pixiecore.Firmware][]byte{
+		pixiecore.FirmwareEFI64: []byte("some-ipxe"),
+	}, cfg.IpxeFirmware())
+	firmware.Files = files
+	return firmware
+}
+
+func TestIpxeFirmwareFromConfig(t *testing.T) {
+	assert := assert.New(t)
+
+	input := strings.NewReader(`
+server:
+  ipxe:
+    x86pc:
+      path: /srv/ipxe/undionly.kpxe
+hosts:
+- mac: "52:54:00:12:34:56"
+  ipxe:
+    efi64:
+      url: https://example.com/snponly.efi
+      sha256: 7676e12a9b6544e21b7510ea4834c310a4188fc356ff7198a0e4d22b100370af
+`)
+	cfg, err := pxeserver.LoadConfig(input)
+	assert.NoError(err)
+	assert.Equal(map[string]map[pixiecore.Firmware]string{
+		"":                  {pixiecore.FirmwareX86PC: "__ipxe_x86pc__"},
+		"52:54:00:12:34:56": {pixiecore.FirmwareEFI64: "52:54:00:12:34:56-__ipxe_efi64__"},
+	}, cfg.IpxeFirmware())
+
+	ids := []string{}
+	for _, f := range cfg.Files() {
+		ids = append(ids, f.ID)
+	}
+	assert.Contains(ids, "__ipxe_x86pc__")
+	assert.Contains(ids, "52:54:00:12:34:56-__ipxe_efi64__")
+}
+
+func TestTFTPServesIpxeFirmwareByHost(t *testing.T) {
+	assert := assert.New(t)
+
+	handler, _ := newTestTFTPHandler(assert)
+	handler.Firmware = newTestIpxeFirmware(assert)
+
+	for p, expected := range map[string]string{
+		"52:54:00:12:34:56/2": "some-snponly\n",
+		"52:54:00:12:34:56/1": "some-snponly\n",
+		"52:54:00:12:34:56/0": "some-undionly\n",
+		"52:54:00:65:43:21/2": "some-ipxe",
+		"52:54:00:65:43:21/0": "some-undionly\n",
+	} {
+		contents, err := readTFTPFile(assert, handler, p)
+		assert.NoError(err, p)
+		assert.Equal(expected, contents, p)
+	}
+
+	_, err := readTFTPFile(assert, handler, "52:54:00:65:43:21/1")
+	assert.NotNil(err)
+}
+
+func TestHTTPServesIpxeFirmwareByHost(t *testing.T) {
+	assert := assert.New(t)
+
+	logs := []string{}
+	handler := newTestHTTPHandler(assert, nil, &logs)
+	handler.Firmware = newTestIpxeFirmware(assert)
+
+	for query, expected := range map[string]string{
+		fmt.Sprintf("arch=%d&mac=52:54:00:12:34:56", pixiecore.ArchX64):  "some-snponly\n",
+		fmt.Sprintf("arch=%d&mac=52:54:00:12:34:56", pixiecore.ArchIA32): "some-snponly\n",
+		fmt.Sprintf("arch=%d&mac=52:54:00:65:43:21", pixiecore.ArchX64):  "some-ipxe",
+		fmt.Sprintf("arch=%d", pixiecore.ArchX64):                        "some-ipxe",
+	} {
+		req := httptest.NewRequest("GET", "/_/ipxe.efi?"+query, nil)
+		recorder := httptest.NewRecorder()
+		handler.ServeHTTP(recorder, req)
+		assert.Equal(http.StatusOK, recorder.Code, query)
+		assert.Equal(expected, recorder.Body.String(), query)
+	}
+
+	req := httptest.NewRequest("GET", fmt.Sprintf("/_/ipxe.efi?arch=%d&mac=52:54:00:65:43:21", pixiecore.ArchIA32), nil)
+	recorder := httptest.NewRecorder()
+	handler.ServeHTTP(recorder, req)
+	assert.Equal(http.StatusNotFound, recorder.Code)
+}
+
+func TestPixiecoreFirmwareIncludesConfiguredTypes(t *testing.T) {
+	assert := assert.New(t)
+
+	firmware := newTestIpxeFirmware(assert).PixiecoreFirmware()
+	for _, fwtype := range []pixiecore.Firmware{pixiecore.FirmwareX86PC, pixiecore.FirmwareEFI32, pixiecore.FirmwareEFI64} {
+		assert.NotNil(firmware[fwtype], fwtype)
+	}
+	assert.Nil(firmware[pixiecore.FirmwareEFIArm32])
+}
+
+func TestErrorOnInvalidIpxeFirmware(t *testing.T) {
+	assert := assert.New(t)
+
+	for _, cfg := range []string{
+		"server:\n  ipxe:\n    efi128:\n      path: /srv/ipxe.efi\n",
+		"server:\n  ipxe:\n    efi64:\n      sha256: abc\n",
+		"hosts:\n- mac: \"52:54:00:12:34:56\"\n  ipxe:\n    efi128:\n      path: /srv/ipxe.efi\n",
+		"hosts:\n- mac: \"52:54:00:12:34:56\"\n  bootloader: uboot\n  ipxe:\n    efi64:\n      path: /srv/ipxe.efi\n",
+	} {
+		_, err := pxeserver.LoadConfig(strings.NewReader(cfg))
+		assert.NotNil(err, cfg)
+	}
+}
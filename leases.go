@@ -0,0 +1,233 @@
+package pxeserver
+
+import (
+	"fmt"
+	"io"
+	"net"
+	"sync"
+
+	"go.universe.tf/netboot/dhcp4"
+	"go.universe.tf/netboot/pixiecore"
+)
+
+// Leases tracks the IPv4 and IPv6 address each MAC was last assigned over
+// DHCP, along with the relay which forwarded its
+// requests.
+type Leases struct {
+	macToIP    map[string]net.IP
+	macToIP6   map[string]net.IP
+	macToRelay map[string]net.IP
+	mu         sync.Mutex
+
+	// TrustedServers are the server identifiers of the DHCP servers whose
+	// DHCPACKs Observe records
+	TrustedServers []net.IP
+	// TrustedRelays are the relay addresses Observe records
+	TrustedRelays []net.IP
+}
+
+func NewLeases() *Leases {
+	return &Leases{
+		macToIP:    make(map[string]net.IP),
+		macToIP6:   make(map[string]net.IP),
+		macToRelay: make(map[string]net.IP),
+	}
+}
+
+// Observe records the address a trusted server's DHCPACK assigned, and the
+// relay address (giaddr) of any packet relayed by a trusted relay. The
+// address a client requests is ignored, as any client could claim another
+// host's address that way, and so are ACKs and relays other clients could
+// forge.
+func (l *Leases) Observe(pkt *dhcp4.Packet) {
+	if pkt.RelayAddr != nil && !pkt.RelayAddr.IsUnspecified() && containsIP(l.TrustedRelays, pkt.RelayAddr) {
+		l.mu.Lock()
+		l.macToRelay[pkt.HardwareAddr.String()] = pkt.RelayAddr
+		l.mu.Unlock()
+	}
+
+	if pkt.Type != dhcp4.MsgAck || pkt.YourAddr == nil || pkt.YourAddr.IsUnspecified() {
+		return
+	}
+	serverID, err := pkt.Options.IP(dhcp4.OptServerIdentifier)
+	if err != nil || !containsIP(l.TrustedServers, serverID) {
+		return
+	}
+	l.Set(pkt.HardwareAddr.String(), pkt.YourAddr)
+}
+
+func containsIP(ips []net.IP, ip net.IP) bool {
+	for _, trusted := range ips {
+		if trusted.Equal(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+func (l *Leases) Set(mac string, ip net.IP) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if ip.To4() == nil {
+		l.macToIP6[mac] = ip
+	} else {
+		l.macToIP[mac] = ip
+	}
+}
+
+func (l *Leases) IP(mac string) (net.IP, bool) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	ip, ok := l.macToIP[mac]
+	return ip, ok
+}
+
+func (l *Leases) IP6(mac string) (net.IP, bool) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	ip, ok := l.macToIP6[mac]
+	return ip, ok
+}
+
+// MAC returns the host last seen with the IPv4 or IPv6 address ip.
+func (l *Leases) MAC(ip net.IP) (string, bool) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	macToIP := l.macToIP
+	if ip.To4() == nil {
+		macToIP = l.macToIP6
+	}
+	for mac, leaseIP := range macToIP {
+		if leaseIP.Equal(ip) {
+			return mac, true
+		}
+	}
+	return "", false
+}
+
+// Check returns an error unless clientIP is the address leased by one of
+// macs, the MACs of the host with the given name.
+func (l *Leases) Check(name string, macs []string, clientIP net.IP) error {
+	var leaseIP net.IP
+	for _, mac := range macs {
+		ip, ok := l.IP(mac)
+		if clientIP.To4() == nil {
+			ip, ok = l.IP6(mac)
+		}
+		if !ok {
+			continue
+		}
+		if ip.Equal(clientIP) {
+			return nil
+		}
+		leaseIP = ip
+	}
+	if leaseIP == nil {
+		return fmt.Errorf("no DHCP lease observed for host '%s'", name)
+	}
+	return fmt.Errorf("client address does not match lease '%s' for host '%s'", leaseIP, name)
+}
+
+// CheckHost is Check for the named host, which may have leased from any of
+// its MACs or those identified by its smbios.
+func (l *Leases) CheckHost(name string, identities *Identities, clientIP net.IP) error {
+	macs := append(identities.MACs(name), identities.ClientMACs(name)...)
+	return l.Check(name, macs, clientIP)
+}
+
+func (l *Leases) Relay(mac string) (net.IP, bool) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	ip, ok := l.macToRelay[mac]
+	return ip, ok
+}
+
+// SnoopLeases passively watches DHCP traffic to and from the DHCP server
+// that hands out addresses, as pxeserver only runs as ProxyDHCP.
+func SnoopLeases(address string, leases *Leases) error {
+	errs := make(chan error, 2)
+	for _, port := range []int{67, 68} {
+		conn, err := dhcp4.NewSnooperConn(fmt.Sprintf("%s:%d", address, port))
+		if err != nil {
+			return err
+		}
+		defer conn.Close()
+
+		go func() {
+			for {
+				pkt, _, err := conn.RecvDHCP()
+				if err != nil {
+					errs <- fmt.Errorf("Receiving DHCP packet for lease tracking: %s", err)
+					return
+				}
+				leases.Observe(pkt)
+			}
+		}()
+	}
+	return <-errs
+}
+
+type leaseBooter struct {
+	pixiecore.Booter
+	leases     *Leases
+	clientIP   net.IP
+	identities *Identities
+	// checkFiles limits ReadBootFile to the host's files
+	checkFiles bool
+	files      Files
+	tokens     *FileTokens
+}
+
+// LeaseBooter only boots the host which leased clientIP, so tokens for a
+// host's files are only handed to that host, for servers such as TFTP which
+// see the client's address.
+func LeaseBooter(booter pixiecore.Booter, leases *Leases, clientIP net.IP, identities *Identities) pixiecore.Booter {
+	return &leaseBooter{
+		Booter:     booter,
+		leases:     leases,
+		clientIP:   clientIP,
+		identities: identities,
+	}
+}
+
+// LeaseFilesBooter is LeaseBooter which also only reads the host's files,
+// or public ones, as servers such as TFTP read files by ID alone.
+func LeaseFilesBooter(booter pixiecore.Booter, leases *Leases, clientIP net.IP, files Files, tokens *FileTokens, identities *Identities) pixiecore.Booter {
+	b := LeaseBooter(booter, leases, clientIP, identities).(*leaseBooter)
+	b.checkFiles = true
+	b.files = files
+	b.tokens = tokens
+	return b
+}
+
+func (b *leaseBooter) BootSpec(m pixiecore.Machine) (*pixiecore.Spec, error) {
+	host := b.identities.Resolve(m.MAC.String())
+	if err := b.leases.CheckHost(host, b.identities, b.clientIP); err != nil {
+		return nil, fmt.Errorf("denied boot spec of '%s' to %s: %s", host, b.clientIP, err)
+	}
+	return b.Booter.BootSpec(m)
+}
+
+func (b *leaseBooter) ReadBootFile(id pixiecore.ID) (io.ReadCloser, int64, error) {
+	if !b.checkFiles {
+		return b.Booter.ReadBootFile(id)
+	}
+	fileID := string(id)
+	if b.tokens != nil {
+		var err error
+		fileID, err = b.tokens.Verify(fileID)
+		if err != nil {
+			return nil, -1, err
+		}
+	}
+	file, ok := b.files.Lookup(fileID)
+	if !ok {
+		return nil, -1, fmt.Errorf("unknown file '%s'", fileID)
+	}
+	if !file.Public {
+		if err := b.leases.CheckHost(file.Host, b.identities, b.clientIP); err != nil {
+			return nil, -1, fmt.Errorf("denied file '%s' to %s: %s", fileID, b.clientIP, err)
+		}
+	}
+	return b.Booter.ReadBootFile(id)
+}
@@ -0,0 +1,140 @@
+package pxeserver_test
+
+import (
+	"net"
+	"testing"
+
+	"github.com/ljfranklin/pxeserver"
+	"github.com/stretchr/testify/assert"
+	"go.universe.tf/netboot/dhcp4"
+)
+
+func TestLeasesIgnoreRequestedIP(t *testing.T) {
+	assert := assert.New(t)
+
+	mac, err := net.ParseMAC("52:54:00:12:34:56")
+	assert.NoError(err)
+
+	leases := pxeserver.NewLeases()
+	leases.Observe(&dhcp4.Packet{
+		Type:         dhcp4.MsgRequest,
+		HardwareAddr: mac,
+		ClientAddr:   net.IPv4zero,
+		Options: dhcp4.Options{
+			dhcp4.OptRequestedIP: net.ParseIP("10.0.0.20").To4(),
+		},
+	})
+
+	_, ok := leases.IP("52:54:00:12:34:56")
+	assert.False(ok)
+}
+
+func TestLeasesObserveAck(t *testing.T) {
+	assert := assert.New(t)
+
+	mac, err := net.ParseMAC("52:54:00:12:34:56")
+	assert.NoError(err)
+
+	leases := pxeserver.NewLeases()
+	leases.TrustedServers = []net.IP{net.ParseIP("10.0.0.1")}
+	leases.Observe(&dhcp4.Packet{
+		Type:         dhcp4.MsgAck,
+		HardwareAddr: mac,
+		YourAddr:     net.ParseIP("10.0.0.21"),
+		Options: dhcp4.Options{
+			dhcp4.OptServerIdentifier: net.ParseIP("10.0.0.1").To4(),
+		},
+	})
+
+	ip, ok := leases.IP("52:54:00:12:34:56")
+	assert.True(ok)
+	assert.True(ip.Equal(net.ParseIP("10.0.0.21")))
+}
+
+func TestLeasesIgnoreForgedAck(t *testing.T) {
+	assert := assert.New(t)
+
+	mac, err := net.ParseMAC("52:54:00:12:34:56")
+	assert.NoError(err)
+
+	leases := pxeserver.NewLeases()
+	leases.TrustedServers = []net.IP{net.ParseIP("10.0.0.1")}
+	for _, options := range []dhcp4.Options{
+		{dhcp4.OptServerIdentifier: net.ParseIP("10.0.0.99").To4()},
+		{},
+	} {
+		leases.Observe(&dhcp4.Packet{
+			Type:         dhcp4.MsgAck,
+			HardwareAddr: mac,
+			YourAddr:     net.ParseIP("10.0.0.99"),
+			Options:      options,
+		})
+	}
+
+	_, ok := leases.IP("52:54:00:12:34:56")
+	assert.False(ok)
+}
+
+func TestLeasesIgnoreDiscover(t *testing.T) {
+	assert := assert.New(t)
+
+	mac, err := net.ParseMAC("52:54:00:12:34:56")
+	assert.NoError(err)
+
+	leases := pxeserver.NewLeases()
+	leases.Observe(&dhcp4.Packet{
+		Type:         dhcp4.MsgDiscover,
+		HardwareAddr: mac,
+		Options:      dhcp4.Options{},
+	})
+
+	_, ok := leases.IP("52:54:00:12:34:56")
+	assert.False(ok)
+}
+
+func TestLeasesKeepIPv4AndIPv6Separately(t *testing.T) {
+	assert := assert.New(t)
+
+	leases := pxeserver.NewLeases()
+	leases.Set("52:54:00:12:34:56", net.ParseIP("10.0.0.20"))
+	leases.Set("52:54:00:12:34:56", net.ParseIP("2001:db8::100"))
+
+	ip, ok := leases.IP("52:54:00:12:34:56")
+	assert.True(ok)
+	assert.True(ip.Equal(net.ParseIP("10.0.0.20")))
+	ip, ok = leases.IP6("52:54:00:12:34:56")
+	assert.True(ok)
+	assert.True(ip.Equal(net.ParseIP("2001:db8::100")))
+}
+
+func TestLeasesObserveRelay(t *testing.T) {
+	assert := assert.New(t)
+
+	mac, err := net.ParseMAC("52:54:00:12:34:56")
+	assert.NoError(err)
+
+	leases := pxeserver.NewLeases()
+	leases.TrustedRelays = []net.IP{net.ParseIP("10.0.1.1")}
+	leases.Observe(&dhcp4.Packet{
+		Type:         dhcp4.MsgDiscover,
+		HardwareAddr: mac,
+		RelayAddr:    net.ParseIP("10.0.1.1"),
+		Options:      dhcp4.Options{},
+	})
+
+	relay, ok := leases.Relay("52:54:00:12:34:56")
+	assert.True(ok)
+	assert.True(relay.Equal(net.ParseIP("10.0.1.1")))
+	_, ok = leases.IP("52:54:00:12:34:56")
+	assert.False(ok)
+
+	leases.Observe(&dhcp4.Packet{
+		Type:         dhcp4.MsgDiscover,
+		HardwareAddr: mac,
+		RelayAddr:    net.ParseIP("10.0.2.1"),
+		Options:      dhcp4.Options{},
+	})
+	relay, ok = leases.Relay("52:54:00:12:34:56")
+	assert.True(ok)
+	assert.True(relay.Equal(net.ParseIP("10.0.1.1")))
+}
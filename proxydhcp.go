@@ -0,0 +1,92 @@
+package pxeserver
+
+import (
+	"errors"
+	"fmt"
+	"net"
+
+	"go.universe.tf/netboot/dhcp4"
+)
+
+// serveProxyDHCP watches for DHCP requests on port 67 of address without
+// binding the port, so Pixiecore and other DHCP servers are unaffected.
+// Packets wanted returns true for are answered with the offer from respond,
+// which may be nil to stay quiet.
+func serveProxyDHCP(address string, subsys string, wanted func(*dhcp4.Packet) bool, respond func(*dhcp4.Packet, net.IP) (*dhcp4.Packet, error), logFunc func(subsys, msg string)) error {
+	log := func(format string, args ...interface{}) {
+		if logFunc != nil {
+			logFunc(subsys, fmt.Sprintf(format, args...))
+		}
+	}
+
+	conn, err := dhcp4.NewSnooperConn(fmt.Sprintf("%s:%d", address, 67))
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	for {
+		pkt, intf, err := conn.RecvDHCP()
+		if err != nil {
+			return fmt.Errorf("Receiving DHCP packet: %s", err)
+		}
+		if !wanted(pkt) {
+			continue
+		}
+		localIP, err := interfaceIPv4(intf)
+		if err != nil {
+			log("Ignoring packet from %s on %s: %s", pkt.HardwareAddr, intf.Name, err)
+			continue
+		}
+		resp, err := respond(pkt, localIP)
+		if err != nil {
+			log("Not offering to boot %s: %s", pkt.HardwareAddr, err)
+			continue
+		}
+		if resp == nil {
+			continue
+		}
+		if err := conn.SendDHCP(resp, intf); err != nil {
+			log("Failed to send ProxyDHCP offer to %s: %s", pkt.HardwareAddr, err)
+			continue
+		}
+		if resp.BootFilename != "" {
+			log("Offered %s to %s", resp.BootFilename, pkt.HardwareAddr)
+		} else {
+			log("Sent ProxyDHCP offer to %s", pkt.HardwareAddr)
+		}
+	}
+}
+
+// proxyOffer is a ProxyDHCP offer for pkt without an address, which leaves
+// the lease to the DHCP server.
+func proxyOffer(pkt *dhcp4.Packet, localIP net.IP) *dhcp4.Packet {
+	resp := &dhcp4.Packet{
+		Type:          dhcp4.MsgOffer,
+		TransactionID: pkt.TransactionID,
+		Broadcast:     true,
+		HardwareAddr:  pkt.HardwareAddr,
+		RelayAddr:     pkt.RelayAddr,
+		ServerAddr:    localIP,
+		Options: dhcp4.Options{
+			dhcp4.OptServerIdentifier: localIP.To4(),
+		},
+	}
+	if relayInfo, ok := pkt.Options[optRelayAgentInfo]; ok {
+		resp.Options[optRelayAgentInfo] = relayInfo
+	}
+	return resp
+}
+
+func interfaceIPv4(intf *net.Interface) (net.IP, error) {
+	addrs, err := intf.Addrs()
+	if err != nil {
+		return nil, err
+	}
+	for _, addr := range addrs {
+		if ipNet, ok := addr.(*net.IPNet); ok && ipNet.IP.To4() != nil {
+			return ipNet.IP.To4(), nil
+		}
+	}
+	return nil, errors.New("interface has no IPv4 address")
+}
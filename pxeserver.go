@@ -1,89 +1,501 @@
 package pxeserver
 
 import (
+	"crypto/tls"
+	"errors"
+	"fmt"
 	"io"
+	"net"
+	"net/http"
 	"text/template"
+	"time"
 
 	"go.universe.tf/netboot/pixiecore"
-	"go.universe.tf/netboot/third_party/ipxe"
 )
 
 type Server struct {
-	Config      io.Reader
-	Address     string
-	LogFunc     func(subsys, msg string)
-	DHCPNoBind  bool
-	SecretsPath string
+	Config    io.Reader
+	Address   string
+	LogFunc   func(subsys, msg string)
+	DebugFunc func(subsys, msg string)
+	// DHCPNoBind forces server.dhcp_mode 'proxy'
+	DHCPNoBind bool
+	// IPv6Address is the address of the interface to answer DHCPv6 on,
+	// taking precedence over server.dhcpv6.address
+	IPv6Address string
+	// IPv4Disabled skips Pixiecore's IPv4 servers, e.g. on IPv6-only
+	// networks where server.dhcpv6 boots every host
+	IPv4Disabled bool
+	SecretsPath  string
+	// ShowSecrets disables masking secret values in LogFunc and DebugFunc
+	ShowSecrets bool
+	// FileTokenTTL is how long file URLs handed to a booting host remain
+	// valid, defaults to one hour
+	FileTokenTTL time.Duration
+	// AuditLogPath enables an audit log of secret reads and file renders
+	// and serves, rotated after AuditLogMaxSize bytes
+	AuditLogPath       string
+	AuditLogMaxSize    int64
+	AuditLogMaxBackups int
+	// OverrideSettings is called with the config's server block before it
+	// is used, e.g. to apply command line flags
+	OverrideSettings func(settings *ServerSettings)
 }
 
 func (s Server) Serve() error {
-	// TODO: ipxe flags
-	firmware := make(map[pixiecore.Firmware][]byte)
-	var err error
-	firmware[pixiecore.FirmwareEFI64], err = readAsset("bindeps/ipxe/x86_64/ipxe.efi")
+	builtinFirmware, err := builtinIpxeFirmware()
 	if err != nil {
 		return err
 	}
-	firmware[pixiecore.FirmwareEFIBC], err = readAsset("bindeps/ipxe/x86_64/ipxe.efi")
+	cfg, err := LoadConfig(s.Config)
 	if err != nil {
 		return err
 	}
-	firmware[pixiecore.FirmwareEFIArm64], err = readAsset("bindeps/ipxe/arm64/ipxe.efi")
-	if err != nil {
-		return err
+	settings := cfg.ServerSettings()
+	if s.OverrideSettings != nil {
+		s.OverrideSettings(&settings)
+		if err := settings.validate(); err != nil {
+			return err
+		}
 	}
-	// TODO: compile ARM 32
-	// TODO: compile this
-	firmware[pixiecore.FirmwareX86Ipxe] = ipxe.MustAsset("ipxe.pxe")
-	if err != nil {
-		return err
+	if s.IPv4Disabled && !settings.DHCPv6.Enabled {
+		return errors.New("server.dhcpv6 must be enabled when IPv4 is disabled")
 	}
-
-	cfg, err := LoadConfig(s.Config)
+	if s.IPv4Disabled && settings.DHCP.Enabled {
+		return errors.New("server.dhcp can't be enabled when IPv4 is disabled")
+	}
+	if settings.TLS.Enabled || settings.ImgVerify {
+		// the builtin iPXE firmware trusts neither pxeserver's certificate
+		// nor its code signing CA, see scripts/build_ipxe
+		if len(cfg.IpxeFirmware()[""]) == 0 {
+			return errors.New("server.tls and server.imgverify require server.ipxe firmware built to trust the certificates from 'pxeserver tls-cert' and 'pxeserver imgverify-ca', see scripts/build_ipxe")
+		}
+		builtinFirmware = nil
+	}
+	// generated keys must outlive the process to match the firmware
+	if s.SecretsPath == "" && settings.TLS.Enabled && settings.TLS.CertFile == "" {
+		return errors.New("server.tls requires --secrets to keep its generated certificate, or server.tls.cert_file and key_file")
+	}
+	if s.SecretsPath == "" && settings.ImgVerify {
+		return errors.New("server.imgverify requires --secrets to keep its code signing CA")
+	}
+	listeners, err := settings.listeners(s.Address)
 	if err != nil {
 		return err
 	}
-	var secrets Secrets
+	if s.IPv6Address != "" {
+		settings.DHCPv6.Address = s.IPv6Address
+	}
+	if settings.DHCPv6.Address == "" && listeners[0].IPv6 != nil {
+		settings.DHCPv6.Address = listeners[0].IPv6.String()
+	}
+	if settings.DHCPv6.Enabled && settings.DHCPv6.Address == "" {
+		return errors.New("server.dhcpv6 requires an address to listen on")
+	}
+	var secrets SecretsStore
+	migratedSecrets := map[string]string{}
 	if s.SecretsPath != "" {
 		secrets, err = LoadLocalSecrets(s.SecretsPath, cfg.SecretDefs())
 		if err != nil {
 			return err
 		}
+		migratedSecrets, err = MigrateSecrets(secrets, cfg.HostMACs())
+		if err != nil {
+			return err
+		}
+	}
+	tokenKey, err := loadFileTokenKey(secrets)
+	if err != nil {
+		return err
+	}
+	tokenTTL := s.FileTokenTTL
+	if tokenTTL == 0 {
+		tokenTTL = time.Hour
+	}
+	tokens := NewFileTokens(tokenKey, tokenTTL)
+	var audit *AuditLog
+	if s.AuditLogPath != "" {
+		audit, err = OpenAuditLog(s.AuditLogPath, s.AuditLogMaxSize, s.AuditLogMaxBackups)
+		if err != nil {
+			return err
+		}
+		defer audit.Close()
+	}
+	var redactor *Redactor
+	if !s.ShowSecrets {
+		redactor = NewRedactor()
+	}
+	logFunc := redactor.RedactLogFunc(s.LogFunc)
+	debugFunc := redactor.RedactLogFunc(s.DebugFunc)
+	if settings.Debug && debugFunc == nil {
+		debugFunc = logFunc
+	}
+	if logFunc != nil {
+		for mac, name := range migratedSecrets {
+			logFunc("Secrets", fmt.Sprintf("Moved secrets of host '%s' from its MAC '%s'", name, mac))
+		}
 	}
 	renderer := Renderer{
-		Secrets: secrets,
+		Secrets:    secrets,
+		Scopes:     cfg.SecretScopes(),
+		FileTokens: tokens,
+		Audit:      audit,
+		Redactor:   redactor,
+		Subnets:    cfg.HostSubnets(),
 	}
 	files, err := LoadFiles(cfg.Files(), renderer)
 	if err != nil {
 		return err
 	}
+	firmware := NewIpxeFirmware(builtinFirmware, cfg.IpxeFirmware())
+	firmware.Files = files
+	firmware.Audit = audit
+
+	identities := NewIdentities(cfg.HostNames(), cfg.HostMACs(), cfg.SMBIOSHosts())
+	identifySMBIOS := len(cfg.SMBIOSHosts()) > 0
 
 	cmdlineTransform := func(tpl string, mac string, funcs template.FuncMap) (string, error) {
-		vars, err := cfg.VarsForHost(mac)
+		host := identities.Resolve(mac)
+		vars, err := cfg.VarsForHost(host)
 		if err != nil {
 			return "", err
 		}
 		return renderer.RenderCmdline(RenderCmdlineArgs{
 			Template:   tpl,
-			Mac:        mac,
+			Host:       host,
 			Vars:       vars,
 			ExtraFuncs: funcs,
 			Files:      files,
 		})
 	}
 
-	booter, err := ConfigBooter(cfg.Pixiecore(), files)
+	booter, err := ConfigBooter(cfg.Pixiecore(), files, tokens, audit)
 	if err != nil {
 		return err
 	}
-
-	server := &pixiecore.Server{
-		Address:          s.Address,
-		CmdlineTransform: cmdlineTransform,
+	if settings.HTTPAddress == "" && logFunc != nil {
+		// Pixiecore's HTTP server doesn't tell the booter which client asks
+		logFunc("Security", "Pixiecore hands a host's boot script and file tokens to any client asking for its MAC, set server.http_address to only hand them to the host at its lease")
+	}
+	var grub *Grub
+	if len(cfg.GrubHosts()) > 0 {
+		grub, err = LoadGrub(settings.Grub, cfg.GrubHosts())
+		if err != nil {
+			return err
+		}
+		grub.Booter = booter
+		grub.CmdlineTransform = cmdlineTransform
+	}
+	var uboot *UBoot
+	if len(cfg.UBootHosts()) > 0 {
+		uboot = NewUBoot(cfg.UBootHosts(), cfg.DHCPReservations())
+		uboot.Booter = booter
+		uboot.Tokens = tokens
+		uboot.CmdlineTransform = cmdlineTransform
+	}
+	var rpi *RaspberryPi
+	if len(cfg.RaspberryPiHosts()) > 0 {
+		rpi, err = NewRaspberryPi(settings.RaspberryPi, cfg.RaspberryPiHosts())
+		if err != nil {
+			return err
+		}
+		rpi.Files = files
+		rpi.Identities = identities
+		rpi.Audit = audit
+	}
+	var tftpFiles *TFTPFiles
+	if len(cfg.TFTPFiles()) > 0 {
+		tftpFiles = NewTFTPFiles(cfg.TFTPFiles(), cfg.DHCPReservations())
+		tftpFiles.Files = files
+		tftpFiles.HostVars = cfg.VarsForHost
+		tftpFiles.Identities = identities
+		tftpFiles.Audit = audit
+	}
+	tftpHandler := TFTPHandler{
 		Booter:           booter,
-		Ipxe:             firmware,
-		Log:              s.LogFunc,
-		DHCPNoBind:       s.DHCPNoBind,
+		Firmware:         firmware,
+		CmdlineTransform: cmdlineTransform,
+		Grub:             grub,
+		UBoot:            uboot,
+		RaspberryPi:      rpi,
+		Files:            tftpFiles,
+		Identities:       identities,
+		HTTPPort:         settings.Ports.HTTP,
+		LogFunc:          logFunc,
+	}
+	if tftpHandler.HTTPPort == 0 {
+		tftpHandler.HTTPPort = 80
+	}
+	tftpPort := settings.Ports.TFTP
+	if tftpPort == 0 {
+		tftpPort = 69
+	}
+
+	errs := make(chan error, 6+6*len(listeners))
+	var dhcpServer *DHCPServer
+	if settings.DHCP.Enabled {
+		dhcpServer, err = NewDHCPServer(settings.DHCP, cfg.DHCPReservations())
+		if err != nil {
+			return err
+		}
+		dhcpServer.LogFunc = logFunc
+		dhcpServer.UBoot = uboot
+		dhcpServer.RaspberryPi = rpi
+		dhcpServer.Identities = identities
+	}
+	// leases bind the boot scripts and configs which hand out tokens for a
+	// host's files to that host, tell which subnet a host behind a relay
+	// boots from, and bind Pi config.txt and cmdline.txt, which may hold
+	// secrets, to the Pi
+	var leases *Leases
+	if settings.HTTPAddress != "" || len(settings.DHCP.Subnets) > 0 || settings.StatusPort != 0 || rpi != nil {
+		leases = NewLeases()
+		if dhcpServer != nil {
+			dhcpServer.OnAck = leases.Set
+		} else if !s.IPv4Disabled {
+			if settings.HTTPAddress != "" && len(settings.TrustedDHCPServers) == 0 {
+				return errors.New("server.http_address only hands a host's boot script and file tokens to the host at its lease, which requires server.dhcp to be enabled or server.trusted_dhcp_servers to be set")
+			}
+			if rpi != nil && len(settings.TrustedDHCPServers) == 0 {
+				return errors.New("hosts with bootloader 'raspberrypi' are only served their config.txt and cmdline.txt at their lease, which requires server.dhcp to be enabled or server.trusted_dhcp_servers to be set")
+			}
+			for _, ip := range settings.TrustedDHCPServers {
+				leases.TrustedServers = append(leases.TrustedServers, net.ParseIP(ip))
+			}
+			for _, ip := range settings.TrustedRelays {
+				leases.TrustedRelays = append(leases.TrustedRelays, net.ParseIP(ip))
+			}
+			for _, l := range listeners {
+				address := l.Address
+				go func() { errs <- SnoopLeases(address, leases) }()
+			}
+		}
+	}
+	if uboot != nil {
+		uboot.Leases = leases
+	}
+	if tftpFiles != nil {
+		tftpFiles.Leases = leases
+	}
+	if rpi != nil {
+		rpi.Leases = leases
+	}
+	if settings.HTTPAddress != "" {
+		tftpHandler.Leases = leases
+		tftpHandler.BindFilesToLease = settings.BindFilesToLease
+		tftpHandler.HostFiles = files
+		tftpHandler.Tokens = tokens
+	}
+	var dhcpv6Server *pixiecore.ServerV6
+	var httpBoot *HTTPBootConfiguration
+	if settings.HTTPAddress != "" {
+		handler := HTTPHandler{
+			BaseURL:          settings.BaseURL(),
+			Booter:           booter,
+			Files:            files,
+			Tokens:           tokens,
+			CmdlineTransform: cmdlineTransform,
+			Firmware:         firmware,
+			Grub:             grub,
+			Identities:       identities,
+			Audit:            audit,
+			LogFunc:          logFunc,
+		}
+		if settings.ImgVerify {
+			handler.Signer, err = LoadCodeSigner(secrets)
+			if err != nil {
+				return err
+			}
+		}
+		handler.Leases = leases
+		handler.BindFilesToLease = settings.BindFilesToLease
+		handler.URLs, err = NewSubnetURLs(settings, cfg.HostSubnets(), leases)
+		if err != nil {
+			return err
+		}
+		if identifySMBIOS {
+			booter = IdentityBooter(booter, identities, handler.URLs)
+			handler.Booter = booter
+			tftpHandler.Booter = booter
+		}
+		httpBoot = &HTTPBootConfiguration{
+			Booter: booter,
+			URLs:   handler.URLs,
+			Modes:  cfg.HTTPBootModes(),
+			Grub:   grub,
+		}
+		tftpHandler.URLs = handler.URLs
+		if dhcpServer != nil {
+			dhcpServer.HTTPBoot = httpBoot
+		}
+		for _, l := range listeners {
+			if len(l.Hosts) > 0 {
+				if handler.InterfaceHosts == nil {
+					handler.InterfaceHosts = make(map[string][]string)
+				}
+				handler.InterfaceHosts[l.Address] = l.Hosts
+				if l.IPv6 != nil {
+					handler.InterfaceHosts[l.IPv6.String()] = l.Hosts
+				}
+			}
+		}
+		if settings.DHCPv6.Enabled {
+			pool, err := NewDHCPv6AddressPool(settings.DHCPv6)
+			if err != nil {
+				return err
+			}
+			if leases != nil {
+				pool.OnReserve = leases.Set
+			}
+			dhcpv6Server, err = NewDHCPv6Server(settings.DHCPv6, settings.BaseURL(), *httpBoot, pool)
+			if err != nil {
+				return err
+			}
+			dhcpv6Server.Log = logFunc
+			dhcpv6Server.Debug = debugFunc
+		}
+		httpServer := &http.Server{
+			Addr:    settings.HTTPAddress,
+			Handler: handler,
+		}
+		if settings.TLS.Enabled {
+			certPEM, keyPEM, err := LoadTLSCertificate(settings, secrets)
+			if err != nil {
+				return err
+			}
+			cert, err := tls.X509KeyPair(certPEM, keyPEM)
+			if err != nil {
+				return err
+			}
+			httpServer.TLSConfig = &tls.Config{Certificates: []tls.Certificate{cert}}
+			go func() { errs <- httpServer.ListenAndServeTLS("", "") }()
+		} else {
+			go func() { errs <- httpServer.ListenAndServe() }()
+		}
+
+		booter = ChainBooter(booter, handler.URLs)
+	}
+	// U-Boot and Pi bootloaders would take Pixiecore's ProxyDHCP offer,
+	// which they can't boot from
+	excludedHosts := []string{}
+	for mac := range cfg.UBootHosts() {
+		excludedHosts = append(excludedHosts, mac)
+	}
+	for mac := range cfg.RaspberryPiHosts() {
+		excludedHosts = append(excludedHosts, mac)
+	}
+	if len(excludedHosts) > 0 {
+		booter = ExcludeBooter(booter, excludedHosts)
+	}
+	if settings.StatusPort != 0 {
+		hosts := []string{}
+		for mac := range cfg.Pixiecore() {
+			hosts = append(hosts, string(mac))
+		}
+		statusServer := &http.Server{
+			Addr: fmt.Sprintf(":%d", settings.StatusPort),
+			Handler: StatusHandler{
+				Hosts:      hosts,
+				Interfaces: settings.Interfaces,
+				Leases:     leases,
+			},
+		}
+		go func() { errs <- statusServer.ListenAndServe() }()
+	}
+
+	servers := []*pixiecore.Server{}
+	dhcpAddresses := []string{}
+	dhcpBound := false
+	for _, l := range listeners {
+		if s.IPv4Disabled || l.Address == "" {
+			continue
+		}
+		listenerBooter := booter
+		listenerTFTP := tftpHandler
+		if len(l.Hosts) > 0 {
+			// Pixiecore and TFTP read files by ID alone, so the booter
+			// keeps them to the interface's hosts
+			listenerBooter = InterfaceFilesBooter(booter, l.Hosts, files, tokens, identities)
+			listenerTFTP.Booter = InterfaceFilesBooter(tftpHandler.Booter, l.Hosts, files, tokens, identities)
+			if grub != nil {
+				listenerTFTP.Grub = grub.OnlyHosts(l.Hosts)
+				listenerTFTP.Grub.Booter = InterfaceFilesBooter(grub.Booter, l.Hosts, files, tokens, identities)
+			}
+			if uboot != nil {
+				listenerTFTP.UBoot = uboot.OnlyHosts(l.Hosts)
+				listenerTFTP.UBoot.Booter = InterfaceFilesBooter(uboot.Booter, l.Hosts, files, tokens, identities)
+			}
+			if rpi != nil {
+				listenerTFTP.RaspberryPi = rpi.OnlyHosts(l.Hosts)
+			}
+		}
+		address := l.Address
+		go func() { errs <- ServeTFTP(fmt.Sprintf("%s:%d", address, tftpPort), listenerTFTP) }()
+		if identifySMBIOS && dhcpServer == nil {
+			go func() { errs <- SnoopIdentities(address, identities, logFunc) }()
+		}
+		if settings.DHCPMode == "none" {
+			continue
+		}
+		// pxeserver answers TFTP itself so each host can be sent its own
+		// bootloader
+		pixiecoreTFTPPort, err := unusedUDPPort(l.Address)
+		if err != nil {
+			return err
+		}
+		server := &pixiecore.Server{
+			Address:          l.Address,
+			CmdlineTransform: cmdlineTransform,
+			Booter:           listenerBooter,
+			Ipxe:             firmware.PixiecoreFirmware(),
+			Log:              logFunc,
+			Debug:            debugFunc,
+			HTTPPort:         settings.Ports.HTTP,
+			DHCPPort:         settings.Ports.DHCP,
+			TFTPPort:         pixiecoreTFTPPort,
+			PXEPort:          settings.Ports.PXE,
+			// the built-in DHCP server binds port 67 instead, and it can
+			// only be bound once so later listeners snoop on it
+			DHCPNoBind: s.DHCPNoBind || settings.DHCPMode != "bind" || dhcpServer != nil || dhcpBound,
+		}
+		dhcpBound = dhcpBound || !server.DHCPNoBind
+		servers = append(servers, server)
+		go func() { errs <- server.Serve() }()
+		if dhcpServer != nil {
+			dhcpAddresses = append(dhcpAddresses, address)
+		} else if httpBoot != nil {
+			// Pixiecore ignores UEFI HTTP Boot clients
+			proxy := &HTTPBootProxy{
+				HTTPBoot: *httpBoot,
+				LogFunc:  logFunc,
+			}
+			if len(l.Hosts) > 0 {
+				proxy.HTTPBoot.Booter = InterfaceBooter(httpBoot.Booter, l.Hosts)
+			}
+			go func() { errs <- proxy.Serve(address) }()
+		}
+		if dhcpServer == nil && rpi != nil {
+			proxy := &RaspberryPiProxy{
+				RaspberryPi: rpi,
+				Hosts:       l.Hosts,
+				LogFunc:     logFunc,
+			}
+			go func() { errs <- proxy.Serve(address) }()
+		}
+	}
+	if len(dhcpAddresses) > 0 {
+		go func() { errs <- dhcpServer.Serve(dhcpAddresses) }()
+	}
+	if dhcpv6Server != nil {
+		go func() { errs <- dhcpv6Server.Serve() }()
+	}
+
+	err = <-errs
+	for _, server := range servers {
+		server.Shutdown()
+	}
+	if dhcpv6Server != nil {
+		dhcpv6Server.Shutdown()
 	}
-	return server.Serve()
+	return err
 }
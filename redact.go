@@ -0,0 +1,139 @@
+package pxeserver
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"reflect"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+)
+
+const redactedValue = "<redacted>"
+
+// Shorter values are not masked as they would match unrelated output
+const minRedactLength = 4
+
+var base64Pattern = regexp.MustCompile(`[A-Za-z0-9+/_-]{16,}={0,2}`)
+
+var base64Encodings = []*base64.Encoding{
+	base64.StdEncoding,
+	base64.URLEncoding,
+	base64.RawStdEncoding,
+	base64.RawURLEncoding,
+}
+
+// Redactor masks secret values in log and preview output. Values are added
+// as templates read them, a nil Redactor leaves output unchanged.
+type Redactor struct {
+	values []string
+	mu     sync.RWMutex
+}
+
+func NewRedactor() *Redactor {
+	return &Redactor{}
+}
+
+// Add tracks every string within secret, e.g. each field of an SSH key.
+func (r *Redactor) Add(secret interface{}) {
+	if r == nil {
+		return
+	}
+	values := []string{}
+	collectSecretStrings(reflect.ValueOf(secret), &values)
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for _, value := range values {
+		if len(value) < minRedactLength {
+			continue
+		}
+		r.addValue(value)
+		// secrets embedded in JSON vars have newlines, quotes, etc. escaped
+		if encoded, err := json.Marshal(value); err == nil {
+			r.addValue(strings.Trim(string(encoded), `"`))
+		}
+	}
+	// longest first so a secret containing another is masked whole
+	sort.Slice(r.values, func(i, j int) bool {
+		return len(r.values[i]) > len(r.values[j])
+	})
+}
+
+func (r *Redactor) addValue(value string) {
+	for _, existing := range r.values {
+		if existing == value {
+			return
+		}
+	}
+	r.values = append(r.values, value)
+}
+
+// Redact replaces each tracked secret in s, along with any base64 blob
+// which decodes to a string containing a tracked secret.
+func (r *Redactor) Redact(s string) string {
+	if r == nil {
+		return s
+	}
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	if len(r.values) == 0 {
+		return s
+	}
+
+	s = r.replaceValues(s)
+	return base64Pattern.ReplaceAllStringFunc(s, func(blob string) string {
+		for _, encoding := range base64Encodings {
+			decoded, err := encoding.DecodeString(blob)
+			if err != nil {
+				continue
+			}
+			if r.replaceValues(string(decoded)) != string(decoded) {
+				return redactedValue
+			}
+		}
+		return blob
+	})
+}
+
+func (r *Redactor) replaceValues(s string) string {
+	for _, value := range r.values {
+		s = strings.ReplaceAll(s, value, redactedValue)
+	}
+	return s
+}
+
+// RedactLogFunc wraps logFunc to mask secrets in each message.
+func (r *Redactor) RedactLogFunc(logFunc func(subsys, msg string)) func(subsys, msg string) {
+	if r == nil || logFunc == nil {
+		return logFunc
+	}
+	return func(subsys, msg string) {
+		logFunc(subsys, r.Redact(msg))
+	}
+}
+
+func collectSecretStrings(v reflect.Value, values *[]string) {
+	switch v.Kind() {
+	case reflect.Interface, reflect.Ptr:
+		if !v.IsNil() {
+			collectSecretStrings(v.Elem(), values)
+		}
+	case reflect.Map:
+		mapIter := v.MapRange()
+		for mapIter.Next() {
+			collectSecretStrings(mapIter.Value(), values)
+		}
+	case reflect.Slice:
+		if v.Type().Elem().Kind() == reflect.Uint8 {
+			*values = append(*values, string(v.Bytes()))
+			return
+		}
+		for i := 0; i < v.Len(); i++ {
+			collectSecretStrings(v.Index(i), values)
+		}
+	case reflect.String:
+		*values = append(*values, v.String())
+	}
+}
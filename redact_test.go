@@ -0,0 +1,90 @@
+package pxeserver_test
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"testing"
+
+	"github.com/ljfranklin/pxeserver"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRedactorMasksSecrets(t *testing.T) {
+	assert := assert.New(t)
+
+	redactor := pxeserver.NewRedactor()
+	redactor.Add("some-password")
+
+	assert.Equal("root_pw=<redacted> quiet", redactor.Redact("root_pw=some-password quiet"))
+	assert.Equal("nothing secret", redactor.Redact("nothing secret"))
+}
+
+func TestRedactorMasksSecretFields(t *testing.T) {
+	assert := assert.New(t)
+
+	redactor := pxeserver.NewRedactor()
+	redactor.Add(map[string]interface{}{
+		"private_key": "-----BEGIN KEY-----\nsome-private-key\n-----END KEY-----\n",
+		"public_key":  "ssh-ed25519 some-public-key",
+	})
+
+	assert.Equal("key=<redacted>", redactor.Redact("key=ssh-ed25519 some-public-key"))
+
+	// JSON escapes the newlines in multi-line secrets
+	encoded, err := json.Marshal(map[string]string{
+		"key": "-----BEGIN KEY-----\nsome-private-key\n-----END KEY-----\n",
+	})
+	assert.NoError(err)
+	assert.Equal(`{"key":"<redacted>"}`, redactor.Redact(string(encoded)))
+}
+
+func TestRedactorMasksBase64EncodedSecrets(t *testing.T) {
+	assert := assert.New(t)
+
+	redactor := pxeserver.NewRedactor()
+	redactor.Add("some-password")
+
+	installer, err := json.Marshal(map[string]string{
+		"hostname": "some-host",
+		"password": "some-password",
+	})
+	assert.NoError(err)
+	cmdline := "netboot_installer=" + base64.StdEncoding.EncodeToString(installer) + " quiet"
+	assert.Equal("netboot_installer=<redacted> quiet", redactor.Redact(cmdline))
+
+	unrelated := "netboot_installer=" + base64.StdEncoding.EncodeToString([]byte(`{"hostname":"some-host"}`))
+	assert.Equal(unrelated, redactor.Redact(unrelated))
+}
+
+func TestRedactorIgnoresShortValues(t *testing.T) {
+	assert := assert.New(t)
+
+	redactor := pxeserver.NewRedactor()
+	redactor.Add("a")
+
+	assert.Equal("a b c", redactor.Redact("a b c"))
+}
+
+func TestRedactorNilLeavesOutputUnchanged(t *testing.T) {
+	assert := assert.New(t)
+
+	var redactor *pxeserver.Redactor
+	redactor.Add("some-password")
+
+	assert.Equal("root_pw=some-password", redactor.Redact("root_pw=some-password"))
+}
+
+func TestRedactLogFunc(t *testing.T) {
+	assert := assert.New(t)
+
+	redactor := pxeserver.NewRedactor()
+	redactor.Add("some-password")
+
+	logs := []string{}
+	logFunc := redactor.RedactLogFunc(func(subsys, msg string) {
+		logs = append(logs, msg)
+	})
+	logFunc("HTTP", "cmdline root_pw=some-password")
+
+	assert.Equal([]string{"cmdline root_pw=<redacted>"}, logs)
+}
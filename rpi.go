@@ -0,0 +1,279 @@
+package pxeserver
+
+import (
+	"encoding/hex"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+
+	"go.universe.tf/netboot/dhcp4"
+)
+
+const (
+	// BootloaderRaspberryPi serves the Raspberry Pi's own network boot,
+	// which fetches its firmware, config.txt and kernel over TFTP without
+	// iPXE
+	BootloaderRaspberryPi = "raspberrypi"
+
+	// raspberryPiBootMenu is the PXE menu item Pi bootloaders look for in
+	// option 43 before accepting an offer
+	raspberryPiBootMenu = "Raspberry Pi Boot"
+	pxeVendorClass      = "PXEClient"
+)
+
+// raspberryPiTemplates are rendered with the host's vars and secrets when
+// served from server.raspberry_pi.firmware_dir.
+var raspberryPiTemplates = []string{"config.txt", "cmdline.txt"}
+
+type RaspberryPiSettings struct {
+	// FirmwareDir is the boot partition served to every Pi, e.g.
+	// bootcode.bin, start4.elf, kernels and device trees
+	FirmwareDir string `json:"firmware_dir"`
+}
+
+func validateRaspberryPiSerial(serial string) error {
+	if _, err := hex.DecodeString(serial); err != nil || len(serial) != 8 {
+		return fmt.Errorf("invalid serial '%s': must be the last 8 hex digits of the Raspberry Pi's serial number", serial)
+	}
+	return nil
+}
+
+func raspberryPiTemplateID(mac string, name string) string {
+	return fmt.Sprintf("%s-__rpi_%s__", mac, name)
+}
+
+// RaspberryPi serves hosts with bootloader 'raspberrypi' over TFTP. Pis
+// request files below a directory named after their serial or, if
+// configured to, their MAC. config.txt and cmdline.txt are rendered for
+// the host, everything else comes from the firmware directory.
+type RaspberryPi struct {
+	firmwareDir string
+	hosts       map[string]bool
+	serials     map[string]string
+
+	Files Files
+	// Identities resolves the MAC a Pi requests files by to its host's
+	// name, if non-nil
+	Identities *Identities
+	// Leases restricts each host's config.txt and cmdline.txt to the IP it
+	// leased, if non-nil
+	Leases *Leases
+	Audit  *AuditLog
+}
+
+// NewRaspberryPi serves settings.FirmwareDir to hosts, which maps each
+// host's MAC to its serial.
+func NewRaspberryPi(settings RaspberryPiSettings, hosts map[string]string) (*RaspberryPi, error) {
+	info, err := os.Stat(settings.FirmwareDir)
+	if err != nil {
+		return nil, fmt.Errorf("reading server.raspberry_pi.firmware_dir: %s", err)
+	}
+	if !info.IsDir() {
+		return nil, fmt.Errorf("server.raspberry_pi.firmware_dir '%s' is not a directory", settings.FirmwareDir)
+	}
+	r := &RaspberryPi{
+		firmwareDir: settings.FirmwareDir,
+		hosts:       make(map[string]bool),
+		serials:     make(map[string]string),
+	}
+	for mac, serial := range hosts {
+		r.hosts[mac] = true
+		if serial != "" {
+			r.serials[serial] = mac
+		}
+	}
+	return r, nil
+}
+
+// IsHost reports whether the host with the given MAC boots as a Pi.
+func (r *RaspberryPi) IsHost(mac string) bool {
+	return r.hosts[mac]
+}
+
+// OnlyHosts returns a copy of r which serves just the hosts with the given
+// MACs, e.g. those on one interface.
+func (r *RaspberryPi) OnlyHosts(macs []string) *RaspberryPi {
+	only := *r
+	only.hosts = make(map[string]bool)
+	only.serials = make(map[string]string)
+	for _, mac := range macs {
+		if r.hosts[mac] {
+			only.hosts[mac] = true
+		}
+	}
+	for serial, mac := range r.serials {
+		if only.hosts[mac] {
+			only.serials[serial] = mac
+		}
+	}
+	return &only
+}
+
+// Open returns the file at p for the client at clientAddr, or false if p
+// isn't a Raspberry Pi path. Paths outside a host's directory are served
+// from the firmware directory, e.g. the Pi 3's bootcode.bin, except for
+// templates which need a host to render.
+func (r *RaspberryPi) Open(p string, clientAddr net.Addr) (io.ReadCloser, int64, bool, error) {
+	p = strings.TrimPrefix(path.Clean("/"+p), "/")
+	elems := strings.SplitN(p, "/", 2)
+	if len(elems) == 2 {
+		if mac, ok := r.prefixHost(elems[0]); ok {
+			f, size, err := r.openHostFile(mac, elems[1], clientAddr)
+			return f, size, true, err
+		}
+	}
+	if isRaspberryPiTemplate(p) {
+		return nil, 0, false, nil
+	}
+	f, size, err := r.openFirmwareFile(p)
+	if os.IsNotExist(err) {
+		return nil, 0, false, nil
+	}
+	return f, size, true, err
+}
+
+func (r *RaspberryPi) prefixHost(prefix string) (string, bool) {
+	if mac, ok := r.serials[strings.ToLower(prefix)]; ok {
+		return mac, true
+	}
+	mac, err := net.ParseMAC(prefix)
+	if err != nil || !r.IsHost(mac.String()) {
+		return "", false
+	}
+	return mac.String(), true
+}
+
+func (r *RaspberryPi) openHostFile(mac string, name string, clientAddr net.Addr) (io.ReadCloser, int64, error) {
+	if !isRaspberryPiTemplate(name) {
+		return r.openFirmwareFile(name)
+	}
+
+	host := r.Identities.Resolve(mac)
+	client := ""
+	if clientAddr != nil {
+		client = clientAddr.String()
+	}
+	// templates may render the host's secrets
+	if r.Leases != nil {
+		clientHost, _, err := net.SplitHostPort(client)
+		if err != nil {
+			return nil, 0, fmt.Errorf("denied '%s' to %s: %s", name, client, err)
+		}
+		if err := r.Leases.Check(host, r.Identities.MACs(host), net.ParseIP(clientHost)); err != nil {
+			return nil, 0, fmt.Errorf("denied '%s' to %s: %s", name, client, err)
+		}
+	}
+	id := raspberryPiTemplateID(host, name)
+	f, size, err := r.Files.Read(id)
+	if err != nil {
+		return nil, 0, err
+	}
+	if err := r.Audit.Record(AuditEvent{
+		Event:  AuditFileServe,
+		Host:   host,
+		FileID: id,
+		Client: client,
+	}); err != nil {
+		f.Close()
+		return nil, 0, err
+	}
+	return f, size, nil
+}
+
+func isRaspberryPiTemplate(name string) bool {
+	for _, template := range raspberryPiTemplates {
+		if name == template {
+			return true
+		}
+	}
+	return false
+}
+
+func (r *RaspberryPi) openFirmwareFile(name string) (io.ReadCloser, int64, error) {
+	filePath := filepath.Join(r.firmwareDir, filepath.FromSlash(name))
+	f, err := os.Open(filePath)
+	if err != nil {
+		return nil, 0, err
+	}
+	info, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return nil, 0, err
+	}
+	if !info.Mode().IsRegular() {
+		f.Close()
+		return nil, 0, fmt.Errorf("'%s' is not a file", name)
+	}
+	return f, info.Size(), nil
+}
+
+// isBootRequest reports whether pkt is from the bootloader of a Pi host,
+// rather than the OS it boots.
+func (r *RaspberryPi) isBootRequest(pkt *dhcp4.Packet) bool {
+	vendorClass, err := pkt.Options.String(dhcp4.OptVendorIdentifier)
+	return err == nil && strings.HasPrefix(vendorClass, pxeVendorClass) && r.IsHost(pkt.HardwareAddr.String())
+}
+
+// setRaspberryPiOptions points a Pi at the TFTP server on serverIP, unless
+// resp already names a server.
+func setRaspberryPiOptions(resp *dhcp4.Packet, serverIP net.IP) {
+	resp.Options[dhcp4.OptVendorIdentifier] = []byte(pxeVendorClass)
+	resp.Options[dhcp4.OptVendorSpecific] = raspberryPiVendorOptions()
+	if resp.ServerAddr == nil {
+		resp.ServerAddr = serverIP
+	}
+}
+
+// raspberryPiVendorOptions are PXE options 6 (discovery control), 10 (menu
+// prompt) and 9 (boot menu), with the single menu item Pis look for.
+func raspberryPiVendorOptions() []byte {
+	b := []byte{6, 1, 3, 10, 4, 0, 'P', 'X', 'E'}
+	b = append(b, 9, byte(3+len(raspberryPiBootMenu)), 0, 0, byte(len(raspberryPiBootMenu)))
+	b = append(b, raspberryPiBootMenu...)
+	return append(b, 255)
+}
+
+// RaspberryPiProxy answers Pi bootloaders as ProxyDHCP, for when the
+// built-in DHCP server isn't enabled.
+type RaspberryPiProxy struct {
+	RaspberryPi *RaspberryPi
+	// Hosts limits answering to these MACs if non-empty, e.g. the hosts on
+	// the proxy's interface
+	Hosts   []string
+	LogFunc func(subsys, msg string)
+}
+
+// Serve answers Pi bootloaders on address.
+func (p *RaspberryPiProxy) Serve(address string) error {
+	return serveProxyDHCP(address, "RaspberryPi", p.wanted, p.Respond, p.LogFunc)
+}
+
+// Respond builds the ProxyDHCP offer for pkt, received on the interface with
+// address localIP, or returns nil if pkt isn't a Pi bootloader's DISCOVER.
+func (p *RaspberryPiProxy) Respond(pkt *dhcp4.Packet, localIP net.IP) (*dhcp4.Packet, error) {
+	if pkt.Type != dhcp4.MsgDiscover || !p.wanted(pkt) {
+		return nil, nil
+	}
+	resp := proxyOffer(pkt, localIP)
+	setRaspberryPiOptions(resp, localIP)
+	return resp, nil
+}
+
+func (p *RaspberryPiProxy) wanted(pkt *dhcp4.Packet) bool {
+	if !p.RaspberryPi.isBootRequest(pkt) {
+		return false
+	}
+	if len(p.Hosts) == 0 {
+		return true
+	}
+	for _, mac := range p.Hosts {
+		if mac == pkt.HardwareAddr.String() {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,196 @@
+package pxeserver_test
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net"
+	"path"
+	"strings"
+	"testing"
+
+	"github.com/ljfranklin/pxeserver"
+	"github.com/stretchr/testify/assert"
+	"go.universe.tf/netboot/dhcp4"
+)
+
+func newTestRaspberryPi(assert *assert.Assertions) *pxeserver.RaspberryPi {
+	input := strings.NewReader(fmt.Sprintf(`
+server:
+  raspberry_pi:
+    firmware_dir: %s
+vars:
+  kernel: kernel8.img
+hosts:
+- mac: "dc:a6:32:01:02:03"
+  bootloader: raspberrypi
+  serial: F00DCAFE
+  vars:
+    hostname: pi-1
+  files:
+  - id: kernel8.img
+    path: %s
+`, path.Join(fixturesDir(), "rpi"), path.Join(fixturesDir(), "files", "simple.txt")))
+	cfg, err := pxeserver.LoadConfig(input)
+	assert.NoError(err)
+	files, err := pxeserver.LoadFiles(cfg.Files(), pxeserver.Renderer{})
+	assert.NoError(err)
+
+	rpi, err := pxeserver.NewRaspberryPi(cfg.ServerSettings().RaspberryPi, cfg.RaspberryPiHosts())
+	assert.NoError(err)
+	rpi.Files = files
+	return rpi
+}
+
+func readRaspberryPiFile(assert *assert.Assertions, rpi *pxeserver.RaspberryPi, p string) (string, bool, error) {
+	f, _, ok, err := rpi.Open(p, nil)
+	if !ok || err != nil {
+		return "", ok, err
+	}
+	contents, err := ioutil.ReadAll(f)
+	assert.NoError(err)
+	return string(contents), true, nil
+}
+
+func TestRaspberryPiServesFirmware(t *testing.T) {
+	assert := assert.New(t)
+
+	rpi := newTestRaspberryPi(assert)
+
+	for p, expected := range map[string]string{
+		"bootcode.bin":                             "some-bootcode\n",
+		"f00dcafe/start4.elf":                      "some-start4\n",
+		"dc-a6-32-01-02-03/start4.elf":             "some-start4\n",
+		"f00dcafe/overlays/uart.dtbo":              "some-overlay\n",
+		"f00dcafe/config.txt":                      "arm_64bit=1\nkernel=kernel8.img\n",
+		"f00dcafe/cmdline.txt":                     "console=serial0,115200 hostname=pi-1\n",
+		"dc-a6-32-01-02-03/../../start4.elf":       "some-start4\n",
+		"dc-a6-32-01-02-03/overlays/../start4.elf": "some-start4\n",
+	} {
+		contents, ok, err := readRaspberryPiFile(assert, rpi, p)
+		assert.True(ok, p)
+		assert.NoError(err, p)
+		assert.Equal(expected, contents, p)
+	}
+
+	// templates need a host, other paths are left to Pixiecore
+	for _, p := range []string{"config.txt", "f00dcafe/../config.txt", "12345678/start4.elf", "52:54:00:12:34:56/0"} {
+		_, ok, _ := readRaspberryPiFile(assert, rpi, p)
+		assert.False(ok, p)
+	}
+	// the host's other files, which may hold secrets, aren't served
+	for _, p := range []string{"f00dcafe/missing.elf", "f00dcafe/kernel8.img"} {
+		_, ok, err := readRaspberryPiFile(assert, rpi, p)
+		assert.True(ok, p)
+		assert.NotNil(err, p)
+	}
+}
+
+func TestRaspberryPiBindsTemplatesToLease(t *testing.T) {
+	assert := assert.New(t)
+
+	rpi := newTestRaspberryPi(assert)
+	rpi.Leases = pxeserver.NewLeases()
+
+	clientAddr := &net.UDPAddr{IP: net.ParseIP("10.0.0.20"), Port: 1234}
+	_, _, ok, err := rpi.Open("f00dcafe/config.txt", clientAddr)
+	assert.True(ok)
+	assert.NotNil(err)
+	assert.Contains(err.Error(), "no DHCP lease")
+
+	rpi.Leases.Set("dc:a6:32:01:02:03", net.ParseIP("10.0.0.20"))
+	f, _, ok, err := rpi.Open("f00dcafe/config.txt", clientAddr)
+	assert.True(ok)
+	assert.NoError(err)
+	f.Close()
+	_, _, ok, err = rpi.Open("f00dcafe/cmdline.txt", &net.UDPAddr{IP: net.ParseIP("10.0.0.99"), Port: 1234})
+	assert.True(ok)
+	assert.NotNil(err)
+
+	// firmware is the same for every Pi
+	f, _, ok, err = rpi.Open("f00dcafe/start4.elf", &net.UDPAddr{IP: net.ParseIP("10.0.0.99"), Port: 1234})
+	assert.True(ok)
+	assert.NoError(err)
+	f.Close()
+}
+
+func TestRaspberryPiOnlyHosts(t *testing.T) {
+	assert := assert.New(t)
+
+	rpi := newTestRaspberryPi(assert).OnlyHosts([]string{"52:54:00:12:34:56"})
+	for _, p := range []string{"f00dcafe/config.txt", "dc-a6-32-01-02-03/cmdline.txt"} {
+		_, ok, _ := readRaspberryPiFile(assert, rpi, p)
+		assert.False(ok, p)
+	}
+
+	rpi = newTestRaspberryPi(assert).OnlyHosts([]string{"dc:a6:32:01:02:03"})
+	_, ok, err := readRaspberryPiFile(assert, rpi, "f00dcafe/config.txt")
+	assert.True(ok)
+	assert.NoError(err)
+}
+
+func raspberryPiDiscover(mac string) *dhcp4.Packet {
+	return dhcpPacket(dhcp4.MsgDiscover, mac, dhcp4.Options{
+		dhcp4.OptVendorIdentifier: []byte("PXEClient:Arch:00000:UNDI:002001"),
+	})
+}
+
+func TestRaspberryPiProxyOffersTFTP(t *testing.T) {
+	assert := assert.New(t)
+
+	proxy := &pxeserver.RaspberryPiProxy{RaspberryPi: newTestRaspberryPi(assert)}
+
+	offer, err := proxy.Respond(raspberryPiDiscover("dc:a6:32:01:02:03"), net.ParseIP("10.0.0.1"))
+	assert.NoError(err)
+	assert.Equal("10.0.0.1", offer.ServerAddr.String())
+	assert.Nil(offer.YourAddr)
+	assert.Equal([]byte("PXEClient"), offer.Options[dhcp4.OptVendorIdentifier])
+	assert.Contains(string(offer.Options[dhcp4.OptVendorSpecific]), "Raspberry Pi Boot")
+
+	for _, pkt := range []*dhcp4.Packet{
+		raspberryPiDiscover("52:54:00:12:34:56"),
+		dhcpPacket(dhcp4.MsgDiscover, "dc:a6:32:01:02:03", nil),
+	} {
+		offer, err = proxy.Respond(pkt, net.ParseIP("10.0.0.1"))
+		assert.NoError(err)
+		assert.Nil(offer)
+	}
+
+	proxy.Hosts = []string{"52:54:00:12:34:56"}
+	offer, err = proxy.Respond(raspberryPiDiscover("dc:a6:32:01:02:03"), net.ParseIP("10.0.0.1"))
+	assert.NoError(err)
+	assert.Nil(offer)
+}
+
+func TestDHCPSendsRaspberryPiOptions(t *testing.T) {
+	assert := assert.New(t)
+
+	server, err := pxeserver.NewDHCPServer(testDHCPSettings(), nil)
+	assert.NoError(err)
+	server.RaspberryPi = newTestRaspberryPi(assert)
+
+	offer, err := server.Respond(raspberryPiDiscover("dc:a6:32:01:02:03"), net.ParseIP("10.0.0.1"))
+	assert.NoError(err)
+	assert.Equal("10.0.0.100", offer.YourAddr.String())
+	assert.Equal("10.0.0.1", offer.ServerAddr.String())
+	assert.Contains(string(offer.Options[dhcp4.OptVendorSpecific]), "Raspberry Pi Boot")
+}
+
+func TestErrorOnInvalidRaspberryPiHost(t *testing.T) {
+	assert := assert.New(t)
+
+	for _, hosts := range []string{
+		"- mac: \"dc:a6:32:01:02:03\"\n  bootloader: raspberrypi\n  serial: f00d",
+		"- mac: \"dc:a6:32:01:02:03\"\n  serial: f00dcafe",
+		"- mac: \"dc:a6:32:01:02:03\"\n  bootloader: raspberrypi\n  http_boot: ipxe",
+		"- mac: \"dc:a6:32:01:02:03\"\n  bootloader: raspberrypi\n  serial: f00dcafe\n- mac: \"dc:a6:32:01:02:04\"\n  bootloader: raspberrypi\n  serial: F00DCAFE",
+	} {
+		input := strings.NewReader("server:\n  raspberry_pi:\n    firmware_dir: /srv/rpi\nhosts:\n" + hosts + "\n")
+		_, err := pxeserver.LoadConfig(input)
+		assert.NotNil(err, hosts)
+	}
+
+	input := strings.NewReader("hosts:\n- mac: \"dc:a6:32:01:02:03\"\n  bootloader: raspberrypi\n")
+	_, err := pxeserver.LoadConfig(input)
+	assert.NotNil(err)
+	assert.Contains(err.Error(), "server.raspberry_pi.firmware_dir")
+}
@@ -0,0 +1,471 @@
+package pxeserver
+
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/pem"
+	"fmt"
+	"io/ioutil"
+	"math/big"
+	"os"
+	"sort"
+	"strings"
+
+	"golang.org/x/crypto/curve25519"
+	"golang.org/x/crypto/ssh"
+)
+
+const (
+	lowercase = "abcdefghijklmnopqrstuvwxyz"
+	letters   = lowercase + "ABCDEFGHIJKLMNOPQRSTUVWXYZ"
+	digits    = "0123456789"
+	symbols   = " !\"#$%&'()*+,-./:;<=>?@[\\]^_`{|}~"
+	allChars  = letters + digits + symbols
+	// maxSecretLength bounds generated passwords and random bytes, far
+	// beyond any real use but small enough to generate safely
+	maxSecretLength = 4096
+)
+
+var passwordCharsets = map[string]string{
+	"all":     allChars,
+	"alnum":   letters + digits,
+	"letters": letters,
+	"digits":  digits,
+	// no_symbols is kept as an alias of alnum for existing configs
+	"no_symbols": letters + digits,
+}
+
+type secretOptKind int
+
+const (
+	intOption secretOptKind = iota
+	stringOption
+	boolOption
+)
+
+type secretOpt struct {
+	kind     secretOptKind
+	required bool
+	min      int
+	// max is unbounded if 0
+	max     int
+	allowed []string
+	// conflicts names an option which can't be set along with this one
+	conflicts string
+}
+
+type secretType struct {
+	opts     map[string]secretOpt
+	generate func(opts map[string]interface{}) (interface{}, error)
+	// imported secrets are loaded from an external source rather than
+	// generated, and can be refreshed if that source changes
+	imported bool
+}
+
+var secretTypes = map[string]secretType{
+	"password": {
+		opts: map[string]secretOpt{
+			"length":  {kind: intOption, min: 1, max: maxSecretLength},
+			"charset": {kind: stringOption, allowed: passwordCharsetNames()},
+			"chars":   {kind: stringOption, conflicts: "charset"},
+		},
+		generate: func(opts map[string]interface{}) (interface{}, error) {
+			return generatePassword(opts)
+		},
+	},
+	"ssh_key": {
+		opts: map[string]secretOpt{
+			"comment": {kind: stringOption},
+		},
+		generate: func(opts map[string]interface{}) (interface{}, error) {
+			return generateSSHKey(opts)
+		},
+	},
+	"bootstrap_token": {
+		generate: func(opts map[string]interface{}) (interface{}, error) {
+			return generateBootstrapToken()
+		},
+	},
+	"random_bytes": {
+		opts: map[string]secretOpt{
+			"length":   {kind: intOption, min: 1, max: maxSecretLength},
+			"encoding": {kind: stringOption, allowed: []string{"hex", "base64", "base64url"}},
+		},
+		generate: func(opts map[string]interface{}) (interface{}, error) {
+			return generateRandomBytes(opts)
+		},
+	},
+	"uuid": {
+		generate: func(opts map[string]interface{}) (interface{}, error) {
+			return generateUUID()
+		},
+	},
+	"wireguard_key": {
+		generate: func(opts map[string]interface{}) (interface{}, error) {
+			return generateWireGuardKey()
+		},
+	},
+	"file": {
+		opts: map[string]secretOpt{
+			"path":       {kind: stringOption, required: true},
+			"trim_space": {kind: boolOption},
+		},
+		generate: func(opts map[string]interface{}) (interface{}, error) {
+			return importFile(opts)
+		},
+		imported: true,
+	},
+	"env": {
+		opts: map[string]secretOpt{
+			"name":       {kind: stringOption, required: true},
+			"trim_space": {kind: boolOption},
+		},
+		generate: func(opts map[string]interface{}) (interface{}, error) {
+			return importEnv(opts)
+		},
+		imported: true,
+	},
+	"static": {
+		opts: map[string]secretOpt{
+			"value": {kind: stringOption, required: true},
+		},
+		generate: func(opts map[string]interface{}) (interface{}, error) {
+			return stringOpt(opts, "value", "")
+		},
+		imported: true,
+	},
+}
+
+// validateSecretDef checks the def against the options schema of its type
+// and returns a copy with numeric options normalized to ints.
+func validateSecretDef(def SecretDef) (SecretDef, error) {
+	if def.ID == "" {
+		return SecretDef{}, fmt.Errorf("secret is missing an 'id'")
+	}
+	secretType, ok := secretTypes[def.Type]
+	if !ok {
+		return SecretDef{}, fmt.Errorf("unknown type '%s', must be one of %s", def.Type, strings.Join(secretTypeNames(), ", "))
+	}
+	for name, opt := range secretType.opts {
+		if _, ok := def.Opts[name]; opt.required && !ok {
+			return SecretDef{}, fmt.Errorf("missing required option '%s' for type '%s'", name, def.Type)
+		}
+	}
+	if len(def.Opts) == 0 {
+		return def, nil
+	}
+
+	normalizedOpts := make(map[string]interface{}, len(def.Opts))
+	for name := range def.Opts {
+		opt, ok := secretType.opts[name]
+		if !ok {
+			return SecretDef{}, fmt.Errorf("unknown option '%s' for type '%s'", name, def.Type)
+		}
+		if _, ok := def.Opts[opt.conflicts]; ok {
+			return SecretDef{}, fmt.Errorf("options '%s' and '%s' can't both be set", name, opt.conflicts)
+		}
+		switch opt.kind {
+		case intOption:
+			intValue, err := intOpt(def.Opts, name, 0)
+			if err != nil {
+				return SecretDef{}, err
+			}
+			if intValue < opt.min {
+				return SecretDef{}, fmt.Errorf("option '%s' must be at least %d but was %d", name, opt.min, intValue)
+			}
+			if opt.max != 0 && intValue > opt.max {
+				return SecretDef{}, fmt.Errorf("option '%s' must be at most %d but was %d", name, opt.max, intValue)
+			}
+			normalizedOpts[name] = intValue
+		case stringOption:
+			stringValue, err := stringOpt(def.Opts, name, "")
+			if err != nil {
+				return SecretDef{}, err
+			}
+			if len(opt.allowed) > 0 && !containsString(opt.allowed, stringValue) {
+				return SecretDef{}, fmt.Errorf("option '%s' must be one of %s but was '%s'", name, strings.Join(opt.allowed, ", "), stringValue)
+			}
+			normalizedOpts[name] = stringValue
+		case boolOption:
+			boolValue, err := boolOpt(def.Opts, name, false)
+			if err != nil {
+				return SecretDef{}, err
+			}
+			normalizedOpts[name] = boolValue
+		}
+	}
+	def.Opts = normalizedOpts
+
+	return def, nil
+}
+
+func generatePassword(opts map[string]interface{}) (string, error) {
+	length, err := intOpt(opts, "length", 20)
+	if err != nil {
+		return "", err
+	}
+	charsetName, err := stringOpt(opts, "charset", "all")
+	if err != nil {
+		return "", err
+	}
+	chars, ok := passwordCharsets[charsetName]
+	if !ok {
+		return "", fmt.Errorf("unknown password charset '%s'", charsetName)
+	}
+	customChars, err := stringOpt(opts, "chars", "")
+	if err != nil {
+		return "", err
+	}
+	if customChars != "" {
+		if _, ok := opts["charset"]; ok {
+			return "", fmt.Errorf("options 'chars' and 'charset' can't both be set")
+		}
+		chars = customChars
+	}
+
+	return randomString(chars, length)
+}
+
+func generateBootstrapToken() (map[string]interface{}, error) {
+	// kubeadm bootstrap tokens must match [a-z0-9]{6}.[a-z0-9]{16}
+	tokenID, err := randomString(lowercase+digits, 6)
+	if err != nil {
+		return nil, err
+	}
+	tokenSecret, err := randomString(lowercase+digits, 16)
+	if err != nil {
+		return nil, err
+	}
+
+	return map[string]interface{}{
+		"token":        fmt.Sprintf("%s.%s", tokenID, tokenSecret),
+		"token_id":     tokenID,
+		"token_secret": tokenSecret,
+	}, nil
+}
+
+func generateRandomBytes(opts map[string]interface{}) (string, error) {
+	length, err := intOpt(opts, "length", 32)
+	if err != nil {
+		return "", err
+	}
+	encoding, err := stringOpt(opts, "encoding", "hex")
+	if err != nil {
+		return "", err
+	}
+
+	output := make([]byte, length)
+	if _, err := rand.Read(output); err != nil {
+		return "", err
+	}
+
+	switch encoding {
+	case "hex":
+		return hex.EncodeToString(output), nil
+	case "base64":
+		return base64.StdEncoding.EncodeToString(output), nil
+	case "base64url":
+		return base64.URLEncoding.EncodeToString(output), nil
+	default:
+		return "", fmt.Errorf("unknown random_bytes encoding '%s'", encoding)
+	}
+}
+
+func generateUUID() (string, error) {
+	uuid := make([]byte, 16)
+	if _, err := rand.Read(uuid); err != nil {
+		return "", err
+	}
+	// RFC 4122 version 4, variant 1
+	uuid[6] = (uuid[6] & 0x0f) | 0x40
+	uuid[8] = (uuid[8] & 0x3f) | 0x80
+
+	return fmt.Sprintf("%x-%x-%x-%x-%x", uuid[0:4], uuid[4:6], uuid[6:8], uuid[8:10], uuid[10:16]), nil
+}
+
+func generateWireGuardKey() (map[string]interface{}, error) {
+	privateKey := make([]byte, curve25519.ScalarSize)
+	if _, err := rand.Read(privateKey); err != nil {
+		return nil, err
+	}
+	// Clamp the private key as done by `wg genkey`
+	privateKey[0] &= 248
+	privateKey[31] = (privateKey[31] & 127) | 64
+
+	publicKey, err := curve25519.X25519(privateKey, curve25519.Basepoint)
+	if err != nil {
+		return nil, err
+	}
+
+	return map[string]interface{}{
+		"private_key": base64.StdEncoding.EncodeToString(privateKey),
+		"public_key":  base64.StdEncoding.EncodeToString(publicKey),
+	}, nil
+}
+
+func generateSSHKey(opts map[string]interface{}) (map[string]interface{}, error) {
+	comment, err := stringOpt(opts, "comment", "")
+	if err != nil {
+		return nil, err
+	}
+
+	privateKey, err := rsa.GenerateKey(rand.Reader, 4096)
+	if err != nil {
+		return nil, err
+	}
+	privateKeyPEM := &pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(privateKey)}
+	var privateKeyContents bytes.Buffer
+	if err := pem.Encode(&privateKeyContents, privateKeyPEM); err != nil {
+		return nil, err
+	}
+
+	publicKey, err := ssh.NewPublicKey(&privateKey.PublicKey)
+	if err != nil {
+		return nil, err
+	}
+	publicKeyContents := string(ssh.MarshalAuthorizedKey(publicKey))
+
+	if comment != "" {
+		publicKeyContents = fmt.Sprintf("%s %s\n", strings.TrimSpace(publicKeyContents), comment)
+	}
+
+	return map[string]interface{}{
+		"public_key":  string(publicKeyContents),
+		"private_key": privateKeyContents.String(),
+	}, nil
+}
+
+func importFile(opts map[string]interface{}) (string, error) {
+	path, err := stringOpt(opts, "path", "")
+	if err != nil {
+		return "", err
+	}
+	trimSpace, err := boolOpt(opts, "trim_space", false)
+	if err != nil {
+		return "", err
+	}
+
+	contents, err := ioutil.ReadFile(path)
+	if err != nil {
+		return "", err
+	}
+	if trimSpace {
+		return strings.TrimSpace(string(contents)), nil
+	}
+	return string(contents), nil
+}
+
+func importEnv(opts map[string]interface{}) (string, error) {
+	name, err := stringOpt(opts, "name", "")
+	if err != nil {
+		return "", err
+	}
+	trimSpace, err := boolOpt(opts, "trim_space", false)
+	if err != nil {
+		return "", err
+	}
+
+	value, ok := os.LookupEnv(name)
+	if !ok {
+		return "", fmt.Errorf("environment variable '%s' is not set", name)
+	}
+	if trimSpace {
+		return strings.TrimSpace(value), nil
+	}
+	return value, nil
+}
+
+func randomString(charset string, length int) (string, error) {
+	// index by rune so a custom charset may hold multi-byte characters
+	chars := []rune(charset)
+	if len(chars) == 0 {
+		return "", fmt.Errorf("cannot generate random string from an empty charset")
+	}
+
+	output := make([]rune, length)
+	for i := 0; i < length; i++ {
+		n, err := rand.Int(rand.Reader, big.NewInt(int64(len(chars))))
+		if err != nil {
+			return "", err
+		}
+		output[i] = chars[n.Int64()]
+	}
+	return string(output), nil
+}
+
+// YAML/JSON decoding turns all numbers into float64, so accept any
+// integral numeric value here.
+func intOpt(opts map[string]interface{}, name string, defaultValue int) (int, error) {
+	rawValue, ok := opts[name]
+	if !ok {
+		return defaultValue, nil
+	}
+	switch v := rawValue.(type) {
+	case int:
+		return v, nil
+	case int64:
+		return int(v), nil
+	case float64:
+		if v != float64(int(v)) {
+			return 0, fmt.Errorf("option '%s' must be an integer but was '%v'", name, v)
+		}
+		return int(v), nil
+	default:
+		return 0, fmt.Errorf("option '%s' must be an integer but was '%v'", name, rawValue)
+	}
+}
+
+func stringOpt(opts map[string]interface{}, name string, defaultValue string) (string, error) {
+	rawValue, ok := opts[name]
+	if !ok {
+		return defaultValue, nil
+	}
+	v, ok := rawValue.(string)
+	if !ok {
+		return "", fmt.Errorf("option '%s' must be a string but was a %T", name, rawValue)
+	}
+	return v, nil
+}
+
+func boolOpt(opts map[string]interface{}, name string, defaultValue bool) (bool, error) {
+	rawValue, ok := opts[name]
+	if !ok {
+		return defaultValue, nil
+	}
+	v, ok := rawValue.(bool)
+	if !ok {
+		return false, fmt.Errorf("option '%s' must be a boolean but was a %T", name, rawValue)
+	}
+	return v, nil
+}
+
+func passwordCharsetNames() []string {
+	names := make([]string, 0, len(passwordCharsets))
+	for name := range passwordCharsets {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+func secretTypeNames() []string {
+	names := make([]string, 0, len(secretTypes))
+	for name := range secretTypes {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+func containsString(values []string, s string) bool {
+	for _, v := range values {
+		if v == s {
+			return true
+		}
+	}
+	return false
+}
@@ -1,45 +1,62 @@
 package pxeserver
 
 import (
-	"bytes"
-	"crypto/rand"
-	"crypto/rsa"
-	"crypto/x509"
-	"encoding/pem"
+	"encoding/json"
 	"fmt"
+	"io"
 	"io/ioutil"
-	"math/big"
 	"os"
+	"path/filepath"
+	"sort"
 	"strings"
 	"sync"
 
 	yamlToJson "github.com/ghodss/yaml"
-	"golang.org/x/crypto/ssh"
 	"gopkg.in/yaml.v2"
 )
 
-const (
-	letters  = "abcdefghijklmnopqrstuvwxyzABCDEFGHIJKLMNOPQRSTUVWXYZ"
-	digits   = "0123456789"
-	symbols  = " !\"#$%&'()*+,-./:;<=>?@[\\]^_`{|}~"
-	allChars = letters + digits + symbols
-)
-
 type Secrets interface {
 	GetOrGenerate(mac string, id string) (interface{}, error)
 	Get(mac string, id string) (interface{}, error)
 	GetField(mac string, id string, field string) (interface{}, error)
 }
 
+// SecretsStore extends Secrets with the operations used to manage the
+// store outside of rendering, e.g. from the CLI.
+type SecretsStore interface {
+	Secrets
+	List() map[string][]string
+	GetPrevious(mac string, id string) (interface{}, error)
+	Set(mac string, id string, value interface{}) error
+	Delete(mac string, id string) error
+	Rotate(mac string, id string) error
+	Rename(from string, to string) error
+	GenerateAll() error
+	Refresh(mac string, id string) error
+	RefreshImported() error
+	Import(r io.Reader) error
+	// GetInternal and SetInternal hold pxeserver's own keys, apart from
+	// the host and shared secrets that templates and the CLI can reach.
+	GetInternal(id string) (interface{}, error)
+	SetInternal(id string, value interface{}) error
+}
+
+// reservedSecretPrefix starts the IDs of pxeserver's own keys, which were
+// kept with the shared secrets before they had their own section.
+const reservedSecretPrefix = "/pxeserver/"
+
 type localSecrets struct {
-	storePath     string
-	hostToSecrets map[string]map[string]interface{}
-	hostToDefs    map[string][]SecretDef
-	mu            sync.Mutex
+	storePath      string
+	hostToSecrets  map[string]map[string]interface{}
+	hostToPrevious map[string]map[string]interface{}
+	hostToDefs     map[string][]SecretDef
+	internal       map[string]interface{}
+	mu             sync.Mutex
 }
 
 type secretsConfig struct {
-	Hosts []hostSecrets
+	Hosts    []hostSecrets
+	Internal []secret `json:"internal,omitempty" yaml:"internal,omitempty"`
 }
 
 type hostSecrets struct {
@@ -48,8 +65,9 @@ type hostSecrets struct {
 }
 
 type secret struct {
-	ID    string
-	Value interface{}
+	ID       string
+	Value    interface{}
+	Previous interface{} `json:"previous,omitempty" yaml:"previous,omitempty"`
 }
 type SecretDef struct {
 	ID   string
@@ -57,11 +75,13 @@ type SecretDef struct {
 	Opts map[string]interface{}
 }
 
-func LoadLocalSecrets(storePath string, hostToDefs map[string][]SecretDef) (Secrets, error) {
+func LoadLocalSecrets(storePath string, hostToDefs map[string][]SecretDef) (SecretsStore, error) {
 	secrets := localSecrets{
-		hostToSecrets: make(map[string]map[string]interface{}),
-		hostToDefs:    hostToDefs,
-		storePath:     storePath,
+		hostToSecrets:  make(map[string]map[string]interface{}),
+		hostToPrevious: make(map[string]map[string]interface{}),
+		hostToDefs:     hostToDefs,
+		internal:       make(map[string]interface{}),
+		storePath:      storePath,
 	}
 
 	_, err := os.Stat(storePath)
@@ -70,23 +90,48 @@ func LoadLocalSecrets(storePath string, hostToDefs map[string][]SecretDef) (Secr
 		if err != nil {
 			return nil, err
 		}
-
-		var initialConfig secretsConfig
-		if err = yamlToJson.Unmarshal(configContents, &initialConfig); err != nil {
+		var config secretsConfig
+		if err := yamlToJson.Unmarshal(configContents, &config); err != nil {
 			return nil, err
 		}
+		secrets.merge(config)
+		for _, internal := range config.Internal {
+			secrets.internal[internal.ID] = internal.Value
+		}
+	}
 
-		for _, host := range initialConfig.Hosts {
-			secrets.hostToSecrets[host.Mac] = make(map[string]interface{})
-			for _, s := range host.Secrets {
-				secrets.hostToSecrets[host.Mac][s.ID] = s.Value
-			}
+	// Move pxeserver's own keys out of the shared secrets of older stores
+	for id, value := range secrets.hostToSecrets[""] {
+		if !strings.HasPrefix(id, reservedSecretPrefix) {
+			continue
+		}
+		if _, ok := secrets.internal[id]; !ok {
+			secrets.internal[id] = value
 		}
+		delete(secrets.hostToSecrets[""], id)
+		delete(secrets.hostToPrevious[""], id)
+	}
+	if len(secrets.hostToSecrets[""]) == 0 {
+		delete(secrets.hostToSecrets, "")
 	}
 
 	return &secrets, nil
 }
 
+func (s *localSecrets) merge(config secretsConfig) {
+	for _, host := range config.Hosts {
+		if _, ok := s.hostToSecrets[host.Mac]; !ok {
+			s.hostToSecrets[host.Mac] = make(map[string]interface{})
+		}
+		for _, secret := range host.Secrets {
+			s.hostToSecrets[host.Mac][secret.ID] = secret.Value
+			if secret.Previous != nil {
+				s.setPrevious(host.Mac, secret.ID, secret.Previous)
+			}
+		}
+	}
+}
+
 func (s *localSecrets) GetOrGenerate(mac string, id string) (interface{}, error) {
 	if secret, err := s.Get(mac, id); err == nil {
 		return secret, nil
@@ -125,10 +170,254 @@ func (s *localSecrets) GetField(mac string, id string, field string) (interface{
 	if err != nil {
 		return nil, err
 	}
-	// TODO: type checking
-	secretMap := fullSecret.(map[string]interface{})
-	// TODO: not found checking
-	return secretMap[field], nil
+	secretMap, ok := fullSecret.(map[string]interface{})
+	if !ok {
+		return nil, fmt.Errorf("secret with id '%s' for host '%s' does not have fields", id, mac)
+	}
+	value, ok := secretMap[field]
+	if !ok {
+		return nil, fmt.Errorf("could not find field '%s' in secret with id '%s' for host '%s'", field, id, mac)
+	}
+	return value, nil
+}
+
+func (s *localSecrets) List() map[string][]string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	result := make(map[string][]string, len(s.hostToSecrets))
+	for mac, secrets := range s.hostToSecrets {
+		ids := make([]string, 0, len(secrets))
+		for id := range secrets {
+			ids = append(ids, id)
+		}
+		sort.Strings(ids)
+		result[mac] = ids
+	}
+	return result
+}
+
+func (s *localSecrets) GetPrevious(mac string, id string) (interface{}, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	previous, ok := s.hostToPrevious[mac][id]
+	if !ok {
+		return nil, fmt.Errorf("could not find a previous version of secret with id '%s' for host '%s'", id, mac)
+	}
+	return previous, nil
+}
+
+func (s *localSecrets) Set(mac string, id string, value interface{}) error {
+	if err := checkSecretID(id); err != nil {
+		return err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if _, ok := s.hostToSecrets[mac]; !ok {
+		s.hostToSecrets[mac] = make(map[string]interface{})
+	}
+	if existing, ok := s.hostToSecrets[mac][id]; ok {
+		s.setPrevious(mac, id, existing)
+	}
+	s.hostToSecrets[mac][id] = value
+	return s.save()
+}
+
+func (s *localSecrets) Delete(mac string, id string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if _, ok := s.hostToSecrets[mac][id]; !ok {
+		return fmt.Errorf("could not find secret with id '%s' for host '%s'", id, mac)
+	}
+	delete(s.hostToSecrets[mac], id)
+	delete(s.hostToPrevious[mac], id)
+	if len(s.hostToSecrets[mac]) == 0 {
+		delete(s.hostToSecrets, mac)
+	}
+	return s.save()
+}
+
+// Rotate replaces a generated secret with a freshly generated value,
+// keeping the current value as the previous version.
+func (s *localSecrets) Rotate(mac string, id string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var def *SecretDef
+	for i := range s.hostToDefs[mac] {
+		if s.hostToDefs[mac][i].ID == id {
+			def = &s.hostToDefs[mac][i]
+			break
+		}
+	}
+	if def == nil {
+		return fmt.Errorf("could not find secret def with id '%s' for host '%s'", id, mac)
+	}
+
+	if existing, ok := s.hostToSecrets[mac][id]; ok {
+		s.setPrevious(mac, id, existing)
+		delete(s.hostToSecrets[mac], id)
+	}
+	return s.generate(mac, []SecretDef{*def})
+}
+
+// Rename moves all secrets stored for host from to host to, failing
+// without changes if to already has a secret with the same ID.
+func (s *localSecrets) Rename(from string, to string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for id := range s.hostToSecrets[from] {
+		if _, ok := s.hostToSecrets[to][id]; ok {
+			return fmt.Errorf("secret with id '%s' is stored for both host '%s' and '%s'", id, from, to)
+		}
+	}
+	if _, ok := s.hostToSecrets[to]; !ok {
+		s.hostToSecrets[to] = make(map[string]interface{})
+	}
+	for id, value := range s.hostToSecrets[from] {
+		s.hostToSecrets[to][id] = value
+	}
+	for id, previous := range s.hostToPrevious[from] {
+		s.setPrevious(to, id, previous)
+	}
+	delete(s.hostToSecrets, from)
+	delete(s.hostToPrevious, from)
+	return s.save()
+}
+
+func (s *localSecrets) GenerateAll() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	macs := make([]string, 0, len(s.hostToDefs))
+	for mac := range s.hostToDefs {
+		macs = append(macs, mac)
+	}
+	sort.Strings(macs)
+	for _, mac := range macs {
+		if err := s.generate(mac, s.hostToDefs[mac]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Refresh re-reads the source of a single imported secret, keeping the
+// current value as the previous version. Generated secrets are rotated
+// with Rotate instead.
+func (s *localSecrets) Refresh(mac string, id string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var def *SecretDef
+	for i := range s.hostToDefs[mac] {
+		if s.hostToDefs[mac][i].ID == id {
+			def = &s.hostToDefs[mac][i]
+			break
+		}
+	}
+	if def == nil {
+		return fmt.Errorf("could not find secret def with id '%s' for host '%s'", id, mac)
+	}
+	if !secretTypes[def.Type].imported {
+		return fmt.Errorf("secret '%s' for host '%s' has type '%s' which is generated, not imported: use 'secrets rotate' instead", id, mac, def.Type)
+	}
+
+	if existing, ok := s.hostToSecrets[mac][id]; ok {
+		s.setPrevious(mac, id, existing)
+		delete(s.hostToSecrets[mac], id)
+	}
+	return s.generate(mac, []SecretDef{*def})
+}
+
+// RefreshImported re-reads the source of every imported secret, e.g.
+// 'file' or 'env' types, keeping the current value as the previous version.
+func (s *localSecrets) RefreshImported() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for mac, defs := range s.hostToDefs {
+		importedDefs := []SecretDef{}
+		for _, def := range defs {
+			if !secretTypes[def.Type].imported {
+				continue
+			}
+			if existing, ok := s.hostToSecrets[mac][def.ID]; ok {
+				s.setPrevious(mac, def.ID, existing)
+				delete(s.hostToSecrets[mac], def.ID)
+			}
+			importedDefs = append(importedDefs, def)
+		}
+		if err := s.generate(mac, importedDefs); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Import merges secrets in the store file format into the store,
+// overwriting any existing secrets with the same ID.
+func (s *localSecrets) Import(r io.Reader) error {
+	contents, err := ioutil.ReadAll(r)
+	if err != nil {
+		return err
+	}
+
+	var config secretsConfig
+	if err := yamlToJson.Unmarshal(contents, &config); err != nil {
+		return fmt.Errorf("secrets to import were not valid YAML/JSON: %s", err)
+	}
+	if len(config.Internal) > 0 {
+		return fmt.Errorf("secrets to import can't include pxeserver's internal keys")
+	}
+	for _, host := range config.Hosts {
+		for _, secret := range host.Secrets {
+			if err := checkSecretID(secret.ID); err != nil {
+				return err
+			}
+		}
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.merge(config)
+	return s.save()
+}
+
+func (s *localSecrets) GetInternal(id string) (interface{}, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	value, ok := s.internal[id]
+	if !ok {
+		return nil, fmt.Errorf("could not find internal key with id '%s'", id)
+	}
+	return value, nil
+}
+
+func (s *localSecrets) SetInternal(id string, value interface{}) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.internal[id] = value
+	return s.save()
+}
+
+// checkSecretID rejects IDs reserved for pxeserver's own keys.
+func checkSecretID(id string) error {
+	if strings.HasPrefix(id, reservedSecretPrefix) {
+		return fmt.Errorf("secret id '%s' is reserved: ids starting with '%s' are used for pxeserver's own keys", id, reservedSecretPrefix)
+	}
+	return nil
+}
+
+func (s *localSecrets) setPrevious(mac string, id string, value interface{}) {
+	if _, ok := s.hostToPrevious[mac]; !ok {
+		s.hostToPrevious[mac] = make(map[string]interface{})
+	}
+	s.hostToPrevious[mac][id] = value
 }
 
 func (s *localSecrets) generate(mac string, secretDefs []SecretDef) error {
@@ -142,22 +431,14 @@ func (s *localSecrets) generate(mac string, secretDefs []SecretDef) error {
 	for _, def := range secretDefs {
 		_, secretExists := hostSecrets[def.ID]
 		if !secretExists {
-			switch def.Type {
-			case "password":
-				// TODO: test for length
-				var err error
-				hostSecrets[def.ID], err = s.generatePassword(def.Opts)
-				if err != nil {
-					return err
-				}
-			case "ssh_key":
-				var err error
-				hostSecrets[def.ID], err = s.generateSSHKey(def.Opts)
-				if err != nil {
-					return err
-				}
-			default:
-				// TODO: raise error if unknown type
+			secretType, ok := secretTypes[def.Type]
+			if !ok {
+				return fmt.Errorf("unknown type '%s' for secret '%s' on host '%s'", def.Type, def.ID, mac)
+			}
+			var err error
+			hostSecrets[def.ID], err = secretType.generate(def.Opts)
+			if err != nil {
+				return fmt.Errorf("generating secret '%s' on host '%s': %s", def.ID, mac, err)
 			}
 			needsSave = true
 		}
@@ -180,24 +461,33 @@ func (s *localSecrets) save() error {
 		}
 		for k, v := range secrets {
 			updatedSecrets.Secrets = append(updatedSecrets.Secrets, secret{
-				ID:    k,
-				Value: v,
+				ID:       k,
+				Value:    v,
+				Previous: s.hostToPrevious[host][k],
 			})
 		}
 		updatedConfig.Hosts = append(updatedConfig.Hosts, updatedSecrets)
 	}
+	for id, value := range s.internal {
+		updatedConfig.Internal = append(updatedConfig.Internal, secret{ID: id, Value: value})
+	}
 
-	storeFile, err := os.OpenFile(s.storePath, os.O_RDWR|os.O_CREATE, 0600)
+	// write to a temp file first so a crash or full disk can't leave a
+	// truncated store behind
+	storeFile, err := ioutil.TempFile(filepath.Dir(s.storePath), ".pxeserver-secrets")
 	if err != nil {
 		return err
 	}
+	defer os.Remove(storeFile.Name())
 	writer := yaml.NewEncoder(storeFile)
 	err = writer.Encode(updatedConfig)
 	if err != nil {
+		storeFile.Close()
 		return err
 	}
 	err = writer.Close()
 	if err != nil {
+		storeFile.Close()
 		return err
 	}
 	err = storeFile.Close()
@@ -205,56 +495,101 @@ func (s *localSecrets) save() error {
 		return err
 	}
 
-	return nil
+	return os.Rename(storeFile.Name(), s.storePath)
 }
 
-func (s *localSecrets) generatePassword(opts map[string]interface{}) (string, error) {
-	length := 20
-	rawLength, ok := opts["length"]
-	if ok {
-		length = rawLength.(int)
+// MigrateSecrets moves secrets stored under the MAC of a named host, from
+// before it was given a name, to the name. hostMACs maps host names to
+// their MACs, the moved MACs are returned mapped to their host's name.
+func MigrateSecrets(store SecretsStore, hostMACs map[string][]string) (map[string]string, error) {
+	migrated := UnmigratedSecrets(store, hostMACs)
+	macs := make([]string, 0, len(migrated))
+	for mac := range migrated {
+		macs = append(macs, mac)
 	}
-
-	output := make([]rune, length)
-	for i := 0; i < length; i++ {
-		n, err := rand.Int(rand.Reader, big.NewInt(int64(len(allChars))))
-		if err != nil {
-			return "", err
+	sort.Strings(macs)
+	for _, mac := range macs {
+		if err := store.Rename(mac, migrated[mac]); err != nil {
+			return nil, fmt.Errorf("migrating secrets of host '%s' from MAC '%s': %s", migrated[mac], mac, err)
 		}
-		output[i] = rune(allChars[n.Int64()])
 	}
-	return string(output), nil
+	return migrated, nil
 }
 
-func (s *localSecrets) generateSSHKey(opts map[string]interface{}) (map[string]interface{}, error) {
-	comment := ""
-	rawComment, ok := opts["comment"]
-	if ok {
-		comment = rawComment.(string)
+// UnmigratedSecrets returns the MACs MigrateSecrets would move secrets
+// from, mapped to their host's name.
+func UnmigratedSecrets(store SecretsStore, hostMACs map[string][]string) map[string]string {
+	stored := store.List()
+	unmigrated := make(map[string]string)
+	for name, macs := range hostMACs {
+		for _, mac := range macs {
+			if mac != name && len(stored[mac]) > 0 {
+				unmigrated[mac] = name
+			}
+		}
 	}
+	return unmigrated
+}
 
-	privateKey, err := rsa.GenerateKey(rand.Reader, 4096)
-	if err != nil {
-		return nil, err
-	}
-	privateKeyPEM := &pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(privateKey)}
-	var privateKeyContents bytes.Buffer
-	if err := pem.Encode(&privateKeyContents, privateKeyPEM); err != nil {
-		return nil, err
+// ExportSecrets writes the given secrets, keyed by ID, in either 'json' or
+// 'dotenv' format. Dotenv keys are derived from the secret IDs, e.g.
+// '/cloud_init/ssh_key' with field 'public_key' becomes
+// CLOUD_INIT_SSH_KEY_PUBLIC_KEY.
+func ExportSecrets(w io.Writer, secrets map[string]interface{}, format string) error {
+	switch format {
+	case "json":
+		encoder := json.NewEncoder(w)
+		encoder.SetIndent("", "  ")
+		return encoder.Encode(secrets)
+	case "dotenv":
+		values := make(map[string]string)
+		for id, value := range secrets {
+			if err := addDotenvValues(values, dotenvKey(id), value); err != nil {
+				return err
+			}
+		}
+		keys := make([]string, 0, len(values))
+		for key := range values {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+		replacer := strings.NewReplacer(`\`, `\\`, `"`, `\"`, "$", `\$`, "`", "\\`", "\n", `\n`)
+		for _, key := range keys {
+			if _, err := fmt.Fprintf(w, "%s=\"%s\"\n", key, replacer.Replace(values[key])); err != nil {
+				return err
+			}
+		}
+		return nil
+	default:
+		return fmt.Errorf("unknown export format '%s', must be one of json, dotenv", format)
 	}
+}
 
-	publicKey, err := ssh.NewPublicKey(&privateKey.PublicKey)
-	if err != nil {
-		return nil, err
+// addDotenvValues adds value to values under key, or each of its fields
+// under their own keys, failing if two secrets or fields share a key.
+func addDotenvValues(values map[string]string, key string, value interface{}) error {
+	if fields, ok := value.(map[string]interface{}); ok {
+		for field, fieldValue := range fields {
+			if err := addDotenvValues(values, fmt.Sprintf("%s_%s", key, dotenvKey(field)), fieldValue); err != nil {
+				return err
+			}
+		}
+		return nil
 	}
-	publicKeyContents := string(ssh.MarshalAuthorizedKey(publicKey))
 
-	if comment != "" {
-		publicKeyContents = fmt.Sprintf("%s %s\n", strings.TrimSpace(publicKeyContents), comment)
+	if _, ok := values[key]; ok {
+		return fmt.Errorf("more than one secret or field would be exported as dotenv key '%s'", key)
 	}
+	values[key] = fmt.Sprintf("%v", value)
+	return nil
+}
 
-	return map[string]interface{}{
-		"public_key":  string(publicKeyContents),
-		"private_key": privateKeyContents.String(),
-	}, nil
+func dotenvKey(id string) string {
+	key := strings.Map(func(r rune) rune {
+		if (r >= 'a' && r <= 'z') || (r >= 'A' && r <= 'Z') || (r >= '0' && r <= '9') {
+			return r
+		}
+		return '_'
+	}, strings.Trim(id, "/"))
+	return strings.ToUpper(key)
 }
@@ -1,6 +1,8 @@
 package pxeserver_test
 
 import (
+	"bytes"
+	"encoding/base64"
 	"fmt"
 	"io/ioutil"
 	"os"
@@ -9,6 +11,7 @@ import (
 
 	"github.com/ljfranklin/pxeserver"
 	"github.com/stretchr/testify/assert"
+	"golang.org/x/crypto/curve25519"
 )
 
 // TODO: test global secrets
@@ -105,6 +108,233 @@ func TestGeneratedSshKey(t *testing.T) {
 	assert.Regexp("^ssh-rsa .+ some-user\n$", publicKey)
 }
 
+func TestGeneratedPasswordOpts(t *testing.T) {
+	assert := assert.New(t)
+
+	defs := map[string][]pxeserver.SecretDef{
+		"some-host": {
+			{
+				ID:   "/some_namespace/alnum",
+				Type: "password",
+				Opts: map[string]interface{}{
+					"length":  32.0,
+					"charset": "alnum",
+				},
+			},
+			{
+				ID:   "/some_namespace/no_symbols",
+				Type: "password",
+				Opts: map[string]interface{}{
+					"charset": "no_symbols",
+				},
+			},
+			{
+				ID:   "/some_namespace/custom",
+				Type: "password",
+				Opts: map[string]interface{}{
+					"chars": "ab",
+				},
+			},
+			{
+				ID:   "/some_namespace/unicode",
+				Type: "password",
+				Opts: map[string]interface{}{
+					"chars": "äß",
+				},
+			},
+		},
+	}
+
+	emptySecrets, err := ioutil.TempFile("", "pxeserver-secrets")
+	assert.NoError(err)
+	defer os.Remove(emptySecrets.Name())
+	secretsCfg, err := pxeserver.LoadLocalSecrets(emptySecrets.Name(), defs)
+	assert.NoError(err)
+
+	secret, err := secretsCfg.GetOrGenerate("some-host", "/some_namespace/alnum")
+	assert.NoError(err)
+	assert.Regexp("^[a-zA-Z0-9]{32}$", secret)
+
+	secret, err = secretsCfg.GetOrGenerate("some-host", "/some_namespace/no_symbols")
+	assert.NoError(err)
+	assert.Regexp("^[a-zA-Z0-9]{20}$", secret)
+
+	secret, err = secretsCfg.GetOrGenerate("some-host", "/some_namespace/custom")
+	assert.NoError(err)
+	assert.Regexp("^[ab]{20}$", secret)
+
+	secret, err = secretsCfg.GetOrGenerate("some-host", "/some_namespace/unicode")
+	assert.NoError(err)
+	assert.Regexp("^[äß]{20}$", secret)
+}
+
+func TestGeneratedPasswordErrorOnBadOpts(t *testing.T) {
+	assert := assert.New(t)
+
+	defs := map[string][]pxeserver.SecretDef{
+		"some-host": {
+			{
+				ID:   "/some_namespace/some_var",
+				Type: "password",
+				Opts: map[string]interface{}{
+					"length": "not-a-number",
+				},
+			},
+		},
+	}
+
+	emptySecrets, err := ioutil.TempFile("", "pxeserver-secrets")
+	assert.NoError(err)
+	defer os.Remove(emptySecrets.Name())
+	secretsCfg, err := pxeserver.LoadLocalSecrets(emptySecrets.Name(), defs)
+	assert.NoError(err)
+
+	_, err = secretsCfg.GetOrGenerate("some-host", "/some_namespace/some_var")
+	assert.NotNil(err)
+	assert.Contains(err.Error(), "length")
+}
+
+func TestGenerateErrorOnUnknownType(t *testing.T) {
+	assert := assert.New(t)
+
+	defs := map[string][]pxeserver.SecretDef{
+		"some-host": {
+			{
+				ID:   "/some_namespace/some_var",
+				Type: "some-unknown-type",
+			},
+		},
+	}
+
+	emptySecrets, err := ioutil.TempFile("", "pxeserver-secrets")
+	assert.NoError(err)
+	defer os.Remove(emptySecrets.Name())
+	secretsCfg, err := pxeserver.LoadLocalSecrets(emptySecrets.Name(), defs)
+	assert.NoError(err)
+
+	_, err = secretsCfg.GetOrGenerate("some-host", "/some_namespace/some_var")
+	assert.NotNil(err)
+	assert.Contains(err.Error(), "some-unknown-type")
+	assert.Contains(err.Error(), "some-host")
+}
+
+func TestGeneratedBootstrapToken(t *testing.T) {
+	assert := assert.New(t)
+
+	defs := map[string][]pxeserver.SecretDef{
+		"some-host": {
+			{
+				ID:   "/some_namespace/some_var",
+				Type: "bootstrap_token",
+			},
+		},
+	}
+
+	emptySecrets, err := ioutil.TempFile("", "pxeserver-secrets")
+	assert.NoError(err)
+	defer os.Remove(emptySecrets.Name())
+	secretsCfg, err := pxeserver.LoadLocalSecrets(emptySecrets.Name(), defs)
+	assert.NoError(err)
+
+	secret, err := secretsCfg.GetOrGenerate("some-host", "/some_namespace/some_var")
+	assert.NoError(err)
+	token := secret.(map[string]interface{})
+	assert.Regexp("^[a-z0-9]{6}\\.[a-z0-9]{16}$", token["token"])
+	assert.Equal(token["token"], fmt.Sprintf("%s.%s", token["token_id"], token["token_secret"]))
+}
+
+func TestGeneratedRandomBytes(t *testing.T) {
+	assert := assert.New(t)
+
+	defs := map[string][]pxeserver.SecretDef{
+		"some-host": {
+			{
+				ID:   "/some_namespace/hex",
+				Type: "random_bytes",
+				Opts: map[string]interface{}{
+					"length": 16.0,
+				},
+			},
+			{
+				ID:   "/some_namespace/base64",
+				Type: "random_bytes",
+				Opts: map[string]interface{}{
+					"encoding": "base64",
+				},
+			},
+		},
+	}
+
+	emptySecrets, err := ioutil.TempFile("", "pxeserver-secrets")
+	assert.NoError(err)
+	defer os.Remove(emptySecrets.Name())
+	secretsCfg, err := pxeserver.LoadLocalSecrets(emptySecrets.Name(), defs)
+	assert.NoError(err)
+
+	secret, err := secretsCfg.GetOrGenerate("some-host", "/some_namespace/hex")
+	assert.NoError(err)
+	assert.Regexp("^[0-9a-f]{32}$", secret)
+
+	secret, err = secretsCfg.GetOrGenerate("some-host", "/some_namespace/base64")
+	assert.NoError(err)
+	decoded, err := base64.StdEncoding.DecodeString(secret.(string))
+	assert.NoError(err)
+	assert.Len(decoded, 32)
+}
+
+func TestGeneratedUUID(t *testing.T) {
+	assert := assert.New(t)
+
+	defs := map[string][]pxeserver.SecretDef{
+		"some-host": {
+			{
+				ID:   "/some_namespace/some_var",
+				Type: "uuid",
+			},
+		},
+	}
+
+	emptySecrets, err := ioutil.TempFile("", "pxeserver-secrets")
+	assert.NoError(err)
+	defer os.Remove(emptySecrets.Name())
+	secretsCfg, err := pxeserver.LoadLocalSecrets(emptySecrets.Name(), defs)
+	assert.NoError(err)
+
+	secret, err := secretsCfg.GetOrGenerate("some-host", "/some_namespace/some_var")
+	assert.NoError(err)
+	assert.Regexp("^[0-9a-f]{8}-[0-9a-f]{4}-4[0-9a-f]{3}-[89ab][0-9a-f]{3}-[0-9a-f]{12}$", secret)
+}
+
+func TestGeneratedWireGuardKey(t *testing.T) {
+	assert := assert.New(t)
+
+	defs := map[string][]pxeserver.SecretDef{
+		"some-host": {
+			{
+				ID:   "/some_namespace/some_var",
+				Type: "wireguard_key",
+			},
+		},
+	}
+
+	emptySecrets, err := ioutil.TempFile("", "pxeserver-secrets")
+	assert.NoError(err)
+	defer os.Remove(emptySecrets.Name())
+	secretsCfg, err := pxeserver.LoadLocalSecrets(emptySecrets.Name(), defs)
+	assert.NoError(err)
+
+	secret, err := secretsCfg.GetOrGenerate("some-host", "/some_namespace/some_var")
+	assert.NoError(err)
+	privateKey, err := base64.StdEncoding.DecodeString(secret.(map[string]interface{})["private_key"].(string))
+	assert.NoError(err)
+	publicKey, err := base64.StdEncoding.DecodeString(secret.(map[string]interface{})["public_key"].(string))
+	assert.NoError(err)
+
+	expectedPublicKey, err := curve25519.X25519(privateKey, curve25519.Basepoint)
+	assert.NoError(err)
+	assert.Equal(expectedPublicKey, publicKey)
+}
+
 func TestGetField(t *testing.T) {
 	assert := assert.New(t)
 
@@ -140,3 +370,461 @@ func TestLocalErrorOnMissingSecretsID(t *testing.T) {
 	assert.NotNil(err)
 	assert.Contains(err.Error(), "missing-id")
 }
+
+func TestSetKeepsPreviousVersion(t *testing.T) {
+	assert := assert.New(t)
+
+	tmpdir, err := ioutil.TempDir("", "pxeserver-secrets")
+	assert.NoError(err)
+	defer os.RemoveAll(tmpdir)
+	secretsPath := path.Join(tmpdir, "secrets.yaml")
+	secretsCfg, err := pxeserver.LoadLocalSecrets(secretsPath, nil)
+	assert.NoError(err)
+
+	assert.NoError(secretsCfg.Set("some-host", "/some_namespace/some_var", "first"))
+	assert.NoError(secretsCfg.Set("some-host", "/some_namespace/some_var", "second"))
+
+	// reload config to ensure changes are persisted
+	secretsCfg, err = pxeserver.LoadLocalSecrets(secretsPath, nil)
+	assert.NoError(err)
+
+	secret, err := secretsCfg.Get("some-host", "/some_namespace/some_var")
+	assert.NoError(err)
+	assert.Equal("second", secret)
+	previous, err := secretsCfg.GetPrevious("some-host", "/some_namespace/some_var")
+	assert.NoError(err)
+	assert.Equal("first", previous)
+}
+
+func TestDeleteSecret(t *testing.T) {
+	assert := assert.New(t)
+
+	tmpdir, err := ioutil.TempDir("", "pxeserver-secrets")
+	assert.NoError(err)
+	defer os.RemoveAll(tmpdir)
+	secretsPath := path.Join(tmpdir, "secrets.yaml")
+	secretsCfg, err := pxeserver.LoadLocalSecrets(secretsPath, nil)
+	assert.NoError(err)
+
+	assert.NoError(secretsCfg.Set("some-host", "/some_namespace/some_var", "some-value"))
+	assert.NoError(secretsCfg.Set("some-host", "/some_namespace/other_var", "other-value"))
+	assert.NoError(secretsCfg.Delete("some-host", "/some_namespace/some_var"))
+
+	secretsCfg, err = pxeserver.LoadLocalSecrets(secretsPath, nil)
+	assert.NoError(err)
+	assert.Equal(map[string][]string{
+		"some-host": {"/some_namespace/other_var"},
+	}, secretsCfg.List())
+
+	err = secretsCfg.Delete("some-host", "/some_namespace/some_var")
+	assert.NotNil(err)
+	assert.Contains(err.Error(), "/some_namespace/some_var")
+}
+
+func TestRotateSecret(t *testing.T) {
+	assert := assert.New(t)
+
+	defs := map[string][]pxeserver.SecretDef{
+		"some-host": {
+			{
+				ID:   "/some_namespace/some_var",
+				Type: "password",
+			},
+		},
+	}
+
+	tmpdir, err := ioutil.TempDir("", "pxeserver-secrets")
+	assert.NoError(err)
+	defer os.RemoveAll(tmpdir)
+	secretsPath := path.Join(tmpdir, "secrets.yaml")
+	secretsCfg, err := pxeserver.LoadLocalSecrets(secretsPath, defs)
+	assert.NoError(err)
+
+	original, err := secretsCfg.GetOrGenerate("some-host", "/some_namespace/some_var")
+	assert.NoError(err)
+	assert.NoError(secretsCfg.Rotate("some-host", "/some_namespace/some_var"))
+
+	secretsCfg, err = pxeserver.LoadLocalSecrets(secretsPath, defs)
+	assert.NoError(err)
+	rotated, err := secretsCfg.Get("some-host", "/some_namespace/some_var")
+	assert.NoError(err)
+	assert.NotEqual(original, rotated)
+	previous, err := secretsCfg.GetPrevious("some-host", "/some_namespace/some_var")
+	assert.NoError(err)
+	assert.Equal(original, previous)
+
+	err = secretsCfg.Rotate("some-host", "missing-id")
+	assert.NotNil(err)
+	assert.Contains(err.Error(), "missing-id")
+}
+
+func TestGenerateAllSecrets(t *testing.T) {
+	assert := assert.New(t)
+
+	defs := map[string][]pxeserver.SecretDef{
+		"": {
+			{
+				ID:   "/some_namespace/shared_var",
+				Type: "uuid",
+			},
+		},
+		"some-host": {
+			{
+				ID:   "/some_namespace/some_var",
+				Type: "password",
+			},
+		},
+	}
+
+	tmpdir, err := ioutil.TempDir("", "pxeserver-secrets")
+	assert.NoError(err)
+	defer os.RemoveAll(tmpdir)
+	secretsPath := path.Join(tmpdir, "secrets.yaml")
+	secretsCfg, err := pxeserver.LoadLocalSecrets(secretsPath, defs)
+	assert.NoError(err)
+	assert.NoError(secretsCfg.GenerateAll())
+
+	secretsCfg, err = pxeserver.LoadLocalSecrets(secretsPath, nil)
+	assert.NoError(err)
+	assert.Equal(map[string][]string{
+		"":          {"/some_namespace/shared_var"},
+		"some-host": {"/some_namespace/some_var"},
+	}, secretsCfg.List())
+}
+
+func TestImportSecrets(t *testing.T) {
+	assert := assert.New(t)
+
+	tmpdir, err := ioutil.TempDir("", "pxeserver-secrets")
+	assert.NoError(err)
+	defer os.RemoveAll(tmpdir)
+	secretsPath := path.Join(tmpdir, "secrets.yaml")
+	secretsCfg, err := pxeserver.LoadLocalSecrets(secretsPath, nil)
+	assert.NoError(err)
+	assert.NoError(secretsCfg.Set("some-host", "/some_namespace/existing_var", "existing-value"))
+
+	importFile, err := os.Open(path.Join(fixturesDir(), "secrets", "secrets-map.yaml"))
+	assert.NoError(err)
+	defer importFile.Close()
+	assert.NoError(secretsCfg.Import(importFile))
+
+	secretsCfg, err = pxeserver.LoadLocalSecrets(secretsPath, nil)
+	assert.NoError(err)
+	secret, err := secretsCfg.Get("some-host", "/some_namespace/existing_var")
+	assert.NoError(err)
+	assert.Equal("existing-value", secret)
+	secret, err = secretsCfg.GetField("some-host", "/some_namespace/some_var", "some_field")
+	assert.NoError(err)
+	assert.Equal("some_value", secret)
+}
+
+func TestInternalKeysAreKeptApartFromSecrets(t *testing.T) {
+	assert := assert.New(t)
+
+	tmpdir, err := ioutil.TempDir("", "pxeserver-secrets")
+	assert.NoError(err)
+	defer os.RemoveAll(tmpdir)
+	secretsPath := path.Join(tmpdir, "secrets.yaml")
+	secretsCfg, err := pxeserver.LoadLocalSecrets(secretsPath, nil)
+	assert.NoError(err)
+	assert.NoError(secretsCfg.SetInternal("/pxeserver/tls_key", "some-key"))
+
+	secretsCfg, err = pxeserver.LoadLocalSecrets(secretsPath, nil)
+	assert.NoError(err)
+	key, err := secretsCfg.GetInternal("/pxeserver/tls_key")
+	assert.NoError(err)
+	assert.Equal("some-key", key)
+	_, err = secretsCfg.Get("", "/pxeserver/tls_key")
+	assert.Error(err)
+	assert.Empty(secretsCfg.List())
+
+	err = secretsCfg.Set("", "/pxeserver/tls_key", "other-key")
+	assert.Error(err)
+	assert.Contains(err.Error(), "reserved")
+	err = secretsCfg.Import(bytes.NewBufferString("hosts:\n- mac: \"\"\n  secrets:\n  - id: /pxeserver/tls_key\n    value: other-key\n"))
+	assert.Error(err)
+	err = secretsCfg.Import(bytes.NewBufferString("internal:\n- id: /pxeserver/tls_key\n  value: other-key\n"))
+	assert.Error(err)
+	key, err = secretsCfg.GetInternal("/pxeserver/tls_key")
+	assert.NoError(err)
+	assert.Equal("some-key", key)
+}
+
+func TestInternalKeysMovedFromSharedSecrets(t *testing.T) {
+	assert := assert.New(t)
+
+	tmpdir, err := ioutil.TempDir("", "pxeserver-secrets")
+	assert.NoError(err)
+	defer os.RemoveAll(tmpdir)
+	secretsPath := path.Join(tmpdir, "secrets.yaml")
+	legacy := "hosts:\n- mac: \"\"\n  secrets:\n  - id: /pxeserver/file_token_key\n    value: some-key\n  - id: /some_namespace/some_var\n    value: some-value\n"
+	assert.NoError(ioutil.WriteFile(secretsPath, []byte(legacy), 0600))
+
+	secretsCfg, err := pxeserver.LoadLocalSecrets(secretsPath, nil)
+	assert.NoError(err)
+	key, err := secretsCfg.GetInternal("/pxeserver/file_token_key")
+	assert.NoError(err)
+	assert.Equal("some-key", key)
+	_, err = secretsCfg.Get("", "/pxeserver/file_token_key")
+	assert.Error(err)
+	assert.Equal(map[string][]string{"": {"/some_namespace/some_var"}}, secretsCfg.List())
+}
+
+func TestExportSecretsJSON(t *testing.T) {
+	assert := assert.New(t)
+
+	var output bytes.Buffer
+	err := pxeserver.ExportSecrets(&output, map[string]interface{}{
+		"/some_namespace/some_var": "some-value",
+	}, "json")
+	assert.NoError(err)
+	assert.JSONEq(`{"/some_namespace/some_var": "some-value"}`, output.String())
+}
+
+func TestExportSecretsDotenv(t *testing.T) {
+	assert := assert.New(t)
+
+	var output bytes.Buffer
+	err := pxeserver.ExportSecrets(&output, map[string]interface{}{
+		"/some_namespace/some_var": "some \"quoted\" $value",
+		"/some_namespace/some_key": map[string]interface{}{
+			"public_key":  "some-public-key",
+			"private_key": "some\nprivate-key",
+		},
+	}, "dotenv")
+	assert.NoError(err)
+	assert.Equal(`SOME_NAMESPACE_SOME_KEY_PRIVATE_KEY="some\nprivate-key"
+SOME_NAMESPACE_SOME_KEY_PUBLIC_KEY="some-public-key"
+SOME_NAMESPACE_SOME_VAR="some \"quoted\" \$value"
+`, output.String())
+}
+
+func TestExportSecretsDotenvErrorOnDuplicateKeys(t *testing.T) {
+	assert := assert.New(t)
+
+	var output bytes.Buffer
+	err := pxeserver.ExportSecrets(&output, map[string]interface{}{
+		"/a/b": "some-value",
+		"/a_b": "other-value",
+	}, "dotenv")
+	assert.NotNil(err)
+	assert.Contains(err.Error(), "A_B")
+	assert.Empty(output.String())
+}
+
+func TestSaveLeavesOnlyTheStoreFile(t *testing.T) {
+	assert := assert.New(t)
+
+	tmpdir, err := ioutil.TempDir("", "pxeserver-secrets")
+	assert.NoError(err)
+	defer os.RemoveAll(tmpdir)
+	secretsPath := path.Join(tmpdir, "secrets.yaml")
+	secretsCfg, err := pxeserver.LoadLocalSecrets(secretsPath, nil)
+	assert.NoError(err)
+	assert.NoError(secretsCfg.Set("some-host", "/some_namespace/some_var", "some-value"))
+	assert.NoError(secretsCfg.Set("some-host", "/some_namespace/some_var", "other-value"))
+
+	entries, err := ioutil.ReadDir(tmpdir)
+	assert.NoError(err)
+	assert.Len(entries, 1)
+	assert.Equal("secrets.yaml", entries[0].Name())
+	assert.Equal(os.FileMode(0600), entries[0].Mode().Perm())
+}
+
+func TestExportSecretsErrorOnUnknownFormat(t *testing.T) {
+	assert := assert.New(t)
+
+	err := pxeserver.ExportSecrets(ioutil.Discard, map[string]interface{}{}, "some-format")
+	assert.NotNil(err)
+	assert.Contains(err.Error(), "some-format")
+}
+
+func TestImportedSecrets(t *testing.T) {
+	assert := assert.New(t)
+
+	os.Setenv("PXESERVER_TEST_SECRET", "some-env-secret")
+	defer os.Unsetenv("PXESERVER_TEST_SECRET")
+
+	defs := map[string][]pxeserver.SecretDef{
+		"some-host": {
+			{
+				ID:   "/some_namespace/file",
+				Type: "file",
+				Opts: map[string]interface{}{
+					"path":       path.Join(fixturesDir(), "secrets", "imported.txt"),
+					"trim_space": true,
+				},
+			},
+			{
+				ID:   "/some_namespace/env",
+				Type: "env",
+				Opts: map[string]interface{}{
+					"name": "PXESERVER_TEST_SECRET",
+				},
+			},
+			{
+				ID:   "/some_namespace/static",
+				Type: "static",
+				Opts: map[string]interface{}{
+					"value": "some-static-secret",
+				},
+			},
+		},
+	}
+
+	tmpdir, err := ioutil.TempDir("", "pxeserver-secrets")
+	assert.NoError(err)
+	defer os.RemoveAll(tmpdir)
+	secretsPath := path.Join(tmpdir, "secrets.yaml")
+	secretsCfg, err := pxeserver.LoadLocalSecrets(secretsPath, defs)
+	assert.NoError(err)
+
+	secret, err := secretsCfg.GetOrGenerate("some-host", "/some_namespace/file")
+	assert.NoError(err)
+	assert.Equal("some-file-secret", secret)
+	secret, err = secretsCfg.GetOrGenerate("some-host", "/some_namespace/env")
+	assert.NoError(err)
+	assert.Equal("some-env-secret", secret)
+	secret, err = secretsCfg.GetOrGenerate("some-host", "/some_namespace/static")
+	assert.NoError(err)
+	assert.Equal("some-static-secret", secret)
+
+	// imported values are stored once and only change on refresh
+	os.Setenv("PXESERVER_TEST_SECRET", "some-new-env-secret")
+	secretsCfg, err = pxeserver.LoadLocalSecrets(secretsPath, defs)
+	assert.NoError(err)
+	secret, err = secretsCfg.GetOrGenerate("some-host", "/some_namespace/env")
+	assert.NoError(err)
+	assert.Equal("some-env-secret", secret)
+
+	assert.NoError(secretsCfg.RefreshImported())
+	secret, err = secretsCfg.Get("some-host", "/some_namespace/env")
+	assert.NoError(err)
+	assert.Equal("some-new-env-secret", secret)
+	previous, err := secretsCfg.GetPrevious("some-host", "/some_namespace/env")
+	assert.NoError(err)
+	assert.Equal("some-env-secret", previous)
+}
+
+func TestRefreshSingleImportedSecret(t *testing.T) {
+	assert := assert.New(t)
+
+	os.Setenv("PXESERVER_TEST_SECRET", "some-env-secret")
+	defer os.Unsetenv("PXESERVER_TEST_SECRET")
+	defs := map[string][]pxeserver.SecretDef{
+		"some-host": {
+			{
+				ID:   "/some_namespace/env",
+				Type: "env",
+				Opts: map[string]interface{}{
+					"name": "PXESERVER_TEST_SECRET",
+				},
+			},
+			{
+				ID:   "/some_namespace/password",
+				Type: "password",
+			},
+		},
+	}
+
+	emptySecrets, err := ioutil.TempFile("", "pxeserver-secrets")
+	assert.NoError(err)
+	defer os.Remove(emptySecrets.Name())
+	secretsCfg, err := pxeserver.LoadLocalSecrets(emptySecrets.Name(), defs)
+	assert.NoError(err)
+	assert.NoError(secretsCfg.GenerateAll())
+	password, err := secretsCfg.Get("some-host", "/some_namespace/password")
+	assert.NoError(err)
+
+	os.Setenv("PXESERVER_TEST_SECRET", "some-new-env-secret")
+	assert.NoError(secretsCfg.Refresh("some-host", "/some_namespace/env"))
+	secret, err := secretsCfg.Get("some-host", "/some_namespace/env")
+	assert.NoError(err)
+	assert.Equal("some-new-env-secret", secret)
+
+	// generated secrets are rotated, not refreshed
+	err = secretsCfg.Refresh("some-host", "/some_namespace/password")
+	assert.NotNil(err)
+	assert.Contains(err.Error(), "rotate")
+	secret, err = secretsCfg.Get("some-host", "/some_namespace/password")
+	assert.NoError(err)
+	assert.Equal(password, secret)
+}
+
+func TestImportedSecretErrorOnMissingEnv(t *testing.T) {
+	assert := assert.New(t)
+
+	defs := map[string][]pxeserver.SecretDef{
+		"some-host": {
+			{
+				ID:   "/some_namespace/env",
+				Type: "env",
+				Opts: map[string]interface{}{
+					"name": "PXESERVER_TEST_MISSING_SECRET",
+				},
+			},
+		},
+	}
+
+	emptySecrets, err := ioutil.TempFile("", "pxeserver-secrets")
+	assert.NoError(err)
+	defer os.Remove(emptySecrets.Name())
+	secretsCfg, err := pxeserver.LoadLocalSecrets(emptySecrets.Name(), defs)
+	assert.NoError(err)
+
+	_, err = secretsCfg.GetOrGenerate("some-host", "/some_namespace/env")
+	assert.NotNil(err)
+	assert.Contains(err.Error(), "PXESERVER_TEST_MISSING_SECRET")
+}
+
+func TestMigrateSecretsToHostName(t *testing.T) {
+	assert := assert.New(t)
+
+	tmpdir, err := ioutil.TempDir("", "pxeserver-secrets")
+	assert.NoError(err)
+	defer os.RemoveAll(tmpdir)
+	secretsPath := path.Join(tmpdir, "secrets.yaml")
+	secretsCfg, err := pxeserver.LoadLocalSecrets(secretsPath, nil)
+	assert.NoError(err)
+
+	assert.NoError(secretsCfg.Set("52:54:00:12:34:56", "/some_namespace/some_var", "first"))
+	assert.NoError(secretsCfg.Set("52:54:00:12:34:56", "/some_namespace/some_var", "second"))
+	assert.NoError(secretsCfg.Set("52:54:00:65:43:21", "/some_namespace/some_var", "other"))
+
+	hostMACs := map[string][]string{
+		"web-1":             {"52:54:00:12:34:56", "52:54:00:12:34:57"},
+		"52:54:00:65:43:21": {"52:54:00:65:43:21"},
+	}
+	assert.Equal(map[string]string{"52:54:00:12:34:56": "web-1"}, pxeserver.UnmigratedSecrets(secretsCfg, hostMACs))
+	migrated, err := pxeserver.MigrateSecrets(secretsCfg, hostMACs)
+	assert.NoError(err)
+	assert.Equal(map[string]string{"52:54:00:12:34:56": "web-1"}, migrated)
+
+	// reload config to ensure changes are persisted
+	secretsCfg, err = pxeserver.LoadLocalSecrets(secretsPath, nil)
+	assert.NoError(err)
+	assert.Equal(map[string][]string{
+		"web-1":             {"/some_namespace/some_var"},
+		"52:54:00:65:43:21": {"/some_namespace/some_var"},
+	}, secretsCfg.List())
+	secret, err := secretsCfg.Get("web-1", "/some_namespace/some_var")
+	assert.NoError(err)
+	assert.Equal("second", secret)
+	previous, err := secretsCfg.GetPrevious("web-1", "/some_namespace/some_var")
+	assert.NoError(err)
+	assert.Equal("first", previous)
+
+	assert.Empty(pxeserver.UnmigratedSecrets(secretsCfg, hostMACs))
+	migrated, err = pxeserver.MigrateSecrets(secretsCfg, hostMACs)
+	assert.NoError(err)
+	assert.Empty(migrated)
+
+	// a secret already generated under the name isn't overwritten
+	assert.NoError(secretsCfg.Set("52:54:00:12:34:57", "/some_namespace/some_var", "stale"))
+	_, err = pxeserver.MigrateSecrets(secretsCfg, hostMACs)
+	assert.NotNil(err)
+	assert.Contains(err.Error(), "/some_namespace/some_var")
+	secret, err = secretsCfg.Get("web-1", "/some_namespace/some_var")
+	assert.NoError(err)
+	assert.Equal("second", secret)
+}
@@ -0,0 +1,67 @@
+package pxeserver
+
+import (
+	"encoding/json"
+	"net/http"
+	"sort"
+)
+
+// StatusHandler reports the hosts pxeserver boots and the addresses they
+// were last seen with, for monitoring on server.status_port.
+type StatusHandler struct {
+	Hosts      []string
+	Interfaces []InterfaceSettings
+	// Leases fills in each host's addresses, if non-nil
+	Leases *Leases
+}
+
+type hostStatus struct {
+	Mac  string `json:"mac"`
+	IPv4 string `json:"ipv4,omitempty"`
+	IPv6 string `json:"ipv6,omitempty"`
+}
+
+type serverStatus struct {
+	Hosts      []hostStatus        `json:"hosts"`
+	Interfaces []InterfaceSettings `json:"interfaces"`
+}
+
+func (h StatusHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	switch r.URL.Path {
+	case "/healthz":
+		w.Header().Set("Content-Type", "text/plain")
+		w.Write([]byte("ok\n"))
+	case "/status":
+		h.handleStatus(w, r)
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+func (h StatusHandler) handleStatus(w http.ResponseWriter, r *http.Request) {
+	macs := append([]string{}, h.Hosts...)
+	sort.Strings(macs)
+
+	status := serverStatus{
+		Hosts:      make([]hostStatus, 0, len(macs)),
+		Interfaces: h.Interfaces,
+	}
+	if status.Interfaces == nil {
+		status.Interfaces = []InterfaceSettings{}
+	}
+	for _, mac := range macs {
+		host := hostStatus{Mac: mac}
+		if h.Leases != nil {
+			if ip, ok := h.Leases.IP(mac); ok {
+				host.IPv4 = ip.String()
+			}
+			if ip, ok := h.Leases.IP6(mac); ok {
+				host.IPv6 = ip.String()
+			}
+		}
+		status.Hosts = append(status.Hosts, host)
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(status)
+}
@@ -0,0 +1,57 @@
+package pxeserver_test
+
+import (
+	"encoding/json"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/ljfranklin/pxeserver"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestStatusHealthz(t *testing.T) {
+	assert := assert.New(t)
+
+	handler := pxeserver.StatusHandler{}
+	recorder := httptest.NewRecorder()
+	handler.ServeHTTP(recorder, httptest.NewRequest("GET", "/healthz", nil))
+
+	assert.Equal(http.StatusOK, recorder.Code)
+	assert.Equal("ok\n", recorder.Body.String())
+}
+
+func TestStatusReportsHostAddresses(t *testing.T) {
+	assert := assert.New(t)
+
+	leases := pxeserver.NewLeases()
+	leases.Set("52:54:00:00:00:01", net.ParseIP("10.0.0.10"))
+	leases.Set("52:54:00:00:00:01", net.ParseIP("2001:db8::100"))
+	handler := pxeserver.StatusHandler{
+		Hosts:      []string{"52:54:00:00:00:02", "52:54:00:00:00:01"},
+		Interfaces: []pxeserver.InterfaceSettings{{Name: "eth1"}},
+		Leases:     leases,
+	}
+	recorder := httptest.NewRecorder()
+	handler.ServeHTTP(recorder, httptest.NewRequest("GET", "/status", nil))
+	assert.Equal(http.StatusOK, recorder.Code)
+
+	var status struct {
+		Hosts []struct {
+			Mac  string `json:"mac"`
+			IPv4 string `json:"ipv4"`
+			IPv6 string `json:"ipv6"`
+		} `json:"hosts"`
+		Interfaces []struct {
+			Name string `json:"name"`
+		} `json:"interfaces"`
+	}
+	assert.NoError(json.Unmarshal(recorder.Body.Bytes(), &status))
+	assert.Len(status.Hosts, 2)
+	assert.Equal("52:54:00:00:00:01", status.Hosts[0].Mac)
+	assert.Equal("10.0.0.10", status.Hosts[0].IPv4)
+	assert.Equal("2001:db8::100", status.Hosts[0].IPv6)
+	assert.Equal("", status.Hosts[1].IPv4)
+	assert.Equal("eth1", status.Interfaces[0].Name)
+}
@@ -0,0 +1,72 @@
+package pxeserver
+
+import (
+	"fmt"
+	"net"
+)
+
+// SubnetURLs picks the base URL of pxeserver's HTTP server handed to each
+// client, using the server_address of the subnet the client boots from so
+// hosts behind a relay are sent an address they can reach.
+type SubnetURLs struct {
+	defaultURL string
+	subnets    []subnetURL
+	hostURLs   map[string]string
+	leases     *Leases
+}
+
+type subnetURL struct {
+	network *net.IPNet
+	baseURL string
+}
+
+// NewSubnetURLs looks hosts up by their configured subnet, then by the
+// address or relay seen in leases, if non-nil.
+func NewSubnetURLs(settings ServerSettings, hostSubnets map[string]DHCPSubnet, leases *Leases) (*SubnetURLs, error) {
+	u := &SubnetURLs{
+		defaultURL: settings.BaseURL(),
+		hostURLs:   make(map[string]string),
+		leases:     leases,
+	}
+	for _, subnet := range settings.DHCP.Subnets {
+		_, network, err := net.ParseCIDR(subnet.CIDR)
+		if err != nil {
+			return nil, fmt.Errorf("invalid DHCP subnet '%s': %s", subnet.CIDR, err)
+		}
+		u.subnets = append(u.subnets, subnetURL{
+			network: network,
+			baseURL: settings.SubnetBaseURL(subnet),
+		})
+	}
+	for mac, subnet := range hostSubnets {
+		u.hostURLs[mac] = settings.SubnetBaseURL(subnet)
+	}
+	return u, nil
+}
+
+// ForIP returns the base URL for a client with address ip.
+func (u *SubnetURLs) ForIP(ip net.IP) string {
+	for _, subnet := range u.subnets {
+		if subnet.network.Contains(ip) {
+			return subnet.baseURL
+		}
+	}
+	return u.defaultURL
+}
+
+// ForHost returns the base URL for the host with the given MAC, before it
+// has contacted the HTTP server.
+func (u *SubnetURLs) ForHost(mac string) string {
+	if baseURL, ok := u.hostURLs[mac]; ok {
+		return baseURL
+	}
+	if u.leases != nil {
+		if ip, ok := u.leases.IP(mac); ok {
+			return u.ForIP(ip)
+		}
+		if relay, ok := u.leases.Relay(mac); ok {
+			return u.ForIP(relay)
+		}
+	}
+	return u.defaultURL
+}
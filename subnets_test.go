@@ -0,0 +1,64 @@
+package pxeserver_test
+
+import (
+	"net"
+	"testing"
+
+	"github.com/ljfranklin/pxeserver"
+	"github.com/stretchr/testify/assert"
+)
+
+func testSubnetSettings() pxeserver.ServerSettings {
+	return pxeserver.ServerSettings{
+		HTTPAddress: "10.0.0.1:8080",
+		DHCP: pxeserver.DHCPSettings{
+			Subnets: []pxeserver.DHCPSubnet{
+				{
+					CIDR: "10.0.0.0/24",
+				},
+				{
+					Name:          "rack-2",
+					CIDR:          "10.0.1.0/24",
+					ServerAddress: "192.168.0.10",
+				},
+			},
+		},
+	}
+}
+
+func TestSubnetURLsForIP(t *testing.T) {
+	assert := assert.New(t)
+
+	urls, err := pxeserver.NewSubnetURLs(testSubnetSettings(), nil, nil)
+	assert.NoError(err)
+
+	assert.Equal("http://10.0.0.1:8080", urls.ForIP(net.ParseIP("10.0.0.20")))
+	assert.Equal("http://192.168.0.10:8080", urls.ForIP(net.ParseIP("10.0.1.20")))
+	assert.Equal("http://10.0.0.1:8080", urls.ForIP(net.ParseIP("172.16.0.20")))
+}
+
+func TestSubnetURLsForHost(t *testing.T) {
+	assert := assert.New(t)
+
+	settings := testSubnetSettings()
+	leases := pxeserver.NewLeases()
+	leases.Set("52:54:00:00:00:02", net.ParseIP("10.0.1.20"))
+	urls, err := pxeserver.NewSubnetURLs(settings, map[string]pxeserver.DHCPSubnet{
+		"52:54:00:00:00:01": settings.DHCP.Subnets[1],
+	}, leases)
+	assert.NoError(err)
+
+	assert.Equal("http://192.168.0.10:8080", urls.ForHost("52:54:00:00:00:01"))
+	assert.Equal("http://192.168.0.10:8080", urls.ForHost("52:54:00:00:00:02"))
+	assert.Equal("http://10.0.0.1:8080", urls.ForHost("52:54:00:00:00:03"))
+}
+
+func TestSubnetBaseURLKeepsSchemeAndPort(t *testing.T) {
+	assert := assert.New(t)
+
+	settings := testSubnetSettings()
+	settings.TLS.Enabled = true
+
+	assert.Equal("https://192.168.0.10:8080", settings.SubnetBaseURL(settings.DHCP.Subnets[1]))
+	assert.Equal("https://10.0.0.1:8080", settings.SubnetBaseURL(settings.DHCP.Subnets[0]))
+}
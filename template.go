@@ -11,10 +11,22 @@ import (
 
 type Renderer struct {
 	Secrets Secrets
+	// Scopes maps each host name to the secret scopes it may read
+	Scopes map[string][]string
+	// FileTokens signs the IDs returned by 'file_url', if non-nil
+	FileTokens *FileTokens
+	// Audit records each secret read and template rendered, if non-nil
+	Audit *AuditLog
+	// Redactor tracks each secret read so it can be masked in logs, if non-nil
+	Redactor *Redactor
+	// Subnets maps each host name to the subnet it boots from, exposed to
+	// templates as .subnet
+	Subnets map[string]DHCPSubnet
 }
 
 type RenderFileArgs struct {
-	Mac      string
+	Host     string
+	FileID   string
 	Template string
 	Vars     map[string]interface{}
 }
@@ -32,10 +44,13 @@ func (r Renderer) RenderFile(args RenderFileArgs) (string, error) {
 		return noopValue, nil
 	}
 	getSecret := func(id string) (interface{}, error) {
-		return r.Secrets.GetOrGenerate(args.Mac, id)
+		return r.getSecret(args.Host, args.FileID, args.Host, "", id)
 	}
 	getSharedSecret := func(id string) (interface{}, error) {
-		return r.Secrets.GetOrGenerate("", id)
+		return r.getSecret(args.Host, args.FileID, "", "", id)
+	}
+	getScopedSecret := func(scope string, id string) (interface{}, error) {
+		return r.getScopedSecret(args.Host, args.FileID, scope, id)
 	}
 	templateFuncs := template.FuncMap{
 		"file_url":      getFileURL,
@@ -43,6 +58,7 @@ func (r Renderer) RenderFile(args RenderFileArgs) (string, error) {
 		"file_md5":      getFileMD5,
 		"secret":        getSecret,
 		"shared_secret": getSharedSecret,
+		"scoped_secret": getScopedSecret,
 	}
 
 	vars, err := r.templateVars(args.Vars, templateFuncs)
@@ -59,7 +75,14 @@ func (r Renderer) RenderFile(args RenderFileArgs) (string, error) {
 		return "", err
 	}
 	var templatedReader bytes.Buffer
-	if err = tmpl.Execute(&templatedReader, map[string]interface{}{"vars": vars}); err != nil {
+	if err = tmpl.Execute(&templatedReader, r.templateData(args.Host, vars)); err != nil {
+		return "", err
+	}
+	if err := r.Audit.Record(AuditEvent{
+		Event:  AuditFileRender,
+		Host:   args.Host,
+		FileID: args.FileID,
+	}); err != nil {
 		return "", err
 	}
 	return templatedReader.String(), nil
@@ -72,7 +95,7 @@ type fileHelper interface {
 
 type RenderCmdlineArgs struct {
 	Template   string
-	Mac        string
+	Host       string
 	Vars       map[string]interface{}
 	ExtraFuncs template.FuncMap
 	Files      fileHelper
@@ -80,21 +103,27 @@ type RenderCmdlineArgs struct {
 
 func (r Renderer) RenderCmdline(args RenderCmdlineArgs) (string, error) {
 	getFileURL := func(id string) (string, error) {
-		namespacedID := fmt.Sprintf("%s-%s", args.Mac, id)
+		namespacedID := fmt.Sprintf("%s-%s", args.Host, id)
+		if r.FileTokens != nil {
+			namespacedID = r.FileTokens.Sign(namespacedID)
+		}
 		idFunc := args.ExtraFuncs["ID"].(func(string) string)
 		return idFunc(namespacedID), nil
 	}
 	getFileSHA256 := func(id string) (string, error) {
-		return args.Files.SHA256(fmt.Sprintf("%s-%s", args.Mac, id))
+		return args.Files.SHA256(fmt.Sprintf("%s-%s", args.Host, id))
 	}
 	getFileMD5 := func(id string) (string, error) {
-		return args.Files.MD5(fmt.Sprintf("%s-%s", args.Mac, id))
+		return args.Files.MD5(fmt.Sprintf("%s-%s", args.Host, id))
 	}
 	getSecret := func(id string) (interface{}, error) {
-		return r.Secrets.GetOrGenerate(args.Mac, id)
+		return r.getSecret(args.Host, "", args.Host, "", id)
 	}
 	getSharedSecret := func(id string) (interface{}, error) {
-		return r.Secrets.GetOrGenerate("", id)
+		return r.getSecret(args.Host, "", "", "", id)
+	}
+	getScopedSecret := func(scope string, id string) (interface{}, error) {
+		return r.getScopedSecret(args.Host, "", scope, id)
 	}
 	templateFuncs := template.FuncMap{
 		"file_url":      getFileURL,
@@ -102,6 +131,7 @@ func (r Renderer) RenderCmdline(args RenderCmdlineArgs) (string, error) {
 		"file_md5":      getFileMD5,
 		"secret":        getSecret,
 		"shared_secret": getSharedSecret,
+		"scoped_secret": getScopedSecret,
 	}
 
 	vars, err := r.templateVars(args.Vars, templateFuncs)
@@ -118,13 +148,51 @@ func (r Renderer) RenderCmdline(args RenderCmdlineArgs) (string, error) {
 		return "", err
 	}
 	var templatedCmdline bytes.Buffer
-	if err = tmpl.Execute(&templatedCmdline, map[string]interface{}{"vars": vars}); err != nil {
+	if err = tmpl.Execute(&templatedCmdline, r.templateData(args.Host, vars)); err != nil {
+		return "", err
+	}
+	if err := r.Audit.Record(AuditEvent{
+		Event: AuditCmdlineRender,
+		Host:  args.Host,
+	}); err != nil {
 		return "", err
 	}
 
 	return templatedCmdline.String(), nil
 }
 
+// getSecret reads secret id from the store under storeKey, i.e. the host's
+// name, "" for shared secrets or the key of a named scope.
+func (r Renderer) getSecret(host string, fileID string, storeKey string, scope string, id string) (interface{}, error) {
+	secret, err := r.Secrets.GetOrGenerate(storeKey, id)
+	if err != nil {
+		return nil, err
+	}
+	r.Redactor.Add(secret)
+	if storeKey == "" {
+		scope = "shared"
+	}
+	if err := r.Audit.Record(AuditEvent{
+		Event:    AuditSecretAccess,
+		Host:     host,
+		SecretID: id,
+		Scope:    scope,
+		FileID:   fileID,
+	}); err != nil {
+		return nil, err
+	}
+	return secret, nil
+}
+
+func (r Renderer) getScopedSecret(host string, fileID string, scope string, id string) (interface{}, error) {
+	for _, allowedScope := range r.Scopes[host] {
+		if allowedScope == scope {
+			return r.getSecret(host, fileID, SecretScopeKey(scope), scope, id)
+		}
+	}
+	return nil, fmt.Errorf("host '%s' is not a member of secret scope '%s'", host, scope)
+}
+
 func (r Renderer) RenderPath(filepath string) (string, error) {
 	getBuiltin := func(builtinPath string) (string, error) {
 		return fmt.Sprintf("__builtin__/%s", builtinPath), nil
@@ -148,6 +216,27 @@ func (r Renderer) RenderPath(filepath string) (string, error) {
 	return templatedPath.String(), nil
 }
 
+// templateData leaves out .subnet for hosts without one so templates
+// referencing it fail rather than render empty values.
+func (r Renderer) templateData(host string, vars map[string]interface{}) map[string]interface{} {
+	data := map[string]interface{}{"vars": vars}
+	if subnet, ok := r.Subnets[host]; ok {
+		dns := subnet.DNS
+		if dns == nil {
+			dns = []string{}
+		}
+		data["subnet"] = map[string]interface{}{
+			"name":           subnet.Name,
+			"cidr":           subnet.CIDR,
+			"server_address": subnet.ServerAddress,
+			"gateway":        subnet.Gateway,
+			"dns":            dns,
+			"domain":         subnet.Domain,
+		}
+	}
+	return data
+}
+
 func (r Renderer) templateVars(vars map[string]interface{}, funcs template.FuncMap) (map[string]interface{}, error) {
 	result, err := r.templateSingleVar(vars, funcs)
 	if err != nil {
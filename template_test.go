@@ -2,9 +2,11 @@ package pxeserver_test
 
 import (
 	"io/ioutil"
+	"os"
 	"path"
 	"testing"
 	"text/template"
+	"time"
 
 	"github.com/ljfranklin/pxeserver"
 	"github.com/stretchr/testify/assert"
@@ -83,7 +85,7 @@ func TestRenderFileWithSecrets(t *testing.T) {
 	assert := assert.New(t)
 
 	mockSecrets := new(MockSecrets)
-	mockSecrets.On("GetOrGenerate", "some-mac", "some-id").Return("1234", nil)
+	mockSecrets.On("GetOrGenerate", "some-host", "some-id").Return("1234", nil)
 
 	templateContents, err := ioutil.ReadFile(path.Join(fixturesDir(), "template", "secrets.txt"))
 	assert.NoError(err)
@@ -93,7 +95,7 @@ func TestRenderFileWithSecrets(t *testing.T) {
 	}
 
 	result, err := renderer.RenderFile(pxeserver.RenderFileArgs{
-		Mac:      "some-mac",
+		Host:     "some-host",
 		Template: string(templateContents),
 		Vars: map[string]interface{}{
 			"some_var": "{{ upper \"some_value\" }}",
@@ -118,7 +120,7 @@ func TestRenderFileWithSharedSecrets(t *testing.T) {
 	}
 
 	result, err := renderer.RenderFile(pxeserver.RenderFileArgs{
-		Mac:      "some-mac",
+		Host:     "some-host",
 		Template: string(templateContents),
 		Vars: map[string]interface{}{
 			"some_var": "{{ upper \"some_value\" }}",
@@ -128,7 +130,7 @@ func TestRenderFileWithSharedSecrets(t *testing.T) {
 	assert.Equal("1234\n", result)
 
 	result, err = renderer.RenderFile(pxeserver.RenderFileArgs{
-		Mac:      "some-other-mac",
+		Host:     "some-other-host",
 		Template: string(templateContents),
 		Vars: map[string]interface{}{
 			"some_var": "{{ upper \"some_value\" }}",
@@ -138,6 +140,40 @@ func TestRenderFileWithSharedSecrets(t *testing.T) {
 	assert.Equal("1234\n", result)
 }
 
+func TestRenderFileWithScopedSecrets(t *testing.T) {
+	assert := assert.New(t)
+
+	mockSecrets := new(MockSecrets)
+	mockSecrets.On("GetOrGenerate", pxeserver.SecretScopeKey("cluster-a"), "some-id").Return("1234", nil)
+
+	templateContents, err := ioutil.ReadFile(path.Join(fixturesDir(), "template", "scoped-secrets.txt"))
+	assert.NoError(err)
+
+	renderer := pxeserver.Renderer{
+		Secrets: mockSecrets,
+		Scopes: map[string][]string{
+			"some-host": {"cluster-a"},
+		},
+	}
+
+	result, err := renderer.RenderFile(pxeserver.RenderFileArgs{
+		Host:     "some-host",
+		Template: string(templateContents),
+		Vars:     map[string]interface{}{},
+	})
+	assert.NoError(err)
+	assert.Equal("1234\n", result)
+
+	_, err = renderer.RenderFile(pxeserver.RenderFileArgs{
+		Host:     "some-other-host",
+		Template: string(templateContents),
+		Vars:     map[string]interface{}{},
+	})
+	assert.NotNil(err)
+	assert.Contains(err.Error(), "cluster-a")
+	mockSecrets.AssertNumberOfCalls(t, "GetOrGenerate", 1)
+}
+
 func TestRenderFileIgnoresFileDownloadHelpers(t *testing.T) {
 	assert := assert.New(t)
 
@@ -158,6 +194,53 @@ func TestRenderFileIgnoresFileDownloadHelpers(t *testing.T) {
 	assert.Equal("some-text\nsome_value\n4\n", result)
 }
 
+func TestRenderFileRecordsAuditEvents(t *testing.T) {
+	assert := assert.New(t)
+
+	tmpdir, err := ioutil.TempDir("", "pxeserver-audit")
+	assert.NoError(err)
+	defer os.RemoveAll(tmpdir)
+	logPath := path.Join(tmpdir, "audit.log")
+	audit, err := pxeserver.OpenAuditLog(logPath, 0, 0)
+	assert.NoError(err)
+
+	mockSecrets := new(MockSecrets)
+	mockSecrets.On("GetOrGenerate", "some-host", "some-id").Return("1234", nil)
+
+	templateContents, err := ioutil.ReadFile(path.Join(fixturesDir(), "template", "secrets.txt"))
+	assert.NoError(err)
+
+	renderer := pxeserver.Renderer{
+		Secrets: mockSecrets,
+		Audit:   audit,
+	}
+
+	_, err = renderer.RenderFile(pxeserver.RenderFileArgs{
+		Host:     "some-host",
+		FileID:   "some-file",
+		Template: string(templateContents),
+		Vars: map[string]interface{}{
+			"some_var": "some_value",
+		},
+	})
+	assert.NoError(err)
+	assert.NoError(audit.Close())
+
+	events, err := pxeserver.QueryAuditLog(logPath, pxeserver.AuditFilter{})
+	assert.NoError(err)
+	assert.Len(events, 2)
+	assert.Equal(pxeserver.AuditSecretAccess, events[0].Event)
+	assert.Equal("some-host", events[0].Host)
+	assert.Equal("some-id", events[0].SecretID)
+	assert.Equal("some-file", events[0].FileID)
+	assert.Equal(pxeserver.AuditFileRender, events[1].Event)
+	assert.Equal("some-file", events[1].FileID)
+
+	rawLog, err := ioutil.ReadFile(logPath)
+	assert.NoError(err)
+	assert.NotContains(string(rawLog), "1234")
+}
+
 func TestRenderFileErrorOnMissingVar(t *testing.T) {
 	assert := assert.New(t)
 
@@ -206,17 +289,47 @@ func TestRenderCmdlineWithTemplatedVars(t *testing.T) {
 	assert.Equal("some_boot_arg=SOME_VALUE", result)
 }
 
+func TestRenderCmdlineWithSubnet(t *testing.T) {
+	assert := assert.New(t)
+
+	renderer := pxeserver.Renderer{
+		Subnets: map[string]pxeserver.DHCPSubnet{
+			"some-host": {
+				Name:    "rack-2",
+				CIDR:    "10.0.1.0/24",
+				Gateway: "10.0.1.1",
+				DNS:     []string{"10.0.1.2"},
+			},
+		},
+	}
+
+	result, err := renderer.RenderCmdline(pxeserver.RenderCmdlineArgs{
+		Template: "gw={{ .subnet.gateway }} ns={{ index .subnet.dns 0 }} rack={{ .subnet.name }}",
+		Host:     "some-host",
+		Vars:     map[string]interface{}{},
+	})
+	assert.NoError(err)
+	assert.Equal("gw=10.0.1.1 ns=10.0.1.2 rack=rack-2", result)
+
+	_, err = renderer.RenderCmdline(pxeserver.RenderCmdlineArgs{
+		Template: "gw={{ .subnet.gateway }}",
+		Host:     "other-host",
+		Vars:     map[string]interface{}{},
+	})
+	assert.NotNil(err)
+}
+
 func TestRenderCmdlineWithSecrets(t *testing.T) {
 	assert := assert.New(t)
 
 	mockSecrets := new(MockSecrets)
-	mockSecrets.On("GetOrGenerate", "some-mac", "some-id").Return("1234", nil)
+	mockSecrets.On("GetOrGenerate", "some-host", "some-id").Return("1234", nil)
 	renderer := pxeserver.Renderer{
 		Secrets: mockSecrets,
 	}
 
 	result, err := renderer.RenderCmdline(pxeserver.RenderCmdlineArgs{
-		Mac:      "some-mac",
+		Host:     "some-host",
 		Template: "some_boot_arg={{ secret \"some-id\" }}",
 		Vars:     map[string]interface{}{},
 	})
@@ -225,17 +338,40 @@ func TestRenderCmdlineWithSecrets(t *testing.T) {
 	assert.Equal("some_boot_arg=1234", result)
 }
 
+func TestRenderCmdlineTracksSecretsForRedaction(t *testing.T) {
+	assert := assert.New(t)
+
+	mockSecrets := new(MockSecrets)
+	mockSecrets.On("GetOrGenerate", "some-host", "some-id").Return("some-password", nil)
+
+	redactor := pxeserver.NewRedactor()
+	renderer := pxeserver.Renderer{
+		Secrets:  mockSecrets,
+		Redactor: redactor,
+	}
+
+	result, err := renderer.RenderCmdline(pxeserver.RenderCmdlineArgs{
+		Template: "some_arg={{ secret \"some-id\" }}",
+		Host:     "some-host",
+		Vars:     map[string]interface{}{},
+	})
+	assert.NoError(err)
+
+	assert.Equal("some_arg=some-password", result)
+	assert.Equal("some_arg=<redacted>", redactor.Redact(result))
+}
+
 func TestRenderCmdlineVarsWithSecrets(t *testing.T) {
 	assert := assert.New(t)
 
 	mockSecrets := new(MockSecrets)
-	mockSecrets.On("GetOrGenerate", "some-mac", "some-id").Return("1234", nil)
+	mockSecrets.On("GetOrGenerate", "some-host", "some-id").Return("1234", nil)
 	renderer := pxeserver.Renderer{
 		Secrets: mockSecrets,
 	}
 
 	result, err := renderer.RenderCmdline(pxeserver.RenderCmdlineArgs{
-		Mac:      "some-mac",
+		Host:     "some-host",
 		Template: "some_boot_arg={{ .vars.some_var }}",
 		Vars: map[string]interface{}{
 			"some_var": "{{ secret \"some-id\" }}",
@@ -256,7 +392,7 @@ func TestRenderCmdlineWithSharedSecrets(t *testing.T) {
 	}
 
 	result, err := renderer.RenderCmdline(pxeserver.RenderCmdlineArgs{
-		Mac:      "some-mac",
+		Host:     "some-host",
 		Template: "some_boot_arg={{ shared_secret \"some-id\" }}",
 		Vars:     map[string]interface{}{},
 	})
@@ -264,7 +400,7 @@ func TestRenderCmdlineWithSharedSecrets(t *testing.T) {
 	assert.Equal("some_boot_arg=1234", result)
 
 	result, err = renderer.RenderCmdline(pxeserver.RenderCmdlineArgs{
-		Mac:      "some-other-mac",
+		Host:     "some-other-host",
 		Template: "some_boot_arg={{ shared_secret \"some-id\" }}",
 		Vars:     map[string]interface{}{},
 	})
@@ -272,17 +408,38 @@ func TestRenderCmdlineWithSharedSecrets(t *testing.T) {
 	assert.Equal("some_boot_arg=1234", result)
 }
 
+func TestRenderCmdlineWithScopedSecrets(t *testing.T) {
+	assert := assert.New(t)
+
+	mockSecrets := new(MockSecrets)
+	mockSecrets.On("GetOrGenerate", pxeserver.SecretScopeKey("cluster-a"), "some-id").Return("1234", nil)
+	renderer := pxeserver.Renderer{
+		Secrets: mockSecrets,
+		Scopes: map[string][]string{
+			"some-host": {"cluster-a"},
+		},
+	}
+
+	result, err := renderer.RenderCmdline(pxeserver.RenderCmdlineArgs{
+		Host:     "some-host",
+		Template: "some_boot_arg={{ scoped_secret \"cluster-a\" \"some-id\" }}",
+		Vars:     map[string]interface{}{},
+	})
+	assert.NoError(err)
+	assert.Equal("some_boot_arg=1234", result)
+}
+
 func TestRenderCmdlineWithFiles(t *testing.T) {
 	assert := assert.New(t)
 	mockFiles := new(MockFiles)
-	mockFiles.On("SHA256", "some_mac-some_file").Return("1234", nil)
+	mockFiles.On("SHA256", "some_host-some_file").Return("1234", nil)
 
 	renderer := pxeserver.Renderer{}
 
 	result, err := renderer.RenderCmdline(pxeserver.RenderCmdlineArgs{
 		Template: "some_file={{ file_url \"some_file\" }} some_checksum={{ file_sha256 \"some_file\" }}",
 		Vars:     map[string]interface{}{},
-		Mac:      "some_mac",
+		Host:     "some_host",
 		ExtraFuncs: template.FuncMap{
 			"ID": func(string) string { return "some_url" },
 		},
@@ -293,6 +450,33 @@ func TestRenderCmdlineWithFiles(t *testing.T) {
 	assert.Equal("some_file=some_url some_checksum=1234", result)
 }
 
+func TestRenderCmdlineWithSignedFiles(t *testing.T) {
+	assert := assert.New(t)
+
+	tokens := pxeserver.NewFileTokens([]byte("some-key"), time.Hour)
+	renderer := pxeserver.Renderer{
+		FileTokens: tokens,
+	}
+
+	var signedID string
+	_, err := renderer.RenderCmdline(pxeserver.RenderCmdlineArgs{
+		Template: "some_file={{ file_url \"some_file\" }}",
+		Vars:     map[string]interface{}{},
+		Host:     "some_host",
+		ExtraFuncs: template.FuncMap{
+			"ID": func(id string) string {
+				signedID = id
+				return "some_url"
+			},
+		},
+	})
+	assert.NoError(err)
+
+	id, err := tokens.Verify(signedID)
+	assert.NoError(err)
+	assert.Equal("some_host-some_file", id)
+}
+
 func TestRenderCmdlineErrorOnMissingVar(t *testing.T) {
 	assert := assert.New(t)
 
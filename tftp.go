@@ -0,0 +1,248 @@
+package pxeserver
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/url"
+	"strconv"
+	"strings"
+	"text/template"
+
+	"go.universe.tf/netboot/pixiecore"
+	"go.universe.tf/netboot/tftp"
+)
+
+// TFTPHandler answers TFTP requests in place of Pixiecore's TFTP server,
+// which can only send the same iPXE build to every host. Pixiecore's own
+// paths, "<mac>/<fwtype>[/<type>/<id>]", are served as Pixiecore would.
+type TFTPHandler struct {
+	Booter           pixiecore.Booter
+	Firmware         *IpxeFirmware
+	CmdlineTransform func(tpl string, mac string, funcs template.FuncMap) (string, error)
+	// Grub serves hosts booting with GRUB, if non-nil
+	Grub *Grub
+	// UBoot serves hosts booting with U-Boot, if non-nil
+	UBoot *UBoot
+	// RaspberryPi serves Pis booting from their firmware, if non-nil
+	RaspberryPi *RaspberryPi
+	// Files serves the config's tftp section, if non-nil
+	Files *TFTPFiles
+	// Identities sends any of a host's MACs that host's iPXE firmware, if
+	// non-nil
+	Identities *Identities
+	// Leases restricts each host's configs, including those of Grub and
+	// UBoot, which hand out tokens for the host's files, to the IP it
+	// leased, if non-nil
+	Leases *Leases
+	// BindFilesToLease also restricts each host's files to the IP it
+	// leased, looking up the host of each file in HostFiles after checking
+	// its Tokens, requires Leases
+	BindFilesToLease bool
+	HostFiles        Files
+	Tokens           *FileTokens
+	// URLs is used to link files in boot_args when pxeserver runs its own
+	// HTTP server, otherwise they're served by Pixiecore on HTTPPort
+	URLs     *SubnetURLs
+	HTTPPort int
+	LogFunc  func(subsys, msg string)
+}
+
+// ServeTFTP answers TFTP requests on address, an ip:port.
+func ServeTFTP(address string, handler TFTPHandler) error {
+	server := tftp.Server{
+		Handler: handler.Handle,
+		TransferLog: func(clientAddr net.Addr, path string, err error) {
+			if err != nil {
+				handler.log("TFTP", "Send of %q to %s failed: %s", path, clientAddr, err)
+			} else {
+				handler.log("TFTP", "Sent %q to %s", path, clientAddr)
+			}
+		},
+	}
+	if err := server.ListenAndServe(address); err != nil {
+		return fmt.Errorf("TFTP server shut down: %s", err)
+	}
+	return nil
+}
+
+func (h TFTPHandler) Handle(path string, clientAddr net.Addr, serverIP string) (io.ReadCloser, int64, error) {
+	path = strings.TrimPrefix(path, "/")
+	if h.Leases != nil {
+		h.bindToLease(clientAddr)
+	}
+	if h.Grub != nil {
+		f, size, ok, err := h.Grub.Open(path, h.fileURLs(path, serverIP))
+		if ok {
+			return f, size, err
+		}
+	}
+	if h.UBoot != nil {
+		f, size, ok, err := h.UBoot.Open(path, func(mac string) func(id string) string {
+			return h.hostFileURLs(mac, serverIP)
+		})
+		if ok {
+			return f, size, err
+		}
+	}
+	if h.RaspberryPi != nil {
+		f, size, ok, err := h.RaspberryPi.Open(path, clientAddr)
+		if ok {
+			return f, size, err
+		}
+	}
+	if h.Files != nil {
+		f, size, ok, err := h.Files.Open(path, clientAddr)
+		if ok {
+			return f, size, err
+		}
+	}
+
+	elems := strings.Split(path, "/")
+	if len(elems) < 2 {
+		return nil, 0, fmt.Errorf("unknown path %q", path)
+	}
+	mac, err := net.ParseMAC(elems[0])
+	if err != nil {
+		return nil, 0, fmt.Errorf("unknown path %q", path)
+	}
+	fwtype, err := strconv.Atoi(elems[1])
+	if err != nil {
+		return nil, 0, fmt.Errorf("unknown path %q", path)
+	}
+
+	switch {
+	case len(elems) == 2:
+		client := ""
+		if clientAddr != nil {
+			client = clientAddr.String()
+		}
+		return h.Firmware.Open(h.Identities.Resolve(mac.String()), pixiecore.Firmware(fwtype), client)
+	case elems[2] == "empty":
+		return ioutil.NopCloser(&bytes.Buffer{}), 0, nil
+	case len(elems) == 4 && elems[2] == "pxelinux.cfg" && elems[3] == "default":
+		return h.pxelinuxConfig(mac, pixiecore.Firmware(fwtype), h.fileURLs(path, serverIP))
+	case len(elems) == 4:
+		return h.Booter.ReadBootFile(pixiecore.ID(elems[3]))
+	}
+	return nil, 0, fmt.Errorf("unknown path %q", path)
+}
+
+// bindToLease has h's booters, and those of Grub and UBoot, refuse specs,
+// and files if BindFilesToLease is set, of hosts which didn't lease
+// clientAddr's IP.
+func (h *TFTPHandler) bindToLease(clientAddr net.Addr) {
+	var clientIP net.IP
+	if clientAddr != nil {
+		if clientHost, _, err := net.SplitHostPort(clientAddr.String()); err == nil {
+			clientIP = net.ParseIP(clientHost)
+		}
+	}
+	bind := func(booter pixiecore.Booter) pixiecore.Booter {
+		if h.BindFilesToLease {
+			return LeaseFilesBooter(booter, h.Leases, clientIP, h.HostFiles, h.Tokens, h.Identities)
+		}
+		return LeaseBooter(booter, h.Leases, clientIP, h.Identities)
+	}
+	h.Booter = bind(h.Booter)
+	if h.Grub != nil {
+		grub := *h.Grub
+		grub.Booter = bind(grub.Booter)
+		h.Grub = &grub
+	}
+	if h.UBoot != nil {
+		uboot := *h.UBoot
+		uboot.Booter = bind(uboot.Booter)
+		h.UBoot = &uboot
+	}
+}
+
+// pxelinuxConfig boots hosts with force_pxe_linux, loading the kernel and
+// initrds over TFTP relative to the config's directory.
+func (h TFTPHandler) pxelinuxConfig(mac net.HardwareAddr, fwtype pixiecore.Firmware, fileURL func(id string) string) (io.ReadCloser, int64, error) {
+	arch, err := firmwareArch(fwtype)
+	if err != nil {
+		return nil, 0, err
+	}
+	spec, err := h.Booter.BootSpec(pixiecore.Machine{MAC: mac, Arch: arch})
+	if err != nil {
+		return nil, 0, err
+	}
+	if spec == nil {
+		return nil, 0, fmt.Errorf("no boot spec for %s", mac)
+	}
+
+	var b bytes.Buffer
+	b.WriteString("DEFAULT default\nLABEL default\n")
+	fmt.Fprintf(&b, "\tkernel kernel/%s\n", spec.Kernel)
+	if len(spec.Initrd) > 0 {
+		initrdPaths := make([]string, 0, len(spec.Initrd))
+		for _, initrd := range spec.Initrd {
+			initrdPaths = append(initrdPaths, fmt.Sprintf("initrd/%s", initrd))
+		}
+		fmt.Fprintf(&b, "\tinitrd %s\n", strings.Join(initrdPaths, ","))
+	}
+	if len(spec.Cmdline) > 0 {
+		cmdline, err := h.CmdlineTransform(spec.Cmdline, mac.String(), template.FuncMap{"ID": fileURL})
+		if err != nil {
+			return nil, 0, fmt.Errorf("expanding cmdline %q: %s", spec.Cmdline, err)
+		}
+		fmt.Fprintf(&b, "\tappend %s\n", cmdline)
+	}
+	b.WriteString("\nPROMPT 1\nTIMEOUT 0\n")
+
+	return ioutil.NopCloser(&b), int64(b.Len()), nil
+}
+
+// fileURLs links files over HTTP for the host whose MAC starts path.
+func (h TFTPHandler) fileURLs(path string, serverIP string) func(id string) string {
+	mac, _ := net.ParseMAC(strings.SplitN(path, "/", 2)[0])
+	return h.hostFileURLs(mac.String(), serverIP)
+}
+
+// hostFileURLs links files over HTTP for the host with the given MAC, which
+// may be empty if it isn't known.
+func (h TFTPHandler) hostFileURLs(mac string, serverIP string) func(id string) string {
+	baseURL := fmt.Sprintf("http://%s", net.JoinHostPort(serverIP, strconv.Itoa(h.HTTPPort)))
+	if mac != "" && h.URLs != nil {
+		baseURL = h.URLs.ForHost(mac)
+	}
+	return func(id string) string {
+		return fmt.Sprintf("%s/_/file?name=%s", baseURL, url.QueryEscape(id))
+	}
+}
+
+func (h TFTPHandler) log(subsys string, format string, args ...interface{}) {
+	if h.LogFunc == nil {
+		return
+	}
+	h.LogFunc(subsys, fmt.Sprintf(format, args...))
+}
+
+// unusedUDPPort picks a port for Pixiecore's TFTP server, which can't be
+// turned off, to move it out of the way of ServeTFTP.
+func unusedUDPPort(address string) (int, error) {
+	conn, err := net.ListenPacket("udp4", net.JoinHostPort(address, "0"))
+	if err != nil {
+		return 0, err
+	}
+	defer conn.Close()
+	return conn.LocalAddr().(*net.UDPAddr).Port, nil
+}
+
+func firmwareArch(fwtype pixiecore.Firmware) (pixiecore.Architecture, error) {
+	switch fwtype {
+	case pixiecore.FirmwareX86PC, pixiecore.FirmwareEFI32, pixiecore.FirmwareX86Ipxe:
+		return pixiecore.ArchIA32, nil
+	case pixiecore.FirmwareEFI64, pixiecore.FirmwareEFIBC, pixiecore.FirmwarePixiecoreIpxe:
+		return pixiecore.ArchX64, nil
+	case pixiecore.FirmwareEFIArm32:
+		return pixiecore.ArchArm32, nil
+	case pixiecore.FirmwareEFIArm64:
+		return pixiecore.ArchArm64, nil
+	}
+	return 0, errors.New("unknown firmware type")
+}
@@ -0,0 +1,167 @@
+package pxeserver_test
+
+import (
+	"io/ioutil"
+	"net"
+	"testing"
+
+	"github.com/ljfranklin/pxeserver"
+	"github.com/stretchr/testify/assert"
+	"go.universe.tf/netboot/pixiecore"
+)
+
+func newTestTFTPHandler(assert *assert.Assertions) (pxeserver.TFTPHandler, pxeserver.HTTPHandler) {
+	logs := []string{}
+	httpHandler := newTestHTTPHandler(assert, nil, &logs)
+	return pxeserver.TFTPHandler{
+		Booter: httpHandler.Booter,
+		Firmware: pxeserver.NewIpxeFirmware(map[pixiecore.Firmware][]byte{
+			pixiecore.FirmwareEFI64: []byte("some-ipxe"),
+		}, nil),
+		CmdlineTransform: httpHandler.CmdlineTransform,
+		HTTPPort:         80,
+	}, httpHandler
+}
+
+func readTFTPFile(assert *assert.Assertions, handler pxeserver.TFTPHandler, p string) (string, error) {
+	return readTFTPFileFrom(assert, handler, p, nil)
+}
+
+func readTFTPFileFrom(assert *assert.Assertions, handler pxeserver.TFTPHandler, p string, clientAddr net.Addr) (string, error) {
+	f, _, err := handler.Handle(p, clientAddr, "10.0.0.1")
+	if err != nil {
+		return "", err
+	}
+	contents, err := ioutil.ReadAll(f)
+	assert.NoError(err)
+	return string(contents), nil
+}
+
+func TestTFTPServesPixiecorePaths(t *testing.T) {
+	assert := assert.New(t)
+
+	handler, httpHandler := newTestTFTPHandler(assert)
+
+	contents, err := readTFTPFile(assert, handler, "52:54:00:12:34:56/2")
+	assert.NoError(err)
+	assert.Equal("some-ipxe", contents)
+
+	contents, err = readTFTPFile(assert, handler, "52:54:00:12:34:56/2/empty")
+	assert.NoError(err)
+	assert.Equal("", contents)
+
+	signedID := httpHandler.Tokens.Sign("52:54:00:12:34:56-__kernel__")
+	contents, err = readTFTPFile(assert, handler, "52:54:00:12:34:56/2/kernel/"+signedID)
+	assert.NoError(err)
+	assert.Equal("some-text\n", contents)
+
+	_, err = readTFTPFile(assert, handler, "52:54:00:12:34:56/0")
+	assert.NotNil(err)
+	_, err = readTFTPFile(assert, handler, "some-file")
+	assert.NotNil(err)
+}
+
+func TestTFTPServesPXELinuxConfig(t *testing.T) {
+	assert := assert.New(t)
+
+	handler, _ := newTestTFTPHandler(assert)
+
+	contents, err := readTFTPFile(assert, handler, "52:54:00:12:34:56/0/pxelinux.cfg/default")
+	assert.NoError(err)
+	assert.Contains(contents, "\tkernel kernel/52:54:00:12:34:56-__kernel__~")
+	assert.Contains(contents, "\tappend some_arg=http://10.0.0.1:80/_/file?name=")
+}
+
+func TestTFTPServesGrub(t *testing.T) {
+	assert := assert.New(t)
+
+	handler, httpHandler := newTestTFTPHandler(assert)
+	handler.Grub = newTestGrub(assert, httpHandler)
+
+	contents, err := readTFTPFile(assert, handler, "52:54:00:12:34:56/2")
+	assert.NoError(err)
+	assert.Equal("some-shim\n", contents)
+
+	contents, err = readTFTPFile(assert, handler, "52:54:00:12:34:56/grub.cfg")
+	assert.NoError(err)
+	assert.Contains(contents, "some_arg=http://10.0.0.1:80/_/file?name=")
+
+	contents, err = readTFTPFile(assert, handler, "52:54:00:65:43:21/2")
+	assert.NoError(err)
+	assert.Equal("some-ipxe", contents)
+}
+
+func TestTFTPBindsFilesToLease(t *testing.T) {
+	assert := assert.New(t)
+
+	leases := pxeserver.NewLeases()
+	leases.Set("52:54:00:12:34:56", net.ParseIP("10.0.0.20"))
+	handler, httpHandler := newTestTFTPHandler(assert)
+	handler.Leases = leases
+	handler.BindFilesToLease = true
+	handler.HostFiles = httpHandler.Files
+	handler.Tokens = httpHandler.Tokens
+	grubHandler := handler
+	grubHandler.Grub = newTestGrub(assert, httpHandler)
+	ubootHandler := handler
+	ubootHandler.UBoot = newTestUBoot(httpHandler)
+
+	host := &net.UDPAddr{IP: net.ParseIP("10.0.0.20"), Port: 1234}
+	other := &net.UDPAddr{IP: net.ParseIP("10.0.0.21"), Port: 1234}
+	signedID := httpHandler.Tokens.Sign("52:54:00:12:34:56-__kernel__")
+	for _, c := range []struct {
+		handler pxeserver.TFTPHandler
+		path    string
+	}{
+		{handler, "52:54:00:12:34:56/0/pxelinux.cfg/default"},
+		{handler, "52:54:00:12:34:56/2/kernel/" + signedID},
+		{grubHandler, "52:54:00:12:34:56/grub.cfg"},
+		{grubHandler, "grub.cfg-01-52-54-00-12-34-56"},
+		{grubHandler, "52:54:00:12:34:56/file/" + signedID},
+		{ubootHandler, "pxelinux.cfg/01-52-54-00-12-34-56"},
+		{ubootHandler, "file/" + signedID},
+	} {
+		_, err := readTFTPFileFrom(assert, c.handler, c.path, host)
+		assert.NoError(err, c.path)
+
+		_, err = readTFTPFileFrom(assert, c.handler, c.path, other)
+		assert.NotNil(err, c.path)
+		_, err = readTFTPFileFrom(assert, c.handler, c.path, nil)
+		assert.NotNil(err, c.path)
+	}
+
+	// firmware and public files hold no secrets
+	contents, err := readTFTPFileFrom(assert, handler, "52:54:00:12:34:56/2", other)
+	assert.NoError(err)
+	assert.Equal("some-ipxe", contents)
+	publicID := httpHandler.Tokens.Sign("52:54:00:12:34:56-some-public-image")
+	_, err = readTFTPFileFrom(assert, handler, "52:54:00:12:34:56/2/initrd/"+publicID, other)
+	assert.NoError(err)
+}
+
+func TestTFTPIssuesFileTokensOnlyToLeasedHost(t *testing.T) {
+	assert := assert.New(t)
+
+	leases := pxeserver.NewLeases()
+	leases.Set("52:54:00:12:34:56", net.ParseIP("10.0.0.20"))
+	handler, httpHandler := newTestTFTPHandler(assert)
+	handler.Leases = leases
+	handler.Grub = newTestGrub(assert, httpHandler)
+
+	host := &net.UDPAddr{IP: net.ParseIP("10.0.0.20"), Port: 1234}
+	other := &net.UDPAddr{IP: net.ParseIP("10.0.0.99"), Port: 1234}
+	for _, p := range []string{"52:54:00:12:34:56/0/pxelinux.cfg/default", "52:54:00:12:34:56/grub.cfg"} {
+		contents, err := readTFTPFileFrom(assert, handler, p, host)
+		assert.NoError(err, p)
+		assert.Contains(contents, "52%3A54%3A00%3A12%3A34%3A56-some-image", p)
+
+		contents, err = readTFTPFileFrom(assert, handler, p, other)
+		assert.NotNil(err, p)
+		assert.Empty(contents, p)
+	}
+
+	// without BindFilesToLease the host may fetch its files from anywhere
+	signedID := httpHandler.Tokens.Sign("52:54:00:12:34:56-__kernel__")
+	_, err := readTFTPFileFrom(assert, handler, "52:54:00:12:34:56/2/kernel/"+signedID, other)
+	assert.NoError(err)
+}
@@ -0,0 +1,168 @@
+package pxeserver
+
+import (
+	"fmt"
+	"io"
+	"net"
+	"path"
+	"strings"
+
+	"github.com/imdario/mergo"
+)
+
+// TFTPFile serves File at each TFTP path matching Match. Templates are
+// rendered for each request with the vars 'client_ip', 'mac' and 'path',
+// along with the vars of the host at the client's address if it's known.
+type TFTPFile struct {
+	// Match is a path or a glob as understood by path.Match, e.g.
+	// "phones/SEP*.cnf.xml"
+	Match string
+	File
+}
+
+func validateTFTPMatch(match string) error {
+	if match == "" {
+		return fmt.Errorf("tftp file is missing a 'match'")
+	}
+	if _, err := path.Match(match, ""); err != nil {
+		return fmt.Errorf("tftp file has invalid match '%s': %s", match, err)
+	}
+	return nil
+}
+
+// TFTPFiles serves the config's tftp section to any client, the first
+// entry matching a path wins.
+type TFTPFiles struct {
+	entries []TFTPFile
+	ipToMAC map[string]string
+
+	Files Files
+	// Leases identifies clients without an 'ip', if non-nil
+	Leases *Leases
+	// HostVars returns the vars of the host with the given name
+	HostVars func(name string) (map[string]interface{}, error)
+	// Identities resolves the client's MAC to its host's name, if non-nil
+	Identities *Identities
+	Audit      *AuditLog
+}
+
+// NewTFTPFiles serves entries, identifying clients by their address in
+// reservations.
+func NewTFTPFiles(entries []TFTPFile, reservations map[string]DHCPReservation) *TFTPFiles {
+	ipToMAC := make(map[string]string)
+	for mac, reservation := range reservations {
+		ipToMAC[reservation.IP.String()] = mac
+	}
+	return &TFTPFiles{
+		entries: entries,
+		ipToMAC: ipToMAC,
+	}
+}
+
+// Open returns the file at p for the client at clientAddr, or false if no
+// entry matches p.
+func (t *TFTPFiles) Open(p string, clientAddr net.Addr) (io.ReadCloser, int64, bool, error) {
+	p = strings.TrimPrefix(path.Clean("/"+p), "/")
+	for _, entry := range t.entries {
+		if ok, _ := path.Match(entry.Match, p); !ok {
+			continue
+		}
+		f, size, err := t.open(entry, p, clientAddr)
+		return f, size, true, err
+	}
+	return nil, 0, false, nil
+}
+
+func (t *TFTPFiles) open(entry TFTPFile, p string, clientAddr net.Addr) (io.ReadCloser, int64, error) {
+	clientIP := addrIP(clientAddr)
+	mac := t.clientMAC(clientIP)
+	host := mac
+	if mac != "" {
+		host = t.Identities.Resolve(mac)
+	}
+
+	var f io.ReadCloser
+	var size int64
+	var err error
+	if entry.Template {
+		var vars map[string]interface{}
+		vars, err = t.clientVars(entry, p, clientIP, mac, host)
+		if err != nil {
+			return nil, 0, err
+		}
+		f, size, err = t.Files.ReadWithVars(entry.ID, host, vars)
+	} else {
+		f, size, err = t.Files.Read(entry.ID)
+	}
+	if err != nil {
+		return nil, 0, err
+	}
+
+	event := AuditEvent{
+		Event:  AuditFileServe,
+		Host:   host,
+		FileID: entry.ID,
+	}
+	if clientAddr != nil {
+		event.Client = clientAddr.String()
+	}
+	if err := t.Audit.Record(event); err != nil {
+		f.Close()
+		return nil, 0, err
+	}
+	return f, size, nil
+}
+
+// clientVars are the entry's vars, overridden by those of the client's
+// host, if known, and details of the request.
+func (t *TFTPFiles) clientVars(entry TFTPFile, p string, clientIP net.IP, mac string, host string) (map[string]interface{}, error) {
+	vars := make(map[string]interface{})
+	for k, v := range entry.Vars {
+		vars[k] = v
+	}
+	if host != "" && t.HostVars != nil {
+		hostVars, err := t.HostVars(host)
+		if err != nil {
+			return nil, err
+		}
+		if err := mergo.Merge(&vars, hostVars, mergo.WithOverride); err != nil {
+			return nil, err
+		}
+	}
+	vars["mac"] = mac
+	vars["path"] = p
+	vars["client_ip"] = ""
+	if clientIP != nil {
+		vars["client_ip"] = clientIP.String()
+	}
+	return vars, nil
+}
+
+func (t *TFTPFiles) clientMAC(ip net.IP) string {
+	if ip == nil {
+		return ""
+	}
+	if mac, ok := t.ipToMAC[ip.String()]; ok {
+		return mac
+	}
+	if t.Leases != nil {
+		if mac, ok := t.Leases.MAC(ip); ok {
+			return mac
+		}
+	}
+	return ""
+}
+
+func addrIP(addr net.Addr) net.IP {
+	if addr == nil {
+		return nil
+	}
+	if udpAddr, ok := addr.(*net.UDPAddr); ok {
+		return udpAddr.IP
+	}
+	host, _, err := net.SplitHostPort(addr.String())
+	if err != nil {
+		return nil
+	}
+	return net.ParseIP(host)
+}
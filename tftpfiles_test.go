@@ -0,0 +1,116 @@
+package pxeserver_test
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net"
+	"path"
+	"strings"
+	"testing"
+
+	"github.com/ljfranklin/pxeserver"
+	"github.com/stretchr/testify/assert"
+)
+
+func newTestTFTPFiles(assert *assert.Assertions) *pxeserver.TFTPFiles {
+	input := strings.NewReader(fmt.Sprintf(`
+hosts:
+- mac: "52:54:00:12:34:56"
+  ip: 10.0.0.20
+  vars:
+    vlan: 20
+tftp:
+- match: phones/SEP*.cnf
+  path: %s
+  template: true
+  vars:
+    vlan: 1
+- match: firmware.bin
+  path: %s
+`, path.Join(fixturesDir(), "tftp", "phone.cfg"), path.Join(fixturesDir(), "files", "simple.txt")))
+	cfg, err := pxeserver.LoadConfig(input)
+	assert.NoError(err)
+	files, err := pxeserver.LoadFiles(cfg.Files(), pxeserver.Renderer{})
+	assert.NoError(err)
+
+	tftpFiles := pxeserver.NewTFTPFiles(cfg.TFTPFiles(), cfg.DHCPReservations())
+	tftpFiles.Files = files
+	tftpFiles.HostVars = cfg.VarsForHost
+	return tftpFiles
+}
+
+func readTFTPFilesFile(assert *assert.Assertions, tftpFiles *pxeserver.TFTPFiles, p string, clientIP string) (string, bool) {
+	f, _, ok, err := tftpFiles.Open(p, &net.UDPAddr{IP: net.ParseIP(clientIP), Port: 2000})
+	if !ok {
+		return "", false
+	}
+	assert.NoError(err)
+	contents, err := ioutil.ReadAll(f)
+	assert.NoError(err)
+	return string(contents), true
+}
+
+func TestTFTPFilesServesMatchingPaths(t *testing.T) {
+	assert := assert.New(t)
+
+	tftpFiles := newTestTFTPFiles(assert)
+
+	contents, ok := readTFTPFilesFile(assert, tftpFiles, "/firmware.bin", "10.0.0.99")
+	assert.True(ok)
+	assert.Equal("some-text\n", contents)
+
+	contents, ok = readTFTPFilesFile(assert, tftpFiles, "phones/SEP0011.cnf", "10.0.0.20")
+	assert.True(ok)
+	assert.Equal("mac=52:54:00:12:34:56 ip=10.0.0.20 path=phones/SEP0011.cnf vlan=20\n", contents)
+
+	contents, ok = readTFTPFilesFile(assert, tftpFiles, "phones/SEP0022.cnf", "10.0.0.99")
+	assert.True(ok)
+	assert.Equal("mac= ip=10.0.0.99 path=phones/SEP0022.cnf vlan=1\n", contents)
+
+	for _, p := range []string{"phones/other.cnf", "phones/sub/SEP0011.cnf", "52:54:00:12:34:56/2"} {
+		_, ok = readTFTPFilesFile(assert, tftpFiles, p, "10.0.0.20")
+		assert.False(ok, p)
+	}
+}
+
+func TestTFTPFilesByLease(t *testing.T) {
+	assert := assert.New(t)
+
+	tftpFiles := newTestTFTPFiles(assert)
+	tftpFiles.Leases = pxeserver.NewLeases()
+	tftpFiles.Leases.Set("52:54:00:12:34:56", net.ParseIP("10.0.0.30"))
+
+	contents, ok := readTFTPFilesFile(assert, tftpFiles, "phones/SEP0011.cnf", "10.0.0.30")
+	assert.True(ok)
+	assert.Contains(contents, "mac=52:54:00:12:34:56 ")
+	assert.Contains(contents, "vlan=20")
+}
+
+func TestTFTPServesTFTPFiles(t *testing.T) {
+	assert := assert.New(t)
+
+	handler, _ := newTestTFTPHandler(assert)
+	handler.Files = newTestTFTPFiles(assert)
+
+	contents, err := readTFTPFile(assert, handler, "firmware.bin")
+	assert.NoError(err)
+	assert.Equal("some-text\n", contents)
+
+	contents, err = readTFTPFile(assert, handler, "52:54:00:12:34:56/2")
+	assert.NoError(err)
+	assert.Equal("some-ipxe", contents)
+}
+
+func TestErrorOnInvalidTFTPFile(t *testing.T) {
+	assert := assert.New(t)
+
+	for _, entry := range []string{
+		"path: /srv/some-file",
+		"match: \"phones/[\"\n  path: /srv/some-file",
+		"match: some-file\n  path: /srv/some-file\n  vars:\n    some: var",
+	} {
+		input := strings.NewReader("tftp:\n- " + entry + "\n")
+		_, err := pxeserver.LoadConfig(input)
+		assert.NotNil(err, entry)
+	}
+}
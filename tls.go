@@ -0,0 +1,175 @@
+package pxeserver
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"time"
+)
+
+const (
+	tlsCertID = "/pxeserver/tls_cert"
+	tlsKeyID  = "/pxeserver/tls_key"
+)
+
+// LoadTLSCertificate returns the PEM encoded certificate and key for
+// pxeserver's HTTPS listener. Unless the config points at existing files,
+// a self-signed certificate is generated and persisted in the secrets store
+// so it can be embedded in iPXE as a trust anchor.
+func LoadTLSCertificate(settings ServerSettings, secrets SecretsStore) ([]byte, []byte, error) {
+	if settings.TLS.CertFile != "" {
+		certPEM, err := ioutil.ReadFile(settings.TLS.CertFile)
+		if err != nil {
+			return nil, nil, err
+		}
+		keyPEM, err := ioutil.ReadFile(settings.TLS.KeyFile)
+		if err != nil {
+			return nil, nil, err
+		}
+		if _, err := tls.X509KeyPair(certPEM, keyPEM); err != nil {
+			return nil, nil, fmt.Errorf("invalid server.tls certificate: %s", err)
+		}
+		return certPEM, keyPEM, nil
+	}
+
+	hostnames, err := tlsHostnames(settings)
+	if err != nil {
+		return nil, nil, err
+	}
+	// a certificate which changes on every start could never match the one
+	// trusted by server.ipxe
+	if secrets == nil {
+		return nil, nil, errors.New("server.tls requires a secrets store to keep its generated certificate, or server.tls.cert_file and key_file")
+	}
+	if certPEM, keyPEM, ok := storedTLSCertificate(secrets, hostnames); ok {
+		return certPEM, keyPEM, nil
+	}
+
+	certPEM, keyPEM, err := generateTLSCertificate(hostnames)
+	if err != nil {
+		return nil, nil, err
+	}
+	if err := storeKeyPair(secrets, tlsCertID, tlsKeyID, certPEM, keyPEM); err != nil {
+		return nil, nil, err
+	}
+	return certPEM, keyPEM, nil
+}
+
+func tlsHostnames(settings ServerSettings) ([]string, error) {
+	host, _, err := net.SplitHostPort(settings.HTTPAddress)
+	if err != nil {
+		return nil, fmt.Errorf("invalid server.http_address: %s", err)
+	}
+	if settings.AdvertiseAddress != "" {
+		host = settings.AdvertiseAddress
+	}
+	if host == "" {
+		return nil, fmt.Errorf("server.http_address must include the host clients connect to for TLS")
+	}
+	hostnames := append([]string{host}, settings.TLS.Hostnames...)
+	for _, subnet := range settings.DHCP.Subnets {
+		if subnet.ServerAddress != "" {
+			hostnames = append(hostnames, subnet.ServerAddress)
+		}
+	}
+	return hostnames, nil
+}
+
+// storedTLSCertificate only returns a previously generated certificate if
+// it is still valid for all of hostnames.
+func storedTLSCertificate(secrets SecretsStore, hostnames []string) ([]byte, []byte, bool) {
+	certPEM, keyPEM, cert, ok := storedKeyPair(secrets, tlsCertID, tlsKeyID)
+	if !ok {
+		return nil, nil, false
+	}
+	for _, hostname := range hostnames {
+		if cert.VerifyHostname(hostname) != nil {
+			return nil, nil, false
+		}
+	}
+	return certPEM, keyPEM, true
+}
+
+// generateTLSCertificate creates a self-signed CA certificate which is also
+// used as the server certificate.
+func generateTLSCertificate(hostnames []string) ([]byte, []byte, error) {
+	template := &x509.Certificate{
+		Subject:     pkix.Name{CommonName: "pxeserver"},
+		KeyUsage:    x509.KeyUsageDigitalSignature | x509.KeyUsageKeyEncipherment | x509.KeyUsageCertSign,
+		ExtKeyUsage: []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		IsCA:        true,
+	}
+	for _, hostname := range hostnames {
+		if ip := net.ParseIP(hostname); ip != nil {
+			template.IPAddresses = append(template.IPAddresses, ip)
+		} else {
+			template.DNSNames = append(template.DNSNames, hostname)
+		}
+	}
+	return generateCertificate(template, nil, nil)
+}
+
+// storedKeyPair returns a PEM encoded certificate and key previously saved
+// in the secrets store, if they are present and unexpired.
+func storedKeyPair(secrets SecretsStore, certID string, keyID string) ([]byte, []byte, *x509.Certificate, bool) {
+	cert, err := secrets.GetInternal(certID)
+	if err != nil {
+		return nil, nil, nil, false
+	}
+	key, err := secrets.GetInternal(keyID)
+	if err != nil {
+		return nil, nil, nil, false
+	}
+	certString, certOK := cert.(string)
+	keyString, keyOK := key.(string)
+	if !certOK || !keyOK {
+		return nil, nil, nil, false
+	}
+
+	keyPair, err := tls.X509KeyPair([]byte(certString), []byte(keyString))
+	if err != nil {
+		return nil, nil, nil, false
+	}
+	parsed, err := x509.ParseCertificate(keyPair.Certificate[0])
+	if err != nil || time.Now().After(parsed.NotAfter) {
+		return nil, nil, nil, false
+	}
+	return []byte(certString), []byte(keyString), parsed, true
+}
+
+// generateCertificate fills in the serial and validity of template and
+// signs it with parentKey, or self-signs it if parent is nil. RSA is used as
+// iPXE has limited support for other key types.
+func generateCertificate(template *x509.Certificate, parent *x509.Certificate, parentKey *rsa.PrivateKey) ([]byte, []byte, error) {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		return nil, nil, err
+	}
+	template.SerialNumber, err = rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+	if err != nil {
+		return nil, nil, err
+	}
+	template.NotBefore = time.Now().Add(-time.Hour)
+	template.NotAfter = time.Now().AddDate(10, 0, 0)
+	template.BasicConstraintsValid = true
+	if parent == nil {
+		parent = template
+		parentKey = key
+	}
+
+	certDER, err := x509.CreateCertificate(rand.Reader, template, parent, &key.PublicKey, parentKey)
+	if err != nil {
+		return nil, nil, err
+	}
+	certPEM := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: certDER})
+	keyPEM := pem.EncodeToMemory(&pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(key)})
+	return certPEM, keyPEM, nil
+}
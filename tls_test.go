@@ -0,0 +1,116 @@
+package pxeserver_test
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/pem"
+	"io/ioutil"
+	"os"
+	"path"
+	"testing"
+
+	"github.com/ljfranklin/pxeserver"
+	"github.com/stretchr/testify/assert"
+)
+
+func parseTestCert(assert *assert.Assertions, certPEM []byte) *x509.Certificate {
+	block, _ := pem.Decode(certPEM)
+	assert.NotNil(block)
+	cert, err := x509.ParseCertificate(block.Bytes)
+	assert.NoError(err)
+	return cert
+}
+
+func TestLoadTLSCertificateGeneratesSelfSigned(t *testing.T) {
+	assert := assert.New(t)
+
+	tmpdir, err := ioutil.TempDir("", "pxeserver-tls")
+	assert.NoError(err)
+	defer os.RemoveAll(tmpdir)
+	secrets, err := pxeserver.LoadLocalSecrets(path.Join(tmpdir, "secrets.yaml"), nil)
+	assert.NoError(err)
+
+	settings := pxeserver.ServerSettings{
+		HTTPAddress: "10.0.0.1:8443",
+		TLS: pxeserver.TLSSettings{
+			Enabled:   true,
+			Hostnames: []string{"pxe.example.com"},
+		},
+	}
+	certPEM, keyPEM, err := pxeserver.LoadTLSCertificate(settings, secrets)
+	assert.NoError(err)
+	_, err = tls.X509KeyPair(certPEM, keyPEM)
+	assert.NoError(err)
+
+	cert := parseTestCert(assert, certPEM)
+	assert.True(cert.IsCA)
+	assert.NoError(cert.VerifyHostname("10.0.0.1"))
+	assert.NoError(cert.VerifyHostname("pxe.example.com"))
+
+	// the certificate is reused after a restart
+	secrets, err = pxeserver.LoadLocalSecrets(path.Join(tmpdir, "secrets.yaml"), nil)
+	assert.NoError(err)
+	reloadedPEM, _, err := pxeserver.LoadTLSCertificate(settings, secrets)
+	assert.NoError(err)
+	assert.Equal(certPEM, reloadedPEM)
+
+	// but regenerated if the address changes
+	settings.HTTPAddress = "10.0.0.2:8443"
+	changedPEM, _, err := pxeserver.LoadTLSCertificate(settings, secrets)
+	assert.NoError(err)
+	assert.NotEqual(certPEM, changedPEM)
+	assert.NoError(parseTestCert(assert, changedPEM).VerifyHostname("10.0.0.2"))
+}
+
+func TestLoadTLSCertificateFromFiles(t *testing.T) {
+	assert := assert.New(t)
+
+	tmpdir, err := ioutil.TempDir("", "pxeserver-tls")
+	assert.NoError(err)
+	defer os.RemoveAll(tmpdir)
+	secrets, err := pxeserver.LoadLocalSecrets(path.Join(tmpdir, "secrets.yaml"), nil)
+	assert.NoError(err)
+	certPEM, keyPEM, err := pxeserver.LoadTLSCertificate(pxeserver.ServerSettings{
+		HTTPAddress: "10.0.0.1:8443",
+		TLS:         pxeserver.TLSSettings{Enabled: true},
+	}, secrets)
+	assert.NoError(err)
+	certPath := path.Join(tmpdir, "cert.pem")
+	keyPath := path.Join(tmpdir, "key.pem")
+	assert.NoError(ioutil.WriteFile(certPath, certPEM, 0600))
+	assert.NoError(ioutil.WriteFile(keyPath, keyPEM, 0600))
+
+	loadedCert, loadedKey, err := pxeserver.LoadTLSCertificate(pxeserver.ServerSettings{
+		HTTPAddress: "pxe.example.com:8443",
+		TLS: pxeserver.TLSSettings{
+			Enabled:  true,
+			CertFile: certPath,
+			KeyFile:  keyPath,
+		},
+	}, nil)
+	assert.NoError(err)
+	assert.Equal(certPEM, loadedCert)
+	assert.Equal(keyPEM, loadedKey)
+}
+
+func TestLoadTLSCertificateErrorOnMissingHost(t *testing.T) {
+	assert := assert.New(t)
+
+	_, _, err := pxeserver.LoadTLSCertificate(pxeserver.ServerSettings{
+		HTTPAddress: ":8443",
+		TLS:         pxeserver.TLSSettings{Enabled: true},
+	}, nil)
+	assert.NotNil(err)
+	assert.Contains(err.Error(), "http_address")
+}
+
+func TestLoadTLSCertificateErrorWithoutSecretsStore(t *testing.T) {
+	assert := assert.New(t)
+
+	_, _, err := pxeserver.LoadTLSCertificate(pxeserver.ServerSettings{
+		HTTPAddress: "10.0.0.1:8443",
+		TLS:         pxeserver.TLSSettings{Enabled: true},
+	}, nil)
+	assert.NotNil(err)
+	assert.Contains(err.Error(), "secrets store")
+}
@@ -0,0 +1,101 @@
+package pxeserver
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	tokenSeparator = "~"
+	fileTokenKeyID = "/pxeserver/file_token_key"
+)
+
+// FileTokens signs file IDs handed out to booting machines so that files
+// can only be downloaded with a URL produced for that host, and only until
+// the token expires.
+type FileTokens struct {
+	key []byte
+	ttl time.Duration
+	now func() time.Time
+}
+
+func NewFileTokens(key []byte, ttl time.Duration) *FileTokens {
+	return &FileTokens{
+		key: key,
+		ttl: ttl,
+		now: time.Now,
+	}
+}
+
+// Sign returns id with an expiry and HMAC appended. File IDs are already
+// namespaced by host, so a token for one host's file can't be used to fetch
+// another host's file.
+func (t *FileTokens) Sign(id string) string {
+	expiry := strconv.FormatInt(t.now().Add(t.ttl).Unix(), 10)
+	return strings.Join([]string{id, expiry, t.mac(id, expiry)}, tokenSeparator)
+}
+
+// Verify checks the token appended by Sign and returns the original ID.
+func (t *FileTokens) Verify(signedID string) (string, error) {
+	macIndex := strings.LastIndex(signedID, tokenSeparator)
+	if macIndex < 0 {
+		return "", fmt.Errorf("missing access token for file '%s'", signedID)
+	}
+	expiryIndex := strings.LastIndex(signedID[:macIndex], tokenSeparator)
+	if expiryIndex < 0 {
+		return "", fmt.Errorf("missing access token for file '%s'", signedID)
+	}
+	id := signedID[:expiryIndex]
+	expiry := signedID[expiryIndex+1 : macIndex]
+	signature := signedID[macIndex+1:]
+
+	if !hmac.Equal([]byte(signature), []byte(t.mac(id, expiry))) {
+		return "", fmt.Errorf("invalid access token for file '%s'", id)
+	}
+	expiryUnix, err := strconv.ParseInt(expiry, 10, 64)
+	if err != nil {
+		return "", errors.New("malformed access token expiry")
+	}
+	if t.now().After(time.Unix(expiryUnix, 0)) {
+		return "", fmt.Errorf("expired access token for file '%s'", id)
+	}
+
+	return id, nil
+}
+
+func (t *FileTokens) mac(id string, expiry string) string {
+	h := hmac.New(sha256.New, t.key)
+	h.Write([]byte(id))
+	h.Write([]byte(tokenSeparator))
+	h.Write([]byte(expiry))
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// loadFileTokenKey persists the signing key in the secrets store, if any,
+// so file URLs handed out before a restart remain valid.
+func loadFileTokenKey(secrets SecretsStore) ([]byte, error) {
+	if secrets != nil {
+		if key, err := secrets.GetInternal(fileTokenKeyID); err == nil {
+			if keyString, ok := key.(string); ok {
+				return []byte(keyString), nil
+			}
+		}
+	}
+
+	key, err := generateRandomBytes(map[string]interface{}{"length": 32})
+	if err != nil {
+		return nil, err
+	}
+	if secrets != nil {
+		if err := secrets.SetInternal(fileTokenKeyID, key); err != nil {
+			return nil, err
+		}
+	}
+	return []byte(key), nil
+}
@@ -0,0 +1,66 @@
+package pxeserver_test
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/ljfranklin/pxeserver"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestFileTokensRoundTrip(t *testing.T) {
+	assert := assert.New(t)
+
+	tokens := pxeserver.NewFileTokens([]byte("some-key"), time.Hour)
+
+	signedID := tokens.Sign("52:54:00:12:34:56-some-file")
+	assert.NotEqual("52:54:00:12:34:56-some-file", signedID)
+
+	id, err := tokens.Verify(signedID)
+	assert.NoError(err)
+	assert.Equal("52:54:00:12:34:56-some-file", id)
+}
+
+func TestFileTokensErrorOnMissingToken(t *testing.T) {
+	assert := assert.New(t)
+
+	tokens := pxeserver.NewFileTokens([]byte("some-key"), time.Hour)
+
+	_, err := tokens.Verify("52:54:00:12:34:56-some-file")
+	assert.NotNil(err)
+	assert.Contains(err.Error(), "missing")
+}
+
+func TestFileTokensErrorOnOtherHost(t *testing.T) {
+	assert := assert.New(t)
+
+	tokens := pxeserver.NewFileTokens([]byte("some-key"), time.Hour)
+
+	signedID := tokens.Sign("52:54:00:12:34:56-some-file")
+	otherHostID := strings.Replace(signedID, "52:54:00:12:34:56", "52:54:00:65:43:21", 1)
+
+	_, err := tokens.Verify(otherHostID)
+	assert.NotNil(err)
+	assert.Contains(err.Error(), "invalid")
+}
+
+func TestFileTokensErrorOnWrongKey(t *testing.T) {
+	assert := assert.New(t)
+
+	signedID := pxeserver.NewFileTokens([]byte("some-key"), time.Hour).Sign("some-file")
+
+	_, err := pxeserver.NewFileTokens([]byte("some-other-key"), time.Hour).Verify(signedID)
+	assert.NotNil(err)
+	assert.Contains(err.Error(), "invalid")
+}
+
+func TestFileTokensErrorOnExpiredToken(t *testing.T) {
+	assert := assert.New(t)
+
+	tokens := pxeserver.NewFileTokens([]byte("some-key"), -time.Minute)
+
+	_, err := tokens.Verify(tokens.Sign("some-file"))
+	assert.NotNil(err)
+	assert.Contains(err.Error(), "expired")
+}
@@ -0,0 +1,198 @@
+package pxeserver
+
+import (
+	"bytes"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/url"
+	"strings"
+	"text/template"
+
+	"go.universe.tf/netboot/pixiecore"
+)
+
+const (
+	// BootloaderUBoot boots boards with U-Boot's 'pxe get' and 'pxe boot',
+	// which fetch an extlinux style config over TFTP
+	BootloaderUBoot = "uboot"
+
+	pxelinuxConfigDir = "pxelinux.cfg"
+	// pxelinuxMACPrefix is how U-Boot names per-MAC configs, e.g.
+	// pxelinux.cfg/01-52-54-00-12-34-56, before falling back to the
+	// client's IPv4 address in hex, e.g. pxelinux.cfg/C000025B
+	pxelinuxMACPrefix = "01-"
+)
+
+type UBootHost struct {
+	// FDT and FDTOverlays are file IDs, FDT is empty if the host has none
+	FDT         string
+	FDTOverlays []string
+}
+
+// UBoot serves each host with bootloader 'uboot' a pxelinux.cfg which loads
+// its kernel, initrd and device tree over TFTP. U-Boot requests files
+// relative to the directory of the boot file it was sent over DHCP, so
+// paths are served both at the root and below the host's MAC.
+type UBoot struct {
+	hosts   map[string]UBootHost
+	ipToMAC map[string]string
+
+	Booter pixiecore.Booter
+	// Tokens signs device tree IDs as Booter signs kernel IDs, if non-nil
+	Tokens *FileTokens
+	// Leases finds hosts without an 'ip' whose config is requested by
+	// address, if non-nil
+	Leases           *Leases
+	CmdlineTransform func(tpl string, mac string, funcs template.FuncMap) (string, error)
+}
+
+// NewUBoot boots the given hosts, looking up configs requested by address
+// in reservations.
+func NewUBoot(hosts map[string]UBootHost, reservations map[string]DHCPReservation) *UBoot {
+	ipToMAC := make(map[string]string)
+	for mac, reservation := range reservations {
+		if _, ok := hosts[mac]; ok {
+			ipToMAC[reservation.IP.String()] = mac
+		}
+	}
+	return &UBoot{
+		hosts:   hosts,
+		ipToMAC: ipToMAC,
+	}
+}
+
+// IsHost reports whether the host with the given MAC boots with U-Boot.
+func (u *UBoot) IsHost(mac string) bool {
+	_, ok := u.hosts[mac]
+	return ok
+}
+
+// OnlyHosts returns a copy of u which serves just the hosts with the given
+// MACs, e.g. those on one interface.
+func (u *UBoot) OnlyHosts(macs []string) *UBoot {
+	only := *u
+	only.hosts = make(map[string]UBootHost)
+	for _, mac := range macs {
+		if host, ok := u.hosts[mac]; ok {
+			only.hosts[mac] = host
+		}
+	}
+	return &only
+}
+
+// Open returns the file at p, or false if p isn't a U-Boot path. fileURLs
+// links files referenced in boot_args for the host with the given MAC.
+func (u *UBoot) Open(p string, fileURLs func(mac string) func(id string) string) (io.ReadCloser, int64, bool, error) {
+	elems := strings.Split(strings.TrimPrefix(p, "/"), "/")
+	if len(elems) == 3 {
+		mac, err := net.ParseMAC(elems[0])
+		if err != nil || !u.IsHost(mac.String()) {
+			return nil, 0, false, nil
+		}
+		elems = elems[1:]
+	}
+	if len(elems) != 2 {
+		return nil, 0, false, nil
+	}
+
+	switch elems[0] {
+	case "file":
+		id, err := url.PathUnescape(elems[1])
+		if err != nil {
+			return nil, 0, true, err
+		}
+		f, size, err := u.Booter.ReadBootFile(pixiecore.ID(id))
+		return f, size, true, err
+	case pxelinuxConfigDir:
+		mac, ok := u.configHost(elems[1])
+		if !ok {
+			return nil, 0, false, nil
+		}
+		contents, err := u.config(mac, fileURLs(mac.String()))
+		if err != nil {
+			return nil, 0, true, err
+		}
+		return ioutil.NopCloser(bytes.NewReader(contents)), int64(len(contents)), true, nil
+	}
+	return nil, 0, false, nil
+}
+
+// configHost finds the host a pxelinux.cfg name is for. U-Boot also tries
+// shorter prefixes of the hex address, which match no host.
+func (u *UBoot) configHost(name string) (net.HardwareAddr, bool) {
+	if strings.HasPrefix(name, pxelinuxMACPrefix) {
+		mac, err := net.ParseMAC(strings.TrimPrefix(name, pxelinuxMACPrefix))
+		if err != nil || !u.IsHost(mac.String()) {
+			return nil, false
+		}
+		return mac, true
+	}
+
+	ip, err := hex.DecodeString(name)
+	if err != nil || len(ip) != net.IPv4len {
+		return nil, false
+	}
+	mac, ok := u.ipToMAC[net.IP(ip).String()]
+	if !ok && u.Leases != nil {
+		mac, ok = u.Leases.MAC(net.IP(ip))
+	}
+	if !ok || !u.IsHost(mac) {
+		return nil, false
+	}
+	hwAddr, err := net.ParseMAC(mac)
+	if err != nil {
+		return nil, false
+	}
+	return hwAddr, true
+}
+
+func (u *UBoot) config(mac net.HardwareAddr, fileURL func(id string) string) ([]byte, error) {
+	spec, err := u.Booter.BootSpec(pixiecore.Machine{MAC: mac, Arch: pixiecore.ArchArm64})
+	if err != nil {
+		return nil, err
+	}
+	if spec == nil || spec.Kernel == "" {
+		return nil, fmt.Errorf("no kernel for %s", mac)
+	}
+	cmdline, err := u.CmdlineTransform(spec.Cmdline, mac.String(), template.FuncMap{"ID": fileURL})
+	if err != nil {
+		return nil, fmt.Errorf("expanding cmdline %q: %s", spec.Cmdline, err)
+	}
+	host := u.hosts[mac.String()]
+
+	var b bytes.Buffer
+	b.WriteString("default pxeserver\nlabel pxeserver\n")
+	fmt.Fprintf(&b, "\tkernel %s\n", ubootFilePath(string(spec.Kernel)))
+	for _, initrd := range spec.Initrd {
+		fmt.Fprintf(&b, "\tinitrd %s\n", ubootFilePath(string(initrd)))
+	}
+	if host.FDT != "" {
+		fmt.Fprintf(&b, "\tfdt %s\n", ubootFilePath(u.sign(host.FDT)))
+	}
+	if len(host.FDTOverlays) > 0 {
+		overlayPaths := make([]string, 0, len(host.FDTOverlays))
+		for _, overlay := range host.FDTOverlays {
+			overlayPaths = append(overlayPaths, ubootFilePath(u.sign(overlay)))
+		}
+		fmt.Fprintf(&b, "\tfdtoverlays %s\n", strings.Join(overlayPaths, " "))
+	}
+	if cmdline != "" {
+		fmt.Fprintf(&b, "\tappend %s\n", cmdline)
+	}
+	return b.Bytes(), nil
+}
+
+func (u *UBoot) sign(id string) string {
+	if u.Tokens == nil {
+		return id
+	}
+	return u.Tokens.Sign(id)
+}
+
+// ubootFilePath is relative to the directory U-Boot loaded the config from.
+func ubootFilePath(id string) string {
+	return fmt.Sprintf("file/%s", url.PathEscape(id))
+}
@@ -0,0 +1,169 @@
+package pxeserver_test
+
+import (
+	"net"
+	"strings"
+	"testing"
+
+	"github.com/ljfranklin/pxeserver"
+	"github.com/stretchr/testify/assert"
+	"go.universe.tf/netboot/dhcp4"
+)
+
+func newTestUBoot(handler pxeserver.HTTPHandler) *pxeserver.UBoot {
+	uboot := pxeserver.NewUBoot(map[string]pxeserver.UBootHost{
+		"52:54:00:12:34:56": {
+			FDT:         "52:54:00:12:34:56-__fdt__",
+			FDTOverlays: []string{"52:54:00:12:34:56-__fdt_overlay0__", "52:54:00:12:34:56-__fdt_overlay1__"},
+		},
+	}, map[string]pxeserver.DHCPReservation{
+		"52:54:00:12:34:56": {IP: net.ParseIP("10.0.0.20").To4()},
+	})
+	uboot.Booter = handler.Booter
+	uboot.Tokens = handler.Tokens
+	uboot.CmdlineTransform = handler.CmdlineTransform
+	return uboot
+}
+
+func TestTFTPServesUBootConfig(t *testing.T) {
+	assert := assert.New(t)
+
+	handler, httpHandler := newTestTFTPHandler(assert)
+	handler.UBoot = newTestUBoot(httpHandler)
+
+	contents, err := readTFTPFile(assert, handler, "pxelinux.cfg/01-52-54-00-12-34-56")
+	assert.NoError(err)
+	assert.Contains(contents, "default pxeserver\n")
+	assert.Contains(contents, "\tkernel file/52:54:00:12:34:56-__kernel__~")
+	assert.Contains(contents, "\tfdt file/52:54:00:12:34:56-__fdt__~")
+	assert.Contains(contents, "\tfdtoverlays file/52:54:00:12:34:56-__fdt_overlay0__~")
+	assert.Contains(contents, " file/52:54:00:12:34:56-__fdt_overlay1__~")
+	assert.Contains(contents, "\tappend some_arg=http://10.0.0.1:80/_/file?name=")
+
+	// relative to a boot file below the host's MAC, and by IP in hex
+	for _, p := range []string{"52:54:00:12:34:56/pxelinux.cfg/01-52-54-00-12-34-56", "pxelinux.cfg/0A000014"} {
+		contents, err = readTFTPFile(assert, handler, p)
+		assert.NoError(err)
+		assert.Contains(contents, "\tkernel file/52:54:00:12:34:56-__kernel__~")
+	}
+
+	for _, p := range []string{"pxelinux.cfg/0A00001", "pxelinux.cfg/0A000015", "pxelinux.cfg/01-52-54-00-65-43-21", "pxelinux.cfg/default"} {
+		_, err = readTFTPFile(assert, handler, p)
+		assert.NotNil(err, p)
+	}
+}
+
+func TestTFTPUBootConfigByLease(t *testing.T) {
+	assert := assert.New(t)
+
+	handler, httpHandler := newTestTFTPHandler(assert)
+	uboot := newTestUBoot(httpHandler)
+	uboot.Leases = pxeserver.NewLeases()
+	uboot.Leases.Set("52:54:00:12:34:56", net.ParseIP("10.0.0.30"))
+	handler.UBoot = uboot
+
+	contents, err := readTFTPFile(assert, handler, "pxelinux.cfg/0a00001e")
+	assert.NoError(err)
+	assert.Contains(contents, "\tkernel file/52:54:00:12:34:56-__kernel__~")
+}
+
+func TestTFTPServesUBootFiles(t *testing.T) {
+	assert := assert.New(t)
+
+	handler, httpHandler := newTestTFTPHandler(assert)
+	handler.UBoot = newTestUBoot(httpHandler)
+
+	contents, err := readTFTPFile(assert, handler, "pxelinux.cfg/01-52-54-00-12-34-56")
+	assert.NoError(err)
+	kernelPath := strings.Fields(strings.Split(contents, "\tkernel ")[1])[0]
+
+	for _, p := range []string{kernelPath, "52:54:00:12:34:56/" + kernelPath} {
+		contents, err = readTFTPFile(assert, handler, p)
+		assert.NoError(err)
+		assert.Equal("some-text\n", contents)
+	}
+
+	_, err = readTFTPFile(assert, handler, "file/52:54:00:12:34:56-__kernel__")
+	assert.NotNil(err)
+}
+
+func TestTFTPServesUBootOnlyHosts(t *testing.T) {
+	assert := assert.New(t)
+
+	handler, httpHandler := newTestTFTPHandler(assert)
+	handler.UBoot = newTestUBoot(httpHandler).OnlyHosts([]string{"52:54:00:65:43:21"})
+
+	_, err := readTFTPFile(assert, handler, "pxelinux.cfg/01-52-54-00-12-34-56")
+	assert.NotNil(err)
+
+	handler.UBoot = newTestUBoot(httpHandler).OnlyHosts([]string{"52:54:00:12:34:56"})
+	_, err = readTFTPFile(assert, handler, "pxelinux.cfg/01-52-54-00-12-34-56")
+	assert.NoError(err)
+}
+
+func TestDHCPSendsUBootNextServer(t *testing.T) {
+	assert := assert.New(t)
+
+	logs := []string{}
+	server, err := pxeserver.NewDHCPServer(testDHCPSettings(), nil)
+	assert.NoError(err)
+	server.UBoot = newTestUBoot(newTestHTTPHandler(assert, nil, &logs))
+
+	offer, err := server.Respond(dhcpPacket(dhcp4.MsgDiscover, "52:54:00:12:34:56", nil), net.ParseIP("10.0.0.1"))
+	assert.NoError(err)
+	assert.Equal("10.0.0.1", offer.ServerAddr.String())
+
+	offer, err = server.Respond(dhcpPacket(dhcp4.MsgDiscover, "52:54:00:12:34:57", nil), net.ParseIP("10.0.0.1"))
+	assert.NoError(err)
+	assert.Nil(offer.ServerAddr)
+}
+
+func TestUBootHosts(t *testing.T) {
+	assert := assert.New(t)
+
+	input := strings.NewReader(`
+hosts:
+- mac: "52:54:00:00:00:01"
+  bootloader: uboot
+  kernel:
+    path: /boot/vmlinuz
+  fdt:
+    path: /boot/dtbs/rk3399-rockpro64.dtb
+  fdt_overlays:
+  - path: /boot/dtbs/overlays/uart.dtbo
+- mac: "52:54:00:00:00:02"
+  bootloader: uboot
+- mac: "52:54:00:00:00:03"
+`)
+	cfg, err := pxeserver.LoadConfig(input)
+	assert.NoError(err)
+	assert.Equal(map[string]pxeserver.UBootHost{
+		"52:54:00:00:00:01": {
+			FDT:         "52:54:00:00:00:01-__fdt__",
+			FDTOverlays: []string{"52:54:00:00:00:01-__fdt_overlay0__"},
+		},
+		"52:54:00:00:00:02": {},
+	}, cfg.UBootHosts())
+
+	ids := []string{}
+	for _, f := range cfg.Files() {
+		ids = append(ids, f.ID)
+	}
+	assert.Contains(ids, "52:54:00:00:00:01-__fdt__")
+	assert.Contains(ids, "52:54:00:00:00:01-__fdt_overlay0__")
+}
+
+func TestErrorOnInvalidUBootHost(t *testing.T) {
+	assert := assert.New(t)
+
+	for _, host := range []string{
+		"bootloader: uboot\n  force_pxe_linux: true",
+		"bootloader: uboot\n  http_boot: ipxe",
+		"bootloader: uboot\n  initrds:\n  - path: /a\n  - path: /b",
+		"fdt:\n    path: /boot/some.dtb",
+	} {
+		input := strings.NewReader("hosts:\n- mac: \"52:54:00:00:00:01\"\n  " + host + "\n")
+		_, err := pxeserver.LoadConfig(input)
+		assert.NotNil(err, host)
+	}
+}